@@ -0,0 +1,39 @@
+/*
+Copyright 2021 Ying Ge Li.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// Labels and annotations the operator puts on the pods it injects directors
+// into, read by the gateways those directors connect to.
+const (
+	// GatewayLabel names the gateway a director pod connects to.
+	GatewayLabel = "egressip.yingeli.github.com/gateway"
+	// TunnelIPAnnotation is the tunnel address assigned to a director pod.
+	TunnelIPAnnotation = "egressip.yingeli.github.com/tunnel-ip"
+	// WireGuardPublicKeyAnnotation is the public key of a director pod.
+	WireGuardPublicKeyAnnotation = "egressip.yingeli.github.com/wireguard-public-key"
+	// WireGuardSecretAnnotation names the Secret holding a director pod's
+	// private key.
+	WireGuardSecretAnnotation = "egressip.yingeli.github.com/wireguard-secret"
+	// WireGuardSecretLabel marks Secrets holding WireGuard keys. Its value
+	// is either "gateway" or "director".
+	WireGuardSecretLabel = "egressip.yingeli.github.com/wireguard"
+)
+
+// CapacityLabel is the number of EgressIPs the daemon of a node reports it
+// can still associate with the node, as its provider bounds them. Gateways
+// prefer nodes where it is not 0.
+const CapacityLabel = "egressip.yingeli.github.com/capacity"
@@ -30,16 +30,150 @@ type EgressIPSpec struct {
 
 	// Foo is an example field of EgressIP. Edit egressip_types.go to remove/update
 	// Foo string `json:"foo,omitempty"`
-	IP          string               `json:"ip"`
+
+	// IP is the public IP egress traffic of selected pods leaves from. When
+	// it is empty, the operator allocates one from PublicIPPrefix and sets
+	// it here.
+	// +optional
+	IP          string               `json:"ip,omitempty"`
 	PodSelector metav1.LabelSelector `json:"podSelector"`
+
+	// PublicIPPrefix is the provider ID of the range of public IPs the IP
+	// of the EgressIP is allocated from when it is not set, such as the
+	// name or resource ID of an Azure public IP prefix. The allocated IP is
+	// released when the EgressIP is deleted.
+	// +optional
+	PublicIPPrefix string `json:"publicIPPrefix,omitempty"`
+
+	// FailPolicy decides where egress traffic of selected pods goes while
+	// the tunnel to the gateway is down. Closed drops it, Open sends it
+	// through the node. Defaults to Closed.
+	// +kubebuilder:validation:Enum=Open;Closed
+	// +optional
+	FailPolicy FailPolicy `json:"failPolicy,omitempty"`
+
+	// Tunnel selects how directors carry traffic to the gateway. gre, ipip
+	// and vxlan are unencrypted kernel tunnels. Defaults to l2tp.
+	// +kubebuilder:validation:Enum=l2tp;wireguard;gre;ipip;vxlan
+	// +optional
+	Tunnel TunnelMode `json:"tunnel,omitempty"`
+
+	// TunnelNetwork is the IPv4 CIDR the gateway hands out tunnel addresses
+	// from. It must not overlap any network of the cluster. Defaults to the
+	// first of 192.168.0.0/16, 172.16.0.0/16 ... 172.31.0.0/16 that does not.
+	// +optional
+	TunnelNetwork string `json:"tunnelNetwork,omitempty"`
+
+	// Gateway sizes the gateway of the EgressIP.
+	// +optional
+	Gateway GatewaySpec `json:"gateway,omitempty"`
+
+	// Subnet, when set, sends the egress traffic of selected pods out
+	// through a NAT gateway of the subnet of a node pool rather than
+	// through a gateway. Selected pods are scheduled to the node pool and
+	// get no director, so that FailPolicy, Tunnel, TunnelNetwork and
+	// Gateway do not apply.
+	// +optional
+	Subnet *SubnetSpec `json:"subnet,omitempty"`
 }
 
+// SubnetSpec is the node pool whose subnet the egress traffic of an
+// EgressIP leaves from.
+type SubnetSpec struct {
+	// ID is the provider ID of the subnet of the node pool, such as the
+	// resource ID of an Azure subnet.
+	ID string `json:"id"`
+
+	// NodeSelector selects the nodes of the node pool, for instance with
+	// kubernetes.azure.com/agentpool.
+	// +kubebuilder:validation:MinProperties=1
+	NodeSelector map[string]string `json:"nodeSelector"`
+}
+
+// GatewaySpec sizes the gateway of an EgressIP. The gateway runs as many
+// replicas as its pods need, all on the node the public IP is associated
+// with.
+type GatewaySpec struct {
+	// MinReplicas is the lowest number of gateway replicas. Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinReplicas int32 `json:"minReplicas,omitempty"`
+
+	// MaxReplicas is the highest number of gateway replicas. Defaults to
+	// MinReplicas.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxReplicas int32 `json:"maxReplicas,omitempty"`
+
+	// PodsPerReplica is the number of pods a gateway replica takes before
+	// another one is added. Defaults to 100.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	PodsPerReplica int32 `json:"podsPerReplica,omitempty"`
+}
+
+// DefaultPodsPerReplica is the number of pods a gateway replica takes when
+// GatewaySpec.PodsPerReplica is not set.
+const DefaultPodsPerReplica = 100
+
+// FailPolicy decides where egress traffic goes while the tunnel is down.
+type FailPolicy string
+
+const (
+	FailPolicyOpen   FailPolicy = "Open"
+	FailPolicyClosed FailPolicy = "Closed"
+)
+
+// TunnelMode selects how directors carry traffic to the gateway.
+type TunnelMode string
+
+const (
+	TunnelL2TP      TunnelMode = "l2tp"
+	TunnelWireGuard TunnelMode = "wireguard"
+	TunnelGRE       TunnelMode = "gre"
+	TunnelIPIP      TunnelMode = "ipip"
+	TunnelVXLAN     TunnelMode = "vxlan"
+)
+
 // EgressIPStatus defines the observed state of EgressIP
 type EgressIPStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	//Phase string `json:"phase,omitempty"`
 	Phase string `json:"phase"`
+
+	// TunnelNetwork is the CIDR the gateway hands out tunnel addresses from.
+	// +optional
+	TunnelNetwork string `json:"tunnelNetwork,omitempty"`
+
+	// TunnelCapacity is the number of pods the gateway can take.
+	// +optional
+	TunnelCapacity int32 `json:"tunnelCapacity,omitempty"`
+
+	// TunnelAllocated is the number of pods connecting to the gateway.
+	// +optional
+	TunnelAllocated int32 `json:"tunnelAllocated,omitempty"`
+
+	// GatewayReplicas is the number of gateway replicas wanted for the pods
+	// connecting to the gateway.
+	// +optional
+	GatewayReplicas int32 `json:"gatewayReplicas,omitempty"`
+
+	// PublicIPPrefix is the range of public IPs the IP of the EgressIP was
+	// allocated from, and is released to.
+	// +optional
+	PublicIPPrefix string `json:"publicIPPrefix,omitempty"`
+
+	// Subnet is the subnet whose traffic leaves from the EgressIP, and the
+	// public IP it leaves from, until they are released.
+	// +optional
+	Subnet *SubnetStatus `json:"subnet,omitempty"`
+}
+
+// SubnetStatus is a subnet the traffic of which leaves from a public IP.
+type SubnetStatus struct {
+	ID string `json:"id"`
+	IP string `json:"ip"`
 }
 
 //+kubebuilder:object:root=true
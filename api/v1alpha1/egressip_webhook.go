@@ -17,6 +17,9 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"fmt"
+	"net"
+
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -42,7 +45,21 @@ var _ webhook.Defaulter = &EgressIP{}
 func (r *EgressIP) Default() {
 	egressiplog.Info("default", "name", r.Name)
 
-	// TODO(user): fill in your defaulting logic.
+	if r.Spec.FailPolicy == "" {
+		r.Spec.FailPolicy = FailPolicyClosed
+	}
+	if r.Spec.Tunnel == "" {
+		r.Spec.Tunnel = TunnelL2TP
+	}
+	if r.Spec.Gateway.MinReplicas == 0 {
+		r.Spec.Gateway.MinReplicas = 1
+	}
+	if r.Spec.Gateway.MaxReplicas == 0 {
+		r.Spec.Gateway.MaxReplicas = r.Spec.Gateway.MinReplicas
+	}
+	if r.Spec.Gateway.PodsPerReplica == 0 {
+		r.Spec.Gateway.PodsPerReplica = DefaultPodsPerReplica
+	}
 }
 
 // TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
@@ -54,15 +71,50 @@ var _ webhook.Validator = &EgressIP{}
 func (r *EgressIP) ValidateCreate() error {
 	egressiplog.Info("validate create", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object creation.
-	return nil
+	if err := r.validateGateway(); err != nil {
+		return err
+	}
+	if r.Spec.IP == "" && r.Spec.PublicIPPrefix == "" {
+		return fmt.Errorf("ip or publicIPPrefix is required")
+	}
+	if err := r.validateSubnet(); err != nil {
+		return err
+	}
+	return r.validateTunnelNetwork()
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *EgressIP) ValidateUpdate(old runtime.Object) error {
 	egressiplog.Info("validate update", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object update.
+	if err := r.validateGateway(); err != nil {
+		return err
+	}
+	if r.Spec.IP == "" && r.Spec.PublicIPPrefix == "" {
+		return fmt.Errorf("ip or publicIPPrefix is required")
+	}
+	if err := r.validateAllocatedIP(old.(*EgressIP)); err != nil {
+		return err
+	}
+	if err := r.validateSubnet(); err != nil {
+		return err
+	}
+	return r.validateTunnelNetwork()
+}
+
+// validateAllocatedIP keeps the ip and publicIPPrefix of an EgressIP whose
+// ip is allocated from a prefix, which would otherwise no longer release
+// it. Its ip can only be set once, by the controller.
+func (r *EgressIP) validateAllocatedIP(old *EgressIP) error {
+	if old.Status.PublicIPPrefix == "" {
+		return nil
+	}
+	if r.Spec.PublicIPPrefix != old.Spec.PublicIPPrefix {
+		return fmt.Errorf("publicIPPrefix cannot change once an ip is allocated from %s", old.Status.PublicIPPrefix)
+	}
+	if old.Spec.IP != "" && r.Spec.IP != old.Spec.IP {
+		return fmt.Errorf("ip cannot change once allocated from %s", old.Status.PublicIPPrefix)
+	}
 	return nil
 }
 
@@ -73,3 +125,46 @@ func (r *EgressIP) ValidateDelete() error {
 	// TODO(user): fill in your validation logic upon object deletion.
 	return nil
 }
+
+// validateTunnelNetwork checks that the tunnel network leaves room for the
+// gateway and at least one pod. Overlap with the cluster networks is checked
+// by the controller, which knows them.
+func (r *EgressIP) validateTunnelNetwork() error {
+	if r.Spec.TunnelNetwork == "" {
+		return nil
+	}
+	ip, network, err := net.ParseCIDR(r.Spec.TunnelNetwork)
+	if err != nil {
+		return fmt.Errorf("invalid tunnelNetwork %s: %v", r.Spec.TunnelNetwork, err)
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("invalid tunnelNetwork %s: not an IPv4 network", r.Spec.TunnelNetwork)
+	}
+	if ones, _ := network.Mask.Size(); ones > 29 {
+		return fmt.Errorf("invalid tunnelNetwork %s: prefix must be /29 or shorter", r.Spec.TunnelNetwork)
+	}
+	return nil
+}
+
+func (r *EgressIP) validateGateway() error {
+	if r.Spec.Gateway.MaxReplicas != 0 && r.Spec.Gateway.MaxReplicas < r.Spec.Gateway.MinReplicas {
+		return fmt.Errorf("gateway.maxReplicas %d is lower than gateway.minReplicas %d",
+			r.Spec.Gateway.MaxReplicas, r.Spec.Gateway.MinReplicas)
+	}
+	return nil
+}
+
+// validateSubnet checks that a subnet EgressIP names its subnet and the
+// nodes its pods are scheduled to.
+func (r *EgressIP) validateSubnet() error {
+	if r.Spec.Subnet == nil {
+		return nil
+	}
+	if r.Spec.Subnet.ID == "" {
+		return fmt.Errorf("subnet.id is required")
+	}
+	if len(r.Spec.Subnet.NodeSelector) == 0 {
+		return fmt.Errorf("subnet.nodeSelector is required")
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	"github.com/yingeli/egress-ip-operator/providers"
+)
+
+var (
+	leakedAssociations = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "egressip_leaked_associations",
+		Help: "Associations leaked on the nodes of the cluster found by the last sweep.",
+	})
+	removedAssociations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "egressip_removed_leaked_associations_total",
+		Help: "Leaked associations removed by sweeps.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(leakedAssociations, removedAssociations)
+}
+
+// AssociationSweeper periodically removes the associations daemons leaked
+// on the nodes of the cluster, for instance by crashing between associating
+// a public IP and adding its SNAT rules, or while the EgressIP was deleted.
+// An association has leaked when it lost its public IP or its public IP is
+// no EgressIP's. Daemons only release the leaks of their own node, when
+// they run.
+type AssociationSweeper struct {
+	Client   client.Client
+	Provider providers.Provider
+	Log      logr.Logger
+	Interval time.Duration
+	// DryRun only reports leaked associations.
+	DryRun bool
+}
+
+// Start sweeps every Interval until ctx is done.
+func (s *AssociationSweeper) Start(ctx context.Context) error {
+	sweeper, ok := s.Provider.(providers.Sweeper)
+	if !ok {
+		s.Log.Info("provider cannot list the associations of the cluster, not sweeping")
+		return nil
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := s.sweep(ctx, sweeper); err != nil {
+				s.Log.Error(err, "error sweeping leaked associations")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection makes a single controller sweep.
+func (s *AssociationSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+// sweep returns the leaked associations, removing them unless DryRun is
+// set. The associations are listed before the EgressIPs, so that the ones
+// of EgressIPs created in between are not taken for leaks.
+func (s *AssociationSweeper) sweep(ctx context.Context, sweeper providers.Sweeper) ([]providers.ClusterAssociation, error) {
+	associations, err := sweeper.ListClusterAssociations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var eips egressipv1alpha1.EgressIPList
+	if err := s.Client.List(ctx, &eips); err != nil {
+		return nil, err
+	}
+	egressIPs := make(map[string]bool)
+	for _, eip := range eips.Items {
+		if eip.Spec.IP != "" {
+			egressIPs[eip.Spec.IP] = true
+		}
+	}
+
+	var leaked []providers.ClusterAssociation
+	for _, association := range associations {
+		if association.PublicIP == "" || !egressIPs[association.PublicIP] {
+			leaked = append(leaked, association)
+		}
+	}
+	leakedAssociations.Set(float64(len(leaked)))
+
+	for _, association := range leaked {
+		log := s.Log.WithValues("node", association.Node, "resource", association.Resource,
+			"private IP", association.SourceIP, "public IP", association.PublicIP, "EgressIP UID", association.Owner)
+		if s.DryRun {
+			log.Info("found leaked association, kept in dry run")
+			continue
+		}
+		if err := sweeper.RemoveClusterAssociation(ctx, association); err != nil {
+			// retried on the next sweep if it is still leaked
+			log.Error(err, "error removing leaked association")
+			continue
+		}
+		removedAssociations.Inc()
+		log.Info("removed leaked association")
+	}
+	return leaked, nil
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	"github.com/yingeli/egress-ip-operator/providers"
+)
+
+// fakeSweeper lists fixed associations and records the removed ones.
+type fakeSweeper struct {
+	associations []providers.ClusterAssociation
+	removed      []providers.ClusterAssociation
+}
+
+func (f *fakeSweeper) ListClusterAssociations(ctx context.Context) ([]providers.ClusterAssociation, error) {
+	return f.associations, nil
+}
+
+func (f *fakeSweeper) RemoveClusterAssociation(ctx context.Context, association providers.ClusterAssociation) error {
+	f.removed = append(f.removed, association)
+	return nil
+}
+
+func newTestSweeper(t *testing.T, dryRun bool) *AssociationSweeper {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := egressipv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	eip := &egressipv1alpha1.EgressIP{
+		ObjectMeta: metav1.ObjectMeta{Name: "eip", Namespace: testNamespace},
+		Spec:       egressipv1alpha1.EgressIPSpec{IP: "20.0.0.1"},
+	}
+	c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(eip).Build()
+	return &AssociationSweeper{
+		Client: c,
+		Log:    ctrl.Log.WithName("test"),
+		DryRun: dryRun,
+	}
+}
+
+func testClusterAssociations() []providers.ClusterAssociation {
+	return []providers.ClusterAssociation{
+		{Association: providers.Association{PublicIP: "20.0.0.1", SourceIP: "10.0.0.10"}, Node: testNode, Resource: "in-use"},
+		{Association: providers.Association{PublicIP: "20.0.0.2", SourceIP: "10.0.0.11"}, Node: testNode, Resource: "deleted"},
+		{Association: providers.Association{SourceIP: "10.0.0.12"}, Node: "node-2", Resource: "detached"},
+	}
+}
+
+func TestSweepRemovesLeakedAssociations(t *testing.T) {
+	s := newTestSweeper(t, false)
+	sweeper := &fakeSweeper{associations: testClusterAssociations()}
+
+	leaked, err := s.sweep(context.Background(), sweeper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaked) != 2 {
+		t.Fatalf("leaked = %v, want the deleted and detached associations", leaked)
+	}
+	if got := testutil.ToFloat64(leakedAssociations); got != 2 {
+		t.Fatalf("leaked gauge = %v, want 2", got)
+	}
+	if len(sweeper.removed) != 2 {
+		t.Fatalf("removed = %v, want 2 associations", sweeper.removed)
+	}
+	for _, association := range sweeper.removed {
+		if association.Resource == "in-use" {
+			t.Fatalf("removed the association of an EgressIP: %v", association)
+		}
+	}
+}
+
+func TestSweepDryRun(t *testing.T) {
+	s := newTestSweeper(t, true)
+	sweeper := &fakeSweeper{associations: testClusterAssociations()}
+
+	leaked, err := s.sweep(context.Background(), sweeper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaked) != 2 {
+		t.Fatalf("leaked = %v, want the deleted and detached associations", leaked)
+	}
+	if len(sweeper.removed) != 0 {
+		t.Fatalf("removed %v in dry run", sweeper.removed)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Ying Ge Li.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+)
+
+const (
+	// how long a director Secret may wait for its pod to be created
+	directorSecretGracePeriod = 5 * time.Minute
+)
+
+// DirectorSecretReconciler ties the WireGuard Secrets handed out by the
+// EgressIPInjector to the pods they were created for, so that they are
+// garbage collected with those pods, and removes the Secrets of pods that
+// were never created.
+type DirectorSecretReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+func (r *DirectorSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var secret corev1.Secret
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if len(secret.OwnerReferences) > 0 {
+		return ctrl.Result{}, nil
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(secret.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Annotations[egressipv1alpha1.WireGuardSecretAnnotation] != secret.Name {
+			continue
+		}
+		if err := controllerutil.SetOwnerReference(pod, &secret, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, r.Update(ctx, &secret)
+	}
+
+	if age := time.Since(secret.CreationTimestamp.Time); age < directorSecretGracePeriod {
+		return ctrl.Result{RequeueAfter: directorSecretGracePeriod - age}, nil
+	}
+	logger.Info("deleting director secret without pod", "namespace", secret.Namespace, "name", secret.Name)
+	return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, &secret))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DirectorSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isDirector := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetLabels()[egressipv1alpha1.WireGuardSecretLabel] == "director"
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Secret{}, builder.WithPredicates(isDirector)).
+		Complete(r)
+}
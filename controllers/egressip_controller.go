@@ -19,18 +19,31 @@ package controllers
 import (
 	"context"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	"github.com/yingeli/egress-ip-operator/providers"
 )
 
 // EgressIPReconciler reconciles a EgressIP object
 type EgressIPReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// Provider is asked for its capabilities and sets up subnet egress,
+	// public IPs are associated with nodes by the daemon
+	Provider providers.Provider
 }
 
 //+kubebuilder:rbac:groups=egressip.yingeli.github.com,resources=egressips,verbs=get;list;watch;create;update;patch;delete
@@ -38,6 +51,11 @@ type EgressIPReconciler struct {
 //+kubebuilder:rbac:groups=egressip.yingeli.github.com,resources=egressips/finalizers,verbs=update
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=delete
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -62,7 +80,30 @@ func (r *EgressIPReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *EgressIPReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	hasGateway := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		_, ok := obj.GetLabels()[egressipv1alpha1.GatewayLabel]
+		return ok
+	})
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&egressipv1alpha1.EgressIP{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.egressIPOfPod),
+			builder.WithPredicates(hasGateway)).
 		Complete(r)
 }
+
+// egressIPOfPod maps a pod connecting to a gateway to the EgressIP of that
+// gateway, so that its tunnel capacity is kept up to date.
+func (r *EgressIPReconciler) egressIPOfPod(obj client.Object) []reconcile.Request {
+	var eips egressipv1alpha1.EgressIPList
+	if err := r.List(context.Background(), &eips); err != nil {
+		return nil
+	}
+	gateway := obj.GetLabels()[egressipv1alpha1.GatewayLabel]
+	for _, eip := range eips.Items {
+		if getGatewayName(&eip) == gateway {
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: eip.Namespace, Name: eip.Name}}}
+		}
+	}
+	return nil
+}
@@ -19,26 +19,43 @@ package controllers
 import (
 	"context"
 	"encoding/json"
-
-	//"fmt"
+	"fmt"
+	"net"
 	"net/http"
+	"sort"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	"github.com/yingeli/egress-ip-operator/tunnel/wireguard"
+)
+
+const (
+	directorImage     = "yingeli/egress-ip-director"
+	directorProbePort = 9081
 )
 
-//+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=fail,groups="",resources=pods,verbs=create;update,versions=v1,name=mpod.kb.io,sideEffects=none,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=fail,groups="",resources=pods,verbs=create;update,versions=v1,name=mpod.kb.io,sideEffects=NoneOnDryRun,admissionReviewVersions=v1
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;update;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // podAnnotator annotates Pods
 type EgressIPInjector struct {
-	Client  client.Client
-	decoder *admission.Decoder
+	Client client.Client
+	// Reader reads the tunnel addresses reserved without a cache, Client
+	// when not set.
+	Reader   client.Reader
+	Recorder record.EventRecorder
+	decoder  *admission.Decoder
 }
 
 // PodAnnotator adds an annotation to every incoming pods.
@@ -57,45 +74,76 @@ func (a *EgressIPInjector) Handle(ctx context.Context, req admission.Request) ad
 	if eip == nil {
 		return admission.Allowed("")
 	}
+	if eip.Spec.IP == "" {
+		return admission.Errored(http.StatusInternalServerError,
+			fmt.Errorf("public IP of EgressIP %s/%s is not allocated yet", eip.Namespace, eip.Name))
+	}
+
+	if eip.Spec.Subnet != nil {
+		// the traffic of the nodes of the subnet leaves from the EgressIP
+		requireNodes(pod, eip.Spec.Subnet.NodeSelector)
+		return patchPod(req, pod)
+	}
+
+	env := getDirectorEnv(eip)
+	if req.Operation == admissionv1.Create && (req.DryRun == nil || !*req.DryRun) {
+		tunnelEnv, err := a.injectTunnel(ctx, pod, eip)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		env = append(env, tunnelEnv...)
+	} else if eip.Spec.Tunnel != "" && eip.Spec.Tunnel != egressipv1alpha1.TunnelL2TP {
+		// tunnel addresses and keys are only handed out once, to pods being
+		// created for real
+		return admission.Allowed("")
+	}
+	if eip.Spec.Tunnel == egressipv1alpha1.TunnelWireGuard {
+		wgEnv, err := a.injectWireGuard(ctx, req.Namespace, pod, eip)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		env = append(env, wgEnv...)
+	}
 
 	privileged := true
 	init := corev1.Container{
 		Name:            "egress-ip-director-init",
-		Image:           "yingeli/egress-ip-director",
+		Image:           directorImage,
 		ImagePullPolicy: "Always",
-		Command: []string{
-			"/init.sh",
-		},
+		Args:            []string{"init"},
 		SecurityContext: &corev1.SecurityContext{
 			Privileged: &privileged,
 		},
-		Env: []corev1.EnvVar{
-			{
-				Name:  "EGRESS_GATEWAY",
-				Value: getGatewayName(eip) + "." + getGatewayNamespace(),
-			},
-			{
-				Name:  "LOCAL_NETWORK",
-				Value: "10.0.0.0/8",
-			},
-		},
+		Env: env,
 	}
 	director := corev1.Container{
 		Name:            "egress-ip-director",
-		Image:           "yingeli/egress-ip-director",
+		Image:           directorImage,
 		ImagePullPolicy: "Always",
+		Args:            []string{"run"},
 		SecurityContext: &corev1.SecurityContext{
 			Privileged: &privileged,
 		},
-		Env: []corev1.EnvVar{
-			{
-				Name:  "EGRESS_GATEWAY",
-				Value: getGatewayName(eip) + "." + getGatewayNamespace(),
+		Env: env,
+		LivenessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: "/healthz",
+					Port: intstr.FromInt(directorProbePort),
+				},
 			},
-			{
-				Name:  "LOCAL_NETWORK",
-				Value: "10.0.0.0/8",
+			InitialDelaySeconds: 15,
+			PeriodSeconds:       20,
+		},
+		ReadinessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: "/readyz",
+					Port: intstr.FromInt(directorProbePort),
+				},
 			},
+			InitialDelaySeconds: 5,
+			PeriodSeconds:       10,
 		},
 	}
 	pod.Spec.InitContainers = append(pod.Spec.InitContainers, init)
@@ -126,6 +174,10 @@ func (a *EgressIPInjector) Handle(ctx context.Context, req admission.Request) ad
 		pod.Spec.Affinity.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
 		term)
 
+	return patchPod(req, pod)
+}
+
+func patchPod(req admission.Request, pod *corev1.Pod) admission.Response {
 	marshaledPod, err := json.Marshal(pod)
 	if err != nil {
 		return admission.Errored(http.StatusInternalServerError, err)
@@ -134,6 +186,43 @@ func (a *EgressIPInjector) Handle(ctx context.Context, req admission.Request) ad
 	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
 }
 
+// requireNodes schedules the pod on nodes with the labels in selector, on
+// top of the node affinity it already has. Terms of a required node
+// affinity are ORed, so the labels are required by each of them.
+func requireNodes(pod *corev1.Pod, selector map[string]string) {
+	keys := make([]string, 0, len(selector))
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var requirements []corev1.NodeSelectorRequirement
+	for _, key := range keys {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{selector[key]},
+		})
+	}
+
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: requirements}},
+		}
+		return
+	}
+	for i := range required.NodeSelectorTerms {
+		term := &required.NodeSelectorTerms[i]
+		term.MatchExpressions = append(term.MatchExpressions, requirements...)
+	}
+}
+
 // EgressIPInjector implements admission.DecoderInjector.
 // A decoder will be automatically injected.
 
@@ -159,3 +248,144 @@ func (a *EgressIPInjector) selectEgressIP(ctx context.Context, pod *corev1.Pod)
 	}
 	return nil, nil
 }
+
+func getDirectorEnv(eip *egressipv1alpha1.EgressIP) []corev1.EnvVar {
+	failPolicy := eip.Spec.FailPolicy
+	if failPolicy == "" {
+		failPolicy = egressipv1alpha1.FailPolicyClosed
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  "EGRESS_GATEWAY",
+			Value: getGatewayName(eip) + "." + getGatewayNamespace(),
+		},
+		{
+			Name:  "LOCAL_NETWORK",
+			Value: directorLocalNetwork,
+		},
+		{
+			Name:  "FAIL_POLICY",
+			Value: string(failPolicy),
+		},
+		{
+			Name:  "TUNNEL",
+			Value: string(eip.Spec.Tunnel),
+		},
+	}
+}
+
+// injectTunnel labels the pod with its gateway and, unless xl2tpd assigns
+// addresses itself, hands the pod its own tunnel address. The address is
+// annotated on the pod for the gateway to route to and for later
+// allocations to skip.
+func (a *EgressIPInjector) injectTunnel(ctx context.Context, pod *corev1.Pod, eip *egressipv1alpha1.EgressIP) ([]corev1.EnvVar, error) {
+	l2tp := eip.Spec.Tunnel == "" || eip.Spec.Tunnel == egressipv1alpha1.TunnelL2TP
+	if eip.Status.TunnelNetwork == "" && l2tp {
+		return nil, nil
+	}
+	_, network, err := net.ParseCIDR(eip.Status.TunnelNetwork)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel network of EgressIP %s/%s is not assigned yet", eip.Namespace, eip.Name)
+	}
+
+	pods, err := listTunnelClients(ctx, a.Client, eip)
+	if err != nil {
+		return nil, err
+	}
+
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels[egressipv1alpha1.GatewayLabel] = getGatewayName(eip)
+
+	full := int32(len(pods)) >= tunnelCapacity(network)
+	var tunnelIP net.IP
+	if !full && !l2tp {
+		reader := a.Reader
+		if reader == nil {
+			reader = a.Client
+		}
+		tunnelIP, err = reserveTunnelIP(ctx, a.Client, reader, eip, network, pods)
+		if err != nil {
+			return nil, err
+		}
+		full = tunnelIP == nil
+	}
+	if full {
+		a.Recorder.Eventf(eip, corev1.EventTypeWarning, "GatewayFull",
+			"No tunnel address left in %s for a pod in namespace %s", network, pod.Namespace)
+		if !l2tp {
+			return nil, fmt.Errorf("no tunnel address left for EgressIP %s/%s", eip.Namespace, eip.Name)
+		}
+	}
+	if l2tp {
+		// xl2tpd hands out the addresses, the pod only counts towards capacity
+		return nil, nil
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[egressipv1alpha1.TunnelIPAnnotation] = tunnelIP.String()
+
+	return []corev1.EnvVar{
+		{
+			Name:  "TUNNEL_IP",
+			Value: tunnelIP.String(),
+		},
+		{
+			Name:  "TUNNEL_NETWORK",
+			Value: network.String(),
+		},
+	}, nil
+}
+
+// injectWireGuard hands the pod its own WireGuard key pair. The private key
+// is stored in a Secret that the pod takes ownership of once it exists; the
+// public key is annotated on the pod for the gateway to peer with.
+func (a *EgressIPInjector) injectWireGuard(ctx context.Context, namespace string, pod *corev1.Pod, eip *egressipv1alpha1.EgressIP) ([]corev1.EnvVar, error) {
+	var gatewaySecret corev1.Secret
+	if err := a.Client.Get(ctx, getGatewayNamespacedName(eip), &gatewaySecret); err != nil {
+		return nil, fmt.Errorf("error getting gateway key for EgressIP %s/%s: %v", eip.Namespace, eip.Name, err)
+	}
+
+	privateKey, publicKey, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "egress-ip-director-",
+			Namespace:    namespace,
+			Labels: map[string]string{
+				egressipv1alpha1.WireGuardSecretLabel: "director",
+			},
+		},
+		StringData: map[string]string{
+			wireGuardPrivateKey: privateKey,
+			wireGuardPublicKey:  publicKey,
+		},
+	}
+	if err := a.Client.Create(ctx, &secret); err != nil {
+		return nil, err
+	}
+
+	pod.Annotations[egressipv1alpha1.WireGuardSecretAnnotation] = secret.Name
+	pod.Annotations[egressipv1alpha1.WireGuardPublicKeyAnnotation] = publicKey
+
+	return []corev1.EnvVar{
+		{
+			Name:  "WIREGUARD_GATEWAY_PUBLIC_KEY",
+			Value: string(gatewaySecret.Data[wireGuardPublicKey]),
+		},
+		{
+			Name: "WIREGUARD_PRIVATE_KEY",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret.Name},
+					Key:                  wireGuardPrivateKey,
+				},
+			},
+		},
+	}, nil
+}
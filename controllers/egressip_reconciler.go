@@ -18,6 +18,9 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
 	"os"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -29,6 +32,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/tunnel"
+	"github.com/yingeli/egress-ip-operator/tunnel/encap"
+	"github.com/yingeli/egress-ip-operator/tunnel/wireguard"
 )
 
 var (
@@ -37,6 +44,14 @@ var (
 
 const (
 	finalizer = "egressip.yingeli.github.com/finalizer"
+
+	gatewayImage = "yingeli/egress-ip-gateway"
+
+	maxPublicIPName = 80
+
+	// keys of the Secrets holding WireGuard key pairs
+	wireGuardPrivateKey = "privatekey"
+	wireGuardPublicKey  = "publickey"
 )
 
 func (r *EgressIPReconciler) reconcile(ctx context.Context, req ctrl.Request) error {
@@ -91,19 +106,52 @@ func (r *EgressIPReconciler) checkDeletion(ctx context.Context, eip *egressipv1a
 }
 
 func (r *EgressIPReconciler) createOrUpdate(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
+	if err := r.ensurePublicIP(ctx, eip); err != nil {
+		return err
+	}
+	if eip.Spec.IP == "" {
+		// retried when the EgressIP changes
+		return nil
+	}
+
+	if eip.Spec.Subnet != nil {
+		return r.ensureSubnetEgress(ctx, eip)
+	}
+	if err := r.removeSubnetEgress(ctx, eip); err != nil {
+		return err
+	}
+
+	if valid, err := r.ensureTunnelNetwork(ctx, eip); err != nil || !valid {
+		// an invalid tunnel network is retried when the EgressIP changes
+		return err
+	}
+
+	if eip.Spec.Tunnel == egressipv1alpha1.TunnelWireGuard {
+		if err := r.ensureGatewaySecret(ctx, eip); err != nil {
+			return err
+		}
+	}
+
+	pods, err := listTunnelClients(ctx, r.Client, eip)
+	if err != nil {
+		return err
+	}
+	allocated := int32(len(pods))
+	replicas := gatewayReplicas(eip, allocated)
+
 	var deployment appsv1.Deployment
-	err := r.Get(ctx, getGatewayNamespacedName(eip), &deployment)
+	err = r.Get(ctx, getGatewayNamespacedName(eip), &deployment)
 	if err != nil {
 		if client.IgnoreNotFound(err) != nil {
 			return err
 		}
-		new_deployment := newEgressIPDeployment(eip)
+		new_deployment := newEgressIPDeployment(eip, replicas, r.Provider.Capabilities())
 		err := r.Create(ctx, new_deployment)
 		if err != nil {
 			return err
 		}
 	} else {
-		updateEgressIPDeployment(&deployment, eip)
+		updateEgressIPDeployment(&deployment, eip, replicas, r.Provider.Capabilities())
 		err := r.Update(ctx, &deployment)
 		if err != nil {
 			return err
@@ -129,10 +177,203 @@ func (r *EgressIPReconciler) createOrUpdate(ctx context.Context, eip *egressipv1
 		}
 	}
 
+	return r.updateGatewayStatus(ctx, eip, allocated, replicas)
+}
+
+// ensureTunnelNetwork assigns the EgressIP its tunnel network. A network
+// picked by the operator is kept once assigned, so that it does not change
+// under connected pods when the cluster grows. It returns false, after
+// raising an Event, when no valid network can be assigned.
+func (r *EgressIPReconciler) ensureTunnelNetwork(ctx context.Context, eip *egressipv1alpha1.EgressIP) (bool, error) {
+	if eip.Status.TunnelNetwork != "" && (eip.Spec.TunnelNetwork == "" || eip.Spec.TunnelNetwork == eip.Status.TunnelNetwork) {
+		return true, nil
+	}
+
+	networks, err := discoverClusterNetworks(ctx, r.Client)
+	if err != nil {
+		return false, err
+	}
+	network, err := selectTunnelNetwork(eip, networks)
+	if err != nil {
+		r.Recorder.Event(eip, corev1.EventTypeWarning, "InvalidTunnelNetwork", err.Error())
+		return false, nil
+	}
+
+	patch := client.MergeFrom(eip.DeepCopy())
+	eip.Status.TunnelNetwork = network.String()
+	eip.Status.TunnelCapacity = tunnelCapacity(network)
+	return true, r.Status().Patch(ctx, eip, patch)
+}
+
+// updateGatewayStatus reports how many pods connect to the gateway and how
+// many replicas serve them, and raises an Event when the gateway becomes
+// full.
+func (r *EgressIPReconciler) updateGatewayStatus(ctx context.Context, eip *egressipv1alpha1.EgressIP, allocated, replicas int32) error {
+	if allocated == eip.Status.TunnelAllocated && replicas == eip.Status.GatewayReplicas {
+		return nil
+	}
+
+	if allocated >= eip.Status.TunnelCapacity && eip.Status.TunnelAllocated < eip.Status.TunnelCapacity {
+		r.Recorder.Eventf(eip, corev1.EventTypeWarning, "GatewayFull",
+			"All %d tunnel addresses in %s are allocated", eip.Status.TunnelCapacity, eip.Status.TunnelNetwork)
+	}
+
+	if replicas != eip.Status.GatewayReplicas {
+		r.Recorder.Eventf(eip, corev1.EventTypeNormal, "GatewayScaled",
+			"Scaled gateway from %d to %d replicas for %d pods", eip.Status.GatewayReplicas, replicas, allocated)
+	}
+
+	patch := client.MergeFrom(eip.DeepCopy())
+	eip.Status.TunnelAllocated = allocated
+	eip.Status.GatewayReplicas = replicas
+	return r.Status().Patch(ctx, eip, patch)
+}
+
+// gatewayReplicas returns the number of gateway replicas needed for
+// allocated pods, within the bounds set on the EgressIP.
+func gatewayReplicas(eip *egressipv1alpha1.EgressIP, allocated int32) int32 {
+	min := eip.Spec.Gateway.MinReplicas
+	if min < 1 {
+		min = 1
+	}
+	max := eip.Spec.Gateway.MaxReplicas
+	if max < min {
+		max = min
+	}
+	perReplica := eip.Spec.Gateway.PodsPerReplica
+	if perReplica < 1 {
+		perReplica = egressipv1alpha1.DefaultPodsPerReplica
+	}
+
+	replicas := (allocated + perReplica - 1) / perReplica
+	if replicas < min {
+		return min
+	}
+	if replicas > max {
+		return max
+	}
+	return replicas
+}
+
+// ensurePublicIP allocates the IP of an EgressIP that has none from its
+// public IP prefix. The prefix is recorded in the status before the IP is
+// allocated, so that the IP, named after the EgressIP, is released along
+// with the EgressIP even when it is deleted before its IP is set.
+func (r *EgressIPReconciler) ensurePublicIP(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
+	if eip.Spec.IP != "" || eip.Spec.PublicIPPrefix == "" {
+		return nil
+	}
+	pp, ok := r.Provider.(providers.PrefixProvider)
+	if !ok {
+		r.Recorder.Event(eip, corev1.EventTypeWarning, "PublicIPPrefixNotSupported", "The provider cannot allocate public IPs from a prefix")
+		return nil
+	}
+
+	if eip.Status.PublicIPPrefix != eip.Spec.PublicIPPrefix {
+		patch := client.MergeFrom(eip.DeepCopy())
+		eip.Status.PublicIPPrefix = eip.Spec.PublicIPPrefix
+		if err := r.Status().Patch(ctx, eip, patch); err != nil {
+			return err
+		}
+	}
+
+	ip, err := pp.AllocatePublicIP(ctx, eip.Spec.PublicIPPrefix, getPublicIPName(eip))
+	if err != nil {
+		r.Recorder.Event(eip, corev1.EventTypeWarning, "PublicIPAllocationFailed", err.Error())
+		return err
+	}
+	patch := client.MergeFrom(eip.DeepCopy())
+	eip.Spec.IP = ip
+	if err := r.Patch(ctx, eip, patch); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(eip, corev1.EventTypeNormal, "PublicIPAllocated", "Allocated %s from %s", ip, eip.Status.PublicIPPrefix)
+	return nil
+}
+
+// releasePublicIP releases the IP allocated for the EgressIP to the prefix
+// it was allocated from, whether or not it was set as the IP of the
+// EgressIP yet.
+func (r *EgressIPReconciler) releasePublicIP(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
+	if eip.Status.PublicIPPrefix == "" {
+		return nil
+	}
+	pp, ok := r.Provider.(providers.PrefixProvider)
+	if !ok {
+		return nil
+	}
+	if err := pp.ReleasePublicIP(ctx, eip.Status.PublicIPPrefix, getPublicIPName(eip)); err != nil {
+		r.Recorder.Event(eip, corev1.EventTypeWarning, "PublicIPReleaseFailed", err.Error())
+		return err
+	}
 	return nil
 }
 
+// ensureSubnetEgress sends the traffic of the subnet of the EgressIP out
+// from its public IP. Selected pods run on the nodes of the subnet and leave
+// from them directly, so the EgressIP has no gateway.
+func (r *EgressIPReconciler) ensureSubnetEgress(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
+	sp, ok := r.Provider.(providers.SubnetProvider)
+	if !ok {
+		r.Recorder.Event(eip, corev1.EventTypeWarning, "SubnetEgressNotSupported", "The provider cannot send the traffic of a subnet out from a public IP")
+		// retried when the EgressIP changes
+		return nil
+	}
+
+	desired := egressipv1alpha1.SubnetStatus{ID: eip.Spec.Subnet.ID, IP: eip.Spec.IP}
+	if eip.Status.Subnet != nil && *eip.Status.Subnet != desired {
+		if err := r.removeSubnetEgress(ctx, eip); err != nil {
+			return err
+		}
+	}
+
+	if err := sp.EnsureSubnetEgress(ctx, desired.IP, desired.ID); err != nil {
+		r.Recorder.Event(eip, corev1.EventTypeWarning, "SubnetEgressFailed", err.Error())
+		return err
+	}
+	if err := r.deleteGateway(ctx, eip); err != nil {
+		return err
+	}
+
+	if eip.Status.Subnet != nil && eip.Status.Phase == "Configured" {
+		return nil
+	}
+	r.Recorder.Eventf(eip, corev1.EventTypeNormal, "SubnetEgressConfigured", "Traffic of subnet %s leaves from %s", desired.ID, desired.IP)
+	patch := client.MergeFrom(eip.DeepCopy())
+	eip.Status.Subnet = &desired
+	eip.Status.Phase = "Configured"
+	return r.Status().Patch(ctx, eip, patch)
+}
+
+// removeSubnetEgress stops sending the traffic of the subnet recorded in
+// the status of the EgressIP out from its public IP.
+func (r *EgressIPReconciler) removeSubnetEgress(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
+	if eip.Status.Subnet == nil {
+		return nil
+	}
+	if sp, ok := r.Provider.(providers.SubnetProvider); ok {
+		if err := sp.RemoveSubnetEgress(ctx, eip.Status.Subnet.IP, eip.Status.Subnet.ID); err != nil {
+			r.Recorder.Event(eip, corev1.EventTypeWarning, "SubnetEgressFailed", err.Error())
+			return err
+		}
+	}
+	r.Recorder.Eventf(eip, corev1.EventTypeNormal, "SubnetEgressRemoved", "Traffic of subnet %s no longer leaves from %s", eip.Status.Subnet.ID, eip.Status.Subnet.IP)
+	patch := client.MergeFrom(eip.DeepCopy())
+	eip.Status.Subnet = nil
+	return r.Status().Patch(ctx, eip, patch)
+}
+
 func (r *EgressIPReconciler) delete(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
+	if err := r.removeSubnetEgress(ctx, eip); err != nil {
+		return err
+	}
+	if err := r.deleteGateway(ctx, eip); err != nil {
+		return err
+	}
+	return r.releasePublicIP(ctx, eip)
+}
+
+func (r *EgressIPReconciler) deleteGateway(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
 	service := newEgressIPService(eip)
 	err := r.Delete(ctx, service)
 	client.IgnoreNotFound(err)
@@ -140,11 +381,70 @@ func (r *EgressIPReconciler) delete(ctx context.Context, eip *egressipv1alpha1.E
 		return err
 	}
 
-	deployment := newEgressIPDeployment(eip)
-	return client.IgnoreNotFound(r.Delete(ctx, deployment))
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getGatewayName(eip),
+			Namespace: getGatewayNamespace(),
+		},
+	}
+	if err := client.IgnoreNotFound(r.Delete(ctx, &deployment)); err != nil {
+		return err
+	}
+
+	// the tunnel addresses reserved for its pods
+	cm := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getGatewayName(eip),
+			Namespace: getGatewayNamespace(),
+		},
+	}
+	if err := client.IgnoreNotFound(r.Delete(ctx, &cm)); err != nil {
+		return err
+	}
+
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getGatewayName(eip),
+			Namespace: getGatewayNamespace(),
+		},
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, &secret))
+}
+
+// ensureGatewaySecret creates the Secret holding the WireGuard key pair of
+// the gateway. The key pair is kept for the lifetime of the EgressIP so that
+// directors keep trusting restarted gateways.
+func (r *EgressIPReconciler) ensureGatewaySecret(ctx context.Context, eip *egressipv1alpha1.EgressIP) error {
+	var secret corev1.Secret
+	err := r.Get(ctx, getGatewayNamespacedName(eip), &secret)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	if err == nil {
+		return nil
+	}
+
+	privateKey, publicKey, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	secret = corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getGatewayName(eip),
+			Namespace: getGatewayNamespace(),
+			Labels: map[string]string{
+				egressipv1alpha1.WireGuardSecretLabel: "gateway",
+			},
+		},
+		StringData: map[string]string{
+			wireGuardPrivateKey: privateKey,
+			wireGuardPublicKey:  publicKey,
+		},
+	}
+	return r.Create(ctx, &secret)
 }
 
-func newEgressIPDeployment(eip *egressipv1alpha1.EgressIP) *appsv1.Deployment {
+func newEgressIPDeployment(eip *egressipv1alpha1.EgressIP, replicas int32, caps providers.Capabilities) *appsv1.Deployment {
 	deployment := appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "apps/v1",
@@ -155,17 +455,66 @@ func newEgressIPDeployment(eip *egressipv1alpha1.EgressIP) *appsv1.Deployment {
 			Namespace: controllerNamespace,
 		},
 	}
-	updateEgressIPDeployment(&deployment, eip)
+	updateEgressIPDeployment(&deployment, eip, replicas, caps)
 	return &deployment
 }
 
-func updateEgressIPDeployment(deployment *appsv1.Deployment, eip *egressipv1alpha1.EgressIP) {
+func updateEgressIPDeployment(deployment *appsv1.Deployment, eip *egressipv1alpha1.EgressIP, replicas int32, caps providers.Capabilities) {
 	privileged := true
 	seccurityContext := corev1.SecurityContext{
 		Privileged: &privileged,
 	}
 
+	gateway := corev1.Container{
+		Image:           gatewayImage,
+		ImagePullPolicy: "Always",
+		Name:            "gateway",
+		Env:             getEnv(eip),
+		Ports: []corev1.ContainerPort{
+			{
+				ContainerPort: 1701,
+				Protocol:      "UDP",
+				Name:          "l2tp",
+			},
+		},
+		SecurityContext: &seccurityContext,
+	}
+	switch eip.Spec.Tunnel {
+	case egressipv1alpha1.TunnelGRE, egressipv1alpha1.TunnelIPIP, egressipv1alpha1.TunnelVXLAN:
+		gateway.Command = []string{"/usr/local/bin/egress-ip-gateway", string(eip.Spec.Tunnel)}
+		// GRE and IPIP are IP protocols rather than UDP ports
+		gateway.Ports = nil
+		if eip.Spec.Tunnel == egressipv1alpha1.TunnelVXLAN {
+			gateway.Ports = []corev1.ContainerPort{
+				{
+					ContainerPort: encap.VXLANPort,
+					Protocol:      "UDP",
+					Name:          "vxlan",
+				},
+			}
+		}
+	case egressipv1alpha1.TunnelWireGuard:
+		gateway.Command = []string{"/usr/local/bin/egress-ip-gateway", "wireguard"}
+		gateway.Ports = []corev1.ContainerPort{
+			{
+				ContainerPort: wireguard.ListenPort,
+				Protocol:      "UDP",
+				Name:          "wireguard",
+			},
+		}
+		gateway.Env = append(gateway.Env, corev1.EnvVar{
+			Name: "WIREGUARD_PRIVATE_KEY",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: getGatewayName(eip)},
+					Key:                  wireGuardPrivateKey,
+				},
+			},
+		})
+	}
+
 	deployment.Spec = appsv1.DeploymentSpec{
+		Replicas: &replicas,
 		Selector: &metav1.LabelSelector{
 			MatchLabels: map[string]string{
 				//"app": getAppName(eip),
@@ -183,22 +532,9 @@ func updateEgressIPDeployment(deployment *appsv1.Deployment, eip *egressipv1alph
 				},
 			},
 			Spec: corev1.PodSpec{
-				Containers: []corev1.Container{{
-					Image:           "yingeli/egress-ip-gateway",
-					ImagePullPolicy: "Always",
-					Name:            "gateway",
-					Env:             getEnv(eip),
-					Ports: []corev1.ContainerPort{
-						{
-							ContainerPort: 1701,
-							Protocol:      "UDP",
-							Name:          "l2tp",
-						},
-					},
-					SecurityContext: &seccurityContext,
-				}},
+				Containers: []corev1.Container{gateway},
 				InitContainers: []corev1.Container{{
-					Image:           "yingeli/egress-ip-gateway",
+					Image:           gatewayImage,
 					ImagePullPolicy: "Always",
 					Name:            "gateway-init",
 					Command: []string{
@@ -210,10 +546,62 @@ func updateEgressIPDeployment(deployment *appsv1.Deployment, eip *egressipv1alph
 			},
 		},
 	}
+
+	// the public IP can only be associated with one node, so every replica
+	// runs on the node of the first one, preferably a node that can take
+	// another public IP
+	if caps.NodeAssociation {
+		deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{
+			PodAffinity: &corev1.PodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"egress-ip": eip.Spec.IP,
+						},
+					},
+					TopologyKey: "kubernetes.io/hostname",
+				}},
+			},
+			NodeAffinity: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{
+					Weight: 100,
+					Preference: corev1.NodeSelectorTerm{
+						MatchExpressions: []corev1.NodeSelectorRequirement{{
+							Key:      egressipv1alpha1.CapacityLabel,
+							Operator: corev1.NodeSelectorOpNotIn,
+							Values:   []string{"0"},
+						}},
+					},
+				}},
+			},
+		}
+		// a node that cannot take another public IP is out for good once
+		// the gateway of another EgressIP runs on it
+		if !caps.MultipleIPsPerNode {
+			deployment.Spec.Template.Spec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
+					LabelSelector: &metav1.LabelSelector{
+						MatchExpressions: []metav1.LabelSelectorRequirement{
+							{
+								Key:      "egress-ip",
+								Operator: metav1.LabelSelectorOpExists,
+							},
+							{
+								Key:      "egress-ip",
+								Operator: metav1.LabelSelectorOpNotIn,
+								Values:   []string{eip.Spec.IP},
+							},
+						},
+					},
+					TopologyKey: "kubernetes.io/hostname",
+				}},
+			}
+		}
+	}
 }
 
 func getEnv(eip *egressipv1alpha1.EgressIP) []corev1.EnvVar {
-	return []corev1.EnvVar{
+	env := []corev1.EnvVar{
 		{
 			Name:  "EGRESS_IP_NAMESPACE",
 			Value: eip.Namespace,
@@ -226,6 +614,41 @@ func getEnv(eip *egressipv1alpha1.EgressIP) []corev1.EnvVar {
 			Name:  "EGRESS_IP",
 			Value: eip.Spec.IP,
 		},
+		{
+			Name:  "GATEWAY_NAME",
+			Value: getGatewayName(eip),
+		},
+		{
+			Name: "POD_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
+			},
+		},
+	}
+	return append(env, getTunnelEnv(eip)...)
+}
+
+// getTunnelEnv tells the gateway its tunnel network, along with the range
+// xl2tpd hands out when the gateway runs L2TP.
+func getTunnelEnv(eip *egressipv1alpha1.EgressIP) []corev1.EnvVar {
+	_, network, err := net.ParseCIDR(eip.Status.TunnelNetwork)
+	if err != nil {
+		return nil
+	}
+	first, last := tunnelIPRange(network)
+	return []corev1.EnvVar{
+		{
+			Name:  "TUNNEL_NETWORK",
+			Value: network.String(),
+		},
+		{
+			Name:  "TUNNEL_LOCAL_IP",
+			Value: tunnel.GatewayIP(network).String(),
+		},
+		{
+			Name:  "TUNNEL_IP_RANGE",
+			Value: first.String() + "-" + last.String(),
+		},
 	}
 }
 
@@ -274,6 +697,18 @@ func getGatewayName(eip *egressipv1alpha1.EgressIP) string {
 	return "egress-ip-gateway-" + eip.Namespace + "-" + eip.Name
 }
 
+// getPublicIPName names the public IP allocated for the EgressIP, within the
+// 80 characters of Azure resource names.
+func getPublicIPName(eip *egressipv1alpha1.EgressIP) string {
+	name := "egress-ip-" + eip.Namespace + "-" + eip.Name
+	if len(name) <= maxPublicIPName {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%s-%08x", name[:maxPublicIPName-9], h.Sum32())
+}
+
 func getGatewayNamespace() string {
 	return controllerNamespace
 }
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/providers/fake"
+)
+
+// TestGatewayPlacement reconciles an EgressIP and checks where its gateway
+// pods may run.
+func TestGatewayPlacement(t *testing.T) {
+	tests := []struct {
+		name string
+		caps providers.Capabilities
+		// whether other gateways keep the pods off their node
+		antiAffinity bool
+	}{
+		{"multiple IPs per node", providers.Capabilities{NodeAssociation: true, MultipleIPsPerNode: true}, false},
+		{"one IP per node", providers.Capabilities{NodeAssociation: true}, true},
+		{"no node association", providers.Capabilities{}, false},
+	}
+	for _, test := range tests {
+		scheme := runtime.NewScheme()
+		if err := clientgoscheme.AddToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+		if err := egressipv1alpha1.AddToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+		eip := &egressipv1alpha1.EgressIP{
+			ObjectMeta: metav1.ObjectMeta{Name: "eip", Namespace: "default"},
+			Spec:       egressipv1alpha1.EgressIPSpec{IP: "20.0.0.1"},
+			Status:     egressipv1alpha1.EgressIPStatus{TunnelNetwork: "192.168.0.0/24"},
+		}
+		c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(eip).Build()
+		provider := fake.New()
+		provider.SetCapabilities(test.caps)
+		r := &EgressIPReconciler{
+			Client:   c,
+			Scheme:   scheme,
+			Recorder: record.NewFakeRecorder(10),
+			Provider: provider,
+		}
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "eip"}}
+		if err := r.reconcile(context.Background(), req); err != nil {
+			t.Fatalf("%s: reconcile error: %v", test.name, err)
+		}
+		var deployment appsv1.Deployment
+		if err := c.Get(context.Background(), getGatewayNamespacedName(eip), &deployment); err != nil {
+			t.Fatalf("%s: get gateway deployment error: %v", test.name, err)
+		}
+
+		affinity := deployment.Spec.Template.Spec.Affinity
+		if (affinity != nil && affinity.PodAffinity != nil) != test.caps.NodeAssociation {
+			t.Errorf("%s: affinity %v, want replicas kept together %v", test.name, affinity, test.caps.NodeAssociation)
+		}
+		if !test.antiAffinity {
+			if affinity != nil && affinity.PodAntiAffinity != nil {
+				t.Errorf("%s: anti-affinity %v, want none", test.name, affinity.PodAntiAffinity)
+			}
+			continue
+		}
+		if affinity == nil || affinity.PodAntiAffinity == nil || len(affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) != 1 {
+			t.Fatalf("%s: affinity %v, want a required anti-affinity", test.name, affinity)
+		}
+		term := affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0]
+		want := []metav1.LabelSelectorRequirement{
+			{Key: "egress-ip", Operator: metav1.LabelSelectorOpExists},
+			{Key: "egress-ip", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"20.0.0.1"}},
+		}
+		if term.TopologyKey != "kubernetes.io/hostname" || term.LabelSelector == nil || !reflect.DeepEqual(term.LabelSelector.MatchExpressions, want) {
+			t.Errorf("%s: anti-affinity term %v, want gateways of other EgressIPs off the node", test.name, term)
+		}
+	}
+}
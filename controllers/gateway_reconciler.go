@@ -18,31 +18,68 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/go-logr/logr"
 	"github.com/yingeli/egress-ip-operator/providers"
-	"github.com/yingeli/egress-ip-operator/providers/azure"
 
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
 	egressipclients "github.com/yingeli/egress-ip-operator/clients"
 )
 
 type GatewayReconciler struct {
-	client       *client.Client
-	eipc         egressipclients.EgressIPClient
-	provider     providers.Provider
-	log          logr.Logger
-	nodeName     string
-	localNetwork string
+	client   *client.Client
+	eipc     egressipclients.EgressIPClient
+	provider providers.Provider
+	snat     SNATBackend
+	log      logr.Logger
+	// raises the refusals of the provider on the EgressIPs
+	recorder        record.EventRecorder
+	nodeName        string
+	localNetwork    string
+	resyncInterval  time.Duration
+	shutdownTimeout time.Duration
+	drainTimeout    time.Duration
+	// when the private IPs being drained are dissociated at the latest
+	drainDeadlines map[string]time.Time
+	health         *providerHealth
+	// the node's network, replaced in tests
+	resolveInterface func(sourceIP string) (string, error)
+	flows            flowTable
 }
 
+// providerHealth caches the result of Provider.Health, as probes run far
+// more often than the provider API should be called.
+type providerHealth struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+const (
+	defaultResyncInterval  = 5 * time.Minute
+	defaultShutdownTimeout = 30 * time.Second
+	drainPollInterval      = 5 * time.Second
+	providerHealthInterval = time.Minute
+
+	// taint the cluster autoscaler puts on nodes it is about to delete
+	toBeDeletedTaint = "ToBeDeletedByClusterAutoscaler"
+)
+
 func GatewayPodSelectors() (fs fields.Selector, ls labels.Selector, err error) {
 	ls, err = labels.Parse("egress-ip")
 	if err != nil {
@@ -54,147 +91,538 @@ func GatewayPodSelectors() (fs fields.Selector, ls labels.Selector, err error) {
 	return fs, ls, nil
 }
 
-func openGatewayReconciler(client *client.Client, provider providers.Provider) (r GatewayReconciler, err error) {
+// GatewayNodeSelector selects the node the daemon runs on.
+func GatewayNodeSelector() fields.Selector {
+	return fields.SelectorFromSet(fields.Set{"metadata.name": os.Getenv("NODE_NAME")})
+}
+
+func openGatewayReconciler(client *client.Client, provider providers.Provider, recorder record.EventRecorder) (r GatewayReconciler, err error) {
 	ctx := context.Background()
 	eipc, err := egressipclients.OpenEgressIPClient(ctx)
 	if err != nil {
 		return r, err
 	}
+	snat, err := DetectSNATBackend()
+	if err != nil {
+		return r, err
+	}
+	resyncInterval, err := durationFromEnv("RESYNC_INTERVAL", defaultResyncInterval)
+	if err != nil {
+		return r, err
+	}
+	shutdownTimeout, err := durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		return r, err
+	}
+	drainTimeout, err := durationFromEnv("DRAIN_TIMEOUT", 0)
+	if err != nil {
+		return r, err
+	}
 	r = GatewayReconciler{
-		client:       client,
-		eipc:         eipc,
-		provider:     provider,
-		log:          ctrl.Log.WithName("gateway-reconciler"),
-		nodeName:     os.Getenv("NODE_NAME"),
-		localNetwork: os.Getenv("LOCAL_NETWORK"),
+		client:           client,
+		eipc:             eipc,
+		provider:         provider,
+		snat:             snat,
+		log:              ctrl.Log.WithName("gateway-reconciler"),
+		recorder:         recorder,
+		nodeName:         os.Getenv("NODE_NAME"),
+		localNetwork:     os.Getenv("LOCAL_NETWORK"),
+		resyncInterval:   resyncInterval,
+		shutdownTimeout:  shutdownTimeout,
+		drainTimeout:     drainTimeout,
+		drainDeadlines:   make(map[string]time.Time),
+		health:           &providerHealth{},
+		resolveInterface: egressInterface,
+		flows:            conntrackTable{},
+	}
+	r.log.Info("using SNAT backend", "backend", snat.Name())
+	if err := CleanupOtherSNATBackends(snat); err != nil {
+		r.log.Error(err, "error cleaning up SNAT backends")
 	}
 	return r, nil
 }
 
-func openAzureGatewayReconciler(client *client.Client) (GatewayReconciler, error) {
-	provider := azure.NewProvider()
-	return openGatewayReconciler(client, &provider)
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return d, fmt.Errorf("invalid %s %s: %v", name, s, err)
+	}
+	return d, nil
 }
 
-func (r *GatewayReconciler) reconcile(ctx context.Context, req ctrl.Request) error {
-	podMap, err := r.getPodMap(ctx, req.Namespace)
+// reconcile makes the SNAT rules and public IP associations of the node
+// match the gateway pods scheduled on it, in every namespace. The state of
+// the node is taken from the provider rather than from the SNAT rules, so
+// that associations left behind by gateways no longer on the node, for
+// instance while the daemon was down, and leaked private IPs are removed.
+func (r *GatewayReconciler) reconcile(ctx context.Context) (ctrl.Result, error) {
+	podMap, err := r.getPodMap(ctx)
 	if err != nil {
-		return err
+		return ctrl.Result{}, err
 	}
 
-	ipt, err := iptables.New()
+	current, err := r.snat.Rules()
 	if err != nil {
-		return err
+		return ctrl.Result{}, err
 	}
-	ruleMap, err := r.getSNATRuleMap(ipt)
+
+	egressIPs, err := r.getEgressIPs(ctx)
 	if err != nil {
-		return err
+		return ctrl.Result{}, err
 	}
 
-	for podIP, rule := range ruleMap {
-		if _, exist := podMap[podIP]; !exist {
-			if err := r.dissociate(ctx, ipt, rule); err != nil {
-				return err
+	associations, err := r.provider.ListAssociations(ctx)
+	if err != nil {
+		// such as a provider refusing to run on the node at all
+		warned := make(map[string]bool)
+		for _, pod := range podMap {
+			if egressIP := pod.Labels["egress-ip"]; egressIP != "" && !warned[egressIP] {
+				warned[egressIP] = true
+				r.warn(pod, egressIPs, "AssociationFailed", fmt.Sprintf("Cannot associate with node %s: %v", r.nodeName, err))
 			}
 		}
+		return ctrl.Result{}, err
+	}
+
+	// gateways keep working on a draining node until they are evicted, but
+	// their EgressIPs are about to move
+	draining, err := r.nodeDraining(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// gateway replicas of an EgressIP share the private IP its public IP is
+	// associated with
+	sources := make(map[string]string)
+	for _, association := range associations {
+		if _, found := egressIPs[association.PublicIP]; found {
+			sources[association.PublicIP] = association.SourceIP
+		}
+	}
+	caps := r.provider.Capabilities()
+
+	// the interface owning a private IP can change when NICs are added or
+	// renamed, so it is resolved on every reconcile
+	interfaces := make(map[string]string)
+
+	var associateErr error
+	missing := make(map[string]string)
+	for podIP, pod := range podMap {
+		egressIP := pod.Labels["egress-ip"]
+		if podIP == "" || egressIP == "" {
+			continue
+		}
+		if !caps.NodeAssociation {
+			// gateways SNAT straight to their EgressIP
+			sources[egressIP] = egressIP
+		}
+		if sources[egressIP] != "" || missing[egressIP] != "" {
+			continue
+		}
+		if !caps.MultipleIPsPerNode && len(sources)+len(missing) > 0 {
+			associateErr = fmt.Errorf("provider cannot associate EgressIP %s with a node that already has one", egressIP)
+			r.log.Error(associateErr, "error associating EgressIP", "EgressIP", egressIP, "pod IP", podIP)
+			r.warn(pod, egressIPs, "AssociationRefused", fmt.Sprintf("Node %s already has an EgressIP and cannot take another one", r.nodeName))
+			continue
+		}
+		missing[egressIP] = podIP
+	}
+	if err := r.associate(ctx, missing, sources, egressIPs, podMap); err != nil {
+		associateErr = err
 	}
 
+	var added []corev1.Pod
+	desired := make(map[string]SNATRule)
 	for podIP, pod := range podMap {
-		if _, exist := ruleMap[podIP]; !exist {
-			//r.log.Info("entering associate", "pod", pod)
-			if err := r.associate(ctx, ipt, &pod); err != nil {
-				return err
+		egressIP := pod.Labels["egress-ip"]
+		if podIP == "" || egressIP == "" || sources[egressIP] == "" {
+			continue
+		}
+		srcIP := sources[egressIP]
+		if _, exist := interfaces[srcIP]; !exist {
+			iface, err := r.resolveInterface(srcIP)
+			if err != nil {
+				return ctrl.Result{}, err
 			}
+			r.log.V(1).Info("resolved egress interface", "private IP", srcIP, "interface", iface)
+			interfaces[srcIP] = iface
+		}
+		desired[podIP] = NewSNATRule(interfaces[srcIP], podIP, r.localNetwork, srcIP)
+		if _, exist := current[podIP]; !exist {
+			added = append(added, pod)
 		}
 	}
 
-	return nil
-}
+	if err := r.snat.Sync(desired); err != nil {
+		return ctrl.Result{}, err
+	}
 
-func (r *GatewayReconciler) getPodMap(ctx context.Context, namespace string) (m map[string]corev1.Pod, err error) {
-	//var pods corev1.PodList
-	//if err := r.List(ctx, &pods, client.InNamespace(req.Namespace),
-	//	client.MatchingFieldsSelector{Selector: fs}, client.MatchingLabelsSelector{Selector: ls}); err != nil {
-	//	return err
-	//}
-	var pods corev1.PodList
-	if err := (*r.client).List(ctx, &pods, client.InNamespace(namespace)); err != nil {
-		return m, err
+	phase, updated := "Configured", added
+	if draining {
+		phase = "Migrating"
+		updated = nil
+		for _, pod := range podMap {
+			updated = append(updated, pod)
+		}
+	}
+	for _, pod := range updated {
+		namespace := pod.Labels["egress-ip-namespace"]
+		name := pod.Labels["egress-ip-name"]
+		if err := r.updateEgressIPStatusPhase(ctx, namespace, name, phase); err != nil {
+			r.log.Error(err, "error updating EgressIP status phase", "egress-ip-namespace", namespace, "egress-ip", name)
+			return ctrl.Result{}, err
+		}
 	}
 
-	m = make(map[string]corev1.Pod)
-	for _, pod := range pods.Items {
-		egressip := pod.Labels["egress-ip"]
-		if pod.Spec.NodeName != r.nodeName || egressip == "" {
-			r.log.Info("skipping non-gateway pod", "nodeName", pod.Spec.NodeName, "egress-ip", egressip)
+	// only associations of EgressIPs and leaked private IPs are ours to
+	// release, the node may have public IPs of its own
+	var result ctrl.Result
+	for _, association := range associations {
+		srcIP := association.SourceIP
+		leaked := association.Owned && association.PublicIP == ""
+		if _, found := egressIPs[association.PublicIP]; !leaked && !found {
 			continue
 		}
-		m[pod.Status.PodIP] = pod
-		//r.log.Info("gateway pod added", "nodeName", pod.Spec.NodeName, "egress-ip", egressip)
+		if usesSource(desired, srcIP) {
+			delete(r.drainDeadlines, srcIP)
+			continue
+		}
+		if !leaked {
+			wait, err := r.drainWait(srcIP)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if wait > 0 {
+				if result.RequeueAfter == 0 || wait < result.RequeueAfter {
+					result.RequeueAfter = wait
+				}
+				continue
+			}
+		}
+		if err := r.provider.Dissociate(ctx, srcIP); err != nil {
+			return ctrl.Result{}, err
+		}
+		delete(r.drainDeadlines, srcIP)
+		r.log.Info("dissociated EgressIP successfuly", "Private IP", srcIP)
+		if n, err := r.flows.DeleteTranslated(srcIP); err != nil {
+			r.log.Error(err, "error deleting conntrack flows", "private IP", srcIP)
+		} else if n > 0 {
+			r.log.Info("deleted conntrack flows", "private IP", srcIP, "flows", n)
+		}
 	}
-	return m, nil
+
+	// flows of pods whose rule changed keep their former translation, unless
+	// it is being drained
+	keep := make([]string, 0, len(r.drainDeadlines))
+	for srcIP := range r.drainDeadlines {
+		keep = append(keep, srcIP)
+	}
+	for podIP, rule := range desired {
+		if prev, exist := current[podIP]; exist && prev.ToSource == rule.ToSource {
+			continue
+		}
+		if n, err := r.flows.DeleteStale(podIP, append(keep, rule.ToSource), r.localNetwork); err != nil {
+			r.log.Error(err, "error deleting conntrack flows", "pod IP", podIP)
+		} else if n > 0 {
+			r.log.Info("deleted conntrack flows", "pod IP", podIP, "flows", n)
+		}
+	}
+
+	// a failure to report the capacity only affects the placement of new
+	// gateways
+	if err := r.reportCapacity(ctx); err != nil {
+		r.log.Error(err, "error reporting capacity of the node")
+	}
+
+	return result, associateErr
 }
 
-func (r *GatewayReconciler) getSNATRuleMap(ipt *iptables.IPTables) (m map[string]SNATRule, err error) {
-	rules, err := ipt.List("nat", "POSTROUTING")
+// drainWait returns how long to wait before dissociating srcIP, which is no
+// longer used by any rule, for the flows translated to it to finish. It is 0
+// once they have or the drain timeout has passed since the wait started.
+func (r *GatewayReconciler) drainWait(srcIP string) (time.Duration, error) {
+	if r.drainTimeout == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	deadline, exist := r.drainDeadlines[srcIP]
+	if !exist {
+		deadline = now.Add(r.drainTimeout)
+		r.drainDeadlines[srcIP] = deadline
+	}
+	if !now.Before(deadline) {
+		r.log.Info("drain timeout passed", "private IP", srcIP)
+		return 0, nil
+	}
+	n, err := r.flows.CountTranslated(srcIP)
 	if err != nil {
-		return m, err
+		return 0, err
 	}
-
-	m = make(map[string]SNATRule)
-	for _, rule := range rules {
-		if sr, ok := ParseSNATRule(rule); ok {
-			m[sr.Source] = sr
-		}
+	if n == 0 {
+		return 0, nil
 	}
-	return m, nil
+	r.log.Info("draining EgressIP", "private IP", srcIP, "flows", n, "deadline", deadline)
+	if wait := deadline.Sub(now); wait < drainPollInterval {
+		return wait, nil
+	}
+	return drainPollInterval, nil
 }
 
-func (r *GatewayReconciler) associate(ctx context.Context, ipt *iptables.IPTables, pod *corev1.Pod) error {
-	egressIP := pod.Labels["egress-ip"]
-	podIP := pod.Status.PodIP
-	if egressIP == "" || podIP == "" {
-		return nil
+// shutdown releases what the daemon holds on the node within the shutdown
+// timeout when the node is drained or deleted, or always if asked to, so
+// that the EgressIPs associated with it can move to another node quickly:
+// they are marked Migrating, the SNAT rules are removed and their public IPs
+// dissociated. Otherwise the daemon is only being restarted, for instance
+// on upgrade, and everything is kept for it to take over on start.
+func (r *GatewayReconciler) shutdown(always bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.shutdownTimeout)
+	defer cancel()
+
+	if !always {
+		leaving, err := r.nodeLeaving(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot tell whether the node is leaving, keeping its EgressIPs: %v", err)
+		}
+		if !leaving {
+			r.log.Info("keeping EgressIPs of the node, which is neither drained nor deleted")
+			return nil
+		}
 	}
+	r.log.Info("releasing EgressIPs of the node")
 
-	srcIP, err := r.provider.Associate(ctx, egressIP, podIP)
+	associations, err := r.provider.ListAssociations(ctx)
 	if err != nil {
 		return err
 	}
-
-	rule := NewSNATRule(podIP, r.localNetwork, srcIP)
-	if err := ipt.Insert("nat", "POSTROUTING", 1, rule.Spec()...); err != nil {
+	var eips egressipv1alpha1.EgressIPList
+	if err := r.eipc.List(ctx, &eips); err != nil {
 		return err
 	}
 
-	namespace := pod.Labels["egress-ip-namespace"]
-	name := pod.Labels["egress-ip-name"]
-	if err := r.updateEgressIPStatusPhase(ctx, namespace, name, "Configured"); err != nil {
-		r.log.Error(err, "error updating EgressIP status phase", "egress-ip-namespace", namespace, "egress-ip", name)
-		return err
+	var shutdownErr error
+	egressIPs := make(map[string]bool)
+	for _, eip := range eips.Items {
+		egressIPs[eip.Spec.IP] = true
+		if !associated(associations, eip.Spec.IP) {
+			continue
+		}
+		if err := r.updateEgressIPStatusPhase(ctx, eip.Namespace, eip.Name, "Migrating"); err != nil {
+			r.log.Error(err, "error updating EgressIP status phase", "egress-ip-namespace", eip.Namespace, "egress-ip", eip.Name)
+			shutdownErr = err
+		}
 	}
 
-	r.log.Info("associated EgressIP successfuly", "EgressIP", egressIP)
-	return nil
+	if err := r.snat.Cleanup(); err != nil {
+		r.log.Error(err, "error removing SNAT rules")
+		shutdownErr = err
+	}
+
+	for _, association := range associations {
+		if !egressIPs[association.PublicIP] {
+			continue
+		}
+		if err := r.provider.Dissociate(ctx, association.SourceIP); err != nil {
+			r.log.Error(err, "error dissociating EgressIP", "EgressIP", association.PublicIP, "private IP", association.SourceIP)
+			shutdownErr = err
+			continue
+		}
+		r.log.Info("dissociated EgressIP successfuly", "EgressIP", association.PublicIP, "private IP", association.SourceIP)
+	}
+	return shutdownErr
 }
 
-func (r *GatewayReconciler) dissociate(ctx context.Context, ipt *iptables.IPTables, rule SNATRule) error {
-	if err := ipt.Delete("nat", "POSTROUTING", rule.Spec()...); err != nil {
+func associated(associations []providers.Association, publicIP string) bool {
+	for _, association := range associations {
+		if association.PublicIP == publicIP {
+			return true
+		}
+	}
+	return false
+}
+
+// associate associates the missing EgressIPs with the node, keyed by the
+// pod IP of one of their gateways, and records their private IPs in sources.
+// Associations run concurrently so that providers can batch them into a
+// single update of the node.
+func (r *GatewayReconciler) associate(ctx context.Context, missing map[string]string, sources map[string]string, egressIPs map[string]types.UID, podMap map[string]corev1.Pod) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var associateErr error
+	for egressIP, podIP := range missing {
+		wg.Add(1)
+		go func(egressIP string, podIP string) {
+			defer wg.Done()
+			owner := providers.Owner{EgressIP: string(egressIPs[egressIP]), Node: r.nodeName}
+			association, err := r.provider.EnsureAssociation(ctx, egressIP, podIP, owner)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				r.log.Error(err, "error associating EgressIP", "EgressIP", egressIP, "pod IP", podIP)
+				r.warn(podMap[podIP], egressIPs, "AssociationFailed", fmt.Sprintf("Cannot associate with node %s: %v", r.nodeName, err))
+				associateErr = err
+				return
+			}
+			r.log.Info("associated EgressIP successfuly", "EgressIP", egressIP, "private IP", association.SourceIP)
+			sources[egressIP] = association.SourceIP
+		}(egressIP, podIP)
+	}
+	wg.Wait()
+	return associateErr
+}
+
+// warn raises a Warning Event on the EgressIP of the gateway pod.
+func (r *GatewayReconciler) warn(pod corev1.Pod, egressIPs map[string]types.UID, reason, message string) {
+	ref := &corev1.ObjectReference{
+		APIVersion: egressipv1alpha1.GroupVersion.String(),
+		Kind:       "EgressIP",
+		Namespace:  pod.Labels["egress-ip-namespace"],
+		Name:       pod.Labels["egress-ip-name"],
+		UID:        egressIPs[pod.Labels["egress-ip"]],
+	}
+	r.recorder.Event(ref, corev1.EventTypeWarning, reason, message)
+}
+
+// nodeDraining returns whether the node is cordoned or about to be deleted.
+func (r *GatewayReconciler) nodeDraining(ctx context.Context) (bool, error) {
+	var node corev1.Node
+	if err := (*r.client).Get(ctx, client.ObjectKey{Name: r.nodeName}, &node); err != nil {
+		return false, err
+	}
+	return isDraining(&node), nil
+}
+
+// nodeLeaving returns whether the node is draining or already deleted.
+func (r *GatewayReconciler) nodeLeaving(ctx context.Context) (bool, error) {
+	draining, err := r.nodeDraining(ctx)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	return draining, err
+}
+
+// reportCapacity records in the CapacityLabel of the node how many more
+// EgressIPs the provider can associate with it, so that gateways are placed
+// elsewhere once it is full. Nodes without a bound have no label.
+func (r *GatewayReconciler) reportCapacity(ctx context.Context) error {
+	capacity, err := r.provider.Capacity(ctx)
+	if err != nil {
 		return err
 	}
-	if err := r.provider.Dissociate(ctx, rule.ToSource); err != nil {
+	var node corev1.Node
+	if err := (*r.client).Get(ctx, client.ObjectKey{Name: r.nodeName}, &node); err != nil {
+		return err
+	}
+	value, exist := node.Labels[egressipv1alpha1.CapacityLabel]
+	if capacity == providers.Unlimited && !exist || value == strconv.Itoa(capacity) {
+		return nil
+	}
+
+	patch := client.MergeFrom(node.DeepCopy())
+	if capacity == providers.Unlimited {
+		delete(node.Labels, egressipv1alpha1.CapacityLabel)
+	} else {
+		if node.Labels == nil {
+			node.Labels = make(map[string]string)
+		}
+		node.Labels[egressipv1alpha1.CapacityLabel] = strconv.Itoa(capacity)
+	}
+	if err := (*r.client).Patch(ctx, &node, patch); err != nil {
 		return err
 	}
-	r.log.Info("dissociated EgressIP successfuly", "Private IP", rule.ToSource)
+	r.log.Info("reported capacity of the node", "capacity", capacity)
 	return nil
 }
 
+func isDraining(node *corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == toBeDeletedTaint {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProvider returns the error of the last provider health check, made
+// at most once every providerHealthInterval.
+func (r *GatewayReconciler) checkProvider(req *http.Request) error {
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+	if time.Since(r.health.checked) < providerHealthInterval {
+		return r.health.err
+	}
+	r.health.err = r.provider.Health(req.Context())
+	r.health.checked = time.Now()
+	if r.health.err != nil {
+		r.log.Error(r.health.err, "provider unhealthy")
+	}
+	return r.health.err
+}
+
+func usesSource(rules map[string]SNATRule, source string) bool {
+	for _, rule := range rules {
+		if rule.ToSource == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *GatewayReconciler) getPodMap(ctx context.Context) (m map[string]corev1.Pod, err error) {
+	//var pods corev1.PodList
+	//if err := r.List(ctx, &pods, client.InNamespace(req.Namespace),
+	//	client.MatchingFieldsSelector{Selector: fs}, client.MatchingLabelsSelector{Selector: ls}); err != nil {
+	//	return err
+	//}
+	var pods corev1.PodList
+	if err := (*r.client).List(ctx, &pods); err != nil {
+		return m, err
+	}
+
+	m = make(map[string]corev1.Pod)
+	for _, pod := range pods.Items {
+		egressip := pod.Labels["egress-ip"]
+		if pod.Spec.NodeName != r.nodeName || egressip == "" {
+			r.log.Info("skipping non-gateway pod", "nodeName", pod.Spec.NodeName, "egress-ip", egressip)
+			continue
+		}
+		m[pod.Status.PodIP] = pod
+		//r.log.Info("gateway pod added", "nodeName", pod.Spec.NodeName, "egress-ip", egressip)
+	}
+	return m, nil
+}
+
+// getEgressIPs returns the UIDs of the EgressIPs of the cluster by public
+// IP, leaving out the ones whose public IP is not allocated yet.
+func (r *GatewayReconciler) getEgressIPs(ctx context.Context) (map[string]types.UID, error) {
+	var eips egressipv1alpha1.EgressIPList
+	if err := r.eipc.List(ctx, &eips); err != nil {
+		return nil, err
+	}
+	m := make(map[string]types.UID)
+	for _, eip := range eips.Items {
+		if eip.Spec.IP != "" {
+			m[eip.Spec.IP] = eip.UID
+		}
+	}
+	return m, nil
+}
+
 func (r *GatewayReconciler) updateEgressIPStatusPhase(ctx context.Context, namespace, name, phase string) error {
 	eip, err := r.eipc.GetEgressIP(ctx, namespace, name)
 	if err != nil {
 		r.log.Error(err, "error updating EgressIP phase", "namespace", namespace, "name", name)
 		return err
 	}
+	if eip.Status.Phase == phase {
+		return nil
+	}
 	eip.Status.Phase = phase
 	if err := eip.UpdateStatus(ctx); err != nil {
 		return err
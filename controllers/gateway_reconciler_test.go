@@ -0,0 +1,561 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	egressipclients "github.com/yingeli/egress-ip-operator/clients"
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/providers/fake"
+)
+
+const (
+	testNode         = "node-1"
+	testNamespace    = "egress-ip-system"
+	testLocalNetwork = "10.0.0.0/8"
+	testInterface    = "eth1"
+)
+
+// fakeSNATBackend keeps the rules in memory instead of the node's tables.
+type fakeSNATBackend struct {
+	rules   map[string]SNATRule
+	syncErr error
+	cleaned bool
+}
+
+func (b *fakeSNATBackend) Name() string {
+	return "fake"
+}
+
+func (b *fakeSNATBackend) Rules() (map[string]SNATRule, error) {
+	m := make(map[string]SNATRule)
+	for source, rule := range b.rules {
+		m[source] = rule
+	}
+	return m, nil
+}
+
+func (b *fakeSNATBackend) Sync(rules map[string]SNATRule) error {
+	if b.syncErr != nil {
+		return b.syncErr
+	}
+	b.rules = rules
+	return nil
+}
+
+func (b *fakeSNATBackend) Cleanup() error {
+	b.rules = nil
+	b.cleaned = true
+	return nil
+}
+
+// fakeFlowTable counts the flows it is told about and records deletions.
+type fakeFlowTable struct {
+	translated map[string]int
+	stale      []string
+	deleted    []string
+}
+
+func (f *fakeFlowTable) DeleteStale(podIP string, keep []string, localNetwork string) (uint, error) {
+	f.stale = append(f.stale, podIP)
+	return 0, nil
+}
+
+func (f *fakeFlowTable) DeleteTranslated(toSource string) (uint, error) {
+	f.deleted = append(f.deleted, toSource)
+	n := f.translated[toSource]
+	delete(f.translated, toSource)
+	return uint(n), nil
+}
+
+func (f *fakeFlowTable) CountTranslated(toSource string) (int, error) {
+	return f.translated[toSource], nil
+}
+
+// gatewayHarness runs a GatewayReconciler against a fake API server,
+// provider, SNAT backend and conntrack table.
+type gatewayHarness struct {
+	t        *testing.T
+	client   client.Client
+	provider *fake.Provider
+	snat     *fakeSNATBackend
+	flows    *fakeFlowTable
+	recorder *record.FakeRecorder
+	r        GatewayReconciler
+}
+
+func newGatewayHarness(t *testing.T, objs ...client.Object) *gatewayHarness {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := egressipv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}}
+	c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(append(objs, node)...).Build()
+
+	h := &gatewayHarness{
+		t:        t,
+		client:   c,
+		provider: fake.New(),
+		snat:     &fakeSNATBackend{},
+		flows:    &fakeFlowTable{translated: make(map[string]int)},
+		recorder: record.NewFakeRecorder(100),
+	}
+	h.r = GatewayReconciler{
+		client:         &h.client,
+		eipc:           egressipclients.EgressIPClient{Client: c},
+		provider:       h.provider,
+		snat:           h.snat,
+		log:            ctrl.Log.WithName("test"),
+		recorder:       h.recorder,
+		nodeName:       testNode,
+		localNetwork:   testLocalNetwork,
+		drainDeadlines: make(map[string]time.Time),
+		health:         &providerHealth{},
+		resolveInterface: func(string) (string, error) {
+			return testInterface, nil
+		},
+		flows: h.flows,
+	}
+	return h
+}
+
+func (h *gatewayHarness) reconcile() (ctrl.Result, error) {
+	return h.r.reconcile(context.Background())
+}
+
+func (h *gatewayHarness) mustReconcile() ctrl.Result {
+	h.t.Helper()
+	result, err := h.reconcile()
+	if err != nil {
+		h.t.Fatalf("reconcile error: %v", err)
+	}
+	return result
+}
+
+func (h *gatewayHarness) phase(name string) string {
+	h.t.Helper()
+	var eip egressipv1alpha1.EgressIP
+	if err := h.client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, &eip); err != nil {
+		h.t.Fatal(err)
+	}
+	return eip.Status.Phase
+}
+
+// events returns the Events raised since the last call.
+func (h *gatewayHarness) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-h.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func (h *gatewayHarness) sourceOf(publicIP string) string {
+	for _, association := range h.provider.Associations() {
+		if association.PublicIP == publicIP {
+			return association.SourceIP
+		}
+	}
+	return ""
+}
+
+func testEgressIP(name string, ip string) *egressipv1alpha1.EgressIP {
+	return &egressipv1alpha1.EgressIP{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       egressipv1alpha1.EgressIPSpec{IP: ip},
+	}
+}
+
+func testGatewayPod(name string, podIP string, eip *egressipv1alpha1.EgressIP, node string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testNamespace,
+			Name:      name,
+			Labels: map[string]string{
+				"egress-ip":           eip.Spec.IP,
+				"egress-ip-namespace": eip.Namespace,
+				"egress-ip-name":      eip.Name,
+			},
+		},
+		Spec:   corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{PodIP: podIP},
+	}
+}
+
+func TestReconcileAssociatesGatewayPods(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip,
+		testGatewayPod("gateway-1", "10.244.0.5", eip, testNode),
+		testGatewayPod("gateway-2", "10.244.0.6", eip, testNode),
+		testGatewayPod("gateway-3", "10.244.1.5", eip, "node-2"))
+
+	h.mustReconcile()
+
+	if n := h.provider.CallCount("EnsureAssociation"); n != 1 {
+		t.Errorf("EnsureAssociation called %d times, want 1 for replicas sharing a public IP", n)
+	}
+	source := h.sourceOf("20.0.0.1")
+	if source == "" {
+		t.Fatalf("public IP not associated, associations %v", h.provider.Associations())
+	}
+	want := map[string]SNATRule{
+		"10.244.0.5": NewSNATRule(testInterface, "10.244.0.5", testLocalNetwork, source),
+		"10.244.0.6": NewSNATRule(testInterface, "10.244.0.6", testLocalNetwork, source),
+	}
+	if len(h.snat.rules) != len(want) {
+		t.Fatalf("rules %v, want %v", h.snat.rules, want)
+	}
+	for podIP, rule := range want {
+		if h.snat.rules[podIP] != rule {
+			t.Errorf("rule of %s is %v, want %v", podIP, h.snat.rules[podIP], rule)
+		}
+	}
+	if phase := h.phase("eip-1"); phase != "Configured" {
+		t.Errorf("phase %q, want Configured", phase)
+	}
+
+	// a second pass finds everything in place
+	h.mustReconcile()
+	if n := h.provider.CallCount("EnsureAssociation"); n != 1 {
+		t.Errorf("EnsureAssociation called %d times after resync, want 1", n)
+	}
+	if n := h.provider.CallCount("Dissociate"); n != 0 {
+		t.Errorf("Dissociate called %d times, want 0", n)
+	}
+}
+
+func TestReconcileReleasesStaleAssociations(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	gone := testEgressIP("eip-2", "20.0.0.2")
+	h := newGatewayHarness(t, eip, gone, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+	h.provider.AddAssociation(providers.Association{PublicIP: "20.0.0.2", SourceIP: "10.240.0.20", Owned: true})
+	// the public IP of the node itself is not ours
+	h.provider.AddAssociation(providers.Association{PublicIP: "52.0.0.1", SourceIP: "10.240.0.4"})
+	// left behind by a failed dissociation
+	h.provider.AddAssociation(providers.Association{SourceIP: "10.240.0.21", Owned: true})
+	h.flows.translated["10.240.0.20"] = 3
+
+	h.mustReconcile()
+
+	var sources []string
+	for _, association := range h.provider.Associations() {
+		sources = append(sources, association.SourceIP)
+	}
+	want := []string{"10.240.0.4", h.sourceOf("20.0.0.1")}
+	if len(sources) != len(want) || sources[0] != want[0] || sources[1] != want[1] {
+		t.Errorf("associations left %v, want %v", sources, want)
+	}
+	if len(h.flows.deleted) != 2 {
+		t.Errorf("flows of %v deleted, want those of both released private IPs", h.flows.deleted)
+	}
+}
+
+func TestReconcileDrainsBeforeDissociating(t *testing.T) {
+	gone := testEgressIP("eip-2", "20.0.0.2")
+	h := newGatewayHarness(t, gone)
+	h.r.drainTimeout = time.Minute
+	h.provider.AddAssociation(providers.Association{PublicIP: "20.0.0.2", SourceIP: "10.240.0.20", Owned: true})
+	h.flows.translated["10.240.0.20"] = 3
+
+	result := h.mustReconcile()
+	if result.RequeueAfter == 0 || result.RequeueAfter > drainPollInterval {
+		t.Errorf("requeue after %v while draining, want at most %v", result.RequeueAfter, drainPollInterval)
+	}
+	if n := h.provider.CallCount("Dissociate"); n != 0 {
+		t.Fatalf("dissociated while flows remain")
+	}
+
+	// flows finished
+	h.flows.translated["10.240.0.20"] = 0
+	h.mustReconcile()
+	if n := h.provider.CallCount("Dissociate"); n != 1 {
+		t.Errorf("Dissociate called %d times once drained, want 1", n)
+	}
+	if len(h.r.drainDeadlines) != 0 {
+		t.Errorf("drain deadlines %v left", h.r.drainDeadlines)
+	}
+}
+
+func TestReconcileDrainTimeout(t *testing.T) {
+	gone := testEgressIP("eip-2", "20.0.0.2")
+	h := newGatewayHarness(t, gone)
+	h.r.drainTimeout = time.Minute
+	h.provider.AddAssociation(providers.Association{PublicIP: "20.0.0.2", SourceIP: "10.240.0.20", Owned: true})
+	h.flows.translated["10.240.0.20"] = 3
+
+	h.mustReconcile()
+	h.r.drainDeadlines["10.240.0.20"] = time.Now().Add(-time.Second)
+	h.mustReconcile()
+	if n := h.provider.CallCount("Dissociate"); n != 1 {
+		t.Errorf("Dissociate called %d times after the drain timeout, want 1", n)
+	}
+}
+
+func TestReconcileAssociateFailure(t *testing.T) {
+	eip1 := testEgressIP("eip-1", "20.0.0.1")
+	eip2 := testEgressIP("eip-2", "20.0.0.2")
+	h := newGatewayHarness(t, eip1, eip2,
+		testGatewayPod("gateway-1", "10.244.0.5", eip1, testNode),
+		testGatewayPod("gateway-2", "10.244.0.6", eip2, testNode))
+	failure := errors.New("conflict")
+	h.provider.FailNext("EnsureAssociation", failure)
+
+	if _, err := h.reconcile(); err != failure {
+		t.Fatalf("reconcile error %v, want %v", err, failure)
+	}
+	if events := h.events(); len(events) != 1 || !strings.HasPrefix(events[0], "Warning AssociationFailed") || !strings.Contains(events[0], "conflict") {
+		t.Errorf("events %q, want the failure raised on the EgressIP", events)
+	}
+	// the other EgressIP is configured anyway
+	if len(h.snat.rules) != 1 {
+		t.Errorf("rules %v, want the one of the EgressIP that was associated", h.snat.rules)
+	}
+
+	// and the failed one on retry
+	h.mustReconcile()
+	if len(h.snat.rules) != 2 {
+		t.Errorf("rules %v after retry, want both", h.snat.rules)
+	}
+	if phase := h.phase("eip-1"); phase != "Configured" {
+		t.Errorf("phase of eip-1 %q, want Configured", phase)
+	}
+	if phase := h.phase("eip-2"); phase != "Configured" {
+		t.Errorf("phase of eip-2 %q, want Configured", phase)
+	}
+}
+
+func TestReconcileProviderFailures(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+
+	h.provider.FailNext("ListAssociations", errors.New("throttled"))
+	if _, err := h.reconcile(); err == nil {
+		t.Errorf("reconcile succeeded without associations")
+	}
+	if events := h.events(); len(events) != 1 || !strings.HasPrefix(events[0], "Warning AssociationFailed") {
+		t.Errorf("events %q, want the failure raised on the EgressIP", events)
+	}
+	if len(h.snat.rules) != 0 {
+		t.Errorf("rules %v programmed without associations", h.snat.rules)
+	}
+
+	h.snat.syncErr = errors.New("iptables-restore failed")
+	if _, err := h.reconcile(); err == nil {
+		t.Errorf("reconcile succeeded without programming rules")
+	}
+	if phase := h.phase("eip-1"); phase != "" {
+		t.Errorf("phase %q before rules are programmed", phase)
+	}
+}
+
+func TestReconcileProviderLatency(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+	h.provider.SetLatency(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := h.r.reconcile(ctx); err != context.DeadlineExceeded {
+		t.Errorf("reconcile error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestReconcileSingleIPPerNode(t *testing.T) {
+	eip1 := testEgressIP("eip-1", "20.0.0.1")
+	eip2 := testEgressIP("eip-2", "20.0.0.2")
+	h := newGatewayHarness(t, eip1, eip2,
+		testGatewayPod("gateway-1", "10.244.0.5", eip1, testNode),
+		testGatewayPod("gateway-2", "10.244.0.6", eip2, testNode))
+	h.provider.SetCapabilities(providers.Capabilities{NodeAssociation: true})
+
+	if _, err := h.reconcile(); err == nil {
+		t.Errorf("reconcile succeeded with two public IPs on a node holding one")
+	}
+	if events := h.events(); len(events) != 1 || !strings.HasPrefix(events[0], "Warning AssociationRefused") {
+		t.Errorf("events %q, want the refusal raised on the EgressIP", events)
+	}
+	if n := len(h.provider.Associations()); n != 1 {
+		t.Errorf("%d associations, want 1", n)
+	}
+}
+
+func TestReconcileWithoutNodeAssociation(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+	h.provider.SetCapabilities(providers.Capabilities{MultipleIPsPerNode: true})
+
+	h.mustReconcile()
+	if n := h.provider.CallCount("EnsureAssociation"); n != 0 {
+		t.Errorf("EnsureAssociation called %d times, want 0", n)
+	}
+	if rule := h.snat.rules["10.244.0.5"]; rule.ToSource != "20.0.0.1" {
+		t.Errorf("rule %v, want SNAT to the EgressIP", rule)
+	}
+}
+
+func TestReconcileDrainingNode(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+	var node corev1.Node
+	if err := h.client.Get(context.Background(), types.NamespacedName{Name: testNode}, &node); err != nil {
+		t.Fatal(err)
+	}
+	node.Spec.Unschedulable = true
+	if err := h.client.Update(context.Background(), &node); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mustReconcile()
+	if phase := h.phase("eip-1"); phase != "Migrating" {
+		t.Errorf("phase %q, want Migrating", phase)
+	}
+	// gateways keep working until evicted
+	if len(h.snat.rules) != 1 {
+		t.Errorf("rules %v, want the gateway's", h.snat.rules)
+	}
+}
+
+func TestReconcileReportsCapacity(t *testing.T) {
+	eip1 := testEgressIP("eip-1", "20.0.0.1")
+	eip2 := testEgressIP("eip-2", "20.0.0.2")
+	gateway2 := testGatewayPod("gateway-2", "10.244.0.6", eip2, testNode)
+	h := newGatewayHarness(t, eip1, eip2, testGatewayPod("gateway-1", "10.244.0.5", eip1, testNode), gateway2)
+	capacity := func(want string) {
+		t.Helper()
+		var node corev1.Node
+		if err := h.client.Get(context.Background(), types.NamespacedName{Name: testNode}, &node); err != nil {
+			t.Fatal(err)
+		}
+		if value, exist := node.Labels[egressipv1alpha1.CapacityLabel]; value != want || exist != (want != "") {
+			t.Errorf("capacity label %q, want %q", value, want)
+		}
+	}
+
+	// nodes without a bound are not labeled
+	h.mustReconcile()
+	capacity("")
+
+	h.provider.SetLimit(3)
+	h.mustReconcile()
+	capacity("1")
+
+	if err := h.client.Delete(context.Background(), gateway2); err != nil {
+		t.Fatal(err)
+	}
+	h.mustReconcile()
+	capacity("2")
+
+	// a full node fails the associations it cannot take
+	h.provider.SetLimit(1)
+	if err := h.client.Create(context.Background(), testGatewayPod("gateway-3", "10.244.0.7", eip2, testNode)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.reconcile(); err == nil {
+		t.Errorf("reconcile succeeded on a full node")
+	}
+	capacity("0")
+
+	h.provider.SetLimit(providers.Unlimited)
+	h.mustReconcile()
+	capacity("")
+}
+
+func (h *gatewayHarness) cordon() {
+	var node corev1.Node
+	if err := h.client.Get(context.Background(), types.NamespacedName{Name: testNode}, &node); err != nil {
+		h.t.Fatal(err)
+	}
+	node.Spec.Unschedulable = true
+	if err := h.client.Update(context.Background(), &node); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+	h.provider.AddAssociation(providers.Association{PublicIP: "52.0.0.1", SourceIP: "10.240.0.4"})
+	h.mustReconcile()
+
+	h.cordon()
+	h.r.shutdownTimeout = time.Second
+	if err := h.r.shutdown(false); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	if !h.snat.cleaned {
+		t.Errorf("SNAT rules not removed")
+	}
+	associations := h.provider.Associations()
+	if len(associations) != 1 || associations[0].PublicIP != "52.0.0.1" {
+		t.Errorf("associations %v left, want only the node's own", associations)
+	}
+	if phase := h.phase("eip-1"); phase != "Migrating" {
+		t.Errorf("phase %q, want Migrating", phase)
+	}
+}
+
+func TestShutdownKeepsAssociationsOnRestart(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+	h.mustReconcile()
+
+	h.r.shutdownTimeout = time.Second
+	if err := h.r.shutdown(false); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	if h.snat.cleaned {
+		t.Errorf("SNAT rules removed on restart")
+	}
+	if associations := h.provider.Associations(); len(associations) != 1 {
+		t.Errorf("associations %v, want the EgressIP kept", associations)
+	}
+	if phase := h.phase("eip-1"); phase == "Migrating" {
+		t.Errorf("phase %q on restart", phase)
+	}
+
+	// unless always asked to
+	if err := h.r.shutdown(true); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	if associations := h.provider.Associations(); len(associations) != 0 {
+		t.Errorf("associations %v left", associations)
+	}
+}
+
+func TestShutdownDeletedNode(t *testing.T) {
+	eip := testEgressIP("eip-1", "20.0.0.1")
+	h := newGatewayHarness(t, eip, testGatewayPod("gateway-1", "10.244.0.5", eip, testNode))
+	h.mustReconcile()
+	if err := h.client.Delete(context.Background(), &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.r.shutdownTimeout = time.Second
+	if err := h.r.shutdown(false); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	if associations := h.provider.Associations(); len(associations) != 0 {
+		t.Errorf("associations %v left on a deleted node", associations)
+	}
+}
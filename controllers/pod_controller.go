@@ -18,25 +18,48 @@ package controllers
 
 import (
 	"context"
+	"net/http"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/yingeli/egress-ip-operator/providers"
+)
+
+const (
+	reconcileRetryDelay    = time.Second
+	maxReconcileRetryDelay = 5 * time.Minute
 )
 
 // PodReconciler reconciles a Pod object
 type PodReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
-	gr     GatewayReconciler // yingeli
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Provider providers.Provider
+	gr       GatewayReconciler // yingeli
 }
 
 //+kubebuilder:rbac:groups=yingeli.github.com,resources=pods,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=yingeli.github.com,resources=pods/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=yingeli.github.com,resources=pods/finalizers,verbs=update
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -51,22 +74,95 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	_ = log.FromContext(ctx)
 
 	// yingeli
-	err := r.gr.reconcile(ctx, req)
-	if err != nil {
-		return ctrl.Result{}, err
-	}
-
-	return ctrl.Result{}, nil
+	// every request reconciles the node as a whole
+	return r.gr.reconcile(ctx)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	gr, err := openAzureGatewayReconciler(&r.Client)
+	gr, err := openGatewayReconciler(&r.Client, r.Provider, r.Recorder)
 	if err != nil {
 		return err
 	}
 	r.gr = gr
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Pod{}).
-		Complete(r)
+
+	// the node is also reconciled on start, periodically and when its links
+	// change
+	nodeEvents := make(chan event.GenericEvent)
+	notify := func(ctx context.Context) func() {
+		return func() {
+			node := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: gr.nodeName}}
+			select {
+			case nodeEvents <- event.GenericEvent{Object: node}:
+			case <-ctx.Done():
+			}
+		}
+	}
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		return resync(ctx, gr.resyncInterval, notify(ctx))
+	})); err != nil {
+		return err
+	}
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		return watchLinks(ctx, gr.log, notify(ctx))
+	})); err != nil {
+		return err
+	}
+
+	// the node is cached alone, see GatewayNodeSelector
+	drainChanges := predicate.Funcs{
+		CreateFunc: func(event.CreateEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return isDraining(e.ObjectOld.(*corev1.Node)) != isDraining(e.ObjectNew.(*corev1.Node))
+		},
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+
+	// every request reconciles the node as a whole, so events are queued as
+	// the node: those coming in during a reconcile make up a single one, and
+	// failures are retried with a backoff the provider API can bear
+	c, err := controller.New("pod", mgr, controller.Options{
+		Reconciler:  r,
+		RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(reconcileRetryDelay, maxReconcileRetryDelay),
+	})
+	if err != nil {
+		return err
+	}
+	toNode := handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: gr.nodeName}}}
+	})
+	if err := c.Watch(&source.Kind{Type: &corev1.Pod{}}, toNode); err != nil {
+		return err
+	}
+	if err := c.Watch(&source.Channel{Source: nodeEvents}, toNode); err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: &corev1.Node{}}, toNode, drainChanges)
+}
+
+// CheckProvider is a readiness check of the provider of the node.
+func (r *PodReconciler) CheckProvider(req *http.Request) error {
+	return r.gr.checkProvider(req)
+}
+
+// Shutdown releases the EgressIPs associated with the node, see
+// GatewayReconciler.shutdown.
+func (r *PodReconciler) Shutdown(always bool) error {
+	return r.gr.shutdown(always)
+}
+
+// resync calls notify on start and then every interval.
+func resync(ctx context.Context, interval time.Duration, notify func()) error {
+	notify()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			notify()
+		case <-ctx.Done():
+			return nil
+		}
+	}
 }
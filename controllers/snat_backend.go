@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SNATBackend programs the SNAT rules of the gateway pods on the node.
+type SNATBackend interface {
+	// Name identifies the backend in logs.
+	Name() string
+	// Rules returns the rules currently programmed, keyed by source.
+	Rules() (map[string]SNATRule, error)
+	// Sync atomically replaces the programmed rules with rules, keyed by
+	// source.
+	Sync(rules map[string]SNATRule) error
+	// Cleanup removes everything the backend programmed.
+	Cleanup() error
+}
+
+const (
+	SNATBackendIPTables       = "iptables"
+	SNATBackendIPTablesLegacy = "iptables-legacy"
+	SNATBackendIPTablesNFT    = "iptables-nft"
+	SNATBackendNFTables       = "nftables"
+)
+
+// NewSNATBackend returns the backend called name.
+func NewSNATBackend(name string) (SNATBackend, error) {
+	switch name {
+	case SNATBackendIPTables, SNATBackendIPTablesLegacy, SNATBackendIPTablesNFT:
+		return NewIPTablesBackend(name), nil
+	case SNATBackendNFTables:
+		return NewNFTablesBackend(), nil
+	default:
+		return nil, fmt.Errorf("unsupported SNAT backend %s", name)
+	}
+}
+
+// DetectSNATBackend returns the backend set by SNAT_BACKEND, or else the one
+// the node's kube-proxy and CNI already program. Rules split between the
+// legacy and nf_tables flavours of iptables are evaluated in an order that
+// is hard to predict, so whichever holds more nat rules wins. Nodes without
+// any nat rule get native nftables when the kernel supports it.
+func DetectSNATBackend() (SNATBackend, error) {
+	if name := os.Getenv("SNAT_BACKEND"); name != "" {
+		return NewSNATBackend(name)
+	}
+
+	legacy := countNATRules(SNATBackendIPTablesLegacy + "-save")
+	nft := countNATRules(SNATBackendIPTablesNFT + "-save")
+	switch {
+	case legacy > 0 && legacy >= nft:
+		return NewSNATBackend(SNATBackendIPTablesLegacy)
+	case nft > 0:
+		return NewSNATBackend(SNATBackendIPTablesNFT)
+	}
+	if nftablesAvailable() {
+		return NewSNATBackend(SNATBackendNFTables)
+	}
+	return NewSNATBackend(SNATBackendIPTables)
+}
+
+// CleanupOtherSNATBackends removes the rules of the backends other than
+// selected that are available on the node. They are left behind whenever
+// the backend changes, through SNAT_BACKEND or along with the flavour of
+// kube-proxy, and would keep SNATing pods to private IPs no longer theirs.
+func CleanupOtherSNATBackends(selected SNATBackend) error {
+	current := selected.Name()
+	if current == SNATBackendIPTables {
+		current = iptablesFlavour()
+	}
+	var errs []string
+	for _, name := range []string{SNATBackendIPTablesLegacy, SNATBackendIPTablesNFT, SNATBackendNFTables} {
+		if name == current || !snatBackendAvailable(name) {
+			continue
+		}
+		b, err := NewSNATBackend(name)
+		if err == nil {
+			err = b.Cleanup()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error removing the rules of other SNAT backends: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// snatBackendAvailable returns whether the backend called name can run on
+// the node.
+func snatBackendAvailable(name string) bool {
+	if name == SNATBackendNFTables {
+		return nftablesAvailable()
+	}
+	for _, tool := range []string{name + "-save", name + "-restore"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// iptablesFlavour returns the flavour iptables is an alias of. Releases
+// before 1.8 do not print it and only know the legacy one.
+func iptablesFlavour() string {
+	out, err := exec.Command(SNATBackendIPTables, "--version").Output()
+	if err == nil && strings.Contains(string(out), "nf_tables") {
+		return SNATBackendIPTablesNFT
+	}
+	return SNATBackendIPTablesLegacy
+}
+
+// countNATRules returns the number of nat rules save prints, or 0 when it
+// is not installed.
+func countNATRules(save string) int {
+	out, err := exec.Command(save, "-t", natTable).Output()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			n++
+		}
+	}
+	return n
+}
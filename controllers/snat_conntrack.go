@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// flowTable deletes and counts the conntrack flows affected by SNAT rule
+// changes.
+type flowTable interface {
+	// DeleteStale deletes the flows of podIP leaving the node that are not
+	// translated to one of keep, so that the pod opens new ones through its
+	// current rule.
+	DeleteStale(podIP string, keep []string, localNetwork string) (uint, error)
+	// DeleteTranslated deletes the flows translated to toSource.
+	DeleteTranslated(toSource string) (uint, error)
+	// CountTranslated returns the number of flows translated to toSource.
+	CountTranslated(toSource string) (int, error)
+}
+
+// conntrackTable is the flowTable of the node, programmed through netlink.
+type conntrackTable struct{}
+
+// flowFilter matches the conntrack flows leaving the node that a SNAT rule
+// change affects. Flows keep the translation they started with until they
+// time out, whatever the rules say since.
+type flowFilter struct {
+	// flows from source, or from anywhere when nil
+	source net.IP
+	// destinations not SNATed by our rules
+	localNetwork *net.IPNet
+	// translated reports whether flows translated to an address match
+	translated func(ip net.IP) bool
+}
+
+func (f *flowFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if f.source != nil && !flow.Forward.SrcIP.Equal(f.source) {
+		return false
+	}
+	if f.localNetwork != nil && f.localNetwork.Contains(flow.Forward.DstIP) {
+		return false
+	}
+	// replies are sent to the address the flow was translated to
+	return f.translated(flow.Reverse.DstIP)
+}
+
+func (conntrackTable) DeleteStale(podIP string, keep []string, localNetwork string) (uint, error) {
+	filter := &flowFilter{
+		source: net.ParseIP(podIP),
+		translated: func(ip net.IP) bool {
+			for _, k := range keep {
+				if ip.Equal(net.ParseIP(k)) {
+					return false
+				}
+			}
+			return true
+		},
+	}
+	if localNetwork != "" {
+		_, network, err := net.ParseCIDR(localNetwork)
+		if err != nil {
+			return 0, fmt.Errorf("invalid local network %s: %v", localNetwork, err)
+		}
+		filter.localNetwork = network
+	}
+	return deleteFlows(filter)
+}
+
+func (conntrackTable) DeleteTranslated(toSource string) (uint, error) {
+	return deleteFlows(translatedTo(toSource))
+}
+
+func (conntrackTable) CountTranslated(toSource string) (int, error) {
+	flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, syscall.AF_INET)
+	if err != nil {
+		return 0, fmt.Errorf("ConntrackTableList error: %v", err)
+	}
+	filter := translatedTo(toSource)
+	n := 0
+	for _, flow := range flows {
+		if filter.MatchConntrackFlow(flow) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func deleteFlows(filter *flowFilter) (uint, error) {
+	n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, syscall.AF_INET, filter)
+	if err != nil {
+		return n, fmt.Errorf("ConntrackDeleteFilter error: %v", err)
+	}
+	return n, nil
+}
+
+func translatedTo(toSource string) *flowFilter {
+	ip := net.ParseIP(toSource)
+	return &flowFilter{translated: ip.Equal}
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	linkResubscribeInterval = 5 * time.Second
+)
+
+// egressInterface returns the interface SNATed traffic to sourceIP leaves
+// the node through: the one sourceIP is assigned to, or else the one of the
+// default route. Nodes with accelerated networking, bonded or multiple NICs
+// do not necessarily call it eth0.
+func egressInterface(sourceIP string) (string, error) {
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return "", fmt.Errorf("invalid source IP %s", sourceIP)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", fmt.Errorf("LinkList error: %v", err)
+	}
+	for _, link := range links {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return "", fmt.Errorf("AddrList %s error: %v", link.Attrs().Name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return link.Attrs().Name, nil
+			}
+		}
+	}
+
+	return defaultRouteInterface()
+}
+
+// defaultRouteInterface returns the interface of the preferred IPv4 default
+// route.
+func defaultRouteInterface() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", fmt.Errorf("RouteList error: %v", err)
+	}
+	var best *netlink.Route
+	for i, route := range routes {
+		if !isDefaultRoute(route) || route.LinkIndex == 0 {
+			continue
+		}
+		if best == nil || route.Priority < best.Priority {
+			best = &routes[i]
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no default route")
+	}
+	link, err := netlink.LinkByIndex(best.LinkIndex)
+	if err != nil {
+		return "", fmt.Errorf("LinkByIndex %d error: %v", best.LinkIndex, err)
+	}
+	return link.Attrs().Name, nil
+}
+
+// isDefaultRoute returns whether route is a default route, which netlink
+// lists with a 0.0.0.0/0 destination and older releases with none.
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// watchLinks calls notify whenever a link of the node other than a pod veth
+// changes, or an IPv4 address is added or removed, so that the SNAT rules
+// follow the egress interface.
+func watchLinks(ctx context.Context, log logr.Logger, notify func()) error {
+	for {
+		done := make(chan struct{})
+		linkUpdates := make(chan netlink.LinkUpdate)
+		addrUpdates := make(chan netlink.AddrUpdate)
+		if err := netlink.LinkSubscribe(linkUpdates, done); err != nil {
+			close(done)
+			return fmt.Errorf("LinkSubscribe error: %v", err)
+		}
+		if err := netlink.AddrSubscribe(addrUpdates, done); err != nil {
+			close(done)
+			return fmt.Errorf("AddrSubscribe error: %v", err)
+		}
+
+	updates:
+		for {
+			select {
+			case update, ok := <-linkUpdates:
+				if !ok {
+					break updates
+				}
+				if update.Link.Type() != "veth" {
+					notify()
+				}
+			case update, ok := <-addrUpdates:
+				if !ok {
+					break updates
+				}
+				if update.LinkAddress.IP.To4() != nil {
+					notify()
+				}
+			case <-ctx.Done():
+				close(done)
+				return nil
+			}
+		}
+		close(done)
+
+		log.Info("netlink subscription closed, resubscribing")
+		select {
+		case <-time.After(linkResubscribeInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// TestEgressInterface routes through veth links in a new network namespace,
+// and is skipped where namespaces are not available.
+func TestEgressInterface(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("netns.Get error: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("netns.New error: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	addLink := func(name, cidr string) netlink.Link {
+		link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-peer"}
+		if err := netlink.LinkAdd(link); err != nil {
+			t.Skipf("LinkAdd %s error: %v", name, err)
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			t.Fatalf("AddrAdd %s error: %v", cidr, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatalf("LinkSetUp %s error: %v", name, err)
+		}
+		return link
+	}
+	addLink("eth1", "10.240.1.4/24")
+	eth0 := addLink("eth0", "10.240.0.4/24")
+
+	if _, err := egressInterface("10.240.0.20"); err == nil {
+		t.Errorf("egressInterface succeeded without a default route")
+	}
+	route := &netlink.Route{LinkIndex: eth0.Attrs().Index, Gw: net.ParseIP("10.240.0.1")}
+	if err := netlink.RouteAdd(route); err != nil {
+		t.Fatalf("RouteAdd error: %v", err)
+	}
+
+	tests := []struct {
+		sourceIP string
+		want     string
+	}{
+		{"10.240.1.4", "eth1"},
+		{"10.240.0.20", "eth0"},
+	}
+	for _, test := range tests {
+		got, err := egressInterface(test.sourceIP)
+		if err != nil {
+			t.Fatalf("egressInterface(%s) error: %v", test.sourceIP, err)
+		}
+		if got != test.want {
+			t.Errorf("egressInterface(%s) = %s, want %s", test.sourceIP, got, test.want)
+		}
+	}
+}
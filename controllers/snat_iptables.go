@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+const (
+	natTable    = "nat"
+	postrouting = "POSTROUTING"
+	snatChain   = "EGRESS-IP-SNAT"
+)
+
+// IPTablesBackend keeps the SNAT rules in a dedicated nat chain jumped to
+// from POSTROUTING. The chain is only ever rewritten as a whole with
+// iptables-restore, so that its rules cannot be reordered by other tools and
+// every sync is atomic.
+type IPTablesBackend struct {
+	// iptables, iptables-legacy or iptables-nft
+	variant string
+}
+
+func NewIPTablesBackend(variant string) *IPTablesBackend {
+	return &IPTablesBackend{variant: variant}
+}
+
+func (b *IPTablesBackend) Name() string {
+	return b.variant
+}
+
+// Rules returns the rules of the chain keyed by source, along with those
+// left in POSTROUTING by versions that did not use the chain.
+func (b *IPTablesBackend) Rules() (map[string]SNATRule, error) {
+	lines, err := b.save()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]SNATRule)
+	for _, line := range lines {
+		if sr, ok := ParseSNATRule(line); ok {
+			m[sr.Source] = sr
+		}
+	}
+	return m, nil
+}
+
+// Sync replaces the rules of the chain with rules, creating the chain and
+// the jump to it and removing rules left in POSTROUTING by versions that did
+// not use the chain, in a single iptables-restore transaction.
+func (b *IPTablesBackend) Sync(rules map[string]SNATRule) error {
+	lines, err := b.save()
+	if err != nil {
+		return err
+	}
+
+	sources := make([]string, 0, len(rules))
+	for source := range rules {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%s\n", natTable)
+	// with --noflush, declaring the chain creates or flushes it and leaves
+	// every other chain alone
+	fmt.Fprintf(&input, ":%s - [0:0]\n", snatChain)
+	jump := "-j " + snatChain + " -m comment --comment " + ruleComment
+	hasJump := false
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "-A "+postrouting+" ") {
+			continue
+		}
+		if strings.Contains(line, "-j "+snatChain) {
+			hasJump = true
+		} else if _, ok := ParseSNATRule(line); ok {
+			fmt.Fprintf(&input, "-D %s\n", strings.TrimPrefix(line, "-A "))
+		}
+	}
+	if !hasJump {
+		fmt.Fprintf(&input, "-I %s 1 %s\n", postrouting, jump)
+	}
+	for _, source := range sources {
+		rule := rules[source]
+		fmt.Fprintf(&input, "-A %s %s\n", snatChain, strings.Join(rule.Spec(), " "))
+	}
+	fmt.Fprintf(&input, "COMMIT\n")
+	return b.restore(&input)
+}
+
+// Cleanup removes the chain and the jump to it, along with the rules left in
+// POSTROUTING by versions that did not use the chain.
+func (b *IPTablesBackend) Cleanup() error {
+	lines, err := b.save()
+	if err != nil {
+		return err
+	}
+
+	hasChain, deleted := false, false
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%s\n", natTable)
+	for _, line := range lines {
+		if strings.HasPrefix(line, ":"+snatChain+" ") {
+			hasChain = true
+		}
+		if !strings.HasPrefix(line, "-A "+postrouting+" ") {
+			continue
+		}
+		if _, ok := ParseSNATRule(line); ok || strings.Contains(line, "-j "+snatChain) {
+			fmt.Fprintf(&input, "-D %s\n", strings.TrimPrefix(line, "-A "))
+			deleted = true
+		}
+	}
+	if !hasChain && !deleted {
+		return nil
+	}
+	if hasChain {
+		fmt.Fprintf(&input, "-F %s\n", snatChain)
+		fmt.Fprintf(&input, "-X %s\n", snatChain)
+	}
+	fmt.Fprintf(&input, "COMMIT\n")
+	return b.restore(&input)
+}
+
+// restore applies input as a single transaction, leaving the chains it
+// does not mention alone.
+func (b *IPTablesBackend) restore(input *bytes.Buffer) error {
+	restore := b.variant + "-restore"
+	cmd := exec.Command(restore, "--noflush")
+	cmd.Stdin = input
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s error: %v: %s", restore, err, out)
+	}
+	return nil
+}
+
+// save returns the rules of the nat table.
+func (b *IPTablesBackend) save() ([]string, error) {
+	save := b.variant + "-save"
+	out, err := exec.Command(save, "-t", natTable).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s error: %v", save, err)
+	}
+	return strings.Split(string(out), "\n"), nil
+}
+
+// ParseSNATRule parses a rule as printed by iptables-save. Only SNAT rules
+// carrying our comment are recognized.
+func ParseSNATRule(rule string) (SNATRule, bool) {
+	sr := SNATRule{}
+	tokens := splitRule(rule)
+	comment, snat := false, false
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			i++
+			if i < len(tokens) {
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "-o", "--out-interface":
+			sr.OutputInterface = next()
+		case "-s", "--source", "--src":
+			// iptables prints host addresses with their prefix length
+			sr.Source = strings.TrimSuffix(next(), "/32")
+		case "-d", "--destination", "--dst":
+			sr.InvertDestination = next()
+		case "--to", "--to-source":
+			sr.ToSource = next()
+		case "-j", "--jump":
+			snat = next() == "SNAT"
+		case "--comment":
+			comment = next() == ruleComment
+		}
+	}
+	return sr, comment && snat
+}
+
+// splitRule splits a rule into arguments the way a shell would, as
+// iptables quotes arguments such as comments when printing rules.
+func splitRule(rule string) []string {
+	var tokens []string
+	var token strings.Builder
+	inToken, quoted, escaped := false, false, false
+	for _, r := range rule {
+		switch {
+		case escaped:
+			token.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inToken = true
+		case r == '"':
+			quoted = !quoted
+			inToken = true
+		case r == ' ' && !quoted:
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// Spec returns the iptables arguments of the rule.
+func (r *SNATRule) Spec() []string {
+	return []string{
+		"-o", r.OutputInterface,
+		"-s", r.Source,
+		"!", "-d", r.InvertDestination,
+		"-j", "SNAT", "--to", r.ToSource,
+		"-m", "comment", "--comment", ruleComment,
+	}
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netns"
+)
+
+func TestParseSNATRule(t *testing.T) {
+	want := SNATRule{
+		OutputInterface:   "eth0",
+		Source:            "10.244.0.5",
+		InvertDestination: "10.0.0.0/8",
+		ToSource:          "10.240.0.20",
+	}
+	tests := []struct {
+		name string
+		line string
+		rule SNATRule
+		ok   bool
+	}{
+		{
+			name: "iptables-save",
+			line: `-A EGRESS-IP-SNAT -s 10.244.0.5/32 ! -d 10.0.0.0/8 -o eth0 -m comment --comment "egressip.yingeli.github.com/v1alpha1" -j SNAT --to-source 10.240.0.20`,
+			rule: want,
+			ok:   true,
+		},
+		{
+			name: "long options",
+			line: `-A EGRESS-IP-SNAT --src 10.244.0.5 ! --dst 10.0.0.0/8 --out-interface eth0 -m comment --comment egressip.yingeli.github.com/v1alpha1 --jump SNAT --to 10.240.0.20`,
+			rule: want,
+			ok:   true,
+		},
+		{
+			name: "not SNAT",
+			line: `-A EGRESS-IP-SNAT -s 10.244.0.5/32 -o eth0 -m comment --comment "egressip.yingeli.github.com/v1alpha1" -j MASQUERADE`,
+			ok:   false,
+		},
+		{
+			name: "not ours",
+			line: `-A POSTROUTING -s 10.244.0.5/32 -o eth0 -m comment --comment "kube-proxy" -j SNAT --to-source 10.240.0.20`,
+			ok:   false,
+		},
+		{
+			name: "no comment",
+			line: `-A POSTROUTING -s 10.244.0.5/32 -o eth0 -j SNAT --to-source 10.240.0.20`,
+			ok:   false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, ok := ParseSNATRule(test.line)
+			if ok != test.ok {
+				t.Fatalf("ParseSNATRule ok = %v, want %v", ok, test.ok)
+			}
+			if ok && rule != test.rule {
+				t.Errorf("ParseSNATRule = %+v, want %+v", rule, test.rule)
+			}
+		})
+	}
+}
+
+func TestSplitRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		tokens []string
+	}{
+		{`-j SNAT`, []string{"-j", "SNAT"}},
+		{`  -j   SNAT  `, []string{"-j", "SNAT"}},
+		{`--comment "two words" -j SNAT`, []string{"--comment", "two words", "-j", "SNAT"}},
+		{`--comment "say \"hi\""`, []string{"--comment", `say "hi"`}},
+		{`--comment ""`, []string{"--comment", ""}},
+	}
+	for _, test := range tests {
+		if tokens := splitRule(test.rule); !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("splitRule(%q) = %q, want %q", test.rule, tokens, test.tokens)
+		}
+	}
+}
+
+func TestSNATRuleSpec(t *testing.T) {
+	rule := NewSNATRule("eth0", "10.244.0.5", "10.0.0.0/8", "10.240.0.20")
+	line := "-A " + snatChain + " " + strings.Join(rule.Spec(), " ")
+	parsed, ok := ParseSNATRule(line)
+	if !ok {
+		t.Fatalf("ParseSNATRule(%q) did not match", line)
+	}
+	if parsed != rule {
+		t.Errorf("ParseSNATRule(%q) = %+v, want %+v", line, parsed, rule)
+	}
+}
+
+// TestIPTablesBackend programs rules in a new network namespace, and is
+// skipped where iptables or namespaces are not available.
+func TestIPTablesBackend(t *testing.T) {
+	if _, err := exec.LookPath("iptables-restore"); err != nil {
+		t.Skip("iptables-restore not found")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("netns.Get error: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("netns.New error: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	b := NewIPTablesBackend("iptables")
+	rules := map[string]SNATRule{
+		"10.244.0.5": NewSNATRule("eth0", "10.244.0.5", "10.0.0.0/8", "10.240.0.20"),
+		"10.244.0.6": NewSNATRule("eth0", "10.244.0.6", "10.0.0.0/8", "10.240.0.21"),
+	}
+	if err := b.Sync(rules); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	got, err := b.Rules()
+	if err != nil {
+		t.Fatalf("Rules error: %v", err)
+	}
+	if !reflect.DeepEqual(got, rules) {
+		t.Errorf("Rules = %v, want %v", got, rules)
+	}
+
+	delete(rules, "10.244.0.6")
+	if err := b.Sync(rules); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	if got, _ := b.Rules(); !reflect.DeepEqual(got, rules) {
+		t.Errorf("Rules = %v after removing one, want %v", got, rules)
+	}
+
+	// a rule left in POSTROUTING by versions that did not use the chain
+	old := NewSNATRule("eth0", "10.244.0.7", "10.0.0.0/8", "10.240.0.22")
+	args := append([]string{"-t", natTable, "-A", postrouting}, old.Spec()...)
+	if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		t.Fatalf("iptables error: %v: %s", err, out)
+	}
+	if err := b.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	if got, _ := b.Rules(); len(got) != 0 {
+		t.Errorf("Rules = %v after Cleanup, want none", got)
+	}
+}
@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+)
+
+const (
+	nftTable = "egress-ip"
+	nftChain = "postrouting"
+	// map from pod IP to the private IP it is SNATed to
+	nftSourceMap = "sources"
+	// IFNAMSIZ of linux/if.h
+	nftIfNameSize = 16
+)
+
+// NFTablesBackend keeps the SNAT rules in a dedicated nftables table,
+// programmed over netlink. The private IP of every pod is looked up in a map
+// keyed by pod IP, so that a single rule serves all pods sharing an output
+// interface. The table is replaced as a whole in a single batch.
+type NFTablesBackend struct{}
+
+func NewNFTablesBackend() *NFTablesBackend {
+	return &NFTablesBackend{}
+}
+
+func (b *NFTablesBackend) Name() string {
+	return "nftables"
+}
+
+// Rules returns the rules in the table keyed by source. Only Source and
+// ToSource are known, as the rest is shared by every rule.
+func (b *NFTablesBackend) Rules() (map[string]SNATRule, error) {
+	m := make(map[string]SNATRule)
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("nftables error: %v", err)
+	}
+	table, err := nftLookupTable(conn)
+	if err != nil || table == nil {
+		return m, err
+	}
+
+	set, err := conn.GetSetByName(table, nftSourceMap)
+	if err != nil {
+		return nil, fmt.Errorf("nftables get map error: %v", err)
+	}
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		return nil, fmt.Errorf("nftables list map error: %v", err)
+	}
+	for _, element := range elements {
+		if len(element.Key) != net.IPv4len || len(element.Val) != net.IPv4len {
+			continue
+		}
+		source := net.IP(element.Key).String()
+		m[source] = SNATRule{Source: source, ToSource: net.IP(element.Val).String()}
+	}
+	return m, nil
+}
+
+// Sync replaces the table with one holding rules.
+func (b *NFTablesBackend) Sync(rules map[string]SNATRule) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables error: %v", err)
+	}
+	table := nftResetTable(conn)
+	if err := nftAddRules(conn, table, rules); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("nftables error: %v", err)
+	}
+	return nil
+}
+
+// Cleanup removes the table.
+func (b *NFTablesBackend) Cleanup() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables error: %v", err)
+	}
+	table := nftResetTable(conn)
+	conn.DelTable(table)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("nftables error: %v", err)
+	}
+	return nil
+}
+
+// nftablesAvailable returns whether the kernel answers nftables requests.
+func nftablesAvailable() bool {
+	conn, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	_, err = conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	return err == nil
+}
+
+// nftLookupTable returns the table, or nil when it is missing.
+func nftLookupTable(conn *nftables.Conn) (*nftables.Table, error) {
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return nil, fmt.Errorf("nftables list tables error: %v", err)
+	}
+	for _, table := range tables {
+		if table.Name == nftTable {
+			return table, nil
+		}
+	}
+	return nil, nil
+}
+
+// nftResetTable queues the removal of the table and its creation afresh.
+// Adding the table first makes deleting it safe when it is missing.
+func nftResetTable(conn *nftables.Conn) *nftables.Table {
+	table := &nftables.Table{Name: nftTable, Family: nftables.TableFamilyIPv4}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	return conn.AddTable(table)
+}
+
+// nftAddRules queues the map of sources and the postrouting chain of rules
+// into table.
+func nftAddRules(conn *nftables.Conn, table *nftables.Table, rules map[string]SNATRule) error {
+	sources := make([]string, 0, len(rules))
+	for source := range rules {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	// pods sharing an output interface and local network share a rule
+	type match struct {
+		oif string
+		dst string
+	}
+	var matches []match
+	groups := make(map[match][]nftables.SetElement)
+	var elements []nftables.SetElement
+	for _, source := range sources {
+		rule := rules[source]
+		src, toSrc := net.ParseIP(rule.Source).To4(), net.ParseIP(rule.ToSource).To4()
+		if src == nil || toSrc == nil {
+			return fmt.Errorf("invalid SNAT rule %s to %s", rule.Source, rule.ToSource)
+		}
+		m := match{oif: rule.OutputInterface, dst: rule.InvertDestination}
+		if _, ok := groups[m]; !ok {
+			matches = append(matches, m)
+		}
+		groups[m] = append(groups[m], nftables.SetElement{Key: src})
+		elements = append(elements, nftables.SetElement{Key: src, Val: toSrc})
+	}
+
+	sourceMap := &nftables.Set{
+		Table:    table,
+		Name:     nftSourceMap,
+		IsMap:    true,
+		KeyType:  nftables.TypeIPAddr,
+		DataType: nftables.TypeIPAddr,
+	}
+	if err := conn.AddSet(sourceMap, elements); err != nil {
+		return fmt.Errorf("nftables add map error: %v", err)
+	}
+
+	policy := nftables.ChainPolicyAccept
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     nftChain,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+		Policy:   &policy,
+	})
+
+	for _, m := range matches {
+		set := &nftables.Set{
+			Table:     table,
+			Anonymous: true,
+			Constant:  true,
+			KeyType:   nftables.TypeIPAddr,
+		}
+		if err := conn.AddSet(set, groups[m]); err != nil {
+			return fmt.Errorf("nftables add set error: %v", err)
+		}
+		exprs, err := nftRuleExprs(m.oif, set, m.dst, sourceMap)
+		if err != nil {
+			return err
+		}
+		conn.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, ruleComment),
+		})
+	}
+	return nil
+}
+
+// nftRuleExprs returns the expressions of
+//
+//	oifname oif ip saddr @set [ip daddr != dst] snat to ip saddr map @sourceMap
+func nftRuleExprs(oif string, set *nftables.Set, dst string, sourceMap *nftables.Set) ([]expr.Any, error) {
+	ifname := make([]byte, nftIfNameSize)
+	copy(ifname, oif+"\x00")
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname},
+		nftPayload(12),
+		&expr.Lookup{SourceRegister: 1, SetID: set.ID, SetName: set.Name},
+	}
+	if dst != "" {
+		network, err := parseNetwork(dst)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs,
+			nftPayload(16),
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            net.IPv4len,
+				Mask:           network.Mask,
+				Xor:            make([]byte, net.IPv4len),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: network.IP},
+		)
+	}
+	return append(exprs,
+		nftPayload(12),
+		&expr.Lookup{
+			SourceRegister: 1,
+			DestRegister:   1,
+			IsDestRegSet:   true,
+			SetID:          sourceMap.ID,
+			SetName:        sourceMap.Name,
+		},
+		&expr.NAT{
+			Type:       expr.NATTypeSourceNAT,
+			Family:     uint32(nftables.TableFamilyIPv4),
+			RegAddrMin: 1,
+		},
+	), nil
+}
+
+// nftPayload loads the IPv4 address at offset of the network header, 12 for
+// the source and 16 for the destination.
+func nftPayload(offset uint32) *expr.Payload {
+	return &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          net.IPv4len,
+	}
+}
+
+// parseNetwork parses an IPv4 address or network.
+func parseNetwork(s string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 network %s", s)
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	network.IP = network.IP.To4()
+	if network.IP == nil || len(network.Mask) != net.IPv4len {
+		return nil, fmt.Errorf("invalid IPv4 network %s", s)
+	}
+	return network, nil
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netns"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+		ok   bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"10.1.2.3/8", "10.0.0.0/8", true},
+		{"10.1.2.3", "10.1.2.3/32", true},
+		{"fd00::/8", "", false},
+		{"eth0", "", false},
+	}
+	for _, test := range tests {
+		network, err := parseNetwork(test.s)
+		if (err == nil) != test.ok {
+			t.Fatalf("parseNetwork(%q) error = %v, want ok %v", test.s, err, test.ok)
+		}
+		if err == nil && network.String() != test.want {
+			t.Errorf("parseNetwork(%q) = %v, want %v", test.s, network, test.want)
+		}
+	}
+}
+
+// TestNFTablesBackend programs rules in a new network namespace, and is
+// skipped where nftables or namespaces are not available.
+func TestNFTablesBackend(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("netns.Get error: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("netns.New error: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+	if !nftablesAvailable() {
+		t.Skip("nftables not available")
+	}
+
+	b := NewNFTablesBackend()
+	rules := map[string]SNATRule{
+		"10.244.0.5": NewSNATRule("eth0", "10.244.0.5", "10.0.0.0/8", "10.240.0.20"),
+		"10.244.0.6": NewSNATRule("eth0", "10.244.0.6", "10.0.0.0/8", "10.240.0.21"),
+		"10.244.0.7": NewSNATRule("eth1", "10.244.0.7", "", "10.240.1.20"),
+	}
+	// only the map of sources is read back
+	want := func() map[string]SNATRule {
+		m := make(map[string]SNATRule)
+		for source, rule := range rules {
+			m[source] = SNATRule{Source: rule.Source, ToSource: rule.ToSource}
+		}
+		return m
+	}
+	if err := b.Sync(rules); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	got, err := b.Rules()
+	if err != nil {
+		t.Fatalf("Rules error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want()) {
+		t.Errorf("Rules = %v, want %v", got, want())
+	}
+
+	delete(rules, "10.244.0.6")
+	if err := b.Sync(rules); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	if got, _ := b.Rules(); !reflect.DeepEqual(got, want()) {
+		t.Errorf("Rules = %v after removing one, want %v", got, want())
+	}
+
+	if err := b.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	if got, _ := b.Rules(); len(got) != 0 {
+		t.Errorf("Rules = %v after Cleanup, want none", got)
+	}
+	if err := b.Cleanup(); err != nil {
+		t.Fatalf("Cleanup of a missing table error: %v", err)
+	}
+}
+
+// TestCleanupOtherSNATBackends switches from nftables to iptables in a new
+// network namespace, and is skipped where nftables or namespaces are not
+// available.
+func TestCleanupOtherSNATBackends(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("netns.Get error: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("netns.New error: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+	if !nftablesAvailable() {
+		t.Skip("nftables not available")
+	}
+
+	b := NewNFTablesBackend()
+	rules := map[string]SNATRule{
+		"10.244.0.5": NewSNATRule("eth0", "10.244.0.5", "10.0.0.0/8", "10.240.0.20"),
+	}
+	if err := b.Sync(rules); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+
+	if err := CleanupOtherSNATBackends(b); err != nil {
+		t.Fatalf("CleanupOtherSNATBackends error: %v", err)
+	}
+	if got, _ := b.Rules(); len(got) != 1 {
+		t.Errorf("Rules = %v after cleaning up other backends, want the selected ones kept", got)
+	}
+
+	if err := CleanupOtherSNATBackends(NewIPTablesBackend(SNATBackendIPTablesLegacy)); err != nil {
+		t.Fatalf("CleanupOtherSNATBackends error: %v", err)
+	}
+	if got, _ := b.Rules(); len(got) != 0 {
+		t.Errorf("Rules = %v after switching to iptables, want none", got)
+	}
+}
@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+)
+
+const (
+	// networks the directors send through the pod network rather than the
+	// tunnel, see getDirectorEnv
+	directorLocalNetwork = "10.0.0.0/8"
+
+	// the network address, the gateway and the broadcast address
+	reservedTunnelAddresses = 3
+
+	// how long a reserved tunnel address no pod holds is kept, which leaves
+	// the pod it was reserved for the time to be created and cached
+	tunnelIPGracePeriod = 2 * time.Minute
+)
+
+// tunnelIPBackoff spaces the retries of webhooks reserving addresses of the
+// same EgressIP at once.
+var tunnelIPBackoff = wait.Backoff{
+	Steps:    10,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   0.5,
+}
+
+// tunnelNetworkCandidates are tried in order for EgressIPs that do not set a
+// tunnel network. Every gateway has its own tunnel network, so they may
+// all use the same one.
+var tunnelNetworkCandidates = func() []string {
+	candidates := []string{"192.168.0.0/16"}
+	for i := 16; i < 32; i++ {
+		candidates = append(candidates, fmt.Sprintf("172.%d.0.0/16", i))
+	}
+	return candidates
+}()
+
+// discoverClusterNetworks returns the networks a tunnel network must not
+// overlap: the pod CIDRs and addresses of the nodes and the networks the
+// directors keep local.
+func discoverClusterNetworks(ctx context.Context, c client.Client) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	_, local, err := net.ParseCIDR(directorLocalNetwork)
+	if err != nil {
+		return nil, err
+	}
+	networks = append(networks, local)
+
+	var nodes corev1.NodeList
+	if err := c.List(ctx, &nodes); err != nil {
+		return nil, err
+	}
+	for _, node := range nodes.Items {
+		cidrs := node.Spec.PodCIDRs
+		if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+			cidrs = []string{node.Spec.PodCIDR}
+		}
+		for _, cidr := range cidrs {
+			if _, network, err := net.ParseCIDR(cidr); err == nil {
+				networks = append(networks, network)
+			}
+		}
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != corev1.NodeInternalIP && addr.Type != corev1.NodeExternalIP {
+				continue
+			}
+			if ip := net.ParseIP(addr.Address).To4(); ip != nil {
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+			}
+		}
+	}
+	return networks, nil
+}
+
+// selectTunnelNetwork returns the tunnel network of eip: the one it sets, or
+// the first candidate not overlapping networks.
+func selectTunnelNetwork(eip *egressipv1alpha1.EgressIP, networks []*net.IPNet) (*net.IPNet, error) {
+	if eip.Spec.TunnelNetwork != "" {
+		_, tunnelNetwork, err := net.ParseCIDR(eip.Spec.TunnelNetwork)
+		if err != nil {
+			return nil, err
+		}
+		if network := overlapping(tunnelNetwork, networks); network != nil {
+			return nil, fmt.Errorf("tunnel network %s overlaps cluster network %s", tunnelNetwork, network)
+		}
+		return tunnelNetwork, nil
+	}
+
+	for _, candidate := range tunnelNetworkCandidates {
+		_, tunnelNetwork, err := net.ParseCIDR(candidate)
+		if err != nil {
+			return nil, err
+		}
+		if overlapping(tunnelNetwork, networks) == nil {
+			return tunnelNetwork, nil
+		}
+	}
+	return nil, fmt.Errorf("every candidate tunnel network overlaps a cluster network, set tunnelNetwork")
+}
+
+func overlapping(network *net.IPNet, networks []*net.IPNet) *net.IPNet {
+	for _, n := range networks {
+		if n.Contains(network.IP) || network.Contains(n.IP) {
+			return n
+		}
+	}
+	return nil
+}
+
+// tunnelCapacity returns the number of pods network has addresses for.
+func tunnelCapacity(network *net.IPNet) int32 {
+	ones, bits := network.Mask.Size()
+	size := int64(1) << uint(bits-ones)
+	if size <= reservedTunnelAddresses {
+		return 0
+	}
+	if size-reservedTunnelAddresses > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(size - reservedTunnelAddresses)
+}
+
+// tunnelIPRange returns the first and last address handed out to pods.
+// The first host address is kept for the gateway.
+func tunnelIPRange(network *net.IPNet) (first net.IP, last net.IP) {
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	ones, bits := network.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	return uint32ToIP(base + 2), uint32ToIP(base + size - 2)
+}
+
+// listTunnelClients returns the live pods connecting to the gateway of eip.
+func listTunnelClients(ctx context.Context, c client.Client, eip *egressipv1alpha1.EgressIP) ([]corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.MatchingLabels{egressipv1alpha1.GatewayLabel: getGatewayName(eip)}); err != nil {
+		return nil, err
+	}
+	var clients []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		clients = append(clients, pod)
+	}
+	return clients, nil
+}
+
+// reserveTunnelIP allocates a tunnel address of network to a pod being
+// admitted, and records it in the ConfigMap of the gateway of eip before
+// the pod exists. Concurrent reservations conflict on the resourceVersion of
+// the ConfigMap, read from reader rather than a cache, and are retried, so
+// that they never hand out the same address. Addresses of pods are free
+// once no pod holds them and their reservation is older than
+// tunnelIPGracePeriod. It returns nil when network is full.
+func reserveTunnelIP(ctx context.Context, c client.Client, reader client.Reader, eip *egressipv1alpha1.EgressIP, network *net.IPNet, pods []corev1.Pod) (net.IP, error) {
+	var ip net.IP
+	err := retry.OnError(tunnelIPBackoff, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		ip = nil
+		cm := corev1.ConfigMap{}
+		err := reader.Get(ctx, getGatewayNamespacedName(eip), &cm)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		found := err == nil
+
+		used := make(map[string]bool)
+		for _, pod := range pods {
+			used[pod.Annotations[egressipv1alpha1.TunnelIPAnnotation]] = true
+		}
+		now := time.Now()
+		for addr, reserved := range cm.Data {
+			if used[addr] {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, reserved); err == nil && now.Sub(t) > tunnelIPGracePeriod {
+				delete(cm.Data, addr)
+				continue
+			}
+			used[addr] = true
+		}
+
+		ip = allocateTunnelIP(network, used)
+		if ip == nil {
+			return nil
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[ip.String()] = now.UTC().Format(time.RFC3339)
+		if found {
+			return c.Update(ctx, &cm)
+		}
+		cm.ObjectMeta = metav1.ObjectMeta{
+			Name:      getGatewayName(eip),
+			Namespace: getGatewayNamespace(),
+			Labels:    map[string]string{egressipv1alpha1.GatewayLabel: getGatewayName(eip)},
+		}
+		return c.Create(ctx, &cm)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reserving tunnel address for EgressIP %s/%s: %v", eip.Namespace, eip.Name, err)
+	}
+	return ip, nil
+}
+
+// allocateTunnelIP returns the lowest address of network not used, or nil
+// when network is full.
+func allocateTunnelIP(network *net.IPNet, used map[string]bool) net.IP {
+	first, last := tunnelIPRange(network)
+	for i := binary.BigEndian.Uint32(first); i <= binary.BigEndian.Uint32(last); i++ {
+		ip := uint32ToIP(i)
+		if !used[ip.String()] {
+			return ip
+		}
+	}
+	return nil
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
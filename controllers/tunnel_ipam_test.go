@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+)
+
+func newIPAMClient(t *testing.T, objs ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func testIPAMEgressIP() *egressipv1alpha1.EgressIP {
+	return &egressipv1alpha1.EgressIP{ObjectMeta: metav1.ObjectMeta{Name: "eip", Namespace: "default"}}
+}
+
+func TestReserveTunnelIPConcurrently(t *testing.T) {
+	c := newIPAMClient(t)
+	eip := testIPAMEgressIP()
+	_, network, _ := net.ParseCIDR("192.168.0.0/24")
+
+	// every webhook sees the same pods, none of the others yet
+	const n = 20
+	ips := make([]net.IP, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ips[i], errs[i] = reserveTunnelIP(context.Background(), c, c, eip, network, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i := range ips {
+		if errs[i] != nil {
+			t.Fatalf("reserveTunnelIP error: %v", errs[i])
+		}
+		if ips[i] == nil || seen[ips[i].String()] {
+			t.Fatalf("addresses %v, want %d distinct ones", ips, n)
+		}
+		seen[ips[i].String()] = true
+	}
+}
+
+func TestReserveTunnelIPReleasesUnused(t *testing.T) {
+	eip := testIPAMEgressIP()
+	stale := time.Now().Add(-2 * tunnelIPGracePeriod).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: getGatewayName(eip), Namespace: getGatewayNamespace()},
+		Data: map[string]string{
+			"192.168.0.2": stale,  // held by a pod
+			"192.168.0.3": recent, // its pod is not cached yet
+			"192.168.0.4": stale,  // its pod is gone
+		},
+	}
+	c := newIPAMClient(t, cm)
+	_, network, _ := net.ParseCIDR("192.168.0.0/24")
+	pods := []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{egressipv1alpha1.TunnelIPAnnotation: "192.168.0.2"},
+	}}}
+
+	ip, err := reserveTunnelIP(context.Background(), c, c, eip, network, pods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "192.168.0.4" {
+		t.Errorf("reserved %v, want the address of the gone pod", ip)
+	}
+
+	_, full, _ := net.ParseCIDR("192.168.0.0/30")
+	if ip, err := reserveTunnelIP(context.Background(), c, c, eip, full, pods); err != nil || ip != nil {
+		t.Errorf("reserved %v, %v in a full network", ip, err)
+	}
+}
@@ -0,0 +1,106 @@
+package director
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// FailPolicy decides where egress traffic goes while the tunnel is down.
+type FailPolicy string
+
+const (
+	// FailOpen restores the pod's original default route so traffic leaves
+	// through the node until the tunnel is back.
+	FailOpen FailPolicy = "Open"
+	// FailClosed keeps the pod without a default route so egress traffic is
+	// dropped until the tunnel is back.
+	FailClosed FailPolicy = "Closed"
+)
+
+// TunnelMode selects how traffic is carried to the gateway.
+type TunnelMode string
+
+const (
+	TunnelL2TP      TunnelMode = "l2tp"
+	TunnelWireGuard TunnelMode = "wireguard"
+	TunnelGRE       TunnelMode = "gre"
+	TunnelIPIP      TunnelMode = "ipip"
+	TunnelVXLAN     TunnelMode = "vxlan"
+)
+
+type Config struct {
+	Gateway       string
+	LocalNetworks []*net.IPNet
+	FailPolicy    FailPolicy
+	Tunnel        TunnelMode
+	TunnelIP      net.IP
+	TunnelNetwork *net.IPNet
+	WireGuard     WireGuardConfig
+}
+
+type WireGuardConfig struct {
+	PrivateKey       string
+	GatewayPublicKey string
+}
+
+// ConfigFromEnv reads the director configuration set by the EgressIP injector.
+func ConfigFromEnv() (cfg Config, err error) {
+	cfg.Gateway = os.Getenv("EGRESS_GATEWAY")
+	if cfg.Gateway == "" {
+		return cfg, fmt.Errorf("EGRESS_GATEWAY is not set")
+	}
+
+	for _, s := range strings.Split(os.Getenv("LOCAL_NETWORK"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid LOCAL_NETWORK %s: %v", s, err)
+		}
+		cfg.LocalNetworks = append(cfg.LocalNetworks, ipnet)
+	}
+	if len(cfg.LocalNetworks) == 0 {
+		return cfg, fmt.Errorf("LOCAL_NETWORK is not set")
+	}
+
+	switch p := FailPolicy(os.Getenv("FAIL_POLICY")); p {
+	case "":
+		cfg.FailPolicy = FailClosed
+	case FailOpen, FailClosed:
+		cfg.FailPolicy = p
+	default:
+		return cfg, fmt.Errorf("invalid FAIL_POLICY %s", p)
+	}
+
+	switch t := TunnelMode(os.Getenv("TUNNEL")); t {
+	case "":
+		cfg.Tunnel = TunnelL2TP
+	case TunnelL2TP, TunnelWireGuard, TunnelGRE, TunnelIPIP, TunnelVXLAN:
+		cfg.Tunnel = t
+	default:
+		return cfg, fmt.Errorf("invalid TUNNEL %s", t)
+	}
+
+	if cfg.Tunnel != TunnelL2TP {
+		if cfg.TunnelIP = net.ParseIP(os.Getenv("TUNNEL_IP")).To4(); cfg.TunnelIP == nil {
+			return cfg, fmt.Errorf("invalid TUNNEL_IP %s", os.Getenv("TUNNEL_IP"))
+		}
+		if _, cfg.TunnelNetwork, err = net.ParseCIDR(os.Getenv("TUNNEL_NETWORK")); err != nil {
+			return cfg, fmt.Errorf("invalid TUNNEL_NETWORK %s: %v", os.Getenv("TUNNEL_NETWORK"), err)
+		}
+	}
+
+	if cfg.Tunnel == TunnelWireGuard {
+		cfg.WireGuard.PrivateKey = os.Getenv("WIREGUARD_PRIVATE_KEY")
+		cfg.WireGuard.GatewayPublicKey = os.Getenv("WIREGUARD_GATEWAY_PUBLIC_KEY")
+		if cfg.WireGuard.PrivateKey == "" || cfg.WireGuard.GatewayPublicKey == "" {
+			return cfg, fmt.Errorf("WIREGUARD_PRIVATE_KEY and WIREGUARD_GATEWAY_PUBLIC_KEY must be set")
+		}
+	}
+
+	return cfg, nil
+}
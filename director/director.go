@@ -0,0 +1,219 @@
+package director
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	checkInterval  = time.Second
+	livenessWindow = 10 * checkInterval
+	minBackoff     = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// Director sends the pod's egress traffic through a tunnel to the EgressIP
+// gateway and falls back according to the fail policy when the tunnel is lost.
+type Director struct {
+	cfg    Config
+	tunnel Tunnel
+	log    logr.Logger
+
+	linkByName func(name string) (netlink.Link, error)
+
+	mu     sync.Mutex
+	routes router
+	up     bool
+	// the index of the tunnel link the default route was installed on
+	index     int
+	heartbeat time.Time
+}
+
+// router is the part of Routes the check loop drives.
+type router interface {
+	RouteVia(link netlink.Link, gw net.IP) error
+	RoutedVia(index int) (bool, error)
+	Restore() error
+	Withdraw() error
+}
+
+func New(cfg Config, tunnel Tunnel) *Director {
+	return &Director{
+		cfg:        cfg,
+		tunnel:     tunnel,
+		log:        ctrl.Log.WithName("director"),
+		linkByName: netlink.LinkByName,
+	}
+}
+
+// Init prepares the pod routing table before the application containers start.
+func (d *Director) Init() error {
+	routes, err := DiscoverRoutes(d.cfg)
+	if err != nil {
+		return err
+	}
+	if err := routes.Setup(d.cfg); err != nil {
+		return err
+	}
+	d.routes = routes
+	d.log.Info("routes configured", "gateway", d.cfg.Gateway, "via", routes.Gateway(), "failPolicy", d.cfg.FailPolicy)
+	return nil
+}
+
+// Run keeps the tunnel running and the default route pointed at it until ctx
+// is done.
+func (d *Director) Run(ctx context.Context) error {
+	if err := d.Init(); err != nil {
+		return err
+	}
+
+	go d.runTunnel(ctx)
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		d.check()
+		select {
+		case <-ctx.Done():
+			d.log.Info("director stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Director) runTunnel(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		d.log.Info("starting tunnel", "interface", d.tunnel.Interface())
+		started := time.Now()
+		err := d.tunnel.Run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		d.log.Error(err, "tunnel exited", "interface", d.tunnel.Interface(), "retryAfter", backoff)
+
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (d *Director) check() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.heartbeat = time.Now()
+
+	link, err := d.linkByName(d.tunnel.Interface())
+	up := err == nil && link.Attrs().Flags&net.FlagUp != 0
+	if hc, ok := d.tunnel.(HealthChecker); ok && up {
+		up = hc.Healthy()
+	}
+
+	switch {
+	case up:
+		if d.up && d.routed(link) {
+			return
+		}
+		var gw net.IP
+		if nh, ok := d.tunnel.(NextHopper); ok {
+			gw = nh.NextHop()
+		}
+		if err := d.routes.RouteVia(link, gw); err != nil {
+			d.log.Error(err, "error routing through tunnel", "interface", d.tunnel.Interface())
+			return
+		}
+		if d.up {
+			d.log.Info("default route restored", "interface", d.tunnel.Interface(), "index", link.Attrs().Index)
+		} else {
+			d.log.Info("tunnel up", "interface", d.tunnel.Interface())
+		}
+		d.up = true
+		d.index = link.Attrs().Index
+	case d.up:
+		d.up = false
+		d.index = 0
+		d.log.Info("tunnel down", "interface", d.tunnel.Interface(), "failPolicy", d.cfg.FailPolicy)
+		d.fail()
+	}
+}
+
+// routed returns whether the default route still goes through link. The
+// tunnel can be rebuilt between two checks, and the kernel drops the
+// default route along with the link it was on.
+func (d *Director) routed(link netlink.Link) bool {
+	if link.Attrs().Index != d.index {
+		return false
+	}
+	routed, err := d.routes.RoutedVia(d.index)
+	if err != nil {
+		d.log.Error(err, "error checking default route", "interface", d.tunnel.Interface())
+		return false
+	}
+	return routed
+}
+
+func (d *Director) fail() {
+	var err error
+	if d.cfg.FailPolicy == FailOpen {
+		err = d.routes.Restore()
+	} else {
+		err = d.routes.Withdraw()
+	}
+	if err != nil {
+		d.log.Error(err, "error applying fail policy", "failPolicy", d.cfg.FailPolicy)
+		return
+	}
+	d.log.Info("fail policy applied", "failPolicy", d.cfg.FailPolicy)
+}
+
+// ServeProbes serves /healthz and /readyz on addr until ctx is done. The
+// director is live while its check loop runs and ready while the tunnel is up.
+func (d *Director) ServeProbes(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		d.mu.Lock()
+		live := time.Since(d.heartbeat) < livenessWindow
+		d.mu.Unlock()
+		probe(w, live)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		d.mu.Lock()
+		ready := d.up
+		d.mu.Unlock()
+		probe(w, ready)
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func probe(w http.ResponseWriter, ok bool) {
+	if !ok {
+		http.Error(w, "not ok", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,184 @@
+package director
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+const testInterface = "eip0"
+
+// fakeTunnel only names its link, which the tests bring up and down.
+type fakeTunnel struct{}
+
+func (t *fakeTunnel) Interface() string {
+	return testInterface
+}
+
+func (t *fakeTunnel) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// fakeRoutes keeps the default route of the pod in memory: the index of the
+// link it goes out of, or -1 for the original one.
+type fakeRoutes struct {
+	via      int
+	routeVia int
+	restore  int
+	withdraw int
+}
+
+func (r *fakeRoutes) RouteVia(link netlink.Link, gw net.IP) error {
+	r.routeVia++
+	r.via = link.Attrs().Index
+	return nil
+}
+
+func (r *fakeRoutes) RoutedVia(index int) (bool, error) {
+	return r.via == index, nil
+}
+
+func (r *fakeRoutes) Restore() error {
+	r.restore++
+	r.via = -1
+	return nil
+}
+
+func (r *fakeRoutes) Withdraw() error {
+	r.withdraw++
+	r.via = 0
+	return nil
+}
+
+// testDirector returns a director of the fake tunnel, whose link is set
+// through the returned function: nil while it is missing.
+func testDirector(policy FailPolicy) (*Director, *fakeRoutes, func(link netlink.Link)) {
+	d := New(Config{FailPolicy: policy}, &fakeTunnel{})
+	routes := &fakeRoutes{}
+	d.routes = routes
+	var current netlink.Link
+	d.linkByName = func(name string) (netlink.Link, error) {
+		if current == nil || name != testInterface {
+			return nil, fmt.Errorf("link %s not found", name)
+		}
+		return current, nil
+	}
+	return d, routes, func(link netlink.Link) { current = link }
+}
+
+func testLink(index int, up bool) netlink.Link {
+	attrs := netlink.LinkAttrs{Name: testInterface, Index: index}
+	if up {
+		attrs.Flags = net.FlagUp
+	}
+	return &netlink.Dummy{LinkAttrs: attrs}
+}
+
+// TestCheckRebuiltTunnel rebuilds the tunnel between two checks, which
+// only notice a new link index.
+func TestCheckRebuiltTunnel(t *testing.T) {
+	d, routes, setLink := testDirector(FailClosed)
+
+	setLink(testLink(5, true))
+	d.check()
+	if !d.up || routes.via != 5 || routes.routeVia != 1 {
+		t.Fatalf("up %v via %d after %d RouteVia, want routed via 5 once", d.up, routes.via, routes.routeVia)
+	}
+	d.check()
+	if routes.routeVia != 1 {
+		t.Errorf("RouteVia called %d times while routed, want once", routes.routeVia)
+	}
+
+	// the kernel dropped the default route along with link 5
+	routes.via = 0
+	setLink(testLink(6, true))
+	d.check()
+	if !d.up || routes.via != 6 || routes.routeVia != 2 {
+		t.Errorf("up %v via %d after %d RouteVia, want routed via 6 again", d.up, routes.via, routes.routeVia)
+	}
+	if routes.withdraw != 0 {
+		t.Errorf("Withdraw called %d times, want none", routes.withdraw)
+	}
+}
+
+// TestCheckMissingDefaultRoute removes the default route behind the back
+// of the director.
+func TestCheckMissingDefaultRoute(t *testing.T) {
+	d, routes, setLink := testDirector(FailClosed)
+
+	setLink(testLink(5, true))
+	d.check()
+	routes.via = 0
+	d.check()
+	if routes.via != 5 || routes.routeVia != 2 {
+		t.Errorf("via %d after %d RouteVia, want routed via 5 again", routes.via, routes.routeVia)
+	}
+}
+
+// unhealthyTunnel has its link up but no handshake with the gateway.
+type unhealthyTunnel struct {
+	fakeTunnel
+}
+
+func (t *unhealthyTunnel) Healthy() bool {
+	return false
+}
+
+func TestCheckFailPolicy(t *testing.T) {
+	tests := []struct {
+		policy   FailPolicy
+		restore  int
+		withdraw int
+		via      int
+	}{
+		{FailClosed, 0, 1, 0},
+		{FailOpen, 1, 0, -1},
+	}
+	for _, test := range tests {
+		d, routes, setLink := testDirector(test.policy)
+
+		// nothing is applied before the tunnel was ever up
+		d.check()
+		if d.up || routes.restore+routes.withdraw+routes.routeVia != 0 {
+			t.Fatalf("%s: up %v with routes %+v before the tunnel is up", test.policy, d.up, routes)
+		}
+
+		setLink(testLink(5, true))
+		d.check()
+		setLink(testLink(5, false))
+		d.check()
+		if d.up || routes.restore != test.restore || routes.withdraw != test.withdraw || routes.via != test.via {
+			t.Errorf("%s: up %v with routes %+v once the link is down", test.policy, d.up, routes)
+		}
+		d.check()
+		if routes.restore+routes.withdraw != 1 {
+			t.Errorf("%s: fail policy applied %d times, want once", test.policy, routes.restore+routes.withdraw)
+		}
+
+		setLink(testLink(5, true))
+		d.check()
+		if !d.up || routes.via != 5 {
+			t.Errorf("%s: up %v via %d once the link is back, want routed via 5", test.policy, d.up, routes.via)
+		}
+		setLink(nil)
+		d.check()
+		if d.up || routes.restore+routes.withdraw != 2 {
+			t.Errorf("%s: up %v with routes %+v once the link is gone", test.policy, d.up, routes)
+		}
+	}
+}
+
+func TestCheckUnhealthyTunnel(t *testing.T) {
+	d, routes, setLink := testDirector(FailClosed)
+	d.tunnel = &unhealthyTunnel{}
+
+	setLink(testLink(5, true))
+	d.check()
+	if d.up || routes.routeVia != 0 {
+		t.Errorf("up %v after %d RouteVia, want the unhealthy tunnel left down", d.up, routes.routeVia)
+	}
+}
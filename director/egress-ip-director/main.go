@@ -0,0 +1,86 @@
+/*
+Copyright 2021 Ying Ge Li.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/yingeli/egress-ip-operator/director"
+)
+
+const (
+	usage = "usage: egress-ip-director [flags] init|run"
+)
+
+var (
+	log = ctrl.Log.WithName("egress-ip-director")
+)
+
+func main() {
+	var probeAddr string
+	flag.StringVar(&probeAddr, "health-probe-bind-address", ":9081", "The address the probe endpoint binds to.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if flag.NArg() != 1 {
+		log.Error(fmt.Errorf("missing action"), usage)
+		os.Exit(1)
+	}
+
+	cfg, err := director.ConfigFromEnv()
+	if err != nil {
+		log.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+	tunnel, err := director.NewTunnel(cfg)
+	if err != nil {
+		log.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+	d := director.New(cfg, tunnel)
+
+	switch flag.Arg(0) {
+	case "init":
+		if err := d.Init(); err != nil {
+			log.Error(err, "error initializing routes")
+			os.Exit(1)
+		}
+	case "run":
+		ctx := ctrl.SetupSignalHandler()
+		go func() {
+			if err := d.ServeProbes(ctx, probeAddr); err != nil {
+				log.Error(err, "error serving probes")
+				os.Exit(1)
+			}
+		}()
+		if err := d.Run(ctx); err != nil {
+			log.Error(err, "error running director")
+			os.Exit(1)
+		}
+	default:
+		log.Error(fmt.Errorf("invalid action"), usage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,75 @@
+package director
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/yingeli/egress-ip-operator/tunnel"
+	"github.com/yingeli/egress-ip-operator/tunnel/encap"
+)
+
+const (
+	encapInterface = "eip0"
+)
+
+// EncapTunnel carries traffic to the gateway in an unencrypted GRE, IPIP or
+// VXLAN tunnel programmed directly in the kernel.
+type EncapTunnel struct {
+	cfg  Config
+	mode encap.Mode
+}
+
+func NewEncapTunnel(cfg Config) *EncapTunnel {
+	return &EncapTunnel{
+		cfg:  cfg,
+		mode: encap.Mode(cfg.Tunnel),
+	}
+}
+
+func (t *EncapTunnel) Interface() string {
+	return encapInterface
+}
+
+// NextHop returns the gateway's tunnel address when the tunnel is a VXLAN
+// segment; GRE and IPIP links are point-to-point and need none.
+func (t *EncapTunnel) NextHop() net.IP {
+	if t.mode != encap.VXLAN {
+		return nil
+	}
+	return tunnel.GatewayIP(t.cfg.TunnelNetwork)
+}
+
+func (t *EncapTunnel) Run(ctx context.Context) error {
+	remote, err := resolveGateway(t.cfg.Gateway, nil)
+	if err != nil {
+		return err
+	}
+	mtu, err := encap.MTU(t.mode, remote)
+	if err != nil {
+		return err
+	}
+	link, err := encap.EnsureLink(t.mode, encapInterface, nil, remote, mtu)
+	if err != nil {
+		return err
+	}
+	defer encap.DeleteLink(encapInterface)
+
+	mask := net.CIDRMask(32, 32)
+	if t.mode == encap.VXLAN {
+		mask = t.cfg.TunnelNetwork.Mask
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: t.cfg.TunnelIP, Mask: mask}}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("AddrReplace %s error: %v", addr, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("LinkSetUp %s error: %v", encapInterface, err)
+	}
+
+	// the link is bound to the gateway pod IP, so it is rebuilt whenever the
+	// gateway is rescheduled
+	return watchGateway(ctx, t.cfg.Gateway, remote)
+}
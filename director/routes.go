@@ -0,0 +1,166 @@
+package director
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Routes manages the pod routing table. It remembers the default route the
+// pod network handed out, with its flags and protocol, so that local traffic
+// and the tunnel itself keep using it while everything else is sent through
+// the tunnel.
+type Routes struct {
+	original netlink.Route
+}
+
+// DiscoverRoutes finds the pod's original default route. When the init
+// container has already withdrawn it, the route is recovered from the local
+// network route that was added in its place.
+func DiscoverRoutes(cfg Config) (*Routes, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("RouteList error: %v", err)
+	}
+
+	for _, route := range routes {
+		if isDefaultRoute(route) && route.Gw != nil {
+			return &Routes{original: route}, nil
+		}
+	}
+
+	local := cfg.LocalNetworks[0].String()
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.String() == local && route.Gw != nil {
+			route.Dst = nil
+			return &Routes{original: route}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("cannot find default route or route for %s", local)
+}
+
+// Gateway returns the next hop of the pod's original default route.
+func (r *Routes) Gateway() net.IP {
+	return r.original.Gw
+}
+
+// Setup routes the local networks and the egress gateway through the pod's
+// original default route. Under FailClosed the default route is withdrawn as
+// well, so that nothing leaves the pod before the tunnel is up.
+func (r *Routes) Setup(cfg Config) error {
+	for _, dst := range cfg.LocalNetworks {
+		if err := r.via(dst); err != nil {
+			return err
+		}
+	}
+
+	addrs, err := net.LookupIP(cfg.Gateway)
+	if err != nil {
+		return fmt.Errorf("LookupIP %s error: %v", cfg.Gateway, err)
+	}
+	for _, addr := range addrs {
+		if addr.To4() == nil || containsIP(cfg.LocalNetworks, addr) {
+			continue
+		}
+		if err := r.via(&net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)}); err != nil {
+			return err
+		}
+	}
+
+	if cfg.FailPolicy == FailClosed {
+		return r.Withdraw()
+	}
+	return nil
+}
+
+// RouteVia makes link the default route of the pod. A nil gw routes
+// directly out of point-to-point links.
+func (r *Routes) RouteVia(link netlink.Link, gw net.IP) error {
+	// netlink refuses routes without any of a destination, source or gateway
+	route := netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if gw != nil {
+		route.Scope = netlink.SCOPE_UNIVERSE
+		route.Gw = gw
+	}
+	if err := netlink.RouteReplace(&route); err != nil {
+		return fmt.Errorf("RouteReplace default dev %s error: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// RoutedVia returns whether a default route of the pod goes out of the link
+// with index.
+func (r *Routes) RoutedVia(index int) (bool, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return false, fmt.Errorf("RouteList error: %v", err)
+	}
+	for _, route := range routes {
+		if isDefaultRoute(route) && route.LinkIndex == index {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Restore puts the original default route back as it was, onlink
+// gateways included.
+func (r *Routes) Restore() error {
+	route := r.original
+	if err := netlink.RouteReplace(&route); err != nil {
+		return fmt.Errorf("RouteReplace default via %s error: %v", r.original.Gw, err)
+	}
+	return nil
+}
+
+// Withdraw removes every default route of the pod.
+func (r *Routes) Withdraw() error {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("RouteList error: %v", err)
+	}
+	for _, route := range routes {
+		if !isDefaultRoute(route) {
+			continue
+		}
+		route := route
+		if err := netlink.RouteDel(&route); err != nil {
+			return fmt.Errorf("RouteDel default error: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *Routes) via(dst *net.IPNet) error {
+	route := r.original
+	route.Dst = dst
+	if err := netlink.RouteReplace(&route); err != nil {
+		return fmt.Errorf("RouteReplace %s via %s error: %v", dst, r.original.Gw, err)
+	}
+	return nil
+}
+
+// isDefaultRoute returns whether route is a default route, which netlink
+// lists with a 0.0.0.0/0 destination and older releases with none.
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
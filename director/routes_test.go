@@ -0,0 +1,146 @@
+package director
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// defaultRoutes returns the default routes of the network namespace.
+func defaultRoutes(t *testing.T) []netlink.Route {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("RouteList error: %v", err)
+	}
+	var defaults []netlink.Route
+	for _, route := range routes {
+		if isDefaultRoute(route) {
+			defaults = append(defaults, route)
+		}
+	}
+	return defaults
+}
+
+// hasRoute returns whether the network namespace routes dst via gw.
+func hasRoute(t *testing.T, dst string, gw string) bool {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("RouteList error: %v", err)
+	}
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.String() == dst && route.Gw.Equal(net.ParseIP(gw)) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestRoutes routes a pod through a tunnel in a new network namespace, and
+// is skipped where namespaces or veth links are not available.
+func TestRoutes(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("netns.Get error: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("netns.New error: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	addLink := func(name, cidr string) netlink.Link {
+		link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-peer"}
+		if err := netlink.LinkAdd(link); err != nil {
+			t.Skipf("LinkAdd %s error: %v", name, err)
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			t.Fatalf("AddrAdd %s error: %v", cidr, err)
+		}
+		// a peer down would flag the routes of the link as linkdown
+		for _, name := range []string{name, link.PeerName} {
+			l, err := netlink.LinkByName(name)
+			if err != nil {
+				t.Fatalf("LinkByName %s error: %v", name, err)
+			}
+			if err := netlink.LinkSetUp(l); err != nil {
+				t.Fatalf("LinkSetUp %s error: %v", name, err)
+			}
+		}
+		return link
+	}
+	eth0 := addLink("eth0", "10.244.0.5/24")
+	tunnel := addLink(testInterface, "172.30.0.2/32")
+	podGateway := net.ParseIP("10.244.0.1")
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: eth0.Attrs().Index, Gw: podGateway}); err != nil {
+		t.Fatalf("RouteAdd error: %v", err)
+	}
+
+	_, local, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg := Config{
+		Gateway:       "192.168.5.5",
+		LocalNetworks: []*net.IPNet{local},
+		FailPolicy:    FailClosed,
+	}
+	routes, err := DiscoverRoutes(cfg)
+	if err != nil {
+		t.Fatalf("DiscoverRoutes error: %v", err)
+	}
+	if !routes.Gateway().Equal(podGateway) {
+		t.Errorf("Gateway = %v, want %v", routes.Gateway(), podGateway)
+	}
+
+	if err := routes.Setup(cfg); err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+	if !hasRoute(t, "10.0.0.0/8", "10.244.0.1") || !hasRoute(t, "192.168.5.5/32", "10.244.0.1") {
+		t.Errorf("local network and gateway not routed via %v", podGateway)
+	}
+	if got := defaultRoutes(t); len(got) != 0 {
+		t.Errorf("default routes %v after Setup under FailClosed, want none", got)
+	}
+
+	// a restarted director recovers the original route from the local one
+	routes, err = DiscoverRoutes(cfg)
+	if err != nil {
+		t.Fatalf("DiscoverRoutes after Setup error: %v", err)
+	}
+	if !routes.Gateway().Equal(podGateway) {
+		t.Errorf("Gateway = %v after Setup, want %v", routes.Gateway(), podGateway)
+	}
+
+	if err := routes.RouteVia(tunnel, nil); err != nil {
+		t.Fatalf("RouteVia error: %v", err)
+	}
+	if routed, err := routes.RoutedVia(tunnel.Attrs().Index); err != nil || !routed {
+		t.Errorf("RoutedVia tunnel = %v, %v after RouteVia, want true", routed, err)
+	}
+	if routed, _ := routes.RoutedVia(eth0.Attrs().Index); routed {
+		t.Errorf("RoutedVia eth0 = true after RouteVia, want false")
+	}
+
+	if err := routes.Restore(); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	got := defaultRoutes(t)
+	if len(got) != 1 || got[0].LinkIndex != eth0.Attrs().Index || !got[0].Gw.Equal(podGateway) {
+		t.Errorf("default routes %v after Restore, want one via %v", got, podGateway)
+	}
+
+	if err := routes.Withdraw(); err != nil {
+		t.Fatalf("Withdraw error: %v", err)
+	}
+	if got := defaultRoutes(t); len(got) != 0 {
+		t.Errorf("default routes %v after Withdraw, want none", got)
+	}
+	if routed, _ := routes.RoutedVia(tunnel.Attrs().Index); routed {
+		t.Errorf("RoutedVia tunnel = true after Withdraw, want false")
+	}
+}
@@ -0,0 +1,174 @@
+package director
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+)
+
+// Tunnel carries the pod's egress traffic to the gateway.
+type Tunnel interface {
+	// Interface returns the name of the link the tunnel brings up.
+	Interface() string
+	// Run starts the tunnel and blocks until it exits or ctx is done.
+	Run(ctx context.Context) error
+}
+
+// HealthChecker is implemented by tunnels that know more about their health
+// than the state of their link.
+type HealthChecker interface {
+	Healthy() bool
+}
+
+// NextHopper is implemented by tunnels whose link is a broadcast network,
+// where the default route needs the gateway's address as next hop.
+type NextHopper interface {
+	NextHop() net.IP
+}
+
+// NewTunnel returns the tunnel selected by cfg.
+func NewTunnel(cfg Config) (Tunnel, error) {
+	switch cfg.Tunnel {
+	case TunnelL2TP:
+		return NewL2TPTunnel(cfg.Gateway), nil
+	case TunnelWireGuard:
+		return NewWireGuardTunnel(cfg), nil
+	case TunnelGRE, TunnelIPIP, TunnelVXLAN:
+		return NewEncapTunnel(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported tunnel %s", cfg.Tunnel)
+	}
+}
+
+const (
+	// how often the gateway name is resolved again
+	gatewayInterval = 30 * time.Second
+)
+
+// resolveGateway returns the IPv4 address of the gateway replica to connect
+// to. The gateway Service is headless, so its name resolves to the pod IPs
+// of all replicas. current is kept as long as it is one of them; otherwise
+// the pod's hostname picks a replica, spreading directors evenly.
+func resolveGateway(name string, current net.IP) (net.IP, error) {
+	addrs, err := net.LookupIP(name)
+	if err != nil {
+		return nil, fmt.Errorf("LookupIP %s error: %v", name, err)
+	}
+	hostname, _ := os.Hostname()
+	return selectGateway(name, addrs, current, hostname)
+}
+
+// selectGateway returns current when it is one of the IPv4 addresses addrs
+// of name, or else the one hostname hashes to.
+func selectGateway(name string, addrs []net.IP, current net.IP, hostname string) (net.IP, error) {
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip := addr.To4(); ip != nil {
+			if ip.Equal(current) {
+				return current, nil
+			}
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IPv4 address for %s", name)
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i], ips[j]) < 0
+	})
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	return ips[h.Sum32()%uint32(len(ips))], nil
+}
+
+// watchGateway blocks until ctx is done, or until the gateway replica at
+// remote goes away, in which case it returns an error so that the tunnel is
+// rebuilt towards another replica.
+func watchGateway(ctx context.Context, name string, remote net.IP) error {
+	ticker := time.NewTicker(gatewayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			ip, err := resolveGateway(name, remote)
+			if err != nil {
+				continue
+			}
+			if !ip.Equal(remote) {
+				return fmt.Errorf("gateway moved from %s to %s", remote, ip)
+			}
+		}
+	}
+}
+
+const (
+	xl2tpdPath        = "/usr/sbin/xl2tpd"
+	xl2tpdConfigPath  = "/etc/xl2tpd/xl2tpd.conf"
+	xl2tpdControlPath = "/var/run/xl2tpd/l2tp-control"
+	pppOptionsPath    = "/etc/ppp/options.xl2tpd.client"
+	pppInterface      = "ppp0"
+)
+
+const xl2tpdConfig = `[global]
+[lac egressgw]
+lns = %s
+pppoptfile = %s
+redial = yes
+autodial = yes
+`
+
+// L2TPTunnel runs xl2tpd as a LAC dialing the gateway's LNS.
+type L2TPTunnel struct {
+	gateway string
+}
+
+func NewL2TPTunnel(gateway string) *L2TPTunnel {
+	return &L2TPTunnel{gateway: gateway}
+}
+
+func (t *L2TPTunnel) Interface() string {
+	return pppInterface
+}
+
+func (t *L2TPTunnel) Run(ctx context.Context) error {
+	remote, err := resolveGateway(t.gateway, nil)
+	if err != nil {
+		return err
+	}
+	config := fmt.Sprintf(xl2tpdConfig, remote, pppOptionsPath)
+	if err := ioutil.WriteFile(xl2tpdConfigPath, []byte(config), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", xl2tpdConfigPath, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, xl2tpdPath, "-D", "-c", xl2tpdConfigPath, "-C", xl2tpdControlPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// xl2tpd keeps redialing the address it was given
+	moved := make(chan error, 1)
+	go func() {
+		moved <- watchGateway(ctx, t.gateway, remote)
+		cancel()
+	}()
+	err = cmd.Wait()
+	cancel()
+	if err := <-moved; err != nil {
+		return err
+	}
+	return err
+}
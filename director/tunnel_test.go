@@ -0,0 +1,51 @@
+package director
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func parseIPs(ss ...string) []net.IP {
+	var ips []net.IP
+	for _, s := range ss {
+		ips = append(ips, net.ParseIP(s))
+	}
+	return ips
+}
+
+func TestSelectGateway(t *testing.T) {
+	replicas := parseIPs("10.244.1.7", "10.244.0.5", "fd00::5", "10.244.2.9")
+
+	ip, err := selectGateway("gw", replicas, net.ParseIP("10.244.2.9"), "app-1")
+	if err != nil || !ip.Equal(net.ParseIP("10.244.2.9")) {
+		t.Errorf("selectGateway = %v, %v, want the current replica kept", ip, err)
+	}
+
+	// the pick only depends on the hostname and the set of replicas
+	want, err := selectGateway("gw", replicas, net.ParseIP("10.244.3.3"), "app-1")
+	if err != nil {
+		t.Fatalf("selectGateway error: %v", err)
+	}
+	reversed := parseIPs("10.244.2.9", "fd00::5", "10.244.0.5", "10.244.1.7")
+	if ip, _ := selectGateway("gw", reversed, nil, "app-1"); !ip.Equal(want) {
+		t.Errorf("selectGateway = %v with replicas reordered, want %v", ip, want)
+	}
+
+	// directors are spread over every IPv4 replica
+	picked := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		ip, err := selectGateway("gw", replicas, nil, fmt.Sprintf("app-%d", i))
+		if err != nil {
+			t.Fatalf("selectGateway error: %v", err)
+		}
+		picked[ip.String()]++
+	}
+	if len(picked) != 3 || picked["fd00::5"] != 0 {
+		t.Errorf("replicas picked %v, want the 3 IPv4 ones", picked)
+	}
+
+	if _, err := selectGateway("gw", parseIPs("fd00::5"), nil, "app-1"); err == nil {
+		t.Errorf("selectGateway succeeded without an IPv4 replica")
+	}
+}
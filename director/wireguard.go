@@ -0,0 +1,123 @@
+package director
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/yingeli/egress-ip-operator/tunnel/wireguard"
+)
+
+const (
+	wireGuardInterface = "wg0"
+	// handshakes are renewed every 2 minutes and rejected after 3
+	handshakeTimeout  = 3 * time.Minute
+	keepaliveInterval = 25
+	endpointInterval  = 30 * time.Second
+)
+
+// WireGuardTunnel keeps a WireGuard link peered with the gateway.
+type WireGuardTunnel struct {
+	cfg Config
+	log logr.Logger
+
+	mu       sync.Mutex
+	endpoint string
+}
+
+func NewWireGuardTunnel(cfg Config) *WireGuardTunnel {
+	return &WireGuardTunnel{
+		cfg: cfg,
+		log: ctrl.Log.WithName("wireguard"),
+	}
+}
+
+func (t *WireGuardTunnel) Interface() string {
+	return wireGuardInterface
+}
+
+func (t *WireGuardTunnel) Run(ctx context.Context) error {
+	link, err := wireguard.EnsureLink(wireGuardInterface)
+	if err != nil {
+		return err
+	}
+	defer wireguard.DeleteLink(wireGuardInterface)
+
+	t.mu.Lock()
+	t.endpoint = ""
+	t.mu.Unlock()
+
+	if err := wireguard.SetPrivateKey(wireGuardInterface, t.cfg.WireGuard.PrivateKey, 0); err != nil {
+		return err
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: t.cfg.TunnelIP, Mask: net.CIDRMask(32, 32)}}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("AddrReplace %s error: %v", addr, err)
+	}
+	if err := t.setPeer(); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("LinkSetUp %s error: %v", wireGuardInterface, err)
+	}
+
+	// the gateway endpoint moves whenever the gateway pod is rescheduled
+	ticker := time.NewTicker(endpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := t.setPeer(); err != nil {
+				t.log.Error(err, "error updating gateway endpoint")
+			}
+		}
+	}
+}
+
+// Healthy reports whether a handshake with the gateway completed recently.
+func (t *WireGuardTunnel) Healthy() bool {
+	handshakes, err := wireguard.LatestHandshakes(wireGuardInterface)
+	if err != nil {
+		return false
+	}
+	last, ok := handshakes[t.cfg.WireGuard.GatewayPublicKey]
+	return ok && time.Since(last) < handshakeTimeout
+}
+
+func (t *WireGuardTunnel) setPeer() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var current net.IP
+	if host, _, err := net.SplitHostPort(t.endpoint); err == nil {
+		current = net.ParseIP(host)
+	}
+	addr, err := resolveGateway(t.cfg.Gateway, current)
+	if err != nil {
+		return err
+	}
+	endpoint := net.JoinHostPort(addr.String(), strconv.Itoa(wireguard.ListenPort))
+	if endpoint == t.endpoint {
+		return nil
+	}
+	err = wireguard.SetPeer(wireGuardInterface, wireguard.Peer{
+		PublicKey:           t.cfg.WireGuard.GatewayPublicKey,
+		Endpoint:            endpoint,
+		AllowedIPs:          []string{"0.0.0.0/0"},
+		PersistentKeepalive: keepaliveInterval,
+	})
+	if err != nil {
+		return err
+	}
+	t.endpoint = endpoint
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021 Ying Ge Li.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+	egressipclients "github.com/yingeli/egress-ip-operator/clients"
+	"github.com/yingeli/egress-ip-operator/gateway"
+	"github.com/yingeli/egress-ip-operator/tunnel/encap"
+)
+
+const (
+	usage = "usage: egress-ip-gateway [flags] wireguard|gre|ipip|vxlan"
+)
+
+var (
+	scheme = runtime.NewScheme()
+	log    = ctrl.Log.WithName("egress-ip-gateway")
+)
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+}
+
+func main() {
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if flag.NArg() != 1 {
+		log.Error(fmt.Errorf("invalid action"), usage)
+		os.Exit(1)
+	}
+	mode := flag.Arg(0)
+
+	_, tunnelNetwork, err := net.ParseCIDR(os.Getenv("TUNNEL_NETWORK"))
+	if err != nil {
+		log.Error(err, "invalid TUNNEL_NETWORK")
+		os.Exit(1)
+	}
+
+	var gw gateway.Gateway
+	switch mode {
+	case "wireguard":
+		gw = gateway.NewWireGuardGateway(os.Getenv("WIREGUARD_PRIVATE_KEY"), tunnelNetwork, os.Getenv("POD_IP"))
+	case string(encap.GRE), string(encap.IPIP), string(encap.VXLAN):
+		gw = gateway.NewEncapGateway(encap.Mode(mode), tunnelNetwork, os.Getenv("POD_IP"))
+	default:
+		log.Error(fmt.Errorf("invalid action %s", mode), usage)
+		os.Exit(1)
+	}
+	if err := gw.Setup(); err != nil {
+		log.Error(err, "error setting up tunnel", "tunnel", mode)
+		os.Exit(1)
+	}
+
+	if err := updatePhase(os.Getenv("EGRESS_IP_NAMESPACE"), os.Getenv("EGRESS_IP_NAME"), "Running"); err != nil {
+		log.Error(err, "error updating EgressIP phase")
+		os.Exit(1)
+	}
+
+	ls, err := labels.Parse(egressipv1alpha1.GatewayLabel + "=" + os.Getenv("GATEWAY_NAME"))
+	if err != nil {
+		log.Error(err, "invalid GATEWAY_NAME")
+		os.Exit(1)
+	}
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: "0",
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.Pod{}: {Label: ls},
+			},
+		}),
+	})
+	if err != nil {
+		log.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+
+	if err = (&gateway.PeerReconciler{
+		Client:  mgr.GetClient(),
+		Gateway: gw,
+		Log:     ctrl.Log.WithName("peer-reconciler"),
+	}).SetupWithManager(mgr); err != nil {
+		log.Error(err, "unable to create controller", "controller", "Peer")
+		os.Exit(1)
+	}
+
+	log.Info("running gateway", "tunnel", mode, "tunnelNetwork", tunnelNetwork)
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		log.Error(err, "problem running manager")
+		os.Exit(1)
+	}
+}
+
+func updatePhase(namespace, name, phase string) error {
+	ctx := context.Background()
+	eipc, err := egressipclients.OpenEgressIPClient(ctx)
+	if err != nil {
+		return err
+	}
+	eip, err := eipc.GetEgressIP(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	eip.Status.Phase = phase
+	return eip.UpdateStatus(ctx)
+}
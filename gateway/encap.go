@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/yingeli/egress-ip-operator/tunnel"
+	"github.com/yingeli/egress-ip-operator/tunnel/encap"
+)
+
+const (
+	vxlanInterface = "vxlan0"
+	// prefix of the per-director GRE and IPIP links
+	encapLinkPrefix = "eip"
+)
+
+// EncapGateway terminates the GRE, IPIP or VXLAN tunnels of the directors of
+// an EgressIP and SNATs their traffic to the gateway pod IP.
+//
+// GRE and IPIP are point-to-point, so every director gets its own link with
+// a route to its tunnel address. VXLAN uses a single link shared with all
+// directors, which are added as flood destinations.
+type EncapGateway struct {
+	mode          encap.Mode
+	tunnelNetwork *net.IPNet
+	podIP         string
+}
+
+func NewEncapGateway(mode encap.Mode, tunnelNetwork *net.IPNet, podIP string) *EncapGateway {
+	return &EncapGateway{
+		mode:          mode,
+		tunnelNetwork: tunnelNetwork,
+		podIP:         podIP,
+	}
+}
+
+// Setup brings up the VXLAN link, if any, and the SNAT rule for the tunnel
+// network.
+func (g *EncapGateway) Setup() error {
+	if g.mode == encap.VXLAN {
+		oif, err := outputInterface()
+		if err != nil {
+			return err
+		}
+		mtu, err := encap.LinkMTU(g.mode, oif)
+		if err != nil {
+			return err
+		}
+		link, err := encap.EnsureLink(g.mode, vxlanInterface, nil, nil, mtu)
+		if err != nil {
+			return err
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: tunnel.GatewayIP(g.tunnelNetwork), Mask: g.tunnelNetwork.Mask}}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("AddrReplace %s error: %v", addr, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("LinkSetUp %s error: %v", vxlanInterface, err)
+		}
+	}
+
+	return setupForwarding(g.tunnelNetwork, g.podIP)
+}
+
+// SyncPeers makes the tunnel endpoints of the gateway match peers. Peers
+// without a pod IP yet are ignored.
+func (g *EncapGateway) SyncPeers(peers []Peer) error {
+	var ready []Peer
+	for _, peer := range peers {
+		if peer.PodIP.To4() != nil {
+			ready = append(ready, peer)
+		}
+	}
+
+	if g.mode == encap.VXLAN {
+		return g.syncFloodEntries(ready)
+	}
+	return g.syncLinks(ready)
+}
+
+func (g *EncapGateway) syncFloodEntries(peers []Peer) error {
+	link, err := netlink.LinkByName(vxlanInterface)
+	if err != nil {
+		return fmt.Errorf("LinkByName %s error: %v", vxlanInterface, err)
+	}
+	current, err := encap.FloodEntries(link)
+	if err != nil {
+		return fmt.Errorf("error listing flood entries of %s: %v", vxlanInterface, err)
+	}
+
+	desired := make(map[string]bool)
+	for _, peer := range peers {
+		desired[peer.PodIP.String()] = true
+	}
+
+	existing := make(map[string]bool)
+	for _, ip := range current {
+		if !desired[ip.String()] {
+			if err := encap.DeleteFloodEntry(link, ip); err != nil {
+				return fmt.Errorf("error deleting flood entry %s: %v", ip, err)
+			}
+			continue
+		}
+		existing[ip.String()] = true
+	}
+
+	for _, peer := range peers {
+		if existing[peer.PodIP.String()] {
+			continue
+		}
+		if err := encap.AddFloodEntry(link, peer.PodIP); err != nil {
+			return fmt.Errorf("error adding flood entry %s: %v", peer.PodIP, err)
+		}
+	}
+	return nil
+}
+
+func (g *EncapGateway) syncLinks(peers []Peer) error {
+	desired := make(map[string]Peer)
+	for _, peer := range peers {
+		desired[encapLinkName(peer.PodIP)] = peer
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("LinkList error: %v", err)
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !strings.HasPrefix(name, encapLinkPrefix) || link.Type() == "vxlan" {
+			continue
+		}
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("LinkDel %s error: %v", name, err)
+		}
+	}
+
+	for name, peer := range desired {
+		mtu, err := encap.MTU(g.mode, peer.PodIP)
+		if err != nil {
+			return err
+		}
+		link, err := encap.EnsureLink(g.mode, name, nil, peer.PodIP, mtu)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("LinkSetUp %s error: %v", name, err)
+		}
+		route := netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: peer.TunnelIP, Mask: net.CIDRMask(32, 32)},
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("RouteReplace %s dev %s error: %v", route.Dst, name, err)
+		}
+	}
+	return nil
+}
+
+// encapLinkName names the link to the director at podIP, keeping within the
+// 15 character limit of interface names.
+func encapLinkName(podIP net.IP) string {
+	return fmt.Sprintf("%s%08x", encapLinkPrefix, binary.BigEndian.Uint32(podIP.To4()))
+}
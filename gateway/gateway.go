@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// Gateway terminates the tunnels of the directors of an EgressIP.
+type Gateway interface {
+	// Setup brings up the gateway side of the tunnel.
+	Setup() error
+	// SyncPeers makes the gateway accept traffic from exactly peers.
+	SyncPeers(peers []Peer) error
+}
+
+// Peer is a director connecting to the gateway.
+type Peer struct {
+	PodIP     net.IP
+	TunnelIP  net.IP
+	PublicKey string
+}
+
+// setupForwarding lets the gateway forward traffic from the tunnel network
+// and SNATs it to the gateway pod IP.
+func setupForwarding(tunnelNetwork *net.IPNet, podIP string) error {
+	if err := ioutil.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("error enabling ip forwarding: %v", err)
+	}
+
+	oif, err := outputInterface()
+	if err != nil {
+		return err
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		return err
+	}
+	spec := []string{
+		"-o", oif,
+		"-s", tunnelNetwork.String(),
+		"-j", "SNAT", "--to", podIP,
+	}
+	exists, err := ipt.Exists("nat", "POSTROUTING", spec...)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ipt.Insert("nat", "POSTROUTING", 1, spec...)
+	}
+	return nil
+}
+
+// outputInterface returns the interface of the default route of the gateway
+// pod.
+func outputInterface() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", fmt.Errorf("RouteList error: %v", err)
+	}
+	for _, route := range routes {
+		if !isDefaultRoute(route) || route.LinkIndex == 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return "", fmt.Errorf("LinkByIndex %d error: %v", route.LinkIndex, err)
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", fmt.Errorf("no default route")
+}
+
+// isDefaultRoute returns whether route is a default route, which netlink
+// lists with a 0.0.0.0/0 destination and older releases with none.
+func isDefaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
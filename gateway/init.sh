@@ -6,7 +6,9 @@ if [ $? -ne 0 ]; then
    exit 1
 fi
 
-local_ip=$(ip -f inet addr show eth0 | sed -En -e 's/.*inet ([0-9.]+).*/\1/p')
+# the interface of the default route, which is not necessarily eth0
+output_interface=$(ip -4 route show default | sed -En -e 's/.* dev ([^ ]+).*/\1/p' | head -n 1)
+local_ip=$(ip -f inet addr show $output_interface | sed -En -e 's/.*inet ([0-9.]+).*/\1/p')
 if [ $? -ne 0 ]; then
    exit 1
 fi
@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"context"
+	"net"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
+)
+
+// PeerReconciler keeps the gateway's tunnel endpoint table in sync with the
+// director pods that connect to it, adding and removing peers as those pods
+// come and go.
+type PeerReconciler struct {
+	client.Client
+	Gateway Gateway
+	Log     logr.Logger
+}
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+func (r *PeerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	// every director pod is cached, so resync all peers on each event
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var peers []Peer
+	for _, pod := range pods.Items {
+		if !pod.DeletionTimestamp.IsZero() || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		ip := net.ParseIP(pod.Annotations[egressipv1alpha1.TunnelIPAnnotation])
+		if ip == nil {
+			r.Log.Info("skipping director pod without tunnel annotations", "namespace", pod.Namespace, "name", pod.Name)
+			continue
+		}
+		peers = append(peers, Peer{
+			PodIP:     net.ParseIP(pod.Status.PodIP),
+			TunnelIP:  ip,
+			PublicKey: pod.Annotations[egressipv1alpha1.WireGuardPublicKeyAnnotation],
+		})
+	}
+
+	if err := r.Gateway.SyncPeers(peers); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.Log.Info("synced peers", "peers", len(peers))
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PeerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Pod{}).
+		Complete(r)
+}
@@ -6,8 +6,12 @@ if [ $? -ne 0 ]; then
    exit 1
 fi
 
+sed -i -e 's/^ip range = .*/ip range = '$TUNNEL_IP_RANGE'/' \
+    -e 's/^local ip = .*/local ip = '$TUNNEL_LOCAL_IP'/' /etc/xl2tpd/xl2tpd.conf
+
 pod_ip=$(hostname -i)
-iptables -t nat -I POSTROUTING -o eth0 -s 192.168.0.0/16 -j SNAT --to $pod_ip
+output_interface=$(ip -4 route show default | sed -En -e 's/.* dev ([^ ]+).*/\1/p' | head -n 1)
+iptables -t nat -I POSTROUTING -o $output_interface -s $TUNNEL_NETWORK -j SNAT --to $pod_ip
 
 echo "Running gateway for EgressIP "$EGRESS_IP
 /usr/sbin/xl2tpd -c /etc/xl2tpd/xl2tpd.conf -D
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/yingeli/egress-ip-operator/tunnel"
+	"github.com/yingeli/egress-ip-operator/tunnel/wireguard"
+)
+
+const (
+	wireGuardInterface = "wg0"
+)
+
+// WireGuardGateway terminates the WireGuard tunnels of the directors of an
+// EgressIP and SNATs their traffic to the gateway pod IP.
+type WireGuardGateway struct {
+	privateKey    string
+	tunnelNetwork *net.IPNet
+	podIP         string
+}
+
+func NewWireGuardGateway(privateKey string, tunnelNetwork *net.IPNet, podIP string) *WireGuardGateway {
+	return &WireGuardGateway{
+		privateKey:    privateKey,
+		tunnelNetwork: tunnelNetwork,
+		podIP:         podIP,
+	}
+}
+
+// Setup brings up the WireGuard link and the SNAT rule for the tunnel network.
+func (g *WireGuardGateway) Setup() error {
+	link, err := wireguard.EnsureLink(wireGuardInterface)
+	if err != nil {
+		return err
+	}
+	if err := wireguard.SetPrivateKey(wireGuardInterface, g.privateKey, wireguard.ListenPort); err != nil {
+		return err
+	}
+
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: tunnel.GatewayIP(g.tunnelNetwork), Mask: g.tunnelNetwork.Mask}}
+	if err := netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("AddrReplace %s error: %v", addr, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("LinkSetUp %s error: %v", wireGuardInterface, err)
+	}
+
+	return setupForwarding(g.tunnelNetwork, g.podIP)
+}
+
+// SyncPeers makes the peers of the WireGuard link match peers. Peers
+// without a public key are ignored.
+func (g *WireGuardGateway) SyncPeers(peers []Peer) error {
+	current, err := wireguard.Peers(wireGuardInterface)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]net.IP)
+	for _, peer := range peers {
+		if peer.PublicKey != "" {
+			keys[peer.PublicKey] = peer.TunnelIP
+		}
+	}
+
+	existing := make(map[string]bool)
+	for _, key := range current {
+		if _, ok := keys[key]; !ok {
+			if err := wireguard.RemovePeer(wireGuardInterface, key); err != nil {
+				return err
+			}
+			continue
+		}
+		existing[key] = true
+	}
+
+	for key, ip := range keys {
+		if existing[key] {
+			continue
+		}
+		err := wireguard.SetPeer(wireGuardInterface, wireguard.Peer{
+			PublicKey:  key,
+			AllowedIPs: []string{ip.String() + "/32"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -19,12 +19,15 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -36,12 +39,21 @@ import (
 
 	egressipv1alpha1 "github.com/yingeli/egress-ip-operator/api/v1alpha1"
 	"github.com/yingeli/egress-ip-operator/controllers"
+	"github.com/yingeli/egress-ip-operator/providers"
+	_ "github.com/yingeli/egress-ip-operator/providers/azure"
+	_ "github.com/yingeli/egress-ip-operator/providers/none"
 	//+kubebuilder:scaffold:imports
 )
 
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
+
+	providerName   string
+	providerConfig string
+
+	sweepInterval time.Duration
+	sweepDryRun   bool
 )
 
 func init() {
@@ -71,20 +83,53 @@ func main() {
 		os.Exit(1)
 	}
 
+	provider, err := providers.NewFromFile(providerName, providerConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to create provider", "provider", providerName)
+		os.Exit(1)
+	}
+	setupLog.Info("using provider", "provider", providerName)
+
+	podReconciler := &controllers.PodReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("egress-ip-daemon"),
+		Provider: provider,
+	}
 	if runningDaemon {
-		if err = (&controllers.PodReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
-		}).SetupWithManager(mgr); err != nil {
+		if err = podReconciler.SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", "Pod")
 			os.Exit(1)
 		}
 	} else {
 		if err = (&controllers.EgressIPReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("egress-ip-controller"),
+			Provider: provider,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "EgressIP")
+			os.Exit(1)
+		}
+
+		if sweepInterval > 0 {
+			if err = mgr.Add(&controllers.AssociationSweeper{
+				Client:   mgr.GetClient(),
+				Provider: provider,
+				Log:      ctrl.Log.WithName("association-sweeper"),
+				Interval: sweepInterval,
+				DryRun:   sweepDryRun,
+			}); err != nil {
+				setupLog.Error(err, "unable to create association sweeper")
+				os.Exit(1)
+			}
+		}
+
+		if err = (&controllers.DirectorSecretReconciler{
 			Client: mgr.GetClient(),
 			Scheme: mgr.GetScheme(),
 		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create controller", "controller", "EgressIP")
+			setupLog.Error(err, "unable to create controller", "controller", "DirectorSecret")
 			os.Exit(1)
 		}
 
@@ -98,7 +143,11 @@ func main() {
 		hookServer := mgr.GetWebhookServer()
 
 		setupLog.Info("registering webhooks to the webhook server")
-		hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: &controllers.EgressIPInjector{Client: mgr.GetClient()}})
+		hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: &controllers.EgressIPInjector{
+			Client:   mgr.GetClient(),
+			Reader:   mgr.GetAPIReader(),
+			Recorder: mgr.GetEventRecorderFor("egress-ip-injector"),
+		}})
 	}
 	//+kubebuilder:scaffold:builder
 
@@ -110,12 +159,27 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if runningDaemon {
+		if err := mgr.AddReadyzCheck("provider", podReconciler.CheckProvider); err != nil {
+			setupLog.Error(err, "unable to set up provider ready check")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+
+	// release the EgressIPs of a drained or deleted node so that they move
+	// elsewhere quickly, or of any node with SHUTDOWN_CLEANUP=true
+	if cleanup := os.Getenv("SHUTDOWN_CLEANUP"); runningDaemon && cleanup != "false" {
+		if err := podReconciler.Shutdown(cleanup == "true"); err != nil {
+			setupLog.Error(err, "problem releasing EgressIPs")
+			os.Exit(1)
+		}
+	}
 }
 
 func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
@@ -124,6 +188,14 @@ func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
 	var probeAddr string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&providerName, "provider", "azure",
+		"The provider associating public IPs with nodes, one of "+strings.Join(providers.Names(), ", ")+".")
+	flag.StringVar(&providerConfig, "provider-config", "",
+		"The file holding the configuration of providers, a block per provider keyed by name.")
+	flag.DurationVar(&sweepInterval, "sweep-interval", 10*time.Minute,
+		"How often the controller removes associations leaked on the nodes of the cluster, 0 to never.")
+	flag.BoolVar(&sweepDryRun, "sweep-dry-run", false,
+		"Only report leaked associations rather than removing them.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -131,7 +203,14 @@ func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
-	flag.Parse()
+	if runningDaemon {
+		// flags follow the daemon argument
+		if err := flag.CommandLine.Parse(os.Args[2:]); err != nil {
+			return options, err
+		}
+	} else {
+		flag.Parse()
+	}
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
@@ -145,8 +224,8 @@ func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
 	}
 
 	if runningDaemon {
-		options.Namespace = os.Getenv("NAMESPACE")
-
+		// the daemon owns every gateway pod on its node whatever the
+		// namespace
 		options.LeaderElection = false
 
 		fs, ls, err := controllers.GatewayPodSelectors()
@@ -159,6 +238,22 @@ func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
 					Field: fs,
 					Label: ls,
 				},
+				&corev1.Node{}: {
+					Field: controllers.GatewayNodeSelector(),
+				},
+			},
+		})
+	} else {
+		// only WireGuard key Secrets are of interest to the controller
+		ls, err := labels.Parse(egressipv1alpha1.WireGuardSecretLabel)
+		if err != nil {
+			return options, err
+		}
+		options.NewCache = cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.Secret{}: {
+					Label: ls,
+				},
 			},
 		})
 	}
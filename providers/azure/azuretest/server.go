@@ -0,0 +1,1693 @@
+// Package azuretest runs a stand-in for Azure Resource Manager, the
+// Instance Metadata Service and the token endpoint of Active Directory, so
+// that the azure provider can be tested without an Azure subscription. It
+// implements the VM, scale set instance, network interface, public IP, public IP prefix, load
+// balancer, NAT gateway and subnet operations the provider uses, including
+// the polling of long running operations, and can be made to answer with
+// errors such as 409 and 429. The metadata service can be made to fail, to
+// answer late or with a garbled document.
+package azuretest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SubscriptionID = "00000000-0000-0000-0000-000000000000"
+	ResourceGroup  = "egress-ip-test"
+	Location       = "westus2"
+	// VMName is the VM the metadata service of NewServer describes.
+	VMName = "node-1"
+	// ScaleSetName and InstanceID identify the instance of a uniform scale
+	// set the metadata service of NewScaleSetServer describes.
+	ScaleSetName = "aks-nodepool1-vmss"
+	InstanceID   = "0"
+
+	// SubnetID is the subnet of the network interfaces.
+	SubnetID = "/subscriptions/" + SubscriptionID + "/resourceGroups/" + ResourceGroup +
+		"/providers/Microsoft.Network/virtualNetworks/vnet/subnets/default"
+)
+
+type subResource struct {
+	ID string `json:"id"`
+}
+
+type ipConfiguration struct {
+	ID         string                    `json:"id,omitempty"`
+	Name       string                    `json:"name"`
+	Properties ipConfigurationProperties `json:"properties"`
+}
+
+type ipConfigurationProperties struct {
+	PrivateIPAddress          string       `json:"privateIPAddress,omitempty"`
+	PrivateIPAllocationMethod string       `json:"privateIPAllocationMethod,omitempty"`
+	Primary                   *bool        `json:"primary,omitempty"`
+	Subnet                    *subResource `json:"subnet,omitempty"`
+	PublicIPAddress           *subResource `json:"publicIPAddress,omitempty"`
+	// pool membership is held by the IP configurations, load balancers
+	// only report it
+	LoadBalancerBackendAddressPools []subResource `json:"loadBalancerBackendAddressPools,omitempty"`
+	ProvisioningState               string        `json:"provisioningState,omitempty"`
+}
+
+type nic struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Etag       string            `json:"etag,omitempty"`
+	Location   string            `json:"location"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Properties nicProperties     `json:"properties"`
+}
+
+type nicProperties struct {
+	Primary           *bool             `json:"primary,omitempty"`
+	IPConfigurations  []ipConfiguration `json:"ipConfigurations"`
+	ProvisioningState string            `json:"provisioningState,omitempty"`
+}
+
+type publicIP struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Location   string             `json:"location"`
+	Sku        *sku               `json:"sku,omitempty"`
+	Tags       map[string]string  `json:"tags,omitempty"`
+	Properties publicIPProperties `json:"properties"`
+}
+
+type publicIPProperties struct {
+	IPAddress                string       `json:"ipAddress"`
+	PublicIPAllocationMethod string       `json:"publicIPAllocationMethod"`
+	IPConfiguration          *subResource `json:"ipConfiguration,omitempty"`
+	NatGateway               *subResource `json:"natGateway,omitempty"`
+	PublicIPPrefix           *subResource `json:"publicIPPrefix,omitempty"`
+	ProvisioningState        string       `json:"provisioningState"`
+}
+
+type publicIPPrefix struct {
+	ID         string                   `json:"id"`
+	Name       string                   `json:"name"`
+	Location   string                   `json:"location"`
+	Sku        *sku                     `json:"sku,omitempty"`
+	Properties publicIPPrefixProperties `json:"properties"`
+}
+
+type publicIPPrefixProperties struct {
+	IPPrefix     string `json:"ipPrefix"`
+	PrefixLength int32  `json:"prefixLength"`
+	// reported from the public IPs
+	PublicIPAddresses []subResource `json:"publicIPAddresses,omitempty"`
+	ProvisioningState string        `json:"provisioningState,omitempty"`
+}
+
+type loadBalancer struct {
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Etag       string                 `json:"etag,omitempty"`
+	Location   string                 `json:"location"`
+	Sku        *sku                   `json:"sku,omitempty"`
+	Properties loadBalancerProperties `json:"properties"`
+}
+
+type sku struct {
+	Name string `json:"name"`
+}
+
+type loadBalancerProperties struct {
+	FrontendIPConfigurations []frontendIPConfiguration `json:"frontendIPConfigurations"`
+	BackendAddressPools      []backendAddressPool      `json:"backendAddressPools"`
+	OutboundRules            []outboundRule            `json:"outboundRules"`
+	ProvisioningState        string                    `json:"provisioningState,omitempty"`
+}
+
+type frontendIPConfiguration struct {
+	ID         string                            `json:"id,omitempty"`
+	Name       string                            `json:"name"`
+	Properties frontendIPConfigurationProperties `json:"properties"`
+}
+
+type frontendIPConfigurationProperties struct {
+	PublicIPAddress *subResource `json:"publicIPAddress,omitempty"`
+}
+
+type backendAddressPool struct {
+	ID         string                       `json:"id,omitempty"`
+	Name       string                       `json:"name"`
+	Properties backendAddressPoolProperties `json:"properties"`
+}
+
+type backendAddressPoolProperties struct {
+	BackendIPConfigurations []subResource `json:"backendIPConfigurations,omitempty"`
+}
+
+type outboundRule struct {
+	ID         string                 `json:"id,omitempty"`
+	Name       string                 `json:"name"`
+	Properties outboundRuleProperties `json:"properties"`
+}
+
+type outboundRuleProperties struct {
+	FrontendIPConfigurations []subResource `json:"frontendIPConfigurations"`
+	BackendAddressPool       *subResource  `json:"backendAddressPool,omitempty"`
+	Protocol                 string        `json:"protocol"`
+	AllocatedOutboundPorts   int32         `json:"allocatedOutboundPorts,omitempty"`
+	IdleTimeoutInMinutes     int32         `json:"idleTimeoutInMinutes,omitempty"`
+	EnableTCPReset           bool          `json:"enableTcpReset,omitempty"`
+}
+
+type natGateway struct {
+	ID         string               `json:"id"`
+	Name       string               `json:"name"`
+	Etag       string               `json:"etag,omitempty"`
+	Location   string               `json:"location"`
+	Sku        *sku                 `json:"sku,omitempty"`
+	Properties natGatewayProperties `json:"properties"`
+}
+
+type natGatewayProperties struct {
+	IdleTimeoutInMinutes int32         `json:"idleTimeoutInMinutes,omitempty"`
+	PublicIPAddresses    []subResource `json:"publicIpAddresses,omitempty"`
+	// reported from the subnets
+	Subnets           []subResource `json:"subnets,omitempty"`
+	ProvisioningState string        `json:"provisioningState,omitempty"`
+}
+
+type subnet struct {
+	ID         string           `json:"id"`
+	Name       string           `json:"name"`
+	Etag       string           `json:"etag,omitempty"`
+	Properties subnetProperties `json:"properties"`
+}
+
+type subnetProperties struct {
+	AddressPrefix     string       `json:"addressPrefix"`
+	NatGateway        *subResource `json:"natGateway,omitempty"`
+	ProvisioningState string       `json:"provisioningState,omitempty"`
+}
+
+type vm struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Location   string       `json:"location"`
+	Properties vmProperties `json:"properties"`
+}
+
+type vmProperties struct {
+	VMID           string         `json:"vmId"`
+	NetworkProfile networkProfile `json:"networkProfile"`
+	// the model of the network interfaces of scale set instances, which
+	// are only updated through it
+	NetworkProfileConfiguration *networkProfileConfiguration `json:"networkProfileConfiguration,omitempty"`
+	ProvisioningState           string                       `json:"provisioningState"`
+}
+
+type networkProfile struct {
+	NetworkInterfaces []nicReference `json:"networkInterfaces"`
+}
+
+type nicReference struct {
+	ID         string `json:"id"`
+	Properties struct {
+		Primary bool `json:"primary"`
+	} `json:"properties"`
+}
+
+type networkProfileConfiguration struct {
+	NetworkInterfaceConfigurations []networkInterfaceConfiguration `json:"networkInterfaceConfigurations"`
+}
+
+type networkInterfaceConfiguration struct {
+	Name       string                                  `json:"name"`
+	Properties networkInterfaceConfigurationProperties `json:"properties"`
+}
+
+type networkInterfaceConfigurationProperties struct {
+	Primary          *bool                     `json:"primary,omitempty"`
+	IPConfigurations []scaleSetIPConfiguration `json:"ipConfigurations"`
+}
+
+type scaleSetIPConfiguration struct {
+	Name       string                            `json:"name"`
+	Properties scaleSetIPConfigurationProperties `json:"properties"`
+}
+
+type scaleSetIPConfigurationProperties struct {
+	Primary                         *bool         `json:"primary,omitempty"`
+	Subnet                          *subResource  `json:"subnet,omitempty"`
+	LoadBalancerBackendAddressPools []subResource `json:"loadBalancerBackendAddressPools,omitempty"`
+}
+
+// IPConfiguration is an IP configuration of a network interface as the
+// server holds it.
+type IPConfiguration struct {
+	Name      string
+	PrivateIP string
+	// PublicIP is the name of the public IP associated with the IP
+	// configuration, if any.
+	PublicIP string
+}
+
+// OutboundRule is an outbound rule of a load balancer as the server holds
+// it.
+type OutboundRule struct {
+	Name string
+	// PublicIP is the name of the public IP of the frontend of the rule.
+	PublicIP string
+	// Members are the private IPs of the IP configurations in the backend
+	// pool of the rule.
+	Members []string
+}
+
+type failure struct {
+	method string
+	status int
+}
+
+// Server serves Resource Manager and the Instance Metadata Service of a
+// single VM at URL.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	metadata map[string]string
+	// served instead of metadata when set
+	metadataBody     string
+	metadataDelay    time.Duration
+	metadataFailures []int
+	metadataRequests []*url.URL
+	vms              map[string]*vm
+	nics             map[string]*nic
+	// the network interface of each VM by VM name
+	vmNics    map[string]string
+	publicIPs map[string]*publicIP
+	// public IP prefixes by resource ID
+	publicIPPrefixes map[string]*publicIPPrefix
+	// load balancers, NAT gateways and subnets by resource ID
+	loadBalancers map[string]*loadBalancer
+	natGateways   map[string]*natGateway
+	subnets       map[string]*subnet
+	// polls left until each operation succeeds
+	operations map[string]int
+	polls      int
+	failures   []failure
+	requests   []string
+	// of the last Resource Manager request
+	authorization string
+	// forms of the token requests
+	tokenRequests []url.Values
+	nextIP        int
+	nextOp        int
+}
+
+// NewServer starts a server holding VMName with a primary network interface
+// and no public IPs. Close it when done.
+func NewServer() *Server {
+	s := newServer()
+	s.AddVM(VMName)
+	s.metadata = metadata(VMName, resourceID("Microsoft.Compute/virtualMachines", VMName), "")
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewScaleSetServer starts a server holding instance InstanceID of the
+// uniform scale set ScaleSetName, whose VM is named ScaleSetName_InstanceID,
+// and no public IPs. Close it when done.
+func NewScaleSetServer() *Server {
+	s := newServer()
+	s.AddScaleSetInstance(InstanceID)
+	s.SetMetadataInstance(InstanceID)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func newServer() *Server {
+	return &Server{
+		vms:              make(map[string]*vm),
+		nics:             make(map[string]*nic),
+		vmNics:           make(map[string]string),
+		publicIPs:        make(map[string]*publicIP),
+		publicIPPrefixes: make(map[string]*publicIPPrefix),
+		loadBalancers:    make(map[string]*loadBalancer),
+		natGateways:      make(map[string]*natGateway),
+		subnets: map[string]*subnet{key(SubnetID): {
+			ID:         SubnetID,
+			Name:       path.Base(SubnetID),
+			Etag:       etag(1),
+			Properties: subnetProperties{AddressPrefix: "10.240.0.0/16", ProvisioningState: "Succeeded"},
+		}},
+		operations: make(map[string]int),
+		polls:      1,
+		nextIP:     3,
+	}
+}
+
+func metadata(name string, id string, vmss string) map[string]string {
+	return map[string]string{
+		"azEnvironment":     "AzurePublicCloud",
+		"location":          Location,
+		"name":              name,
+		"resourceGroupName": ResourceGroup,
+		"resourceId":        id,
+		"subscriptionId":    SubscriptionID,
+		"vmId":              name,
+		"vmScaleSetName":    vmss,
+	}
+}
+
+// AddVM adds a VM with a network interface named after it, holding a
+// primary IP configuration.
+func (s *Server) AddVM(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addVM(name, resourceID("Microsoft.Compute/virtualMachines", name),
+		resourceID("Microsoft.Network/networkInterfaces", name+"-nic"))
+}
+
+func (s *Server) addVM(name string, id string, nicID string) {
+	primary := true
+	n := &nic{
+		ID:       nicID,
+		Name:     path.Base(nicID),
+		Etag:     etag(1),
+		Location: Location,
+		Properties: nicProperties{
+			Primary:           &primary,
+			ProvisioningState: "Succeeded",
+		},
+	}
+	n.Properties.IPConfigurations = []ipConfiguration{{
+		ID:   n.ID + "/ipConfigurations/ipconfig1",
+		Name: "ipconfig1",
+		Properties: ipConfigurationProperties{
+			PrivateIPAddress:          s.allocateIP(),
+			PrivateIPAllocationMethod: "Dynamic",
+			Primary:                   &primary,
+			Subnet:                    &subResource{ID: SubnetID},
+			ProvisioningState:         "Succeeded",
+		},
+	}}
+	s.nics[key(n.ID)] = n
+	s.vmNics[name] = key(n.ID)
+
+	v := &vm{
+		ID:       id,
+		Name:     name,
+		Location: Location,
+		Properties: vmProperties{
+			VMID:              name,
+			ProvisioningState: "Succeeded",
+		},
+	}
+	ref := nicReference{ID: n.ID}
+	ref.Properties.Primary = true
+	v.Properties.NetworkProfile.NetworkInterfaces = []nicReference{ref}
+	s.vms[key(v.ID)] = v
+}
+
+// AddScaleSetInstance adds the instance instanceID of ScaleSetName, whose VM
+// is named ScaleSetName_instanceID, with a network interface named after
+// the scale set holding a primary IP configuration.
+func (s *Server) AddScaleSetInstance(instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := scaleSetInstanceID(instanceID)
+	s.addVM(ScaleSetName+"_"+instanceID, id, id+"/networkInterfaces/"+ScaleSetName)
+}
+
+// SetMetadataInstance makes the metadata service describe the instance
+// instanceID of ScaleSetName, added with AddScaleSetInstance, as if the
+// provider ran on it.
+func (s *Server) SetMetadataInstance(instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata = metadata(ScaleSetName+"_"+instanceID, scaleSetInstanceID(instanceID), ScaleSetName)
+}
+
+func scaleSetInstanceID(instanceID string) string {
+	return resourceID("Microsoft.Compute/virtualMachineScaleSets", ScaleSetName) + "/virtualMachines/" + instanceID
+}
+
+// SetMetadataVM makes the metadata service describe the VM vmName, added
+// with AddVM, as if the provider ran on it.
+func (s *Server) SetMetadataVM(vmName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata = metadata(vmName, resourceID("Microsoft.Compute/virtualMachines", vmName), "")
+}
+
+// AddPublicIP adds a static public IP with address.
+func (s *Server) AddPublicIP(name string, address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pip := &publicIP{
+		ID:       resourceID("Microsoft.Network/publicIPAddresses", name),
+		Name:     name,
+		Location: Location,
+		Properties: publicIPProperties{
+			IPAddress:                address,
+			PublicIPAllocationMethod: "Static",
+			ProvisioningState:        "Succeeded",
+		},
+	}
+	s.publicIPs[key(pip.ID)] = pip
+}
+
+// AddOutboundLoadBalancer adds the load balancer lbName with an outbound
+// rule sending the traffic of its backend pool, named after it, out from a
+// public IP of its own, and puts the primary IP configuration of the VM
+// vmName in the pool, as AKS does with the kubernetes load balancer.
+func (s *Server) AddOutboundLoadBalancer(lbName string, vmName string) error {
+	s.AddPublicIP(lbName+"-outbound", "52.0.0.100")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, found := s.nics[s.vmNics[vmName]]
+	if !found {
+		return fmt.Errorf("vm %s is not found", vmName)
+	}
+	id := resourceID("Microsoft.Network/loadBalancers", lbName)
+	frontendID := id + "/frontendIPConfigurations/" + lbName
+	poolID := id + "/backendAddressPools/" + lbName
+	pip := s.publicIPs[key(resourceID("Microsoft.Network/publicIPAddresses", lbName+"-outbound"))]
+	pip.Properties.IPConfiguration = &subResource{ID: frontendID}
+	s.loadBalancers[key(id)] = &loadBalancer{
+		ID:       id,
+		Name:     lbName,
+		Etag:     etag(1),
+		Location: Location,
+		Sku:      &sku{Name: "Standard"},
+		Properties: loadBalancerProperties{
+			FrontendIPConfigurations: []frontendIPConfiguration{{
+				ID:         frontendID,
+				Name:       lbName,
+				Properties: frontendIPConfigurationProperties{PublicIPAddress: &subResource{ID: pip.ID}},
+			}},
+			BackendAddressPools: []backendAddressPool{{ID: poolID, Name: lbName}},
+			OutboundRules: []outboundRule{{
+				ID:   id + "/outboundRules/aksOutboundRule",
+				Name: "aksOutboundRule",
+				Properties: outboundRuleProperties{
+					FrontendIPConfigurations: []subResource{{ID: frontendID}},
+					BackendAddressPool:       &subResource{ID: poolID},
+					Protocol:                 "All",
+				},
+			}},
+			ProvisioningState: "Succeeded",
+		},
+	}
+	for i := range n.Properties.IPConfigurations {
+		ipconfig := &n.Properties.IPConfigurations[i]
+		if ipconfig.Properties.Primary != nil && *ipconfig.Properties.Primary {
+			ipconfig.Properties.LoadBalancerBackendAddressPools = append(ipconfig.Properties.LoadBalancerBackendAddressPools, subResource{ID: poolID})
+		}
+	}
+	return nil
+}
+
+// AddPublicIPPrefix adds a public IP prefix holding the addresses of cidr.
+func (s *Server) AddPublicIPPrefix(name string, cidr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ones, _ := network.Mask.Size()
+	prefix := &publicIPPrefix{
+		ID:       resourceID("Microsoft.Network/publicIPPrefixes", name),
+		Name:     name,
+		Location: Location,
+		Sku:      &sku{Name: "Standard"},
+		Properties: publicIPPrefixProperties{
+			IPPrefix:          network.String(),
+			PrefixLength:      int32(ones),
+			ProvisioningState: "Succeeded",
+		},
+	}
+	s.publicIPPrefixes[key(prefix.ID)] = prefix
+	return nil
+}
+
+// HasPublicIP tells whether the public IP named name exists.
+func (s *Server) HasPublicIP(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.publicIPs[key(resourceID("Microsoft.Network/publicIPAddresses", name))]
+	return found
+}
+
+// Associate associates the public IP with the primary IP configuration of
+// the network interface of vmName, as done outside the operator.
+func (s *Server) Associate(vmName string, publicIPName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, found := s.nics[s.vmNics[vmName]]
+	if !found {
+		return fmt.Errorf("no VM %s", vmName)
+	}
+	pip, found := s.publicIPs[key(resourceID("Microsoft.Network/publicIPAddresses", publicIPName))]
+	if !found {
+		return fmt.Errorf("no public IP %s", publicIPName)
+	}
+	ipconfig := &n.Properties.IPConfigurations[0]
+	ipconfig.Properties.PublicIPAddress = &subResource{ID: pip.ID}
+	pip.Properties.IPConfiguration = &subResource{ID: ipconfig.ID}
+	n.Etag = nextEtag(n.Etag)
+	return nil
+}
+
+// DetachPublicIP takes the public IP off its IP configuration, leaving the
+// IP configuration behind as a daemon that crashed halfway would.
+func (s *Server) DetachPublicIP(publicIPName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pip, found := s.publicIPs[key(resourceID("Microsoft.Network/publicIPAddresses", publicIPName))]
+	if !found || pip.Properties.IPConfiguration == nil {
+		return fmt.Errorf("no associated public IP %s", publicIPName)
+	}
+	for _, n := range s.nics {
+		for i := range n.Properties.IPConfigurations {
+			ipconfig := &n.Properties.IPConfigurations[i]
+			if key(ipconfig.ID) == key(pip.Properties.IPConfiguration.ID) {
+				ipconfig.Properties.PublicIPAddress = nil
+				n.Etag = nextEtag(n.Etag)
+			}
+		}
+	}
+	pip.Properties.IPConfiguration = nil
+	return nil
+}
+
+// NicTags returns the tags of the primary network interface of vmName.
+func (s *Server) NicTags(vmName string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n, found := s.nics[s.vmNics[vmName]]; found {
+		return n.Tags
+	}
+	return nil
+}
+
+// PublicIPTags returns the tags of the public IP named name.
+func (s *Server) PublicIPTags(name string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pip, found := s.publicIPs[key(resourceID("Microsoft.Network/publicIPAddresses", name))]; found {
+		return pip.Tags
+	}
+	return nil
+}
+
+// AddNic adds a secondary network interface named name to vmName, holding
+// a primary IP configuration.
+func (s *Server) AddNic(vmName string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, found := s.nics[s.vmNics[vmName]]
+	if !found {
+		return fmt.Errorf("no VM %s", vmName)
+	}
+	primary, secondary := true, false
+	secondaryNic := &nic{
+		ID:       resourceID("Microsoft.Network/networkInterfaces", name),
+		Name:     name,
+		Etag:     etag(1),
+		Location: Location,
+		Properties: nicProperties{
+			Primary:           &secondary,
+			ProvisioningState: "Succeeded",
+		},
+	}
+	secondaryNic.Properties.IPConfigurations = []ipConfiguration{{
+		ID:   secondaryNic.ID + "/ipConfigurations/ipconfig1",
+		Name: "ipconfig1",
+		Properties: ipConfigurationProperties{
+			PrivateIPAddress:          s.allocateIP(),
+			PrivateIPAllocationMethod: "Dynamic",
+			Primary:                   &primary,
+			Subnet:                    &subResource{ID: SubnetID},
+			ProvisioningState:         "Succeeded",
+		},
+	}}
+	s.nics[key(secondaryNic.ID)] = secondaryNic
+	for _, v := range s.vms {
+		for _, ref := range v.Properties.NetworkProfile.NetworkInterfaces {
+			if key(ref.ID) == key(n.ID) {
+				v.Properties.NetworkProfile.NetworkInterfaces = append(v.Properties.NetworkProfile.NetworkInterfaces, nicReference{ID: secondaryNic.ID})
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no VM holds %s", n.ID)
+}
+
+// IPConfigurations returns the IP configurations of the primary network
+// interface of vmName.
+func (s *Server) IPConfigurations(vmName string) []IPConfiguration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ipConfigurations(s.vmNics[vmName])
+}
+
+// NicIPConfigurations returns the IP configurations of the network interface
+// named name.
+func (s *Server) NicIPConfigurations(name string) []IPConfiguration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ipConfigurations(key(resourceID("Microsoft.Network/networkInterfaces", name)))
+}
+
+func (s *Server) ipConfigurations(nicKey string) []IPConfiguration {
+	n, found := s.nics[nicKey]
+	if !found {
+		return nil
+	}
+	var ipconfigs []IPConfiguration
+	for _, ipconfig := range n.Properties.IPConfigurations {
+		c := IPConfiguration{
+			Name:      ipconfig.Name,
+			PrivateIP: ipconfig.Properties.PrivateIPAddress,
+		}
+		if ref := ipconfig.Properties.PublicIPAddress; ref != nil {
+			if pip, found := s.publicIPs[key(ref.ID)]; found {
+				c.PublicIP = pip.Name
+			}
+		}
+		ipconfigs = append(ipconfigs, c)
+	}
+	return ipconfigs
+}
+
+// OutboundRules returns the outbound rules of the load balancer named
+// lbName, none when it does not exist.
+func (s *Server) OutboundRules(lbName string) []OutboundRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lb, found := s.loadBalancers[key(resourceID("Microsoft.Network/loadBalancers", lbName))]
+	if !found {
+		return nil
+	}
+	var rules []OutboundRule
+	for _, rule := range lb.Properties.OutboundRules {
+		r := OutboundRule{Name: rule.Name}
+		for _, frontend := range lb.Properties.FrontendIPConfigurations {
+			if len(rule.Properties.FrontendIPConfigurations) == 0 || key(frontend.ID) != key(rule.Properties.FrontendIPConfigurations[0].ID) || frontend.Properties.PublicIPAddress == nil {
+				continue
+			}
+			if pip, found := s.publicIPs[key(frontend.Properties.PublicIPAddress.ID)]; found {
+				r.PublicIP = pip.Name
+			}
+		}
+		if rule.Properties.BackendAddressPool != nil {
+			for _, member := range s.poolMembers(rule.Properties.BackendAddressPool.ID) {
+				r.Members = append(r.Members, s.privateIP(member.ID))
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// SubnetNatGateway returns the name of the NAT gateway attached to the
+// subnet SubnetID, if any.
+func (s *Server) SubnetNatGateway() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ref := s.subnets[key(SubnetID)].Properties.NatGateway; ref != nil {
+		return path.Base(ref.ID)
+	}
+	return ""
+}
+
+// NatGatewayPublicIPs returns the names of the public IPs of the NAT gateway
+// named name, and whether it exists.
+func (s *Server) NatGatewayPublicIPs(name string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nat, found := s.natGateways[key(resourceID("Microsoft.Network/natGateways", name))]
+	if !found {
+		return nil, false
+	}
+	var names []string
+	for _, ref := range nat.Properties.PublicIPAddresses {
+		if pip, found := s.publicIPs[key(ref.ID)]; found {
+			names = append(names, pip.Name)
+		}
+	}
+	return names, true
+}
+
+// SetPolls sets the number of times long running operations report being in
+// progress before they succeed.
+func (s *Server) SetPolls(polls int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polls = polls
+}
+
+// FailNext answers the next Resource Manager request with method with
+// status instead of serving it. 429 responses ask to retry after a second.
+// Failures queue up.
+func (s *Server) FailNext(method string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{method: method, status: status})
+}
+
+// FailNextMetadata answers the next request to the metadata service with
+// status instead of serving it. Failures queue up.
+func (s *Server) FailNextMetadata(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadataFailures = append(s.metadataFailures, status)
+}
+
+// SetMetadataBody makes the metadata service answer body as is, such as a
+// truncated or garbled document, instead of describing the VM. An empty
+// body describes the VM again.
+func (s *Server) SetMetadataBody(body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadataBody = body
+}
+
+// SetMetadataDelay makes the metadata service wait for delay, or until the
+// request is canceled, before answering.
+func (s *Server) SetMetadataDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadataDelay = delay
+}
+
+// MetadataRequests returns the URLs of the requests to the metadata service
+// so far.
+func (s *Server) MetadataRequests() []*url.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*url.URL(nil), s.metadataRequests...)
+}
+
+// Requests returns the Resource Manager requests served so far, as method
+// and path.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Authorization returns the Authorization header of the last Resource
+// Manager request.
+func (s *Server) Authorization() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authorization
+}
+
+// TokenRequests returns the forms posted to the token endpoint of Active
+// Directory, which the server also stands in for.
+func (s *Server) TokenRequests() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]url.Values(nil), s.tokenRequests...)
+}
+
+// RequestCount returns the number of requests served with method whose
+// path contains substr.
+func (s *Server) RequestCount(method string, substr string) int {
+	n := 0
+	for _, request := range s.Requests() {
+		if strings.HasPrefix(request, method+" ") && strings.Contains(request, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metadata/instance" {
+		s.serveMetadata(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/oauth2/token") {
+		s.issueToken(w, r)
+		return
+	}
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.authorization = r.Header.Get("Authorization")
+	for i, f := range s.failures {
+		if f.method == r.Method {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			if f.status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			writeError(w, f.status, http.StatusText(f.status), "injected failure")
+			return
+		}
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/operations/") {
+		s.serveOperation(w, r)
+		return
+	}
+
+	id := key(r.URL.Path)
+	switch {
+	case r.Method == http.MethodGet && s.vms[id] != nil:
+		writeJSON(w, http.StatusOK, s.vmView(s.vms[id]))
+	case r.Method == http.MethodPut && s.vms[id] != nil && strings.Contains(id, "/virtualmachinescalesets/"):
+		s.updateInstance(w, r, s.vms[id])
+	case r.Method == http.MethodGet && s.nics[id] != nil:
+		writeJSON(w, http.StatusOK, s.nics[id])
+	case r.Method == http.MethodPut && s.nics[id] != nil && strings.Contains(id, "/virtualmachinescalesets/"):
+		writeError(w, http.StatusBadRequest, "OperationNotAllowed", "network interfaces of scale set instances are updated through the scale set model")
+	case r.Method == http.MethodPut && s.nics[id] != nil:
+		s.updateNic(w, r, s.nics[id])
+	case r.Method == http.MethodGet && s.loadBalancers[id] != nil:
+		writeJSON(w, http.StatusOK, s.loadBalancerView(s.loadBalancers[id]))
+	case r.Method == http.MethodPut && path.Base(path.Dir(id)) == "loadbalancers":
+		s.updateLoadBalancer(w, r, s.loadBalancers[id])
+	case r.Method == http.MethodGet && s.natGateways[id] != nil:
+		writeJSON(w, http.StatusOK, s.natGatewayView(s.natGateways[id]))
+	case r.Method == http.MethodPut && path.Base(path.Dir(id)) == "natgateways":
+		s.updateNatGateway(w, r, s.natGateways[id])
+	case r.Method == http.MethodDelete && s.natGateways[id] != nil:
+		s.deleteNatGateway(w, s.natGateways[id])
+	case r.Method == http.MethodGet && s.subnets[id] != nil:
+		writeJSON(w, http.StatusOK, s.subnets[id])
+	case r.Method == http.MethodPut && s.subnets[id] != nil:
+		s.updateSubnet(w, r, s.subnets[id])
+	case r.Method == http.MethodGet && s.publicIPs[id] != nil:
+		writeJSON(w, http.StatusOK, s.publicIPs[id])
+	case r.Method == http.MethodPut && path.Base(path.Dir(id)) == "publicipaddresses":
+		s.updatePublicIP(w, r, s.publicIPs[id])
+	case r.Method == http.MethodPatch && s.publicIPs[id] != nil:
+		s.updatePublicIPTags(w, r, s.publicIPs[id])
+	case r.Method == http.MethodDelete && s.publicIPs[id] != nil:
+		s.deletePublicIP(w, s.publicIPs[id])
+	case r.Method == http.MethodGet && s.publicIPPrefixes[id] != nil:
+		writeJSON(w, http.StatusOK, s.publicIPPrefixView(s.publicIPPrefixes[id]))
+	case r.Method == http.MethodGet && path.Base(id) == "publicipaddresses":
+		s.listPublicIPs(w, path.Dir(path.Dir(path.Dir(id))))
+	case r.Method == http.MethodGet && path.Base(id) == "networkinterfaces":
+		s.listNics(w, path.Dir(path.Dir(path.Dir(id))))
+	default:
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("%s %s is not found", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	u := *r.URL
+	s.metadataRequests = append(s.metadataRequests, &u)
+	delay := s.metadataDelay
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if r.Header.Get("Metadata") != "True" {
+		http.Error(w, "Required metadata header not specified", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.metadataFailures) > 0 {
+		status := s.metadataFailures[0]
+		s.metadataFailures = s.metadataFailures[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if s.metadataBody != "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(s.metadataBody))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"compute": s.metadata, "network": s.metadataNetwork()})
+}
+
+// metadataNetwork describes the IP configurations of the NICs of the VM of
+// the metadata service, the primary NIC first.
+func (s *Server) metadataNetwork() map[string]interface{} {
+	interfaces := []interface{}{}
+	v, found := s.vms[key(s.metadata["resourceId"])]
+	if !found {
+		return map[string]interface{}{"interface": interfaces}
+	}
+	refs := append([]nicReference(nil), v.Properties.NetworkProfile.NetworkInterfaces...)
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].Properties.Primary && !refs[j].Properties.Primary
+	})
+	for _, ref := range refs {
+		n, found := s.nics[key(ref.ID)]
+		if !found {
+			continue
+		}
+		addrs := []interface{}{}
+		for _, ipconfig := range n.Properties.IPConfigurations {
+			public := ""
+			if ipconfig.Properties.PublicIPAddress != nil {
+				if pip, found := s.publicIPs[key(ipconfig.Properties.PublicIPAddress.ID)]; found {
+					public = pip.Properties.IPAddress
+				}
+			}
+			addrs = append(addrs, map[string]string{
+				"privateIpAddress": ipconfig.Properties.PrivateIPAddress,
+				"publicIpAddress":  public,
+			})
+		}
+		interfaces = append(interfaces, map[string]interface{}{
+			"ipv4": map[string]interface{}{"ipAddress": addrs},
+		})
+	}
+	return map[string]interface{}{"interface": interfaces}
+}
+
+// issueToken answers any client credentials with a token.
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	s.tokenRequests = append(s.tokenRequests, r.PostForm)
+	now := time.Now()
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": fmt.Sprintf("token-%d", len(s.tokenRequests)),
+		"expires_in":   "3600",
+		"expires_on":   strconv.FormatInt(now.Add(time.Hour).Unix(), 10),
+		"not_before":   strconv.FormatInt(now.Unix(), 10),
+		"resource":     r.PostForm.Get("resource"),
+		"token_type":   "Bearer",
+	})
+}
+
+func (s *Server) serveOperation(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/operations/")
+	polls, found := s.operations[id]
+	if !found {
+		writeError(w, http.StatusNotFound, "OperationNotFound", fmt.Sprintf("operation %s is not found", id))
+		return
+	}
+	w.Header().Set("Retry-After", "0")
+	if polls > 0 {
+		s.operations[id] = polls - 1
+		writeJSON(w, http.StatusOK, map[string]string{"status": "InProgress"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "Succeeded"})
+}
+
+func (s *Server) listPublicIPs(w http.ResponseWriter, group string) {
+	var ids []string
+	for id := range s.publicIPs {
+		if strings.HasPrefix(id, group+"/") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	pips := make([]*publicIP, 0, len(ids))
+	for _, id := range ids {
+		pips = append(pips, s.publicIPs[id])
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": pips})
+}
+
+func (s *Server) listNics(w http.ResponseWriter, group string) {
+	var ids []string
+	for id := range s.nics {
+		if strings.HasPrefix(id, group+"/providers/microsoft.network/") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	nics := make([]*nic, 0, len(ids))
+	for _, id := range ids {
+		nics = append(nics, s.nics[id])
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": nics})
+}
+
+// updatePublicIPTags replaces the tags of pip.
+func (s *Server) updatePublicIPTags(w http.ResponseWriter, r *http.Request, pip *publicIP) {
+	var update struct {
+		Tags map[string]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	pip.Tags = update.Tags
+	writeJSON(w, http.StatusOK, pip)
+}
+
+// updateNic replaces the IP configurations of n, allocating private IPs to
+// new ones and keeping the public IPs pointing at their IP configuration,
+// and starts an operation to poll for completion. Updates conditional on
+// another ETag than the one of n fail.
+func (s *Server) updateNic(w http.ResponseWriter, r *http.Request, n *nic) {
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != n.Etag {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed",
+			fmt.Sprintf("%s has ETag %s, not %s", n.ID, n.Etag, match))
+		return
+	}
+
+	var update nic
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+
+	owners := make(map[string]string)
+	for _, ipconfig := range update.Properties.IPConfigurations {
+		ref := ipconfig.Properties.PublicIPAddress
+		if ref == nil {
+			continue
+		}
+		pip, found := s.publicIPs[key(ref.ID)]
+		if !found {
+			writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("public IP %s is not found", ref.ID))
+			return
+		}
+		ipconfigID := n.ID + "/ipConfigurations/" + ipconfig.Name
+		if owner := pip.Properties.IPConfiguration; owner != nil && !strings.HasPrefix(key(owner.ID), key(n.ID)+"/") {
+			writeError(w, http.StatusBadRequest, "PublicIPAddressInUse",
+				fmt.Sprintf("public IP %s is in use by %s", pip.ID, owner.ID))
+			return
+		}
+		if owner := pip.Properties.NatGateway; owner != nil {
+			writeError(w, http.StatusBadRequest, "PublicIPAddressInUse",
+				fmt.Sprintf("public IP %s is in use by %s", pip.ID, owner.ID))
+			return
+		}
+		if other, found := owners[key(pip.ID)]; found {
+			writeError(w, http.StatusBadRequest, "PublicIPAddressInUse",
+				fmt.Sprintf("public IP %s is referenced by %s and %s", pip.ID, other, ipconfigID))
+			return
+		}
+		owners[key(pip.ID)] = ipconfigID
+	}
+	for _, ipconfig := range update.Properties.IPConfigurations {
+		if !s.checkBackendPools(w, ipconfig.Name, ipconfig.Properties.LoadBalancerBackendAddressPools) {
+			return
+		}
+	}
+
+	for _, pip := range s.publicIPs {
+		if owner := pip.Properties.IPConfiguration; owner != nil && strings.HasPrefix(key(owner.ID), key(n.ID)+"/") {
+			pip.Properties.IPConfiguration = nil
+		}
+	}
+	ipconfigs := make([]ipConfiguration, 0, len(update.Properties.IPConfigurations))
+	for _, ipconfig := range update.Properties.IPConfigurations {
+		ipconfig.ID = n.ID + "/ipConfigurations/" + ipconfig.Name
+		if ipconfig.Properties.PrivateIPAddress == "" {
+			ipconfig.Properties.PrivateIPAddress = s.allocateIP()
+		}
+		if ref := ipconfig.Properties.PublicIPAddress; ref != nil {
+			pip := s.publicIPs[key(ref.ID)]
+			ipconfig.Properties.PublicIPAddress = &subResource{ID: pip.ID}
+			pip.Properties.IPConfiguration = &subResource{ID: ipconfig.ID}
+		}
+		if ipconfig.Properties.Subnet != nil {
+			ipconfig.Properties.Subnet = &subResource{ID: ipconfig.Properties.Subnet.ID}
+		}
+		ipconfig.Properties.ProvisioningState = "Succeeded"
+		ipconfigs = append(ipconfigs, ipconfig)
+	}
+	n.Properties.IPConfigurations = ipconfigs
+	n.Tags = update.Tags
+	n.Etag = nextEtag(n.Etag)
+
+	s.startOperation(w)
+	updating := *n
+	updating.Properties.ProvisioningState = "Updating"
+	writeJSON(w, http.StatusOK, &updating)
+}
+
+// checkBackendPools answers with an error unless the IP configuration named
+// ipconfigName can be in pools, which must exist and include the pool of a
+// single outbound rule at most.
+func (s *Server) checkBackendPools(w http.ResponseWriter, ipconfigName string, pools []subResource) bool {
+	outbound := 0
+	for _, pool := range pools {
+		if !s.poolExists(pool.ID) {
+			writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("backend address pool %s is not found", pool.ID))
+			return false
+		}
+		if s.outboundPool(pool.ID) {
+			outbound++
+		}
+	}
+	if outbound > 1 {
+		writeError(w, http.StatusBadRequest, "MultipleOutboundRulesForIPConfiguration",
+			fmt.Sprintf("ip configuration %s is in the backend pools of %d outbound rules", ipconfigName, outbound))
+		return false
+	}
+	return true
+}
+
+// vmView returns v, with the model of its network interfaces when it is a
+// scale set instance.
+func (s *Server) vmView(v *vm) *vm {
+	if !strings.Contains(key(v.ID), "/virtualmachinescalesets/") {
+		return v
+	}
+	view := *v
+	config := &networkProfileConfiguration{}
+	for _, ref := range v.Properties.NetworkProfile.NetworkInterfaces {
+		n, found := s.nics[key(ref.ID)]
+		if !found {
+			continue
+		}
+		c := networkInterfaceConfiguration{Name: n.Name}
+		c.Properties.Primary = n.Properties.Primary
+		for _, ipconfig := range n.Properties.IPConfigurations {
+			c.Properties.IPConfigurations = append(c.Properties.IPConfigurations, scaleSetIPConfiguration{
+				Name: ipconfig.Name,
+				Properties: scaleSetIPConfigurationProperties{
+					Primary:                         ipconfig.Properties.Primary,
+					Subnet:                          ipconfig.Properties.Subnet,
+					LoadBalancerBackendAddressPools: ipconfig.Properties.LoadBalancerBackendAddressPools,
+				},
+			})
+		}
+		config.NetworkInterfaceConfigurations = append(config.NetworkInterfaceConfigurations, c)
+	}
+	view.Properties.NetworkProfileConfiguration = config
+	return &view
+}
+
+// updateInstance applies the backend pools of the model of the network
+// interfaces of the scale set instance v to them, and starts an operation
+// to poll for completion. Network interfaces and IP configurations cannot
+// be added or removed.
+func (s *Server) updateInstance(w http.ResponseWriter, r *http.Request, v *vm) {
+	var update vm
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	config := update.Properties.NetworkProfileConfiguration
+	if config == nil {
+		writeError(w, http.StatusBadRequest, "InvalidParameter", "networkProfileConfiguration is missing")
+		return
+	}
+
+	pools := make(map[*ipConfiguration][]subResource)
+	for _, c := range config.NetworkInterfaceConfigurations {
+		n, found := s.nics[key(v.ID+"/networkInterfaces/"+c.Name)]
+		if !found {
+			writeError(w, http.StatusBadRequest, "InvalidParameter", fmt.Sprintf("network interface %s of %s is not found", c.Name, v.ID))
+			return
+		}
+		for _, update := range c.Properties.IPConfigurations {
+			var ipconfig *ipConfiguration
+			for i := range n.Properties.IPConfigurations {
+				if n.Properties.IPConfigurations[i].Name == update.Name {
+					ipconfig = &n.Properties.IPConfigurations[i]
+				}
+			}
+			if ipconfig == nil {
+				writeError(w, http.StatusBadRequest, "InvalidParameter", fmt.Sprintf("ip configuration %s of %s is not found", update.Name, n.ID))
+				return
+			}
+			if !s.checkBackendPools(w, update.Name, update.Properties.LoadBalancerBackendAddressPools) {
+				return
+			}
+			pools[ipconfig] = update.Properties.LoadBalancerBackendAddressPools
+		}
+	}
+	for ipconfig, p := range pools {
+		ipconfig.Properties.LoadBalancerBackendAddressPools = p
+	}
+	for _, ref := range v.Properties.NetworkProfile.NetworkInterfaces {
+		if n, found := s.nics[key(ref.ID)]; found {
+			n.Etag = nextEtag(n.Etag)
+		}
+	}
+
+	s.startOperation(w)
+	updating := *s.vmView(v)
+	updating.Properties.ProvisioningState = "Updating"
+	writeJSON(w, http.StatusOK, &updating)
+}
+
+// updateLoadBalancer creates or replaces a load balancer, pointing the public
+// IPs of its frontends at them, and starts an operation to poll for
+// completion. Updates conditional on another ETag than the one of lb fail.
+func (s *Server) updateLoadBalancer(w http.ResponseWriter, r *http.Request, lb *loadBalancer) {
+	if match := r.Header.Get("If-Match"); lb != nil && match != "" && match != "*" && match != lb.Etag {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed",
+			fmt.Sprintf("%s has ETag %s, not %s", lb.ID, lb.Etag, match))
+		return
+	}
+
+	var update loadBalancer
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	if update.Sku == nil || !strings.EqualFold(update.Sku.Name, "Standard") {
+		writeError(w, http.StatusBadRequest, "OutboundRulesNotSupported", "outbound rules need a Standard load balancer")
+		return
+	}
+	id := strings.TrimSuffix(r.URL.Path, "/")
+	update.ID, update.Name = id, path.Base(id)
+	update.Etag = etag(1)
+	if lb != nil {
+		update.Etag = nextEtag(lb.Etag)
+	}
+
+	frontends := make(map[string]string)
+	for i := range update.Properties.FrontendIPConfigurations {
+		frontend := &update.Properties.FrontendIPConfigurations[i]
+		frontend.ID = id + "/frontendIPConfigurations/" + frontend.Name
+		if ref := frontend.Properties.PublicIPAddress; ref != nil {
+			pip, found := s.publicIPs[key(ref.ID)]
+			if !found {
+				writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("public IP %s is not found", ref.ID))
+				return
+			}
+			if owner := pip.Properties.IPConfiguration; owner != nil && !strings.HasPrefix(key(owner.ID), key(id)+"/") {
+				writeError(w, http.StatusBadRequest, "PublicIPAddressInUse",
+					fmt.Sprintf("public IP %s is in use by %s", pip.ID, owner.ID))
+				return
+			}
+			frontends[key(frontend.ID)] = pip.ID
+		}
+	}
+	pools := make(map[string]bool)
+	for i := range update.Properties.BackendAddressPools {
+		pool := &update.Properties.BackendAddressPools[i]
+		pool.ID = id + "/backendAddressPools/" + pool.Name
+		pool.Properties.BackendIPConfigurations = nil
+		pools[key(pool.ID)] = true
+	}
+	for i := range update.Properties.OutboundRules {
+		rule := &update.Properties.OutboundRules[i]
+		rule.ID = id + "/outboundRules/" + rule.Name
+		for _, frontend := range rule.Properties.FrontendIPConfigurations {
+			if _, found := frontends[key(frontend.ID)]; !found {
+				writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("frontend IP configuration %s is not found", frontend.ID))
+				return
+			}
+		}
+		if pool := rule.Properties.BackendAddressPool; pool == nil || !pools[key(pool.ID)] {
+			writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("backend address pool of outbound rule %s is not found", rule.Name))
+			return
+		}
+	}
+
+	for _, pip := range s.publicIPs {
+		if owner := pip.Properties.IPConfiguration; owner != nil && strings.HasPrefix(key(owner.ID), key(id)+"/") {
+			pip.Properties.IPConfiguration = nil
+		}
+	}
+	for frontendID, pipID := range frontends {
+		pip := s.publicIPs[key(pipID)]
+		for _, frontend := range update.Properties.FrontendIPConfigurations {
+			if key(frontend.ID) == frontendID {
+				frontend.Properties.PublicIPAddress.ID = pip.ID
+				pip.Properties.IPConfiguration = &subResource{ID: frontend.ID}
+			}
+		}
+	}
+	update.Properties.ProvisioningState = "Succeeded"
+	s.loadBalancers[key(id)] = &update
+
+	s.startOperation(w)
+	updating := s.loadBalancerView(&update)
+	updating.Properties.ProvisioningState = "Updating"
+	writeJSON(w, http.StatusOK, updating)
+}
+
+// loadBalancerView returns a copy of lb reporting the members of its backend
+// pools.
+func (s *Server) loadBalancerView(lb *loadBalancer) *loadBalancer {
+	view := *lb
+	view.Properties.BackendAddressPools = nil
+	for _, pool := range lb.Properties.BackendAddressPools {
+		pool.Properties.BackendIPConfigurations = s.poolMembers(pool.ID)
+		view.Properties.BackendAddressPools = append(view.Properties.BackendAddressPools, pool)
+	}
+	return &view
+}
+
+// poolMembers returns the IP configurations in the backend pool with ID
+// poolID, ordered by ID.
+func (s *Server) poolMembers(poolID string) []subResource {
+	var members []subResource
+	for _, n := range s.nics {
+		for _, ipconfig := range n.Properties.IPConfigurations {
+			for _, pool := range ipconfig.Properties.LoadBalancerBackendAddressPools {
+				if key(pool.ID) == key(poolID) {
+					members = append(members, subResource{ID: ipconfig.ID})
+				}
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// outboundPool returns whether the backend pool with ID poolID is the one
+// of an outbound rule.
+func (s *Server) outboundPool(poolID string) bool {
+	lb, found := s.loadBalancers[key(path.Dir(path.Dir(poolID)))]
+	if !found {
+		return false
+	}
+	for _, rule := range lb.Properties.OutboundRules {
+		if rule.Properties.BackendAddressPool != nil && key(rule.Properties.BackendAddressPool.ID) == key(poolID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) poolExists(poolID string) bool {
+	lb, found := s.loadBalancers[key(path.Dir(path.Dir(poolID)))]
+	if !found {
+		return false
+	}
+	for _, pool := range lb.Properties.BackendAddressPools {
+		if key(pool.ID) == key(poolID) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateIP returns the private IP of the IP configuration with ID
+// ipconfigID.
+func (s *Server) privateIP(ipconfigID string) string {
+	for _, n := range s.nics {
+		for _, ipconfig := range n.Properties.IPConfigurations {
+			if key(ipconfig.ID) == key(ipconfigID) {
+				return ipconfig.Properties.PrivateIPAddress
+			}
+		}
+	}
+	return ""
+}
+
+// updateNatGateway creates or replaces a NAT gateway, pointing its public
+// IPs at it.
+func (s *Server) updateNatGateway(w http.ResponseWriter, r *http.Request, nat *natGateway) {
+	var update natGateway
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	id := strings.TrimSuffix(r.URL.Path, "/")
+	update.ID, update.Name = id, path.Base(id)
+	update.Etag = etag(1)
+	if nat != nil {
+		update.Etag = nextEtag(nat.Etag)
+	}
+	for i, ref := range update.Properties.PublicIPAddresses {
+		pip, found := s.publicIPs[key(ref.ID)]
+		if !found {
+			writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("public IP %s is not found", ref.ID))
+			return
+		}
+		if owner := pip.Properties.IPConfiguration; owner != nil {
+			writeError(w, http.StatusBadRequest, "PublicIPAddressInUse", fmt.Sprintf("public IP %s is in use by %s", pip.ID, owner.ID))
+			return
+		}
+		if owner := pip.Properties.NatGateway; owner != nil && key(owner.ID) != key(id) {
+			writeError(w, http.StatusBadRequest, "PublicIPAddressInUse", fmt.Sprintf("public IP %s is in use by %s", pip.ID, owner.ID))
+			return
+		}
+		update.Properties.PublicIPAddresses[i] = subResource{ID: pip.ID}
+	}
+
+	for _, pip := range s.publicIPs {
+		if owner := pip.Properties.NatGateway; owner != nil && key(owner.ID) == key(id) {
+			pip.Properties.NatGateway = nil
+		}
+	}
+	for _, ref := range update.Properties.PublicIPAddresses {
+		s.publicIPs[key(ref.ID)].Properties.NatGateway = &subResource{ID: id}
+	}
+	update.Properties.Subnets = nil
+	update.Properties.ProvisioningState = "Succeeded"
+	s.natGateways[key(id)] = &update
+	s.startOperation(w)
+	updating := s.natGatewayView(&update)
+	updating.Properties.ProvisioningState = "Updating"
+	writeJSON(w, http.StatusOK, updating)
+}
+
+// deleteNatGateway deletes a NAT gateway no subnet is attached to.
+func (s *Server) deleteNatGateway(w http.ResponseWriter, nat *natGateway) {
+	if subnets := s.natGatewayView(nat).Properties.Subnets; len(subnets) > 0 {
+		writeError(w, http.StatusBadRequest, "InUseNatGatewayCannotBeDeleted",
+			fmt.Sprintf("%s is in use by %s", nat.ID, subnets[0].ID))
+		return
+	}
+	for _, pip := range s.publicIPs {
+		if owner := pip.Properties.NatGateway; owner != nil && key(owner.ID) == key(nat.ID) {
+			pip.Properties.NatGateway = nil
+		}
+	}
+	delete(s.natGateways, key(nat.ID))
+	s.startOperation(w)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// natGatewayView returns a copy of nat reporting the subnets attached to it.
+func (s *Server) natGatewayView(nat *natGateway) *natGateway {
+	view := *nat
+	view.Properties.Subnets = nil
+	for _, sn := range s.subnets {
+		if ref := sn.Properties.NatGateway; ref != nil && key(ref.ID) == key(nat.ID) {
+			view.Properties.Subnets = append(view.Properties.Subnets, subResource{ID: sn.ID})
+		}
+	}
+	return &view
+}
+
+// updateSubnet replaces the NAT gateway of a subnet. Updates conditional on
+// another ETag than the one of sn fail.
+func (s *Server) updateSubnet(w http.ResponseWriter, r *http.Request, sn *subnet) {
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != sn.Etag {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed",
+			fmt.Sprintf("%s has ETag %s, not %s", sn.ID, sn.Etag, match))
+		return
+	}
+	var update subnet
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	if ref := update.Properties.NatGateway; ref != nil {
+		nat, found := s.natGateways[key(ref.ID)]
+		if !found {
+			writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("nat gateway %s is not found", ref.ID))
+			return
+		}
+		sn.Properties.NatGateway = &subResource{ID: nat.ID}
+	} else {
+		sn.Properties.NatGateway = nil
+	}
+	sn.Etag = nextEtag(sn.Etag)
+	s.startOperation(w)
+	writeJSON(w, http.StatusOK, sn)
+}
+
+// updatePublicIP creates a Standard public IP, allocating its address from
+// the public IP prefix it references. Existing public IPs are left as they
+// are.
+func (s *Server) updatePublicIP(w http.ResponseWriter, r *http.Request, pip *publicIP) {
+	if pip != nil {
+		s.startOperation(w)
+		writeJSON(w, http.StatusOK, pip)
+		return
+	}
+	var update publicIP
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	ref := update.Properties.PublicIPPrefix
+	if ref == nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", "public IPs are only created from a public IP prefix")
+		return
+	}
+	prefix, found := s.publicIPPrefixes[key(ref.ID)]
+	if !found {
+		writeError(w, http.StatusBadRequest, "InvalidResourceReference", fmt.Sprintf("public IP prefix %s is not found", ref.ID))
+		return
+	}
+	if update.Sku == nil || update.Sku.Name != "Standard" {
+		writeError(w, http.StatusBadRequest, "PublicIPAndPublicIpPrefixSkuMismatch", "public IPs of a public IP prefix must be Standard ones")
+		return
+	}
+	if update.Location != prefix.Location {
+		writeError(w, http.StatusBadRequest, "PublicIPPrefixLocationMismatch", fmt.Sprintf("public IP prefix %s is in %s", prefix.ID, prefix.Location))
+		return
+	}
+	address := s.allocatePublicIP(prefix)
+	if address == "" {
+		writeError(w, http.StatusBadRequest, "PublicIpPrefixOutOfIpAddressesForPublicIp", fmt.Sprintf("public IP prefix %s has no address left", prefix.ID))
+		return
+	}
+
+	id := strings.TrimSuffix(r.URL.Path, "/")
+	pip = &publicIP{
+		ID:       id,
+		Name:     path.Base(id),
+		Location: update.Location,
+		Sku:      update.Sku,
+		Properties: publicIPProperties{
+			IPAddress:                address,
+			PublicIPAllocationMethod: "Static",
+			PublicIPPrefix:           &subResource{ID: prefix.ID},
+			ProvisioningState:        "Succeeded",
+		},
+	}
+	s.publicIPs[key(id)] = pip
+	s.startOperation(w)
+	writeJSON(w, http.StatusCreated, pip)
+}
+
+// allocatePublicIP returns the first address of prefix no public IP holds,
+// or "" when there is none left.
+func (s *Server) allocatePublicIP(prefix *publicIPPrefix) string {
+	taken := make(map[string]bool)
+	for _, pip := range s.publicIPs {
+		taken[pip.Properties.IPAddress] = true
+	}
+	_, network, _ := net.ParseCIDR(prefix.Properties.IPPrefix)
+	for ip := network.IP.To4(); network.Contains(ip); ip = nextIP(ip) {
+		if !taken[ip.String()] {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// deletePublicIP deletes a public IP nothing uses.
+func (s *Server) deletePublicIP(w http.ResponseWriter, pip *publicIP) {
+	for _, owner := range []*subResource{pip.Properties.IPConfiguration, pip.Properties.NatGateway} {
+		if owner != nil {
+			writeError(w, http.StatusBadRequest, "PublicIPAddressCannotBeDeleted",
+				fmt.Sprintf("%s is in use by %s", pip.ID, owner.ID))
+			return
+		}
+	}
+	for _, lb := range s.loadBalancers {
+		for _, frontend := range lb.Properties.FrontendIPConfigurations {
+			if ref := frontend.Properties.PublicIPAddress; ref != nil && key(ref.ID) == key(pip.ID) {
+				writeError(w, http.StatusBadRequest, "PublicIPAddressCannotBeDeleted",
+					fmt.Sprintf("%s is in use by %s", pip.ID, lb.ID))
+				return
+			}
+		}
+	}
+	delete(s.publicIPs, key(pip.ID))
+	s.startOperation(w)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// publicIPPrefixView returns a copy of prefix reporting the public IPs
+// allocated from it.
+func (s *Server) publicIPPrefixView(prefix *publicIPPrefix) *publicIPPrefix {
+	view := *prefix
+	view.Properties.PublicIPAddresses = nil
+	for _, pip := range s.publicIPs {
+		if ref := pip.Properties.PublicIPPrefix; ref != nil && key(ref.ID) == key(prefix.ID) {
+			view.Properties.PublicIPAddresses = append(view.Properties.PublicIPAddresses, subResource{ID: pip.ID})
+		}
+	}
+	return &view
+}
+
+// startOperation starts an operation to poll for completion and points the
+// response at it.
+func (s *Server) startOperation(w http.ResponseWriter) {
+	s.nextOp++
+	op := strconv.Itoa(s.nextOp)
+	s.operations[op] = s.polls
+	w.Header().Set("Azure-AsyncOperation", s.URL+"/operations/"+op)
+	w.Header().Set("Retry-After", "0")
+}
+
+// allocateIP returns the next private IP of the subnet.
+func (s *Server) allocateIP() string {
+	s.nextIP++
+	return fmt.Sprintf("10.240.%d.%d", s.nextIP/256, s.nextIP%256)
+}
+
+func etag(version int) string {
+	return fmt.Sprintf("W/\"%d\"", version)
+}
+
+// nextEtag returns the ETag following current, which are weak version
+// numbers.
+func nextEtag(current string) string {
+	version, _ := strconv.Atoi(strings.Trim(strings.TrimPrefix(current, "W/"), "\""))
+	return etag(version + 1)
+}
+
+func resourceID(resourceType string, name string) string {
+	return "/subscriptions/" + SubscriptionID + "/resourceGroups/" + ResourceGroup +
+		"/providers/" + resourceType + "/" + name
+}
+
+// key returns the key of a resource ID, which are case insensitive.
+func key(id string) string {
+	return strings.ToLower(strings.TrimSuffix(id, "/"))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
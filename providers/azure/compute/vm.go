@@ -10,6 +10,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 	"github.com/yingeli/egress-ip-operator/providers/azure/network"
@@ -22,6 +23,7 @@ func getVMClient() compute.VirtualMachinesClient {
 	a, _ := iam.GetResourceManagementAuthorizer()
 	vmClient.Authorizer = a
 	vmClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&vmClient.Client)
 	return vmClient
 }
 
@@ -30,6 +32,7 @@ func getVMExtensionsClient() compute.VirtualMachineExtensionsClient {
 	a, _ := iam.GetResourceManagementAuthorizer()
 	extClient.Authorizer = a
 	extClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&extClient.Client)
 	return extClient
 }
 
@@ -2,15 +2,17 @@ package compute
 
 import (
 	"context"
-	//"fmt"
+	"fmt"
 	//"regexp"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
 	//"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 	//"github.com/yingeli/egress-ip-operator/gateway/azpip/network"
-	//"github.com/Azure/go-autorest/autorest/to"
 	//"honnef.co/go/tools/config"
 )
 
@@ -21,6 +23,7 @@ func getVMSSVMsClient() compute.VirtualMachineScaleSetVMsClient {
 	a, _ := iam.GetResourceManagementAuthorizer()
 	vmsClient.Authorizer = a
 	vmsClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&vmsClient.Client)
 	return vmsClient
 }
 
@@ -30,6 +33,101 @@ func GetVMSSVM(ctx context.Context, vmssName string, instanceId string) (vmssvm
 	return vmsClient.Get(ctx, config.GroupName(), vmssName, instanceId, compute.InstanceView)
 }
 
+// UpdateVMSSVM puts the model of the VMSS VM back, which is how the network
+// interfaces of instances of uniform scale sets change.
+func UpdateVMSSVM(ctx context.Context, vmssName string, instanceId string, vm compute.VirtualMachineScaleSetVM) (compute.VirtualMachineScaleSetVM, error) {
+	vmsClient := getVMSSVMsClient()
+	future, err := vmsClient.Update(ctx, config.GroupName(), vmssName, instanceId, vm)
+	if err != nil {
+		return vm, fmt.Errorf("cannot update vmss vm: %v", err)
+	}
+
+	err = future.WaitForCompletionRef(ctx, vmsClient.Client)
+	if err != nil {
+		return vm, fmt.Errorf("cannot get the vmss vm update future response: %v", err)
+	}
+
+	return future.Result(vmsClient)
+}
+
+// ModifyVMSSVM reads the model of the VMSS VM, applies change and puts it
+// back when change reports it changed.
+func ModifyVMSSVM(ctx context.Context, vmssName string, instanceId string, change func(*compute.VirtualMachineScaleSetVM) (bool, error)) (compute.VirtualMachineScaleSetVM, error) {
+	vmsClient := getVMSSVMsClient()
+	vm, err := vmsClient.Get(ctx, config.GroupName(), vmssName, instanceId, "")
+	if err != nil {
+		return vm, fmt.Errorf("GetVMSSVM error: %v", err)
+	}
+	changed, err := change(&vm)
+	if err != nil || !changed {
+		return vm, err
+	}
+	return UpdateVMSSVM(ctx, vmssName, instanceId, vm)
+}
+
+// SetVMSSVMBackendPool puts the IP configuration ipconfigName of the network
+// interface nicName of vm in the backend pool with ID poolID. It reports
+// whether vm changed.
+func SetVMSSVMBackendPool(vm *compute.VirtualMachineScaleSetVM, nicName string, ipconfigName string, poolID string) (bool, error) {
+	ipconfig, found := vmssVMIPConfiguration(vm, nicName, ipconfigName)
+	if !found {
+		return false, fmt.Errorf("cannot find ip configuration %s of nic %s in the model of vmss vm %s", ipconfigName, nicName, to.String(vm.Name))
+	}
+	pools := []compute.SubResource{}
+	if ipconfig.LoadBalancerBackendAddressPools != nil {
+		for _, pool := range *ipconfig.LoadBalancerBackendAddressPools {
+			if pool.ID != nil && strings.EqualFold(*pool.ID, poolID) {
+				return false, nil
+			}
+			pools = append(pools, compute.SubResource{ID: pool.ID})
+		}
+	}
+	pools = append(pools, compute.SubResource{ID: to.StringPtr(poolID)})
+	ipconfig.LoadBalancerBackendAddressPools = &pools
+	return true, nil
+}
+
+// RemoveVMSSVMBackendPools takes the IP configuration ipconfigName of the
+// network interface nicName of vm out of the backend pools whose ID starts
+// with poolPrefix. It reports whether vm changed.
+func RemoveVMSSVMBackendPools(vm *compute.VirtualMachineScaleSetVM, nicName string, ipconfigName string, poolPrefix string) bool {
+	ipconfig, found := vmssVMIPConfiguration(vm, nicName, ipconfigName)
+	if !found || ipconfig.LoadBalancerBackendAddressPools == nil {
+		return false
+	}
+	changed := false
+	pools := []compute.SubResource{}
+	for _, pool := range *ipconfig.LoadBalancerBackendAddressPools {
+		if pool.ID != nil && len(*pool.ID) >= len(poolPrefix) && strings.EqualFold((*pool.ID)[:len(poolPrefix)], poolPrefix) {
+			changed = true
+			continue
+		}
+		pools = append(pools, compute.SubResource{ID: pool.ID})
+	}
+	ipconfig.LoadBalancerBackendAddressPools = &pools
+	return changed
+}
+
+// vmssVMIPConfiguration returns the IP configuration ipconfigName of the
+// network interface nicName in the model of vm. Network interfaces of
+// instances are named after their configuration in the model.
+func vmssVMIPConfiguration(vm *compute.VirtualMachineScaleSetVM, nicName string, ipconfigName string) (*compute.VirtualMachineScaleSetIPConfigurationProperties, bool) {
+	if vm.VirtualMachineScaleSetVMProperties == nil || vm.NetworkProfileConfiguration == nil || vm.NetworkProfileConfiguration.NetworkInterfaceConfigurations == nil {
+		return nil, false
+	}
+	for _, nic := range *vm.NetworkProfileConfiguration.NetworkInterfaceConfigurations {
+		if !strings.EqualFold(to.String(nic.Name), nicName) || nic.VirtualMachineScaleSetNetworkConfigurationProperties == nil || nic.IPConfigurations == nil {
+			continue
+		}
+		for i, ipconfig := range *nic.IPConfigurations {
+			if strings.EqualFold(to.String(ipconfig.Name), ipconfigName) && ipconfig.VirtualMachineScaleSetIPConfigurationProperties != nil {
+				return (*nic.IPConfigurations)[i].VirtualMachineScaleSetIPConfigurationProperties, true
+			}
+		}
+	}
+	return nil, false
+}
+
 /*
 // AssociateVMWithPublicIP attach public IP to VM. If public IP is already attached to VM, it will be detached by removing the ip configutation
 func AssociateVMSSVMWithPublicIP(ctx context.Context, vmName string, address string) (privateIPAddress string, err error) {
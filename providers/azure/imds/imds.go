@@ -1,62 +1,276 @@
+// Package imds reads the metadata of the VM from the Instance Metadata
+// Service.
 package imds
 
 import (
-	//"fmt"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
-type Metadata struct {
-	Compute Compute
+// DefaultEndpoint is the endpoint of the Instance Metadata Service on Azure
+// VMs.
+const DefaultEndpoint = "http://169.254.169.254"
+
+// APIVersion of the instance metadata, the first one with the zone and the
+// network of the VM as they are read here.
+const APIVersion = "2021-02-01"
+
+const (
+	DefaultTimeout    = 5 * time.Second
+	DefaultAttempts   = 5
+	DefaultRetryDelay = time.Second
+	DefaultMaxAge     = time.Minute
+
+	maxRetryDelay = 30 * time.Second
+	// metadata documents are a few kilobytes
+	maxBodySize = 1 << 20
+)
+
+// retryStatusCodes are retried, as the service answers 410 while the VM
+// starts and 429 when it is called too often.
+var retryStatusCodes = map[int]bool{
+	http.StatusGone:                true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
 }
 
-//func (metadata *Metadata) Compute() *Compute {
-//	return &metadata.compute
-//}
+type Metadata struct {
+	Compute Compute `json:"compute"`
+	Network Network `json:"network"`
+}
 
 type Compute struct {
-	AzEnvironment     string
-	Name              string
-	ResourceGroupName string
-	ResourceId        string
-	SubscriptionId    string
-	VmId              string
-	VmScaleSetName    string
+	AzEnvironment     string `json:"azEnvironment"`
+	Location          string `json:"location"`
+	Name              string `json:"name"`
+	ResourceGroupName string `json:"resourceGroupName"`
+	ResourceId        string `json:"resourceId"`
+	SubscriptionId    string `json:"subscriptionId"`
+	VmId              string `json:"vmId"`
+	VmScaleSetName    string `json:"vmScaleSetName"`
+	// Zone is empty for VMs outside availability zones.
+	Zone string `json:"zone"`
 }
 
-//func (compute *Compute) AzEnvironment() string {
-//	return compute.AzEnvironment
-//}
+type Network struct {
+	Interfaces []Interface `json:"interface"`
+}
 
-func GetMetadata() (Metadata, error) {
-	var PTransport = &http.Transport{Proxy: nil}
+// Interface is a network interface of the VM, in the order of the NICs of
+// the VM, the primary one first.
+type Interface struct {
+	IPv4       IPAddresses `json:"ipv4"`
+	IPv6       IPAddresses `json:"ipv6"`
+	MacAddress string      `json:"macAddress"`
+}
 
-	client := http.Client{Transport: PTransport}
+type IPAddresses struct {
+	IPAddresses []IPAddress `json:"ipAddress"`
+	Subnets     []Subnet    `json:"subnet"`
+}
 
-	req, _ := http.NewRequest("GET", "http://169.254.169.254/metadata/instance", nil)
-	req.Header.Add("Metadata", "True")
+// IPAddress is an IP configuration of an interface. PublicIPAddress is
+// empty when it has no public IP.
+type IPAddress struct {
+	PrivateIPAddress string `json:"privateIpAddress"`
+	PublicIPAddress  string `json:"publicIpAddress"`
+}
+
+type Subnet struct {
+	Address string `json:"address"`
+	Prefix  string `json:"prefix"`
+}
 
+// InterfaceOf returns the interface holding the private IP privateIPAddr.
+func (n Network) InterfaceOf(privateIPAddr string) (Interface, bool) {
+	for _, iface := range n.Interfaces {
+		for _, addrs := range []IPAddresses{iface.IPv4, iface.IPv6} {
+			for _, addr := range addrs.IPAddresses {
+				if addr.PrivateIPAddress == privateIPAddr {
+					return iface, true
+				}
+			}
+		}
+	}
+	return Interface{}, false
+}
+
+// PublicIPAddresses returns the public IPs of the VM by the private IP they
+// are associated with.
+func (n Network) PublicIPAddresses() map[string]string {
+	addrs := make(map[string]string)
+	for _, iface := range n.Interfaces {
+		for _, a := range []IPAddresses{iface.IPv4, iface.IPv6} {
+			for _, addr := range a.IPAddresses {
+				if addr.PublicIPAddress != "" {
+					addrs[addr.PrivateIPAddress] = addr.PublicIPAddress
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// Client reads the metadata of the VM from the service at Endpoint. Zero
+// fields take their default value.
+type Client struct {
+	Endpoint string
+	// Timeout bounds every attempt.
+	Timeout time.Duration
+	// Attempts bounds the tries of a read. Retries wait for RetryDelay,
+	// doubled on every retry.
+	Attempts   int
+	RetryDelay time.Duration
+	// MaxAge is how long metadata is reused before it is read again.
+	MaxAge time.Duration
+
+	once       sync.Once
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	metadata Metadata
+	read     time.Time
+}
+
+// NewClient returns a client of the service at endpoint, DefaultEndpoint
+// when empty.
+func NewClient(endpoint string) *Client {
+	return &Client{Endpoint: endpoint}
+}
+
+// GetMetadata returns the metadata of the VM, read again when older than
+// MaxAge.
+func (c *Client) GetMetadata(ctx context.Context) (Metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.read.IsZero() && time.Since(c.read) < c.maxAge() {
+		return c.metadata, nil
+	}
+	metadata, err := c.readMetadata(ctx)
+	if err != nil {
+		return metadata, err
+	}
+	c.metadata, c.read = metadata, time.Now()
+	return metadata, nil
+}
+
+func (c *Client) readMetadata(ctx context.Context) (Metadata, error) {
+	attempts := c.Attempts
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		metadata, retry, err := c.tryReadMetadata(ctx)
+		if err == nil || !retry || attempt >= attempts || ctx.Err() != nil {
+			return metadata, err
+		}
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-ctx.Done():
+			return metadata, fmt.Errorf("%v, last error: %v", ctx.Err(), err)
+		}
+	}
+}
+
+// tryReadMetadata reads the metadata once, returning whether a failure is
+// worth retrying.
+func (c *Client) tryReadMetadata(ctx context.Context) (Metadata, bool, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/metadata/instance", nil)
+	if err != nil {
+		return Metadata{}, false, err
+	}
+	req.Header.Add("Metadata", "True")
 	q := req.URL.Query()
 	q.Add("format", "json")
-	q.Add("api-version", "2019-03-11")
+	q.Add("api-version", APIVersion)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := client.Do(req)
+	resp, err := c.client().Do(req)
 	if err != nil {
-		return Metadata{}, err
+		return Metadata{}, true, err
 	}
-
 	defer resp.Body.Close()
-	resp_body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
 	if err != nil {
-		return Metadata{}, err
+		return Metadata{}, true, fmt.Errorf("cannot read metadata: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Metadata{}, retryStatusCodes[resp.StatusCode], fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
 	}
 
-	//fmt.Println(string(resp_body))
-
-	metadata := Metadata{}
-	json.Unmarshal(resp_body, &metadata)
+	metadata, err := decode(body)
+	return metadata, false, err
+}
 
+// decode parses a metadata document, which must describe a VM.
+func decode(body []byte) (Metadata, error) {
+	var metadata Metadata
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return Metadata{}, fmt.Errorf("cannot decode metadata: %v", err)
+	}
+	compute := metadata.Compute
+	for _, field := range []struct{ name, value string }{
+		{"name", compute.Name},
+		{"resourceGroupName", compute.ResourceGroupName},
+		{"resourceId", compute.ResourceId},
+		{"subscriptionId", compute.SubscriptionId},
+	} {
+		if field.value == "" {
+			return Metadata{}, fmt.Errorf("metadata has no compute %s", field.name)
+		}
+	}
 	return metadata, nil
 }
+
+// client does not go through proxies, which cannot reach the link local
+// address of the service.
+func (c *Client) client() *http.Client {
+	c.once.Do(func() {
+		c.httpClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+	})
+	return c.httpClient
+}
+
+// backoff returns the delay before retry attempt, with jitter.
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (c *Client) maxAge() time.Duration {
+	if c.MaxAge > 0 {
+		return c.MaxAge
+	}
+	return DefaultMaxAge
+}
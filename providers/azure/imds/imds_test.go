@@ -0,0 +1,188 @@
+package imds
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yingeli/egress-ip-operator/providers/azure/azuretest"
+)
+
+// testMetadata holds the fields the stand-in of the service leaves out.
+const testMetadata = `{
+	"compute": {
+		"azEnvironment": "AzurePublicCloud",
+		"location": "westus2",
+		"name": "vm-1",
+		"resourceGroupName": "rg",
+		"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-1",
+		"subscriptionId": "sub",
+		"vmId": "id",
+		"zone": "2",
+		"tags": "unused"
+	},
+	"network": {
+		"interface": [{
+			"ipv4": {
+				"ipAddress": [
+					{"privateIpAddress": "10.240.0.4", "publicIpAddress": ""},
+					{"privateIpAddress": "10.240.0.5", "publicIpAddress": "20.0.0.1"}
+				],
+				"subnet": [{"address": "10.240.0.0", "prefix": "16"}]
+			},
+			"ipv6": {"ipAddress": []},
+			"macAddress": "000D3AF806EC"
+		}]
+	}
+}`
+
+func newTestServer(t *testing.T) *azuretest.Server {
+	s := azuretest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testClient(s *azuretest.Server) *Client {
+	return &Client{Endpoint: s.URL, RetryDelay: 10 * time.Millisecond}
+}
+
+func TestGetMetadata(t *testing.T) {
+	s := newTestServer(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	if err := s.Associate(azuretest.VMName, "eip-1"); err != nil {
+		t.Fatal(err)
+	}
+	privateIP := s.IPConfigurations(azuretest.VMName)[0].PrivateIP
+
+	metadata, err := testClient(s).GetMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	compute := metadata.Compute
+	if compute.Name != azuretest.VMName || compute.Location != azuretest.Location || compute.ResourceGroupName != azuretest.ResourceGroup || compute.SubscriptionId != azuretest.SubscriptionID {
+		t.Errorf("compute %+v, want %s in %s of %s", compute, azuretest.VMName, azuretest.ResourceGroup, azuretest.Location)
+	}
+	if _, found := metadata.Network.InterfaceOf(privateIP); !found {
+		t.Errorf("no interface of %s in %+v", privateIP, metadata.Network)
+	}
+	if addrs := metadata.Network.PublicIPAddresses(); len(addrs) != 1 || addrs[privateIP] != "20.0.0.1" {
+		t.Errorf("public IPs %v, want 20.0.0.1 on %s", addrs, privateIP)
+	}
+
+	u := s.MetadataRequests()[0]
+	if u.Query().Get("api-version") != APIVersion || u.Query().Get("format") != "json" || u.Path != "/metadata/instance" {
+		t.Errorf("request %s", u)
+	}
+
+	s.SetMetadataBody(testMetadata)
+	c := testClient(s)
+	metadata, err = c.GetMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Compute.Zone != "2" {
+		t.Errorf("zone %q, want 2", metadata.Compute.Zone)
+	}
+	iface, found := metadata.Network.InterfaceOf("10.240.0.5")
+	if !found || iface.MacAddress != "000D3AF806EC" || len(iface.IPv4.Subnets) != 1 {
+		t.Errorf("interface of 10.240.0.5 %+v, %v", iface, found)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	s := newTestServer(t)
+	s.FailNextMetadata(http.StatusGone)
+	s.FailNextMetadata(http.StatusTooManyRequests)
+	s.FailNextMetadata(http.StatusInternalServerError)
+	if _, err := testClient(s).GetMetadata(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.MetadataRequests()); n != 4 {
+		t.Errorf("%d requests, want 4", n)
+	}
+
+	s = newTestServer(t)
+	s.FailNextMetadata(http.StatusBadRequest)
+	if _, err := testClient(s).GetMetadata(context.Background()); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("error %v, want the status", err)
+	}
+	if n := len(s.MetadataRequests()); n != 1 {
+		t.Errorf("%d requests, want a bad request not to be retried", n)
+	}
+
+	s = newTestServer(t)
+	s.FailNextMetadata(http.StatusServiceUnavailable)
+	s.FailNextMetadata(http.StatusServiceUnavailable)
+	c := testClient(s)
+	c.Attempts = 2
+	if _, err := c.GetMetadata(context.Background()); err == nil {
+		t.Error("no error after the last attempt failed")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.SetMetadataDelay(time.Minute)
+
+	c := &Client{Endpoint: s.URL, Timeout: 50 * time.Millisecond, Attempts: 2, RetryDelay: 10 * time.Millisecond}
+	start := time.Now()
+	if _, err := c.GetMetadata(context.Background()); err == nil {
+		t.Fatal("no error from a service that does not answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+	if n := len(s.MetadataRequests()); n != 2 {
+		t.Errorf("%d requests, want every attempt to time out", n)
+	}
+
+	// a late answer within the timeout is fine
+	s.SetMetadataDelay(20 * time.Millisecond)
+	c = &Client{Endpoint: s.URL, Timeout: time.Second, Attempts: 1}
+	if _, err := c.GetMetadata(context.Background()); err != nil {
+		t.Errorf("error %v from a slow service", err)
+	}
+}
+
+func TestInvalidMetadata(t *testing.T) {
+	tests := []struct {
+		body string
+		err  string
+	}{
+		{`{"compute": {`, "cannot decode metadata"},
+		{`<html>Bad Gateway</html>`, "cannot decode metadata"},
+		{`{"compute": {"name": 1}}`, "cannot decode metadata"},
+		{`{"compute": {"resourceGroupName": "rg", "resourceId": "id", "subscriptionId": "sub"}}`, "no compute name"},
+		{`{"compute": {"name": "vm-1", "resourceId": "id", "subscriptionId": "sub"}}`, "no compute resourceGroupName"},
+	}
+	for _, test := range tests {
+		s := newTestServer(t)
+		s.SetMetadataBody(test.body)
+		if _, err := testClient(s).GetMetadata(context.Background()); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("metadata %s: error %v, want %q", test.body, err, test.err)
+		}
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	s := newTestServer(t)
+	c := testClient(s)
+	c.MaxAge = 50 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetMetadata(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(s.MetadataRequests()); n != 1 {
+		t.Errorf("%d requests, want the metadata reused", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.GetMetadata(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.MetadataRequests()); n != 2 {
+		t.Errorf("%d requests, want the metadata read again", n)
+	}
+}
@@ -0,0 +1,51 @@
+package arm
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "egressip_arm_requests_total",
+		Help: "Requests sent to Azure Resource Manager by method, resource type and status code.",
+	}, []string{"method", "resource", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "egressip_arm_request_duration_seconds",
+		Help:    "Latency of the requests sent to Azure Resource Manager.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "resource"})
+
+	throttles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "egressip_arm_throttled_requests_total",
+		Help: "Requests Azure Resource Manager answered with 429 Too Many Requests.",
+	}, []string{"method", "resource"})
+
+	rateLimitWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "egressip_arm_rate_limit_wait_seconds",
+		Help:    "Time requests to Azure Resource Manager waited for the rate limit of their subscription.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(requests, requestDuration, throttles, rateLimitWait)
+}
+
+// observe records a request, code being error when it got no response.
+func observe(method string, resource string, resp *http.Response, err error, duration time.Duration) {
+	code := "error"
+	if err == nil && resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	requests.WithLabelValues(method, resource, code).Inc()
+	requestDuration.WithLabelValues(method, resource).Observe(duration.Seconds())
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		throttles.WithLabelValues(method, resource).Inc()
+	}
+}
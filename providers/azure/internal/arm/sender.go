@@ -0,0 +1,221 @@
+// Package arm sends the Resource Manager requests of every client of the
+// provider through a single sender, which rate limits them per subscription,
+// retries the throttled and failed ones and records metrics.
+package arm
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"golang.org/x/time/rate"
+)
+
+// Options of the requests to Resource Manager. Zero fields take the value
+// of DefaultOptions.
+type Options struct {
+	// RequestsPerSecond and Burst size the token bucket of each
+	// subscription, shared by retries and polls of long running operations.
+	RequestsPerSecond float64
+	Burst             int
+	// Attempts bounds the tries of a request.
+	Attempts int
+	// RetryDelay is the delay before retrying a request that failed without
+	// a Retry-After, doubled on every retry up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// DefaultOptions keep a node well under the limits Resource Manager puts on
+// a subscription, which all the nodes of a cluster share.
+var DefaultOptions = Options{
+	RequestsPerSecond: 5,
+	Burst:             10,
+	Attempts:          3,
+	RetryDelay:        time.Second,
+	MaxRetryDelay:     time.Minute,
+}
+
+// retryStatusCodes are retried. Resource Manager answers 409 while another
+// operation is in progress on the resource.
+var retryStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusConflict,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+var (
+	mu       sync.Mutex
+	options  = DefaultOptions
+	limiters = make(map[string]*rate.Limiter)
+
+	httpSender = autorest.CreateSender()
+)
+
+// SetOptions sets the options of the requests sent from now on.
+func SetOptions(o Options) {
+	if o.RequestsPerSecond == 0 {
+		o.RequestsPerSecond = DefaultOptions.RequestsPerSecond
+	}
+	if o.Burst == 0 {
+		o.Burst = DefaultOptions.Burst
+	}
+	if o.Attempts == 0 {
+		o.Attempts = DefaultOptions.Attempts
+	}
+	if o.RetryDelay == 0 {
+		o.RetryDelay = DefaultOptions.RetryDelay
+	}
+	if o.MaxRetryDelay == 0 {
+		o.MaxRetryDelay = DefaultOptions.MaxRetryDelay
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	options = o
+	limiters = make(map[string]*rate.Limiter)
+}
+
+// Configure makes client send its requests through the shared sender, which
+// takes over retries from the SendDecorators of the client.
+func Configure(client *autorest.Client) {
+	mu.Lock()
+	defer mu.Unlock()
+	client.Sender = sender{}
+	client.SendDecorators = []autorest.SendDecorator{}
+	// polls of long running operations that fail are retried by the
+	// client
+	client.RetryAttempts = options.Attempts
+	client.RetryDuration = options.RetryDelay
+}
+
+// limiter returns the options and the token bucket of subscription.
+func limiter(subscription string) (Options, *rate.Limiter) {
+	mu.Lock()
+	defer mu.Unlock()
+	l, found := limiters[subscription]
+	if !found {
+		l = rate.NewLimiter(rate.Limit(options.RequestsPerSecond), options.Burst)
+		limiters[subscription] = l
+	}
+	return options, l
+}
+
+type sender struct{}
+
+func (sender) Do(r *http.Request) (*http.Response, error) {
+	o, l := limiter(subscription(r.URL.Path))
+	resource := resourceType(r.URL.Path)
+	ctx := r.Context()
+	rr := autorest.NewRetriableRequest(r)
+	for attempt := 1; ; attempt++ {
+		if err := rr.Prepare(); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		if err := l.Wait(ctx); err != nil {
+			return nil, err
+		}
+		rateLimitWait.Observe(time.Since(start).Seconds())
+
+		start = time.Now()
+		resp, err := httpSender.Do(rr.Request())
+		observe(r.Method, resource, resp, err, time.Since(start))
+		if attempt >= o.Attempts || ctx.Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+
+		delay, found := retryAfter(resp)
+		if !found {
+			delay = backoff(o, attempt)
+		}
+		autorest.DrainResponseBody(resp)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return autorest.ResponseHasStatusCode(resp, retryStatusCodes...)
+}
+
+// retryAfter returns the delay a response asks for, in seconds or as a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// backoff returns the delay before retry attempt, with jitter so that the
+// nodes throttled together do not retry together.
+func backoff(o Options, attempt int) time.Duration {
+	delay := o.RetryDelay
+	for i := 1; i < attempt && delay < o.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxRetryDelay {
+		delay = o.MaxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// subscription returns the lower case subscription ID of a Resource Manager
+// path, empty when it has none.
+func subscription(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 1 && strings.EqualFold(segments[0], "subscriptions") {
+		return strings.ToLower(segments[1])
+	}
+	return ""
+}
+
+// resourceType returns the type of the resource a Resource Manager path is
+// about, such as networkInterfaces, to label metrics with.
+func resourceType(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	last := -1
+	for i, segment := range segments {
+		if strings.EqualFold(segment, "providers") {
+			last = i
+		}
+	}
+	if last < 0 || last+2 >= len(segments) {
+		return "other"
+	}
+	// types and names of nested resources alternate after the namespace
+	types := segments[last+2:]
+	t := types[0]
+	for i := 2; i < len(types); i += 2 {
+		t = types[i]
+	}
+	return t
+}
@@ -0,0 +1,187 @@
+package arm
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const nicPath = "/subscriptions/SUB-1/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/nic"
+
+// testServer answers requests with the statuses queued, then 200.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	headers  []http.Header
+	requests []time.Time
+	bodies   []string
+}
+
+func newTestServer(t *testing.T, statuses ...int) *testServer {
+	s := &testServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests = append(s.requests, time.Now())
+		s.bodies = append(s.bodies, string(body))
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status = s.statuses[0]
+			s.statuses = s.statuses[1:]
+		}
+		if len(s.headers) > 0 {
+			for name, values := range s.headers[0] {
+				w.Header()[name] = values
+			}
+			s.headers = s.headers[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) requestTimes() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.requests...)
+}
+
+func testClient(t *testing.T, o Options) autorest.Client {
+	SetOptions(o)
+	t.Cleanup(func() { SetOptions(Options{}) })
+	client := autorest.NewClientWithUserAgent("test")
+	Configure(&client)
+	return client
+}
+
+func send(t *testing.T, client autorest.Client, url string, body string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.Send(req)
+}
+
+func TestRetries(t *testing.T) {
+	s := newTestServer(t, http.StatusInternalServerError, http.StatusConflict)
+	client := testClient(t, Options{RetryDelay: 10 * time.Millisecond})
+	failures := testutil.ToFloat64(requests.WithLabelValues(http.MethodPut, "networkInterfaces", "500"))
+
+	resp, err := send(t, client, s.URL+nicPath, "nic")
+	if err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want 200", resp.StatusCode)
+	}
+	// the body goes with every try
+	if len(s.bodies) != 3 || s.bodies[2] != "nic" {
+		t.Errorf("bodies %q, want nic 3 times", s.bodies)
+	}
+	if n := testutil.ToFloat64(requests.WithLabelValues(http.MethodPut, "networkInterfaces", "500")); n != failures+1 {
+		t.Errorf("%v failures counted, want %v", n, failures+1)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	s := newTestServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	client := testClient(t, Options{Attempts: 2, RetryDelay: 10 * time.Millisecond})
+
+	resp, err := send(t, client, s.URL+nicPath, "")
+	if err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", resp.StatusCode)
+	}
+	if n := len(s.requestTimes()); n != 2 {
+		t.Errorf("%d tries, want 2", n)
+	}
+
+	// other failures are not retried
+	s = newTestServer(t, http.StatusBadRequest)
+	if resp, _ := send(t, client, s.URL+nicPath, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", resp.StatusCode)
+	}
+	if n := len(s.requestTimes()); n != 1 {
+		t.Errorf("%d tries, want 1", n)
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	s := newTestServer(t, http.StatusTooManyRequests)
+	s.headers = []http.Header{{"Retry-After": []string{"1"}}}
+	client := testClient(t, Options{RetryDelay: 10 * time.Millisecond})
+	throttled := testutil.ToFloat64(throttles.WithLabelValues(http.MethodPut, "networkInterfaces"))
+
+	if _, err := send(t, client, s.URL+nicPath, ""); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	times := s.requestTimes()
+	if len(times) != 2 {
+		t.Fatalf("%d tries, want 2", len(times))
+	}
+	if wait := times[1].Sub(times[0]); wait < time.Second {
+		t.Errorf("retried after %v, want the second Retry-After asks for", wait)
+	}
+	if n := testutil.ToFloat64(throttles.WithLabelValues(http.MethodPut, "networkInterfaces")); n != throttled+1 {
+		t.Errorf("%v throttles counted, want %v", n, throttled+1)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	client := testClient(t, Options{RequestsPerSecond: 20, Burst: 1})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := send(t, client, s.URL+nicPath, ""); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("5 requests took %v, want at least 200ms at 20 per second", elapsed)
+	}
+
+	// subscriptions have buckets of their own
+	if _, l := limiter("sub-2"); !l.Allow() {
+		t.Errorf("request of another subscription rate limited")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	o := Options{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second}
+	for i, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := backoff(o, i+1); delay < max/2 || delay > max {
+			t.Errorf("backoff of attempt %d %v, want between %v and %v", i+1, delay, max/2, max)
+		}
+	}
+}
+
+func TestResourceType(t *testing.T) {
+	for path, want := range map[string]string{
+		nicPath: "networkInterfaces",
+		"/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/0/networkInterfaces/nic": "networkInterfaces",
+		"/subscriptions/s/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses":                                                    "publicIPAddresses",
+		"/subscriptions/s/providers/Microsoft.Network/locations/eastus/operations/1":                                                          "operations",
+		"/subscriptions/s/resourceGroups/rg": "other",
+	} {
+		if got := resourceType(path); got != want {
+			t.Errorf("resourceType(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
@@ -27,6 +27,13 @@ var (
 	baseGroupName          string
 	userAgent              string
 	environment            *azure.Environment
+	// overrides the endpoint of the cloud, to talk to a stand-in
+	resourceManagerEndpoint   string
+	authMethod                string
+	clientCertificatePath     string
+	clientCertificatePassword string
+	federatedTokenFile        string
+	authorityHost             string
 )
 
 // ClientID is the OAuth client ID.
@@ -68,6 +75,39 @@ func AuthorizationServerURL() string {
 	return authorizationServerURL
 }
 
+// AuthMethod is the method to authenticate with, picked from the
+// credentials available when empty.
+func AuthMethod() string {
+	return authMethod
+}
+
+func SetAuthMethod(method string) {
+	authMethod = method
+}
+
+// ClientCertificatePath is the PEM or PKCS#12 file holding the certificate
+// and private key of a service principal.
+func ClientCertificatePath() string {
+	return clientCertificatePath
+}
+
+// ClientCertificatePassword decrypts a PKCS#12 ClientCertificatePath.
+func ClientCertificatePassword() string {
+	return clientCertificatePassword
+}
+
+// FederatedTokenFile is the file workload identity projects the service
+// account token of the pod to.
+func FederatedTokenFile() string {
+	return federatedTokenFile
+}
+
+// AuthorityHost overrides the Active Directory endpoint of the cloud for
+// workload identity.
+func AuthorityHost() string {
+	return authorityHost
+}
+
 // UseDeviceFlow() specifies if interactive auth should be used. Interactive
 // auth uses the OAuth Device Flow grant type.
 func UseDeviceFlow() bool {
@@ -115,10 +155,20 @@ func Environment() *azure.Environment {
 		panic(fmt.Sprintf(
 			"invalid cloud name '%s' specified, cannot continue\n", cloudName))
 	}
+	if resourceManagerEndpoint != "" {
+		env.ResourceManagerEndpoint = resourceManagerEndpoint
+	}
 	environment = &env
 	return environment
 }
 
+// SetResourceManagerEndpoint overrides the Resource Manager endpoint of the
+// cloud.
+func SetResourceManagerEndpoint(endpoint string) {
+	resourceManagerEndpoint = endpoint
+	environment = nil
+}
+
 // GenerateGroupName leverages BaseGroupName() to return a more detailed name,
 // helping to avoid collisions.  It appends each of the `affixes` to
 // BaseGroupName() separated by dashes, and adds a 5-character random string.
@@ -142,6 +192,9 @@ func AppendRandomSuffix(prefix string) string {
 }
 
 func SetGroup(cloud string, subscription string, group string) {
+	if cloud != cloudName {
+		environment = nil
+	}
 	cloudName = cloud
 	subscriptionID = subscription
 	groupName = group
@@ -42,5 +42,12 @@ func ParseEnvironment() error {
 	// subscriptionID (ARM)
 	subscriptionID = os.Getenv("AZURE_SUBSCRIPTION_ID")
 
+	// optional, depending on the auth method
+	clientCertificatePath = os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH")
+	clientCertificatePassword = os.Getenv("AZURE_CLIENT_CERTIFICATE_PASSWORD")
+	// set by the workload identity webhook
+	federatedTokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	authorityHost = os.Getenv("AZURE_AUTHORITY_HOST")
+
 	return nil
 }
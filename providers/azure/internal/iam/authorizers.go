@@ -32,14 +32,66 @@ const (
 	OAuthGrantTypeServicePrincipal OAuthGrantType = iota
 	// OAuthGrantTypeDeviceFlow for device flow
 	OAuthGrantTypeDeviceFlow
+	// OAuthGrantTypeCertificate for client credentials flow with a
+	// certificate
+	OAuthGrantTypeCertificate
+	// OAuthGrantTypeManagedIdentity for the managed identity of the VM
+	OAuthGrantTypeManagedIdentity
+	// OAuthGrantTypeWorkloadIdentity for client credentials flow with a
+	// federated service account token
+	OAuthGrantTypeWorkloadIdentity
+	// OAuthGrantTypeNone sends no credentials, for stand-ins of Azure
+	OAuthGrantTypeNone
 )
 
-// GrantType returns what grant type has been configured.
-func grantType() OAuthGrantType {
-	if config.UseDeviceFlow() {
-		return OAuthGrantTypeDeviceFlow
+// auth methods of config.AuthMethod
+const (
+	AuthMethodServicePrincipal = "servicePrincipal"
+	AuthMethodCertificate      = "certificate"
+	AuthMethodManagedIdentity  = "managedIdentity"
+	AuthMethodWorkloadIdentity = "workloadIdentity"
+	AuthMethodNone             = "none"
+)
+
+// GrantType returns what grant type has been configured, picking it from
+// the credentials available when no auth method is.
+func grantType() (OAuthGrantType, error) {
+	switch config.AuthMethod() {
+	case "":
+		switch {
+		case config.UseDeviceFlow():
+			return OAuthGrantTypeDeviceFlow, nil
+		case config.FederatedTokenFile() != "":
+			return OAuthGrantTypeWorkloadIdentity, nil
+		case config.ClientSecret() != "":
+			return OAuthGrantTypeServicePrincipal, nil
+		case config.ClientCertificatePath() != "":
+			return OAuthGrantTypeCertificate, nil
+		default:
+			return OAuthGrantTypeManagedIdentity, nil
+		}
+	case AuthMethodServicePrincipal:
+		return OAuthGrantTypeServicePrincipal, nil
+	case AuthMethodCertificate:
+		return OAuthGrantTypeCertificate, nil
+	case AuthMethodManagedIdentity:
+		return OAuthGrantTypeManagedIdentity, nil
+	case AuthMethodWorkloadIdentity:
+		return OAuthGrantTypeWorkloadIdentity, nil
+	case AuthMethodNone:
+		return OAuthGrantTypeNone, nil
+	default:
+		return 0, fmt.Errorf("unknown auth method %q", config.AuthMethod())
 	}
-	return OAuthGrantTypeServicePrincipal
+}
+
+// ResetAuthorizers drops the authorizers made so far, so that the next ones
+// are made from the current configuration.
+func ResetAuthorizers() {
+	armAuthorizer = nil
+	batchAuthorizer = nil
+	graphAuthorizer = nil
+	keyvaultAuthorizer = nil
 }
 
 // GetResourceManagementAuthorizer gets an OAuthTokenAuthorizer for Azure Resource Manager
@@ -51,8 +103,7 @@ func GetResourceManagementAuthorizer() (autorest.Authorizer, error) {
 	var a autorest.Authorizer
 	var err error
 
-	a, err = getAuthorizerForResource(
-		grantType(), config.Environment().ResourceManagerEndpoint)
+	a, err = getAuthorizerForResource(config.Environment().ResourceManagerEndpoint)
 
 	if err == nil {
 		// cache
@@ -73,8 +124,7 @@ func GetBatchAuthorizer() (autorest.Authorizer, error) {
 	var a autorest.Authorizer
 	var err error
 
-	a, err = getAuthorizerForResource(
-		grantType(), config.Environment().BatchManagementEndpoint)
+	a, err = getAuthorizerForResource(config.Environment().BatchManagementEndpoint)
 
 	if err == nil {
 		// cache
@@ -96,7 +146,7 @@ func GetGraphAuthorizer() (autorest.Authorizer, error) {
 	var a autorest.Authorizer
 	var err error
 
-	a, err = getAuthorizerForResource(grantType(), config.Environment().GraphEndpoint)
+	a, err = getAuthorizerForResource(config.Environment().GraphEndpoint)
 
 	if err == nil {
 		// cache
@@ -123,9 +173,12 @@ func GetKeyvaultAuthorizer() (autorest.Authorizer, error) {
 		"https://login.windows.net/" + config.TenantID() + "/oauth2/token")
 
 	var a autorest.Authorizer
-	var err error
+	grantType, err := grantType()
+	if err != nil {
+		return a, err
+	}
 
-	switch grantType() {
+	switch grantType {
 	case OAuthGrantTypeServicePrincipal:
 		oauthconfig, err := adal.NewOAuthConfig(
 			config.Environment().ActiveDirectoryEndpoint, config.TenantID())
@@ -160,13 +213,19 @@ func GetKeyvaultAuthorizer() (autorest.Authorizer, error) {
 	return keyvaultAuthorizer, err
 }
 
-func getAuthorizerForResource(grantType OAuthGrantType, resource string) (autorest.Authorizer, error) {
+func getAuthorizerForResource(resource string) (autorest.Authorizer, error) {
 	var a autorest.Authorizer
-	var err error
+	grantType, err := grantType()
+	if err != nil {
+		return nil, err
+	}
 
 	switch grantType {
 
 	case OAuthGrantTypeServicePrincipal:
+		if config.ClientID() == "" || config.TenantID() == "" || config.ClientSecret() == "" {
+			return nil, fmt.Errorf("auth method %s requires AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_CLIENT_SECRET", AuthMethodServicePrincipal)
+		}
 		oauthConfig, err := adal.NewOAuthConfig(
 			config.Environment().ActiveDirectoryEndpoint, config.TenantID())
 		if err != nil {
@@ -188,6 +247,60 @@ func getAuthorizerForResource(grantType OAuthGrantType, resource string) (autore
 			return nil, err
 		}
 
+	case OAuthGrantTypeCertificate:
+		if config.ClientID() == "" || config.TenantID() == "" || config.ClientCertificatePath() == "" {
+			return nil, fmt.Errorf("auth method %s requires AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_CLIENT_CERTIFICATE_PATH", AuthMethodCertificate)
+		}
+		certificate, privateKey, err := loadCertificate(config.ClientCertificatePath(), config.ClientCertificatePassword())
+		if err != nil {
+			return nil, err
+		}
+		oauthConfig, err := adal.NewOAuthConfig(
+			config.Environment().ActiveDirectoryEndpoint, config.TenantID())
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := adal.NewServicePrincipalTokenFromCertificate(
+			*oauthConfig, config.ClientID(), certificate, privateKey, resource)
+		if err != nil {
+			return nil, err
+		}
+		a = autorest.NewBearerAuthorizer(token)
+
+	case OAuthGrantTypeManagedIdentity:
+		// the client ID picks a user-assigned identity, the system-assigned
+		// one is used otherwise
+		options := &adal.ManagedIdentityOptions{ClientID: config.ClientID()}
+		token, err := adal.NewServicePrincipalTokenFromManagedIdentity(resource, options)
+		if err != nil {
+			return nil, fmt.Errorf("auth method %s: %v", AuthMethodManagedIdentity, err)
+		}
+		a = autorest.NewBearerAuthorizer(token)
+
+	case OAuthGrantTypeWorkloadIdentity:
+		if config.ClientID() == "" || config.TenantID() == "" || config.FederatedTokenFile() == "" {
+			return nil, fmt.Errorf("auth method %s requires AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE", AuthMethodWorkloadIdentity)
+		}
+		authorityHost := config.AuthorityHost()
+		if authorityHost == "" {
+			authorityHost = config.Environment().ActiveDirectoryEndpoint
+		}
+		oauthConfig, err := adal.NewOAuthConfig(authorityHost, config.TenantID())
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := adal.NewServicePrincipalTokenWithSecret(
+			*oauthConfig, config.ClientID(), resource, &federatedTokenSecret{path: config.FederatedTokenFile()})
+		if err != nil {
+			return nil, err
+		}
+		a = autorest.NewBearerAuthorizer(token)
+
+	case OAuthGrantTypeNone:
+		a = autorest.NullAuthorizer{}
+
 	default:
 		return a, fmt.Errorf("invalid grant type specified")
 	}
@@ -0,0 +1,76 @@
+package iam
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"golang.org/x/crypto/pkcs12"
+)
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// federatedTokenSecret authenticates a service principal with the service
+// account token workload identity projects to path. The token is read on
+// every refresh since the kubelet rotates it.
+type federatedTokenSecret struct {
+	path string
+}
+
+func (s *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, values *url.Values) error {
+	token, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("cannot read federated token: %v", err)
+	}
+	values.Set("client_assertion_type", clientAssertionType)
+	values.Set("client_assertion", strings.TrimSpace(string(token)))
+	return nil
+}
+
+// loadCertificate reads the certificate and RSA private key of a service
+// principal from a PEM file, or a PKCS#12 file decrypted with password.
+func loadCertificate(path string, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read certificate: %v", err)
+	}
+
+	var certificate *x509.Certificate
+	var key interface{}
+	if strings.Contains(string(data), "-----BEGIN") {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "CERTIFICATE":
+				if certificate == nil {
+					certificate, err = x509.ParseCertificate(block.Bytes)
+				}
+			case "RSA PRIVATE KEY":
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot parse %s of %s: %v", strings.ToLower(block.Type), path, err)
+			}
+		}
+	} else {
+		key, certificate, err = pkcs12.Decode(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot decode %s: %v", path, err)
+		}
+	}
+
+	if certificate == nil {
+		return nil, nil, fmt.Errorf("no certificate in %s", path)
+	}
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("no RSA private key in %s", path)
+	}
+	return certificate, privateKey, nil
+}
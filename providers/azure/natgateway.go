@@ -0,0 +1,118 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/providers/azure/network"
+)
+
+// EgressIPs of a node pool leave from a NAT gateway named after their public
+// IP, in the resource group of the nodes and the region of the public IP,
+// attached to the subnet of the node pool. A NAT gateway serves every subnet
+// that sends its traffic out from its public IP.
+var _ providers.SubnetProvider = &Provider{}
+
+func (p *Provider) EnsureSubnetEgress(ctx context.Context, publicIPAddr string, subnetID string) error {
+	if err := p.initialize(); err != nil {
+		return err
+	}
+	pip, err := p.lookupPublicIP(ctx, publicIPAddr)
+	if err != nil {
+		return err
+	}
+
+	// a subnet holds a single NAT gateway, which is checked before making
+	// one that could not be attached
+	name := natGatewayName(*pip.Name)
+	subnet, err := network.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return fmt.Errorf("GetSubnet error: %v", err)
+	}
+	if _, err := network.SetSubnetNatGateway(&subnet, network.NatGatewayID(name)); err != nil {
+		return err
+	}
+
+	// the public IP cannot be on a NIC and a NAT gateway at once
+	if pip.IPConfiguration != nil && pip.IPConfiguration.ID != nil && strings.Contains(strings.ToLower(*pip.IPConfiguration.ID), "/networkinterfaces/") {
+		if err := network.DissociatePublicIP(ctx, &pip, ipconfigPrefix); err != nil {
+			return fmt.Errorf("DissociatePublicIP error: %v", err)
+		}
+	}
+
+	nat, err := network.GetNatGateway(ctx, name)
+	if err != nil {
+		if nat.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("GetNatGateway error: %v", err)
+		}
+		nat = aznetwork.NatGateway{
+			Name:     to.StringPtr(name),
+			Location: pip.Location,
+			Sku:      &aznetwork.NatGatewaySku{Name: aznetwork.NatGatewaySkuNameStandard},
+			NatGatewayPropertiesFormat: &aznetwork.NatGatewayPropertiesFormat{
+				IdleTimeoutInMinutes: to.Int32Ptr(p.idleTimeout()),
+			},
+		}
+	}
+	if network.SetNatGatewayPublicIP(&nat, pip) {
+		if nat, err = network.CreateOrUpdateNatGateway(ctx, nat); err != nil {
+			return fmt.Errorf("CreateOrUpdateNatGateway error: %v", err)
+		}
+	}
+
+	_, err = network.ModifySubnet(ctx, subnetID, func(subnet *aznetwork.Subnet) (bool, error) {
+		return network.SetSubnetNatGateway(subnet, network.NatGatewayID(name))
+	})
+	if err != nil {
+		return fmt.Errorf("cannot attach nat gateway %s to subnet %s: %v", name, subnetID, err)
+	}
+	return nil
+}
+
+func (p *Provider) RemoveSubnetEgress(ctx context.Context, publicIPAddr string, subnetID string) error {
+	if err := p.initialize(); err != nil {
+		return err
+	}
+	// public IPs of NAT gateways cannot be deleted, so none sends traffic
+	// out from a missing one
+	pip, found, err := network.LookupPublicIPInGroup(ctx, p.publicIPGroup(), publicIPAddr)
+	if err != nil {
+		return fmt.Errorf("LookupPublicIP error: %v", err)
+	}
+	if !found {
+		return nil
+	}
+
+	name := natGatewayName(*pip.Name)
+	_, err = network.ModifySubnet(ctx, subnetID, func(subnet *aznetwork.Subnet) (bool, error) {
+		return network.RemoveSubnetNatGateway(subnet, network.NatGatewayID(name)), nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot detach nat gateway %s from subnet %s: %v", name, subnetID, err)
+	}
+
+	nat, err := network.GetNatGateway(ctx, name)
+	if err != nil {
+		if nat.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("GetNatGateway error: %v", err)
+	}
+	if nat.NatGatewayPropertiesFormat != nil && nat.Subnets != nil && len(*nat.Subnets) > 0 {
+		// other subnets still send their traffic out from the public IP
+		return nil
+	}
+	if err := network.DeleteNatGateway(ctx, name); err != nil {
+		return fmt.Errorf("DeleteNatGateway error: %v", err)
+	}
+	return nil
+}
+
+func natGatewayName(pipName string) string {
+	return outboundPrefix + "_" + pipName
+}
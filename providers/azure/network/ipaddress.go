@@ -11,6 +11,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 )
@@ -21,22 +22,27 @@ func getIPClient() network.PublicIPAddressesClient {
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	ipClient.Authorizer = auth
 	ipClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&ipClient.Client)
 	return ipClient
 }
 
-// CreatePublicIP creates a new public IP
-func CreatePublicIP(ctx context.Context, ipName string) (ip network.PublicIPAddress, err error) {
+// CreatePublicIP creates a new public IP in a resource group, allocated
+// from a public IP prefix
+func CreatePublicIP(ctx context.Context, group string, ipName string, prefix network.PublicIPPrefix) (ip network.PublicIPAddress, err error) {
 	ipClient := getIPClient()
 	future, err := ipClient.CreateOrUpdate(
 		ctx,
-		config.GroupName(),
+		group,
 		ipName,
 		network.PublicIPAddress{
 			Name:     to.StringPtr(ipName),
-			Location: to.StringPtr(config.Location()),
+			Location: prefix.Location,
+			Zones:    prefix.Zones,
+			Sku:      &network.PublicIPAddressSku{Name: network.PublicIPAddressSkuNameStandard},
 			PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
 				PublicIPAddressVersion:   network.IPv4,
 				PublicIPAllocationMethod: network.Static,
+				PublicIPPrefix:           &network.SubResource{ID: prefix.ID},
 			},
 		},
 	)
@@ -55,8 +61,13 @@ func CreatePublicIP(ctx context.Context, ipName string) (ip network.PublicIPAddr
 
 // GetPublicIP returns an existing public IP
 func GetPublicIP(ctx context.Context, ipName string) (network.PublicIPAddress, error) {
+	return GetPublicIPInGroup(ctx, config.GroupName(), ipName)
+}
+
+// GetPublicIPInGroup returns an existing public IP of a resource group
+func GetPublicIPInGroup(ctx context.Context, group string, ipName string) (network.PublicIPAddress, error) {
 	ipClient := getIPClient()
-	return ipClient.Get(ctx, config.GroupName(), ipName, "")
+	return ipClient.Get(ctx, group, ipName, "")
 }
 
 // DeletePublicIP deletes an existing public IP
@@ -65,15 +76,39 @@ func DeletePublicIP(ctx context.Context, ipName string) (result network.PublicIP
 	return ipClient.Delete(ctx, config.GroupName(), ipName)
 }
 
+// DeletePublicIPInGroup deletes an existing public IP of a resource group
+// and waits for its deletion
+func DeletePublicIPInGroup(ctx context.Context, group string, ipName string) error {
+	ipClient := getIPClient()
+	future, err := ipClient.Delete(ctx, group, ipName)
+	if err != nil {
+		return fmt.Errorf("cannot delete public ip address: %v", err)
+	}
+	if err := future.WaitForCompletionRef(ctx, ipClient.Client); err != nil {
+		return fmt.Errorf("cannot get public ip address delete future response: %v", err)
+	}
+	return nil
+}
+
 // ListPublicIPs lists public IPs
 func ListPublicIPs(ctx context.Context) (result network.PublicIPAddressListResultPage, err error) {
+	return ListPublicIPsInGroup(ctx, config.GroupName())
+}
+
+// ListPublicIPsInGroup lists public IPs of a resource group
+func ListPublicIPsInGroup(ctx context.Context, group string) (result network.PublicIPAddressListResultPage, err error) {
 	ipClient := getIPClient()
-	return ipClient.List(ctx, config.GroupName())
+	return ipClient.List(ctx, group)
 }
 
 // LookupPublicIP lookup public IP by address
 func LookupPublicIP(ctx context.Context, address string) (ip network.PublicIPAddress, found bool, err error) {
-	result, err := ListPublicIPs(ctx)
+	return LookupPublicIPInGroup(ctx, config.GroupName(), address)
+}
+
+// LookupPublicIPInGroup lookup public IP of a resource group by address
+func LookupPublicIPInGroup(ctx context.Context, group string, address string) (ip network.PublicIPAddress, found bool, err error) {
+	result, err := ListPublicIPsInGroup(ctx, group)
 	if err != nil {
 		return ip, false, err
 	}
@@ -98,12 +133,16 @@ func DissociatePublicIP(ctx context.Context, pip *network.PublicIPAddress, ipcon
 			return fmt.Errorf("ParseIPConfigurationID error: %v", err)
 		}
 
-		nic, err := GetNic(ctx, r.NicName)
-		if err != nil {
-			return fmt.Errorf("GetNic error: %v", err)
+		getNic := func(ctx context.Context) (network.Interface, error) {
+			nic, err := GetNic(ctx, r.NicName)
+			if err != nil {
+				return nic, fmt.Errorf("GetNic error: %v", err)
+			}
+			return nic, nil
 		}
-
-		err = DissociateNicPublicIP(ctx, &nic, *pip.IPConfiguration.ID, ipconfigPrefixToDelete)
+		_, err = ModifyNic(ctx, getNic, func(nic *network.Interface) (bool, error) {
+			return RemoveNicPublicIP(nic, *pip.IPConfiguration.ID, ipconfigPrefixToDelete), nil
+		})
 		if err != nil {
 			return fmt.Errorf("DissociateNicWithPublicIP error: %v", err)
 		}
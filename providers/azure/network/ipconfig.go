@@ -11,6 +11,7 @@ import (
 	"regexp"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 )
@@ -21,6 +22,7 @@ func getIPConfigurationClient() network.InterfaceIPConfigurationsClient {
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	ipcClient.Authorizer = auth
 	ipcClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&ipcClient.Client)
 	return ipcClient
 }
 
@@ -61,3 +63,33 @@ func ParseIPConfigurationID(ipconfigID string) (resource IPConfigurationResource
 
 	return result, nil
 }
+
+// VMSSIPConfigurationResource contains details about an IP configuration of
+// a network interface of an instance of a uniform scale set.
+type VMSSIPConfigurationResource struct {
+	SubscriptionID string
+	ResourceGroup  string
+	ScaleSetName   string
+	InstanceID     string
+	NicName        string
+	Name           string
+}
+
+var vmssIPConfigurationIDPattern = regexp.MustCompile(`(?i)subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft.Compute/virtualMachineScaleSets/([^/]+)/virtualMachines/([^/]+)/networkInterfaces/([^/]+)/ipConfigurations/([^/]+)$`)
+
+// ParseVMSSIPConfigurationID parses the resource ID of an IP configuration
+// of a scale set instance, and reports whether it is one.
+func ParseVMSSIPConfigurationID(ipconfigID string) (VMSSIPConfigurationResource, bool) {
+	match := vmssIPConfigurationIDPattern.FindStringSubmatch(ipconfigID)
+	if match == nil {
+		return VMSSIPConfigurationResource{}, false
+	}
+	return VMSSIPConfigurationResource{
+		SubscriptionID: match[1],
+		ResourceGroup:  match[2],
+		ScaleSetName:   match[3],
+		InstanceID:     match[4],
+		NicName:        match[5],
+		Name:           match[6],
+	}, true
+}
@@ -7,19 +7,26 @@ package network
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 )
 
 func getLBClient() network.LoadBalancersClient {
-	lbClient := network.NewLoadBalancersClient(config.SubscriptionID())
+	lbClient := network.NewLoadBalancersClientWithBaseURI(
+		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	lbClient.Authorizer = auth
 	lbClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&lbClient.Client)
 	return lbClient
 }
 
@@ -29,6 +36,36 @@ func GetLoadBalancer(ctx context.Context, lbName string) (network.LoadBalancer,
 	return lbClient.Get(ctx, config.GroupName(), lbName, "")
 }
 
+// BackendPoolResource is the load balancer a backend pool belongs to.
+type BackendPoolResource struct {
+	SubscriptionID   string
+	ResourceGroup    string
+	LoadBalancerName string
+	Name             string
+}
+
+// ParseBackendPoolID parses a backend pool resource ID into a
+// BackendPoolResource struct.
+func ParseBackendPoolID(poolID string) (resource BackendPoolResource, err error) {
+	const poolIDPatternText = `(?i)^/?subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft.Network/loadBalancers/([^/]+)/backendAddressPools/([^/]+)/?$`
+	match := regexp.MustCompile(poolIDPatternText).FindStringSubmatch(poolID)
+	if len(match) != 5 {
+		return resource, fmt.Errorf("parsing failed for %s. Invalid backend address pool Id format", poolID)
+	}
+	return BackendPoolResource{
+		SubscriptionID:   match[1],
+		ResourceGroup:    match[2],
+		LoadBalancerName: match[3],
+		Name:             match[4],
+	}, nil
+}
+
+// GetLoadBalancerInGroup gets a load balancer of a resource group
+func GetLoadBalancerInGroup(ctx context.Context, group string, lbName string) (network.LoadBalancer, error) {
+	lbClient := getLBClient()
+	return lbClient.Get(ctx, group, lbName, "")
+}
+
 // CreateLoadBalancer creates a load balancer with 2 inbound NAT rules.
 func CreateLoadBalancer(ctx context.Context, lbName, pipName string) (lb network.LoadBalancer, err error) {
 	probeName := "probe"
@@ -138,3 +175,232 @@ func CreateLoadBalancer(ctx context.Context, lbName, pipName string) (lb network
 
 	return future.Result(lbClient)
 }
+
+// LoadBalancerID returns the resource ID of the load balancer named lbName
+func LoadBalancerID(lbName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/loadBalancers/%s", config.SubscriptionID(), config.GroupName(), lbName)
+}
+
+// ErrLoadBalancerModified is returned by UpdateLoadBalancer when the load
+// balancer changed since it was read
+var ErrLoadBalancerModified = errors.New("load balancer was modified concurrently")
+
+// UpdateLoadBalancer creates or updates a load balancer, on condition that
+// its ETag still matches the one it was read with when it has one
+func UpdateLoadBalancer(ctx context.Context, lb network.LoadBalancer) (network.LoadBalancer, error) {
+	lbClient := getLBClient()
+
+	req, err := lbClient.CreateOrUpdatePreparer(ctx, config.GroupName(), *lb.Name, lb)
+	if err != nil {
+		return lb, fmt.Errorf("cannot prepare load balancer update: %v", err)
+	}
+	if lb.Etag != nil {
+		req.Header.Set("If-Match", *lb.Etag)
+	}
+
+	future, err := lbClient.CreateOrUpdateSender(req)
+	if err != nil {
+		if future.FutureAPI != nil && future.Response() != nil && future.Response().StatusCode == http.StatusPreconditionFailed {
+			return lb, ErrLoadBalancerModified
+		}
+		return lb, fmt.Errorf("cannot update load balancer: %v", err)
+	}
+
+	err = future.WaitForCompletionRef(ctx, lbClient.Client)
+	if err != nil {
+		return lb, fmt.Errorf("cannot get load balancer update future response: %v", err)
+	}
+
+	lb, err = future.Result(lbClient)
+	if err != nil {
+		return lb, fmt.Errorf("error loading update result: %v", err)
+	}
+	return lb, nil
+}
+
+// ModifyLoadBalancer reads a load balancer with get, applies change and
+// updates it, starting over when it was modified in between. The load
+// balancer is not updated when change reports no change.
+func ModifyLoadBalancer(ctx context.Context, get func(context.Context) (network.LoadBalancer, error), change func(*network.LoadBalancer) (bool, error)) (network.LoadBalancer, error) {
+	for i := 0; ; i++ {
+		lb, err := get(ctx)
+		if err != nil {
+			return lb, err
+		}
+		changed, err := change(&lb)
+		if err != nil || !changed {
+			return lb, err
+		}
+		lb, err = UpdateLoadBalancer(ctx, lb)
+		if err != ErrLoadBalancerModified || i+1 == maxNicUpdates {
+			return lb, err
+		}
+	}
+}
+
+// SetOutboundRule makes the load balancer send the traffic of the backend
+// pool named name out from a public IP, through a frontend IP configuration
+// and an outbound rule also named name. It reports whether lb changed.
+func SetOutboundRule(lb *network.LoadBalancer, name string, ip network.PublicIPAddress, allocatedOutboundPorts int32, idleTimeoutInMinutes int32) bool {
+	if lb.LoadBalancerPropertiesFormat == nil {
+		lb.LoadBalancerPropertiesFormat = &network.LoadBalancerPropertiesFormat{}
+	}
+	frontendID := *lb.ID + "/frontendIPConfigurations/" + name
+	poolID := *lb.ID + "/backendAddressPools/" + name
+	changed := false
+
+	if lb.FrontendIPConfigurations == nil {
+		lb.FrontendIPConfigurations = &[]network.FrontendIPConfiguration{}
+	}
+	found := false
+	for i, frontend := range *lb.FrontendIPConfigurations {
+		if frontend.Name == nil || *frontend.Name != name {
+			continue
+		}
+		found = true
+		if frontend.FrontendIPConfigurationPropertiesFormat == nil || frontend.PublicIPAddress == nil || frontend.PublicIPAddress.ID == nil || !strings.EqualFold(*frontend.PublicIPAddress.ID, *ip.ID) {
+			(*lb.FrontendIPConfigurations)[i].FrontendIPConfigurationPropertiesFormat = &network.FrontendIPConfigurationPropertiesFormat{
+				PublicIPAddress: &network.PublicIPAddress{ID: ip.ID},
+			}
+			changed = true
+		}
+	}
+	if !found {
+		*lb.FrontendIPConfigurations = append(*lb.FrontendIPConfigurations, network.FrontendIPConfiguration{
+			Name: to.StringPtr(name),
+			FrontendIPConfigurationPropertiesFormat: &network.FrontendIPConfigurationPropertiesFormat{
+				PublicIPAddress: &network.PublicIPAddress{ID: ip.ID},
+			},
+		})
+		changed = true
+	}
+
+	if lb.BackendAddressPools == nil {
+		lb.BackendAddressPools = &[]network.BackendAddressPool{}
+	}
+	found = false
+	for _, pool := range *lb.BackendAddressPools {
+		if pool.Name != nil && *pool.Name == name {
+			found = true
+		}
+	}
+	if !found {
+		*lb.BackendAddressPools = append(*lb.BackendAddressPools, network.BackendAddressPool{Name: to.StringPtr(name)})
+		changed = true
+	}
+
+	if lb.OutboundRules == nil {
+		lb.OutboundRules = &[]network.OutboundRule{}
+	}
+	rule := network.OutboundRule{
+		Name: to.StringPtr(name),
+		OutboundRulePropertiesFormat: &network.OutboundRulePropertiesFormat{
+			Protocol:                 network.LoadBalancerOutboundRuleProtocolAll,
+			FrontendIPConfigurations: &[]network.SubResource{{ID: to.StringPtr(frontendID)}},
+			BackendAddressPool:       &network.SubResource{ID: to.StringPtr(poolID)},
+			IdleTimeoutInMinutes:     to.Int32Ptr(idleTimeoutInMinutes),
+			EnableTCPReset:           to.BoolPtr(true),
+		},
+	}
+	if allocatedOutboundPorts > 0 {
+		rule.AllocatedOutboundPorts = to.Int32Ptr(allocatedOutboundPorts)
+	}
+	for i, r := range *lb.OutboundRules {
+		if r.Name == nil || *r.Name != name {
+			continue
+		}
+		if !sameOutboundRule(r, rule) {
+			(*lb.OutboundRules)[i] = rule
+			changed = true
+		}
+		return changed
+	}
+	*lb.OutboundRules = append(*lb.OutboundRules, rule)
+	return true
+}
+
+func sameOutboundRule(a network.OutboundRule, b network.OutboundRule) bool {
+	if a.OutboundRulePropertiesFormat == nil || a.BackendAddressPool == nil || a.BackendAddressPool.ID == nil ||
+		a.FrontendIPConfigurations == nil || len(*a.FrontendIPConfigurations) != 1 || (*a.FrontendIPConfigurations)[0].ID == nil {
+		return false
+	}
+	return strings.EqualFold(*a.BackendAddressPool.ID, *b.BackendAddressPool.ID) &&
+		strings.EqualFold(*(*a.FrontendIPConfigurations)[0].ID, *(*b.FrontendIPConfigurations)[0].ID) &&
+		int32Value(a.AllocatedOutboundPorts) == int32Value(b.AllocatedOutboundPorts) &&
+		int32Value(a.IdleTimeoutInMinutes) == int32Value(b.IdleTimeoutInMinutes)
+}
+
+func int32Value(v *int32) int32 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// OutboundPublicIPs returns the resource IDs of the public IPs the outbound
+// rules of lb send the traffic of their backend pool out from, keyed by the
+// lower case ID of the pool.
+func OutboundPublicIPs(lb network.LoadBalancer) map[string]string {
+	ips := make(map[string]string)
+	if lb.LoadBalancerPropertiesFormat == nil || lb.OutboundRules == nil || lb.FrontendIPConfigurations == nil {
+		return ips
+	}
+	frontends := make(map[string]string)
+	for _, frontend := range *lb.FrontendIPConfigurations {
+		if frontend.ID != nil && frontend.FrontendIPConfigurationPropertiesFormat != nil && frontend.PublicIPAddress != nil && frontend.PublicIPAddress.ID != nil {
+			frontends[strings.ToLower(*frontend.ID)] = *frontend.PublicIPAddress.ID
+		}
+	}
+	for _, rule := range *lb.OutboundRules {
+		if rule.OutboundRulePropertiesFormat == nil || rule.BackendAddressPool == nil || rule.BackendAddressPool.ID == nil || rule.FrontendIPConfigurations == nil {
+			continue
+		}
+		for _, frontend := range *rule.FrontendIPConfigurations {
+			if frontend.ID == nil {
+				continue
+			}
+			if ip, found := frontends[strings.ToLower(*frontend.ID)]; found {
+				ips[strings.ToLower(*rule.BackendAddressPool.ID)] = ip
+				break
+			}
+		}
+	}
+	return ips
+}
+
+// OutboundRuleOfPool returns the name of the outbound rule of lb sending the
+// traffic of the backend pool with ID poolID out.
+func OutboundRuleOfPool(lb network.LoadBalancer, poolID string) (string, bool) {
+	if lb.LoadBalancerPropertiesFormat == nil || lb.OutboundRules == nil {
+		return "", false
+	}
+	for _, rule := range *lb.OutboundRules {
+		if rule.OutboundRulePropertiesFormat == nil || rule.BackendAddressPool == nil || rule.BackendAddressPool.ID == nil || rule.Name == nil {
+			continue
+		}
+		if strings.EqualFold(*rule.BackendAddressPool.ID, poolID) {
+			return *rule.Name, true
+		}
+	}
+	return "", false
+}
+
+// BackendPoolMembers returns the IDs of the IP configurations in the backend
+// pool with ID poolID.
+func BackendPoolMembers(lb network.LoadBalancer, poolID string) []string {
+	var members []string
+	if lb.LoadBalancerPropertiesFormat == nil || lb.BackendAddressPools == nil {
+		return members
+	}
+	for _, pool := range *lb.BackendAddressPools {
+		if pool.ID == nil || !strings.EqualFold(*pool.ID, poolID) || pool.BackendAddressPoolPropertiesFormat == nil || pool.BackendIPConfigurations == nil {
+			continue
+		}
+		for _, ipconfig := range *pool.BackendIPConfigurations {
+			if ipconfig.ID != nil {
+				members = append(members, *ipconfig.ID)
+			}
+		}
+	}
+	return members
+}
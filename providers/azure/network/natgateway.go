@@ -0,0 +1,82 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
+)
+
+func getNatGatewayClient() network.NatGatewaysClient {
+	natClient := network.NewNatGatewaysClientWithBaseURI(
+		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
+	auth, _ := iam.GetResourceManagementAuthorizer()
+	natClient.Authorizer = auth
+	natClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&natClient.Client)
+	return natClient
+}
+
+// NatGatewayID returns the resource ID of the NAT gateway named natName
+func NatGatewayID(natName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/natGateways/%s", config.SubscriptionID(), config.GroupName(), natName)
+}
+
+// GetNatGateway returns an existing NAT gateway
+func GetNatGateway(ctx context.Context, natName string) (network.NatGateway, error) {
+	natClient := getNatGatewayClient()
+	return natClient.Get(ctx, config.GroupName(), natName, "")
+}
+
+// CreateOrUpdateNatGateway creates or updates a NAT gateway
+func CreateOrUpdateNatGateway(ctx context.Context, nat network.NatGateway) (network.NatGateway, error) {
+	natClient := getNatGatewayClient()
+	future, err := natClient.CreateOrUpdate(ctx, config.GroupName(), *nat.Name, nat)
+	if err != nil {
+		return nat, fmt.Errorf("cannot update nat gateway: %v", err)
+	}
+
+	err = future.WaitForCompletionRef(ctx, natClient.Client)
+	if err != nil {
+		return nat, fmt.Errorf("cannot get nat gateway update future response: %v", err)
+	}
+
+	return future.Result(natClient)
+}
+
+// DeleteNatGateway deletes an existing NAT gateway
+func DeleteNatGateway(ctx context.Context, natName string) error {
+	natClient := getNatGatewayClient()
+	future, err := natClient.Delete(ctx, config.GroupName(), natName)
+	if err != nil {
+		return fmt.Errorf("cannot delete nat gateway: %v", err)
+	}
+
+	err = future.WaitForCompletionRef(ctx, natClient.Client)
+	if err != nil {
+		return fmt.Errorf("cannot get nat gateway delete future response: %v", err)
+	}
+	return nil
+}
+
+// SetNatGatewayPublicIP makes a public IP the only one of a NAT gateway. It
+// reports whether nat changed.
+func SetNatGatewayPublicIP(nat *network.NatGateway, ip network.PublicIPAddress) bool {
+	if nat.NatGatewayPropertiesFormat == nil {
+		nat.NatGatewayPropertiesFormat = &network.NatGatewayPropertiesFormat{}
+	}
+	if ips := nat.PublicIPAddresses; ips != nil && len(*ips) == 1 && (*ips)[0].ID != nil && strings.EqualFold(*(*ips)[0].ID, *ip.ID) {
+		return false
+	}
+	nat.PublicIPAddresses = &[]network.SubResource{{ID: ip.ID}}
+	return true
+}
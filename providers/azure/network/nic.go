@@ -7,12 +7,15 @@ package network
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 )
@@ -24,6 +27,7 @@ func getNicClient() network.InterfacesClient {
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	nicClient.Authorizer = auth
 	nicClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&nicClient.Client)
 	return nicClient
 }
 
@@ -137,138 +141,247 @@ func GetNic(ctx context.Context, nicName string) (network.Interface, error) {
 	return nicClient.Get(ctx, config.GroupName(), nicName, "")
 }
 
+// ListNics lists the network interfaces of the resource group
+func ListNics(ctx context.Context) ([]network.Interface, error) {
+	nicClient := getNicClient()
+	result, err := nicClient.ListComplete(ctx, config.GroupName())
+	if err != nil {
+		return nil, err
+	}
+	var nics []network.Interface
+	for result.NotDone() {
+		nics = append(nics, result.Value())
+		if err := result.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return nics, nil
+}
+
+// GetVMSSNic returns a network interface of an instance of a scale set
+func GetVMSSNic(ctx context.Context, vmssName string, instanceID string, nicName string) (network.Interface, error) {
+	nicClient := getNicClient()
+	return nicClient.GetVirtualMachineScaleSetNetworkInterface(ctx, config.GroupName(), vmssName, instanceID, nicName, "")
+}
+
 // DeleteNic deletes an existing network interface
 func DeleteNic(ctx context.Context, nic string) (result network.InterfacesDeleteFuture, err error) {
 	nicClient := getNicClient()
 	return nicClient.Delete(ctx, config.GroupName(), nic)
 }
 
-// AssociateNicWithPublicIP associate public IP to network interface
-func AssociateNicWithPublicIP(ctx context.Context, nic network.Interface, ip network.PublicIPAddress, localIPAddr string, ipconfigName string) (privateIPAddr string, err error) {
-	found := false
-	for _, ifconfig := range *nic.IPConfigurations {
-		if *ifconfig.PrivateIPAddress == localIPAddr {
-			ifconfig.PublicIPAddress = &ip
-			found = true
-			break
-		}
-	}
-	if !found {
-		var subnet network.Subnet
-		for _, ifconfig := range *nic.IPConfigurations {
-			if ifconfig.Primary == nil || *ifconfig.Primary {
-				subnet = *ifconfig.Subnet
-				break
-			}
-		}
-		if subnet.ID == nil || *subnet.ID == "" {
-			return privateIPAddr, fmt.Errorf("cannot get subnet")
-		}
-		*nic.IPConfigurations = append(*nic.IPConfigurations, network.InterfaceIPConfiguration{
-			Name: to.StringPtr(ipconfigName),
-			InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
-				Subnet:                    &subnet,
-				PrivateIPAllocationMethod: network.Dynamic,
-				PublicIPAddress:           &ip,
-			}})
-	}
+// maxNicUpdates bounds the updates ModifyNic tries while the network
+// interface keeps changing under it
+const maxNicUpdates = 5
+
+// ErrNicModified is returned by UpdateNic when the network interface changed
+// since it was read
+var ErrNicModified = errors.New("network interface was modified concurrently")
 
+// UpdateNic updates a network interface on condition that its ETag still
+// matches the one it was read with
+func UpdateNic(ctx context.Context, nic network.Interface) (network.Interface, error) {
 	nicClient := getNicClient()
 
-	future, err := nicClient.CreateOrUpdate(ctx, config.GroupName(), *nic.Name, nic)
+	req, err := nicClient.CreateOrUpdatePreparer(ctx, config.GroupName(), *nic.Name, nic)
 	if err != nil {
-		return privateIPAddr, fmt.Errorf("cannot update nic: %v", err)
+		return nic, fmt.Errorf("cannot prepare nic update: %v", err)
+	}
+	if nic.Etag != nil {
+		req.Header.Set("If-Match", *nic.Etag)
+	}
+
+	future, err := nicClient.CreateOrUpdateSender(req)
+	if err != nil {
+		if future.FutureAPI != nil && future.Response() != nil && future.Response().StatusCode == http.StatusPreconditionFailed {
+			return nic, ErrNicModified
+		}
+		return nic, fmt.Errorf("cannot update nic: %v", err)
 	}
 
 	err = future.WaitForCompletionRef(ctx, nicClient.Client)
 	if err != nil {
-		return privateIPAddr, fmt.Errorf("cannot get nic update future response: %v", err)
+		return nic, fmt.Errorf("cannot get nic update future response: %v", err)
 	}
 
 	nic, err = future.Result(nicClient)
 	if err != nil {
-		return privateIPAddr, fmt.Errorf("error loading update result: %v", err)
+		return nic, fmt.Errorf("error loading update result: %v", err)
 	}
+	return nic, nil
+}
 
-	if found {
-		return localIPAddr, nil
-	} else {
-		for _, ifconfig := range *nic.IPConfigurations {
-			if *ifconfig.Name == ipconfigName {
-				return *ifconfig.PrivateIPAddress, nil
-			}
+// ModifyNic reads a network interface with get, applies change and updates
+// it, starting over when it was modified in between. The interface is not
+// updated when change reports no change.
+func ModifyNic(ctx context.Context, get func(context.Context) (network.Interface, error), change func(*network.Interface) (bool, error)) (network.Interface, error) {
+	for i := 0; ; i++ {
+		nic, err := get(ctx)
+		if err != nil {
+			return nic, err
+		}
+		changed, err := change(&nic)
+		if err != nil || !changed {
+			return nic, err
+		}
+		nic, err = UpdateNic(ctx, nic)
+		if err != ErrNicModified || i+1 == maxNicUpdates {
+			return nic, err
 		}
 	}
-
-	return privateIPAddr, fmt.Errorf("failed to get PrivateIPAddress: %v", err)
 }
 
-func DissociateNicPublicIP(ctx context.Context, nic *network.Interface, ipconfigID string, prefixToDelete string) error {
-	ipconfigs := nic.IPConfigurations
-	fmt.Printf("nic.IPConfigurations: %v\n", *ipconfigs)
-	l := len(*ipconfigs)
-	fmt.Printf("len(*ipconfigs): %d\n", l)
-	for i := 0; i < l; i++ {
-		ipconfig := (*ipconfigs)[i]
-		fmt.Printf("ipconfig: %v\n", ipconfig)
-		if *ipconfig.ID == ipconfigID {
-			fmt.Printf("ipconfig.ID == pip.IPConfiguration.ID. ipconfig.ID: %s\n", *ipconfig.ID)
-			if strings.HasPrefix(*ipconfig.Name, prefixToDelete) {
-				copy((*ipconfigs)[i:], (*ipconfigs)[i+1:])
-				*nic.IPConfigurations = (*ipconfigs)[:l-1]
-			} else {
-				ipconfig.PublicIPAddress = nil
-			}
+// SetNicPublicIP associates a public IP with the IP configuration of
+// localIPAddr, or with a new IP configuration named ipconfigName when
+// localIPAddr has none. It reports whether nic changed.
+func SetNicPublicIP(nic *network.Interface, ip network.PublicIPAddress, localIPAddr string, ipconfigName string) (bool, error) {
+	var subnet *network.Subnet
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PublicIPAddress != nil && ipconfig.PublicIPAddress.ID != nil && strings.EqualFold(*ipconfig.PublicIPAddress.ID, *ip.ID) {
+			return false, nil
+		}
+		if ipconfig.Name != nil && *ipconfig.Name == ipconfigName {
+			return false, fmt.Errorf("ip configuration %s is taken", ipconfigName)
+		}
+		if subnet == nil && (ipconfig.Primary == nil || *ipconfig.Primary) {
+			subnet = ipconfig.Subnet
 		}
 	}
 
-	fmt.Printf("getNicClient\n")
-
-	nicClient := getNicClient()
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PrivateIPAddress != nil && *ipconfig.PrivateIPAddress == localIPAddr {
+			ipconfig.PublicIPAddress = &ip
+			return true, nil
+		}
+	}
 
-	future, err := nicClient.CreateOrUpdate(ctx, config.GroupName(), *nic.Name, *nic)
-	if err != nil {
-		return fmt.Errorf("cannot update nic: %v", err)
+	if subnet == nil || subnet.ID == nil || *subnet.ID == "" {
+		return false, fmt.Errorf("cannot get subnet")
 	}
+	*nic.IPConfigurations = append(*nic.IPConfigurations, network.InterfaceIPConfiguration{
+		Name: to.StringPtr(ipconfigName),
+		InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+			Subnet:                    subnet,
+			PrivateIPAllocationMethod: network.Dynamic,
+			PublicIPAddress:           &ip,
+		}})
+	return true, nil
+}
 
-	err = future.WaitForCompletionRef(ctx, nicClient.Client)
-	if err != nil {
-		return fmt.Errorf("cannot get nic update future response: %v", err)
+// NicPrivateIP returns the private IP of the IP configuration associated
+// with a public IP
+func NicPrivateIP(nic network.Interface, ip network.PublicIPAddress) (string, bool) {
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PublicIPAddress == nil || ipconfig.PublicIPAddress.ID == nil || ipconfig.PrivateIPAddress == nil {
+			continue
+		}
+		if strings.EqualFold(*ipconfig.PublicIPAddress.ID, *ip.ID) {
+			return *ipconfig.PrivateIPAddress, true
+		}
 	}
+	return "", false
+}
 
-	_, err = future.Result(nicClient)
-	return err
+// RemoveNicPublicIP removes the public IP of the IP configuration with ID
+// ipconfigID, and the IP configuration itself when its name starts with
+// prefixToDelete. It reports whether nic changed.
+func RemoveNicPublicIP(nic *network.Interface, ipconfigID string, prefixToDelete string) bool {
+	return removeNicPublicIP(nic, func(ipconfig network.InterfaceIPConfiguration) bool {
+		return ipconfig.ID != nil && strings.EqualFold(*ipconfig.ID, ipconfigID)
+	}, prefixToDelete)
 }
 
-func DissociateNicPublicIPWithPrivateIP(ctx context.Context, nic *network.Interface, privateIPAddr string, prefixToDelete string) error {
-	ipconfigs := nic.IPConfigurations
-	l := len(*ipconfigs)
-	for i := 0; i < l; i++ {
-		ifconfig := (*ipconfigs)[i]
-		if ifconfig.PrivateIPAddress != nil && *ifconfig.PrivateIPAddress == privateIPAddr {
-			if strings.HasPrefix(*ifconfig.Name, prefixToDelete) {
-				copy((*ipconfigs)[i:], (*ipconfigs)[i+1:])
-				*nic.IPConfigurations = (*ipconfigs)[:l-1]
-			} else {
-				ifconfig.PublicIPAddress = nil
+// RemoveNicPublicIPWithPrivateIP is RemoveNicPublicIP for the IP
+// configuration of privateIPAddr.
+func RemoveNicPublicIPWithPrivateIP(nic *network.Interface, privateIPAddr string, prefixToDelete string) bool {
+	return removeNicPublicIP(nic, func(ipconfig network.InterfaceIPConfiguration) bool {
+		return ipconfig.PrivateIPAddress != nil && *ipconfig.PrivateIPAddress == privateIPAddr
+	}, prefixToDelete)
+}
+
+func removeNicPublicIP(nic *network.Interface, match func(network.InterfaceIPConfiguration) bool, prefixToDelete string) bool {
+	changed := false
+	ipconfigs := (*nic.IPConfigurations)[:0]
+	for _, ipconfig := range *nic.IPConfigurations {
+		if !match(ipconfig) {
+			ipconfigs = append(ipconfigs, ipconfig)
+			continue
+		}
+		if ipconfig.Name != nil && strings.HasPrefix(*ipconfig.Name, prefixToDelete) {
+			changed = true
+			continue
+		}
+		if ipconfig.PublicIPAddress != nil {
+			ipconfig.PublicIPAddress = nil
+			changed = true
+		}
+		ipconfigs = append(ipconfigs, ipconfig)
+	}
+	*nic.IPConfigurations = ipconfigs
+	return changed
+}
+
+// SetNicBackendPool puts the IP configuration of privateIPAddr in the
+// backend pool with ID poolID. It reports whether nic changed.
+func SetNicBackendPool(nic *network.Interface, privateIPAddr string, poolID string) (bool, error) {
+	for i, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PrivateIPAddress == nil || *ipconfig.PrivateIPAddress != privateIPAddr {
+			continue
+		}
+		pools := []network.BackendAddressPool{}
+		if ipconfig.LoadBalancerBackendAddressPools != nil {
+			for _, pool := range *ipconfig.LoadBalancerBackendAddressPools {
+				if pool.ID != nil && strings.EqualFold(*pool.ID, poolID) {
+					return false, nil
+				}
+				pools = append(pools, network.BackendAddressPool{ID: pool.ID})
 			}
 		}
+		pools = append(pools, network.BackendAddressPool{ID: to.StringPtr(poolID)})
+		(*nic.IPConfigurations)[i].LoadBalancerBackendAddressPools = &pools
+		return true, nil
 	}
+	return false, fmt.Errorf("cannot find ip configuration of %s on nic %s", privateIPAddr, to.String(nic.Name))
+}
 
-	nicClient := getNicClient()
+// RemoveNicBackendPools takes the IP configuration of privateIPAddr out of
+// the backend pools whose ID starts with poolPrefix. It reports whether nic
+// changed.
+func RemoveNicBackendPools(nic *network.Interface, privateIPAddr string, poolPrefix string) bool {
+	return removeNicBackendPools(nic, func(ipconfig network.InterfaceIPConfiguration) bool {
+		return ipconfig.PrivateIPAddress != nil && *ipconfig.PrivateIPAddress == privateIPAddr
+	}, poolPrefix)
+}
 
-	future, err := nicClient.CreateOrUpdate(ctx, config.GroupName(), *nic.Name, *nic)
-	if err != nil {
-		return fmt.Errorf("cannot update nic: %v", err)
-	}
+// RemoveNicBackendPool takes the IP configuration with ID ipconfigID out of
+// the backend pool with ID poolID. It reports whether nic changed.
+func RemoveNicBackendPool(nic *network.Interface, ipconfigID string, poolID string) bool {
+	return removeNicBackendPools(nic, func(ipconfig network.InterfaceIPConfiguration) bool {
+		return ipconfig.ID != nil && strings.EqualFold(*ipconfig.ID, ipconfigID)
+	}, poolID)
+}
 
-	err = future.WaitForCompletionRef(ctx, nicClient.Client)
-	if err != nil {
-		return fmt.Errorf("cannot get nic update future response: %v", err)
+func removeNicBackendPools(nic *network.Interface, match func(network.InterfaceIPConfiguration) bool, poolPrefix string) bool {
+	changed := false
+	for i, ipconfig := range *nic.IPConfigurations {
+		if !match(ipconfig) || ipconfig.LoadBalancerBackendAddressPools == nil {
+			continue
+		}
+		pools := []network.BackendAddressPool{}
+		for _, pool := range *ipconfig.LoadBalancerBackendAddressPools {
+			if pool.ID != nil && hasPrefixFold(*pool.ID, poolPrefix) {
+				changed = true
+				continue
+			}
+			pools = append(pools, network.BackendAddressPool{ID: pool.ID})
+		}
+		(*nic.IPConfigurations)[i].LoadBalancerBackendAddressPools = &pools
 	}
+	return changed
+}
 
-	_, err = future.Result(nicClient)
-	return err
+func hasPrefixFold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
 }
 
 func getVMSSNicClient() VMSSInterfacesClient {
@@ -278,6 +391,7 @@ func getVMSSNicClient() VMSSInterfacesClient {
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	nicClient.Authorizer = auth
 	nicClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&nicClient.Client)
 	return nicClient
 }
 
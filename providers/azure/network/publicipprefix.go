@@ -0,0 +1,54 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
+)
+
+func getPublicIPPrefixClient() network.PublicIPPrefixesClient {
+	prefixClient := network.NewPublicIPPrefixesClientWithBaseURI(
+		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
+	auth, _ := iam.GetResourceManagementAuthorizer()
+	prefixClient.Authorizer = auth
+	prefixClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&prefixClient.Client)
+	return prefixClient
+}
+
+// PublicIPPrefixResource contains details about an Azure public IP prefix resource.
+type PublicIPPrefixResource struct {
+	SubscriptionID string
+	ResourceGroup  string
+	Name           string
+}
+
+// ParsePublicIPPrefixID parses a public IP prefix resource ID into a PublicIPPrefixResource struct.
+func ParsePublicIPPrefixID(prefixID string) (resource PublicIPPrefixResource, err error) {
+	const prefixIDPatternText = `(?i)^/?subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft.Network/publicIPPrefixes/([^/]+)/?$`
+	match := regexp.MustCompile(prefixIDPatternText).FindStringSubmatch(prefixID)
+	if len(match) != 4 {
+		return resource, fmt.Errorf("parsing failed for %s. Invalid public ip prefix Id format", prefixID)
+	}
+	return PublicIPPrefixResource{
+		SubscriptionID: match[1],
+		ResourceGroup:  match[2],
+		Name:           match[3],
+	}, nil
+}
+
+// GetPublicIPPrefix returns an existing public IP prefix of a resource group
+func GetPublicIPPrefix(ctx context.Context, group string, prefixName string) (network.PublicIPPrefix, error) {
+	prefixClient := getPublicIPPrefixClient()
+	return prefixClient.Get(ctx, group, prefixName, "")
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 )
@@ -20,6 +21,7 @@ func getNsgClient() network.SecurityGroupsClient {
 	a, _ := iam.GetResourceManagementAuthorizer()
 	nsgClient.Authorizer = a
 	nsgClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&nsgClient.Client)
 	return nsgClient
 }
 
@@ -120,6 +122,7 @@ func getSecurityRulesClient() network.SecurityRulesClient {
 	a, _ := iam.GetResourceManagementAuthorizer()
 	rulesClient.Authorizer = a
 	rulesClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&rulesClient.Client)
 	return rulesClient
 }
 
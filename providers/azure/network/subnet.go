@@ -7,19 +7,26 @@ package network
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 )
 
 func getSubnetsClient() network.SubnetsClient {
-	subnetsClient := network.NewSubnetsClient(config.SubscriptionID())
+	subnetsClient := network.NewSubnetsClientWithBaseURI(
+		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	subnetsClient.Authorizer = auth
 	subnetsClient.AddToUserAgent(config.UserAgent())
+	arm.Configure(&subnetsClient.Client)
 	return subnetsClient
 }
 
@@ -88,3 +95,123 @@ func GetVirtualNetworkSubnet(ctx context.Context, vnetName string, subnetName st
 	subnetsClient := getSubnetsClient()
 	return subnetsClient.Get(ctx, config.GroupName(), vnetName, subnetName, "")
 }
+
+// SubnetResource contains details about an Azure subnet resource.
+type SubnetResource struct {
+	SubscriptionID string
+	ResourceGroup  string
+	VnetName       string
+	Name           string
+}
+
+// ParseSubnetID parses a subnet resource ID into a SubnetResource struct.
+func ParseSubnetID(subnetID string) (resource SubnetResource, err error) {
+	const subnetIDPatternText = `(?i)^/?subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft.Network/virtualNetworks/([^/]+)/subnets/([^/]+)/?$`
+	match := regexp.MustCompile(subnetIDPatternText).FindStringSubmatch(subnetID)
+	if len(match) != 5 {
+		return resource, fmt.Errorf("parsing failed for %s. Invalid subnet Id format", subnetID)
+	}
+	return SubnetResource{
+		SubscriptionID: match[1],
+		ResourceGroup:  match[2],
+		VnetName:       match[3],
+		Name:           match[4],
+	}, nil
+}
+
+// GetSubnet returns an existing subnet by resource ID
+func GetSubnet(ctx context.Context, subnetID string) (network.Subnet, error) {
+	r, err := ParseSubnetID(subnetID)
+	if err != nil {
+		return network.Subnet{}, err
+	}
+	subnetsClient := getSubnetsClient()
+	return subnetsClient.Get(ctx, r.ResourceGroup, r.VnetName, r.Name, "")
+}
+
+// ErrSubnetModified is returned by UpdateSubnet when the subnet changed
+// since it was read
+var ErrSubnetModified = errors.New("subnet was modified concurrently")
+
+// UpdateSubnet updates a subnet on condition that its ETag still matches
+// the one it was read with
+func UpdateSubnet(ctx context.Context, subnet network.Subnet) (network.Subnet, error) {
+	r, err := ParseSubnetID(*subnet.ID)
+	if err != nil {
+		return subnet, err
+	}
+	subnetsClient := getSubnetsClient()
+
+	req, err := subnetsClient.CreateOrUpdatePreparer(ctx, r.ResourceGroup, r.VnetName, r.Name, subnet)
+	if err != nil {
+		return subnet, fmt.Errorf("cannot prepare subnet update: %v", err)
+	}
+	if subnet.Etag != nil {
+		req.Header.Set("If-Match", *subnet.Etag)
+	}
+
+	future, err := subnetsClient.CreateOrUpdateSender(req)
+	if err != nil {
+		if future.FutureAPI != nil && future.Response() != nil && future.Response().StatusCode == http.StatusPreconditionFailed {
+			return subnet, ErrSubnetModified
+		}
+		return subnet, fmt.Errorf("cannot update subnet: %v", err)
+	}
+
+	err = future.WaitForCompletionRef(ctx, subnetsClient.Client)
+	if err != nil {
+		return subnet, fmt.Errorf("cannot get subnet update future response: %v", err)
+	}
+
+	subnet, err = future.Result(subnetsClient)
+	if err != nil {
+		return subnet, fmt.Errorf("error loading update result: %v", err)
+	}
+	return subnet, nil
+}
+
+// ModifySubnet reads the subnet with ID subnetID, applies change and updates
+// it, starting over when it was modified in between. The subnet is not
+// updated when change reports no change.
+func ModifySubnet(ctx context.Context, subnetID string, change func(*network.Subnet) (bool, error)) (network.Subnet, error) {
+	for i := 0; ; i++ {
+		subnet, err := GetSubnet(ctx, subnetID)
+		if err != nil {
+			return subnet, fmt.Errorf("GetSubnet error: %v", err)
+		}
+		changed, err := change(&subnet)
+		if err != nil || !changed {
+			return subnet, err
+		}
+		subnet, err = UpdateSubnet(ctx, subnet)
+		if err != ErrSubnetModified || i+1 == maxNicUpdates {
+			return subnet, err
+		}
+	}
+}
+
+// SetSubnetNatGateway attaches the NAT gateway with ID natID to a subnet,
+// which holds a single NAT gateway. It reports whether subnet changed.
+func SetSubnetNatGateway(subnet *network.Subnet, natID string) (bool, error) {
+	if subnet.SubnetPropertiesFormat == nil {
+		subnet.SubnetPropertiesFormat = &network.SubnetPropertiesFormat{}
+	}
+	if current := subnet.NatGateway; current != nil && current.ID != nil {
+		if strings.EqualFold(*current.ID, natID) {
+			return false, nil
+		}
+		return false, fmt.Errorf("subnet %s has nat gateway %s", to.String(subnet.ID), *current.ID)
+	}
+	subnet.NatGateway = &network.SubResource{ID: to.StringPtr(natID)}
+	return true, nil
+}
+
+// RemoveSubnetNatGateway detaches the NAT gateway with ID natID from a
+// subnet. It reports whether subnet changed.
+func RemoveSubnetNatGateway(subnet *network.Subnet, natID string) bool {
+	if subnet.SubnetPropertiesFormat == nil || subnet.NatGateway == nil || subnet.NatGateway.ID == nil || !strings.EqualFold(*subnet.NatGateway.ID, natID) {
+		return false
+	}
+	subnet.NatGateway = nil
+	return true
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package network
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// SetTags sets tags on top of the tags of a resource, leaving the others as
+// they are. It reports whether the tags changed.
+func SetTags(current *map[string]*string, tags map[string]string) bool {
+	changed := false
+	for name, value := range tags {
+		if v, found := (*current)[name]; found && v != nil && *v == value {
+			continue
+		}
+		if *current == nil {
+			*current = make(map[string]*string)
+		}
+		(*current)[name] = to.StringPtr(value)
+		changed = true
+	}
+	return changed
+}
+
+// SetNicTags is SetTags for the tags of a network interface.
+func SetNicTags(nic *network.Interface, tags map[string]string) bool {
+	return SetTags(&nic.Tags, tags)
+}
+
+// UpdatePublicIPTags sets tags on top of the tags of a public IP of a
+// resource group, unless it already has them
+func UpdatePublicIPTags(ctx context.Context, group string, ip network.PublicIPAddress, tags map[string]string) (network.PublicIPAddress, error) {
+	current := ip.Tags
+	if !SetTags(&current, tags) {
+		return ip, nil
+	}
+	ipClient := getIPClient()
+	return ipClient.UpdateTags(ctx, group, *ip.Name, network.TagsObject{Tags: current})
+}
@@ -0,0 +1,88 @@
+package azure
+
+import (
+	"context"
+	"sync"
+
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/yingeli/egress-ip-operator/providers/azure/network"
+)
+
+// nicChange changes the IP configurations of a NIC and reports whether it
+// did. A change that fails must leave the NIC untouched.
+type nicChange func(nic *aznetwork.Interface) (bool, error)
+
+type pendingNicChange struct {
+	change nicChange
+	nic    aznetwork.Interface
+	err    error
+	done   chan struct{}
+}
+
+// nicUpdater coalesces the changes made to the primary NIC of the node
+// while an update is in flight into the next update, so that concurrent
+// associations cost a single long-running PUT. The caller that finds the
+// updater idle runs the updates for everyone with its context.
+type nicUpdater struct {
+	get    func(ctx context.Context) (aznetwork.Interface, error)
+	modify func(ctx context.Context, get func(context.Context) (aznetwork.Interface, error), change func(*aznetwork.Interface) (bool, error)) (aznetwork.Interface, error)
+
+	mu      sync.Mutex
+	pending []*pendingNicChange
+	busy    bool
+}
+
+func newNicUpdater(get func(ctx context.Context) (aznetwork.Interface, error)) *nicUpdater {
+	return &nicUpdater{get: get, modify: network.ModifyNic}
+}
+
+// apply applies change to the NIC and returns the NIC as updated.
+func (u *nicUpdater) apply(ctx context.Context, change nicChange) (aznetwork.Interface, error) {
+	c := &pendingNicChange{change: change, done: make(chan struct{})}
+	u.mu.Lock()
+	u.pending = append(u.pending, c)
+	leader := !u.busy
+	u.busy = true
+	u.mu.Unlock()
+
+	if leader {
+		u.flush(ctx)
+	}
+	select {
+	case <-c.done:
+		return c.nic, c.err
+	case <-ctx.Done():
+		return aznetwork.Interface{}, ctx.Err()
+	}
+}
+
+// flush updates the NIC with the pending changes until none are left.
+func (u *nicUpdater) flush(ctx context.Context) {
+	for {
+		u.mu.Lock()
+		batch := u.pending
+		u.pending = nil
+		if len(batch) == 0 {
+			u.busy = false
+			u.mu.Unlock()
+			return
+		}
+		u.mu.Unlock()
+
+		nic, err := u.modify(ctx, u.get, func(nic *aznetwork.Interface) (bool, error) {
+			changed := false
+			for _, c := range batch {
+				var ok bool
+				ok, c.err = c.change(nic)
+				changed = changed || ok
+			}
+			return changed, nil
+		})
+		for _, c := range batch {
+			if c.err == nil {
+				c.nic, c.err = nic, err
+			}
+			close(c.done)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// fakeNic is a NIC whose IP configurations are names, updated by a
+// blocking fake of network.ModifyNic.
+type fakeNic struct {
+	mu      sync.Mutex
+	names   []string
+	updates [][]string
+	// updates signal updating, then wait for release
+	updating chan struct{}
+	release  chan struct{}
+}
+
+func (f *fakeNic) get(ctx context.Context) (aznetwork.Interface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ipconfigs []aznetwork.InterfaceIPConfiguration
+	for _, name := range f.names {
+		ipconfigs = append(ipconfigs, aznetwork.InterfaceIPConfiguration{Name: to.StringPtr(name)})
+	}
+	return aznetwork.Interface{
+		Name:                      to.StringPtr("node-1-nic"),
+		InterfacePropertiesFormat: &aznetwork.InterfacePropertiesFormat{IPConfigurations: &ipconfigs},
+	}, nil
+}
+
+func (f *fakeNic) modify(ctx context.Context, get func(context.Context) (aznetwork.Interface, error), change func(*aznetwork.Interface) (bool, error)) (aznetwork.Interface, error) {
+	nic, err := get(ctx)
+	if err != nil {
+		return nic, err
+	}
+	if changed, err := change(&nic); err != nil || !changed {
+		return nic, err
+	}
+	f.updating <- struct{}{}
+	<-f.release
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.names = nil
+	for _, ipconfig := range *nic.IPConfigurations {
+		f.names = append(f.names, *ipconfig.Name)
+	}
+	f.updates = append(f.updates, f.names)
+	return nic, nil
+}
+
+func addIPConfiguration(name string) nicChange {
+	return func(nic *aznetwork.Interface) (bool, error) {
+		for _, ipconfig := range *nic.IPConfigurations {
+			if *ipconfig.Name == name {
+				return false, fmt.Errorf("%s exists", name)
+			}
+		}
+		*nic.IPConfigurations = append(*nic.IPConfigurations, aznetwork.InterfaceIPConfiguration{Name: to.StringPtr(name)})
+		return true, nil
+	}
+}
+
+func (u *nicUpdater) pendingChanges() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.pending)
+}
+
+func TestNicUpdaterCoalesces(t *testing.T) {
+	f := &fakeNic{names: []string{"ipconfig1"}, updating: make(chan struct{}, 2), release: make(chan struct{})}
+	u := newNicUpdater(f.get)
+	u.modify = f.modify
+	ctx := testContext(t)
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result)
+	apply := func(name string) {
+		_, err := u.apply(ctx, addIPConfiguration(name))
+		results <- result{name, err}
+	}
+
+	// the first change is in flight when the others come in
+	go apply("a")
+	<-f.updating
+	go apply("b")
+	go apply("c")
+	go apply("ipconfig1")
+	for u.pendingChanges() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(f.release)
+
+	errs := make(map[string]error)
+	for i := 0; i < 4; i++ {
+		r := <-results
+		errs[r.name] = r.err
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if errs[name] != nil {
+			t.Errorf("change %s error: %v", name, errs[name])
+		}
+	}
+	if errs["ipconfig1"] == nil {
+		t.Errorf("change ipconfig1 succeeded, want it failed alone")
+	}
+
+	if len(f.updates) != 2 {
+		t.Fatalf("updates %v, want 2", f.updates)
+	}
+	// b and c come in either order
+	got := append([]string(nil), f.updates[1]...)
+	sort.Strings(got)
+	if want := []string{"a", "b", "c", "ipconfig1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second update %v, want %v", f.updates[1], want)
+	}
+}
+
+func TestNicUpdaterErrors(t *testing.T) {
+	f := &fakeNic{updating: make(chan struct{}, 1), release: make(chan struct{})}
+	close(f.release)
+	u := newNicUpdater(func(ctx context.Context) (aznetwork.Interface, error) {
+		return aznetwork.Interface{}, errors.New("GetVM error")
+	})
+	u.modify = f.modify
+
+	if _, err := u.apply(testContext(t), addIPConfiguration("a")); err == nil || err.Error() != "GetVM error" {
+		t.Errorf("apply error %v, want GetVM error", err)
+	}
+	// the updater is idle again
+	if u.busy {
+		t.Errorf("updater busy after its update failed")
+	}
+}
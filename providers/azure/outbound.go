@@ -0,0 +1,326 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	azcompute "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/providers/azure/compute"
+	"github.com/yingeli/egress-ip-operator/providers/azure/network"
+)
+
+// In the loadBalancer mode, every EgressIP has a frontend IP configuration
+// with its public IP, a backend pool and an outbound rule sending the
+// traffic of the pool out from the frontend, all named after the public IP.
+// The primary IP configuration of the node its gateway runs on is the only
+// member of the pool, so moving the EgressIP is a change of membership.
+// Instances of uniform scale sets join and leave pools through their model.
+const (
+	defaultLoadBalancer = "egress-ip"
+	outboundPrefix      = "egress-ip"
+
+	defaultIdleTimeoutInMinutes = 4
+)
+
+func (p *Provider) ensureOutbound(ctx context.Context, publicIPAddr string, owner providers.Owner) (association providers.Association, err error) {
+	pip, err := p.lookupPublicIP(ctx, publicIPAddr)
+	if err != nil {
+		return association, err
+	}
+	if pip, err = p.tagPublicIP(ctx, pip, owner); err != nil {
+		return association, err
+	}
+
+	nics, err := p.nics(ctx)
+	if err != nil {
+		return association, err
+	}
+	nic := nics[0]
+	ipconfig, found := primaryIPConfiguration(nic)
+	if !found {
+		return association, fmt.Errorf("cannot find primary ip configuration on nic %s", *nic.Name)
+	}
+	association = providers.Association{PublicIP: publicIPAddr, SourceIP: *ipconfig.PrivateIPAddress}
+
+	name := outboundName(*pip.Name)
+	poolID := p.poolID(name)
+	if pool, found := p.outboundPool(nic); found {
+		if strings.EqualFold(pool, poolID) {
+			return association, nil
+		}
+		return association, fmt.Errorf("cannot put VM %s in backend pool %s: it is in backend pool %s", p.vm, poolID, pool)
+	}
+
+	// Azure applies a single outbound rule to an IP configuration
+	if err := p.checkOtherOutboundRules(ctx, ipconfig); err != nil {
+		return association, err
+	}
+
+	// the public IP cannot be on a NIC and the load balancer at once
+	if pip.IPConfiguration != nil && pip.IPConfiguration.ID != nil && strings.Contains(strings.ToLower(*pip.IPConfiguration.ID), "/networkinterfaces/") {
+		if err := network.DissociatePublicIP(ctx, &pip, ipconfigPrefix); err != nil {
+			return association, fmt.Errorf("DissociatePublicIP error: %v", err)
+		}
+	}
+
+	lb, err := network.ModifyLoadBalancer(ctx, func(ctx context.Context) (aznetwork.LoadBalancer, error) {
+		return p.getLoadBalancer(ctx, *nic.Location)
+	}, func(lb *aznetwork.LoadBalancer) (bool, error) {
+		return network.SetOutboundRule(lb, name, pip, p.config.AllocatedOutboundPorts, p.idleTimeout()), nil
+	})
+	if err != nil {
+		return association, fmt.Errorf("ModifyLoadBalancer error: %v", err)
+	}
+
+	// the public IP moves along with the membership of the pool
+	for _, member := range network.BackendPoolMembers(lb, poolID) {
+		if strings.EqualFold(member, *ipconfig.ID) {
+			continue
+		}
+		if err := leaveBackendPool(ctx, member, poolID); err != nil {
+			return association, err
+		}
+	}
+
+	if p.vmss != "" {
+		// the NICs of scale set instances cannot be tagged
+		_, err = compute.ModifyVMSSVM(ctx, p.vmss, p.instance, func(vm *azcompute.VirtualMachineScaleSetVM) (bool, error) {
+			return compute.SetVMSSVMBackendPool(vm, *nic.Name, *ipconfig.Name, poolID)
+		})
+	} else {
+		_, err = p.updater(*nic.Name).apply(ctx, func(nic *aznetwork.Interface) (bool, error) {
+			changed, err := network.SetNicBackendPool(nic, association.SourceIP, poolID)
+			if err != nil {
+				return false, err
+			}
+			return network.SetNicTags(nic, p.nicTags(owner)) || changed, nil
+		})
+	}
+	p.forgetCapacity()
+	if err != nil {
+		return association, err
+	}
+	return association, nil
+}
+
+// checkOtherOutboundRules returns an error when ipconfig is in the backend
+// pool of an outbound rule of another load balancer, such as the kubernetes
+// load balancer of AKS clusters of the loadBalancer outbound type.
+func (p *Provider) checkOtherOutboundRules(ctx context.Context, ipconfig aznetwork.InterfaceIPConfiguration) error {
+	if ipconfig.LoadBalancerBackendAddressPools == nil {
+		return nil
+	}
+	prefix := strings.ToLower(p.poolID(outboundPrefix + "_"))
+	for _, pool := range *ipconfig.LoadBalancerBackendAddressPools {
+		if pool.ID == nil || strings.HasPrefix(strings.ToLower(*pool.ID), prefix) {
+			continue
+		}
+		r, err := network.ParseBackendPoolID(*pool.ID)
+		if err != nil {
+			return fmt.Errorf("ParseBackendPoolID error: %v", err)
+		}
+		lb, err := network.GetLoadBalancerInGroup(ctx, r.ResourceGroup, r.LoadBalancerName)
+		if err != nil {
+			return fmt.Errorf("GetLoadBalancer error: %v", err)
+		}
+		if rule, found := network.OutboundRuleOfPool(lb, *pool.ID); found {
+			return fmt.Errorf("cannot send the traffic of VM %s out through load balancer %s: its primary ip configuration is in backend pool %s of outbound rule %s of load balancer %s, and Azure applies a single outbound rule to it",
+				p.vm, p.loadBalancerName(), r.Name, rule, r.LoadBalancerName)
+		}
+	}
+	return nil
+}
+
+// leaveBackendPool takes the IP configuration with ID ipconfigID, of
+// another node, out of the backend pool with ID poolID.
+func leaveBackendPool(ctx context.Context, ipconfigID string, poolID string) error {
+	if r, found := network.ParseVMSSIPConfigurationID(ipconfigID); found {
+		_, err := compute.ModifyVMSSVM(ctx, r.ScaleSetName, r.InstanceID, func(vm *azcompute.VirtualMachineScaleSetVM) (bool, error) {
+			return compute.RemoveVMSSVMBackendPools(vm, r.NicName, r.Name, poolID), nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot take %s out of backend pool %s: %v", ipconfigID, poolID, err)
+		}
+		return nil
+	}
+	r, err := network.ParseIPConfigurationID(ipconfigID)
+	if err != nil {
+		return fmt.Errorf("ParseIPConfigurationID error: %v", err)
+	}
+	getNic := func(ctx context.Context) (aznetwork.Interface, error) {
+		nic, err := network.GetNic(ctx, r.NicName)
+		if err != nil {
+			return nic, fmt.Errorf("GetNic error: %v", err)
+		}
+		return nic, nil
+	}
+	_, err = network.ModifyNic(ctx, getNic, func(nic *aznetwork.Interface) (bool, error) {
+		return network.RemoveNicBackendPool(nic, ipconfigID, poolID), nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot take %s out of backend pool %s: %v", ipconfigID, poolID, err)
+	}
+	return nil
+}
+
+func (p *Provider) listOutbound(ctx context.Context) ([]providers.Association, error) {
+	nics, err := p.nics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pools := make(map[string]string)
+	for _, nic := range nics {
+		for _, ipconfig := range *nic.IPConfigurations {
+			if ipconfig.PrivateIPAddress == nil {
+				continue
+			}
+			if pool, found := p.ipconfigOutboundPool(ipconfig); found {
+				pools[*ipconfig.PrivateIPAddress] = pool
+			}
+		}
+	}
+	if len(pools) == 0 {
+		return nil, nil
+	}
+
+	lb, err := network.GetLoadBalancer(ctx, p.loadBalancerName())
+	if err != nil {
+		if lb.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetLoadBalancer error: %v", err)
+	}
+	outbound := network.OutboundPublicIPs(lb)
+	addrs, err := publicIPAddresses(ctx, p.publicIPGroup())
+	if err != nil {
+		return nil, err
+	}
+
+	var associations []providers.Association
+	for source, pool := range pools {
+		if addr, found := addrs[strings.ToLower(outbound[strings.ToLower(pool)])]; found {
+			associations = append(associations, providers.Association{PublicIP: addr, SourceIP: source})
+		}
+	}
+	return associations, nil
+}
+
+func (p *Provider) dissociateOutbound(ctx context.Context, privateIPAddr string) error {
+	nics, err := p.nics(ctx)
+	if err != nil {
+		return err
+	}
+	prefix := p.poolID(outboundPrefix + "_")
+	for _, nic := range nics {
+		if !hasPrivateIP(nic, privateIPAddr) {
+			continue
+		}
+		if p.vmss != "" {
+			err = p.leaveScaleSetBackendPools(ctx, nic, privateIPAddr, prefix)
+		} else {
+			_, err = p.updater(*nic.Name).apply(ctx, func(nic *aznetwork.Interface) (bool, error) {
+				return network.RemoveNicBackendPools(nic, privateIPAddr, prefix), nil
+			})
+		}
+		p.forgetCapacity()
+		return err
+	}
+	return nil
+}
+
+// leaveScaleSetBackendPools takes the IP configuration of privateIPAddr on
+// nic, of this scale set instance, out of the backend pools whose ID starts
+// with poolPrefix.
+func (p *Provider) leaveScaleSetBackendPools(ctx context.Context, nic aznetwork.Interface, privateIPAddr string, poolPrefix string) error {
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PrivateIPAddress == nil || *ipconfig.PrivateIPAddress != privateIPAddr || ipconfig.Name == nil {
+			continue
+		}
+		_, err := compute.ModifyVMSSVM(ctx, p.vmss, p.instance, func(vm *azcompute.VirtualMachineScaleSetVM) (bool, error) {
+			return compute.RemoveVMSSVMBackendPools(vm, *nic.Name, *ipconfig.Name, poolPrefix), nil
+		})
+		return err
+	}
+	return nil
+}
+
+// getLoadBalancer returns the load balancer of the EgressIPs, or a new one
+// in location when it does not exist yet.
+func (p *Provider) getLoadBalancer(ctx context.Context, location string) (aznetwork.LoadBalancer, error) {
+	name := p.loadBalancerName()
+	lb, err := network.GetLoadBalancer(ctx, name)
+	if err == nil {
+		return lb, nil
+	}
+	if lb.StatusCode != http.StatusNotFound {
+		return lb, fmt.Errorf("GetLoadBalancer error: %v", err)
+	}
+	return aznetwork.LoadBalancer{
+		Name:                         to.StringPtr(name),
+		ID:                           to.StringPtr(network.LoadBalancerID(name)),
+		Location:                     to.StringPtr(location),
+		Sku:                          &aznetwork.LoadBalancerSku{Name: aznetwork.LoadBalancerSkuNameStandard},
+		LoadBalancerPropertiesFormat: &aznetwork.LoadBalancerPropertiesFormat{},
+	}, nil
+}
+
+// outboundPool returns the backend pool of an EgressIP the primary IP
+// configuration of nic is in.
+func (p *Provider) outboundPool(nic aznetwork.Interface) (string, bool) {
+	ipconfig, found := primaryIPConfiguration(nic)
+	if !found {
+		return "", false
+	}
+	return p.ipconfigOutboundPool(ipconfig)
+}
+
+func (p *Provider) ipconfigOutboundPool(ipconfig aznetwork.InterfaceIPConfiguration) (string, bool) {
+	if ipconfig.LoadBalancerBackendAddressPools == nil {
+		return "", false
+	}
+	prefix := strings.ToLower(p.poolID(outboundPrefix + "_"))
+	for _, pool := range *ipconfig.LoadBalancerBackendAddressPools {
+		if pool.ID != nil && strings.HasPrefix(strings.ToLower(*pool.ID), prefix) {
+			return *pool.ID, true
+		}
+	}
+	return "", false
+}
+
+func primaryIPConfiguration(nic aznetwork.Interface) (aznetwork.InterfaceIPConfiguration, bool) {
+	for _, ipconfig := range *nic.IPConfigurations {
+		if (ipconfig.Primary == nil || *ipconfig.Primary) && ipconfig.ID != nil && ipconfig.PrivateIPAddress != nil {
+			return ipconfig, true
+		}
+	}
+	return aznetwork.InterfaceIPConfiguration{}, false
+}
+
+func (p *Provider) poolID(name string) string {
+	return network.LoadBalancerID(p.loadBalancerName()) + "/backendAddressPools/" + name
+}
+
+func (p *Provider) loadBalancerName() string {
+	if p.config.LoadBalancer != "" {
+		return p.config.LoadBalancer
+	}
+	return defaultLoadBalancer
+}
+
+func (p *Provider) idleTimeout() int32 {
+	if p.config.IdleTimeoutInMinutes > 0 {
+		return p.config.IdleTimeoutInMinutes
+	}
+	return defaultIdleTimeoutInMinutes
+}
+
+// outboundName names the frontend IP configuration, backend pool and
+// outbound rule of the public IP named pipName.
+func outboundName(pipName string) string {
+	return outboundPrefix + "_" + pipName
+}
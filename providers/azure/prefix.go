@@ -0,0 +1,112 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
+	"github.com/yingeli/egress-ip-operator/providers/azure/network"
+)
+
+// Public IPs allocated from a public IP prefix are Standard ones in the
+// resource group of the public IPs, and the region and zones of the prefix.
+// A prefix is named either by its resource ID or by its name in the resource
+// group of the public IPs.
+var _ providers.PrefixProvider = &Provider{}
+
+func (p *Provider) AllocatePublicIP(ctx context.Context, prefix string, name string) (string, error) {
+	if err := p.initialize(); err != nil {
+		return "", err
+	}
+	group := p.publicIPGroup()
+	pip, err := network.GetPublicIPInGroup(ctx, group, name)
+	if err == nil {
+		if !fromPrefix(pip, p.prefixID(prefix)) {
+			return "", fmt.Errorf("public ip %s exists and is not allocated from prefix %s", name, prefix)
+		}
+		if pip.IPAddress == nil {
+			return "", fmt.Errorf("public ip %s has no address yet", name)
+		}
+		return *pip.IPAddress, nil
+	}
+	if pip.StatusCode != http.StatusNotFound {
+		return "", fmt.Errorf("GetPublicIP error: %v", err)
+	}
+
+	prefixGroup, prefixName, err := p.parsePrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	pfx, err := network.GetPublicIPPrefix(ctx, prefixGroup, prefixName)
+	if err != nil {
+		return "", fmt.Errorf("GetPublicIPPrefix error: %v", err)
+	}
+	pip, err = network.CreatePublicIP(ctx, group, name, pfx)
+	if err != nil {
+		return "", fmt.Errorf("CreatePublicIP error: %v", err)
+	}
+	if pip.IPAddress == nil {
+		return "", fmt.Errorf("public ip %s has no address yet", name)
+	}
+	return *pip.IPAddress, nil
+}
+
+func (p *Provider) ReleasePublicIP(ctx context.Context, prefix string, name string) error {
+	if err := p.initialize(); err != nil {
+		return err
+	}
+	group := p.publicIPGroup()
+	pip, err := network.GetPublicIPInGroup(ctx, group, name)
+	if err != nil {
+		if pip.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("GetPublicIP error: %v", err)
+	}
+	if !fromPrefix(pip, p.prefixID(prefix)) {
+		return nil
+	}
+
+	// public IPs cannot be deleted while they are on a NIC
+	if pip.IPConfiguration != nil && pip.IPConfiguration.ID != nil && strings.Contains(strings.ToLower(*pip.IPConfiguration.ID), "/networkinterfaces/") {
+		if err := network.DissociatePublicIP(ctx, &pip, ipconfigPrefix); err != nil {
+			return fmt.Errorf("DissociatePublicIP error: %v", err)
+		}
+	}
+	if err := network.DeletePublicIPInGroup(ctx, group, *pip.Name); err != nil {
+		return fmt.Errorf("DeletePublicIP error: %v", err)
+	}
+	return nil
+}
+
+// parsePrefix returns the resource group and name of prefix.
+func (p *Provider) parsePrefix(prefix string) (string, string, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		return p.publicIPGroup(), prefix, nil
+	}
+	r, err := network.ParsePublicIPPrefixID(prefix)
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.EqualFold(r.SubscriptionID, config.SubscriptionID()) {
+		return "", "", fmt.Errorf("public ip prefix %s is not in subscription %s", prefix, config.SubscriptionID())
+	}
+	return r.ResourceGroup, r.Name, nil
+}
+
+func (p *Provider) prefixID(prefix string) string {
+	if strings.HasPrefix(prefix, "/") {
+		return prefix
+	}
+	return "/subscriptions/" + config.SubscriptionID() + "/resourceGroups/" + p.publicIPGroup() +
+		"/providers/Microsoft.Network/publicIPPrefixes/" + prefix
+}
+
+func fromPrefix(pip aznetwork.PublicIPAddress, prefixID string) bool {
+	return pip.PublicIPAddressPropertiesFormat != nil && pip.PublicIPPrefix != nil && pip.PublicIPPrefix.ID != nil &&
+		strings.EqualFold(strings.TrimSuffix(*pip.PublicIPPrefix.ID, "/"), strings.TrimSuffix(prefixID, "/"))
+}
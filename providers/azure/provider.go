@@ -2,134 +2,655 @@ package azure
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
 
+	azcompute "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest/azure"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yingeli/egress-ip-operator/providers"
 	"github.com/yingeli/egress-ip-operator/providers/azure/compute"
 	"github.com/yingeli/egress-ip-operator/providers/azure/imds"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/arm"
 	"github.com/yingeli/egress-ip-operator/providers/azure/internal/config"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
 	"github.com/yingeli/egress-ip-operator/providers/azure/network"
 	//ctrl "sigs.k8s.io/controller-runtime"
 )
 
 const (
+	Name = "azure"
+
 	ipconfigPrefix = "ipconfig-egress-ip"
+
+	// tags recording the cluster, EgressIP and node public IPs are
+	// associated for on them, and the cluster and node on their NICs
+	tagCluster  = "egress-ip-cluster"
+	tagEgressIP = "egress-ip-uid"
+	tagNode     = "egress-ip-node"
+
+	// the IP configurations an Azure NIC can hold
+	defaultMaxIPConfigurationsPerNic = 256
+
+	// ModeIPConfiguration associates public IPs with IP configurations of
+	// the NICs of the node.
+	ModeIPConfiguration = "ipConfiguration"
+	// ModeLoadBalancer sends the traffic of the node out from public IPs
+	// through the outbound rules of a load balancer.
+	ModeLoadBalancer = "loadBalancer"
 )
 
 var (
-//log = ctrl.Log.WithName("setup")
+// log = ctrl.Log.WithName("setup")
 )
 
+func init() {
+	providers.Register(Name, func(data json.RawMessage) (providers.Provider, error) {
+		var config Config
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &config); err != nil {
+				return nil, fmt.Errorf("invalid %s provider config: %v", Name, err)
+			}
+		}
+		switch config.Mode {
+		case "", ModeIPConfiguration, ModeLoadBalancer:
+		default:
+			return nil, fmt.Errorf("invalid %s provider config: unknown mode %s", Name, config.Mode)
+		}
+		return NewProvider(config), nil
+	})
+}
+
+// Config is the azure block of the provider configuration.
+type Config struct {
+	// PublicIPResourceGroup holds the public IPs of the EgressIPs, the
+	// resource group of the node when not set.
+	PublicIPResourceGroup string `json:"publicIPResourceGroup,omitempty"`
+	// ResourceManagerEndpoint overrides the Resource Manager endpoint of
+	// the cloud the node runs in.
+	ResourceManagerEndpoint string `json:"resourceManagerEndpoint,omitempty"`
+	// MetadataEndpoint overrides the endpoint of the Instance Metadata
+	// Service.
+	MetadataEndpoint string `json:"metadataEndpoint,omitempty"`
+	// AuthMethod is one of servicePrincipal, certificate, managedIdentity,
+	// workloadIdentity or none. When not set, it is picked from the
+	// credentials in the environment, falling back to the managed identity
+	// of the node.
+	AuthMethod string `json:"authMethod,omitempty"`
+	// RequestsPerSecond and RequestBurst size the token bucket rate limiting
+	// the requests of the node to Resource Manager, 5 and 10 when not set.
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	RequestBurst      int     `json:"requestBurst,omitempty"`
+	// RetryAttempts bounds the tries of throttled and failed requests, 3
+	// when not set. Retries wait for the Retry-After of the response or
+	// else RetryDelay, 1s when not set, doubled on every retry up to
+	// MaxRetryDelay, 1m when not set.
+	RetryAttempts int             `json:"retryAttempts,omitempty"`
+	RetryDelay    metav1.Duration `json:"retryDelay,omitempty"`
+	MaxRetryDelay metav1.Duration `json:"maxRetryDelay,omitempty"`
+	// MaxIPConfigurationsPerNic is the number of IP configurations a NIC
+	// can hold, 256 when not set. Public IPs go to secondary NICs once the
+	// primary one is full.
+	MaxIPConfigurationsPerNic int `json:"maxIPConfigurationsPerNic,omitempty"`
+	// Mode is ipConfiguration, the default, or loadBalancer.
+	Mode string `json:"mode,omitempty"`
+	// LoadBalancer is the Standard load balancer of the loadBalancer mode
+	// in the resource group of the node, egress-ip when not set. It is
+	// created when it does not exist.
+	LoadBalancer string `json:"loadBalancer,omitempty"`
+	// AllocatedOutboundPorts and IdleTimeoutInMinutes tune the outbound
+	// rules of the loadBalancer mode, which default to the ports Azure
+	// allocates for the size of the backend pool and 4 minutes.
+	AllocatedOutboundPorts int32 `json:"allocatedOutboundPorts,omitempty"`
+	IdleTimeoutInMinutes   int32 `json:"idleTimeoutInMinutes,omitempty"`
+	// ClusterID is recorded on the public IPs and NICs the operator
+	// changes, the resource group of the node when not set. Clusters
+	// sharing a resource group need IDs of their own.
+	ClusterID string `json:"clusterID,omitempty"`
+}
+
 type Provider struct {
-	vm string
+	config   Config
+	metadata *imds.Client
+	// initMu serializes the initialization, which sets vm, vmss and
+	// instance and resets the settings of the packages talking to Azure
+	initMu sync.Mutex
+	vm     string
+	// the scale set and instance ID of the node when it is an instance of a
+	// uniform scale set, whose NICs change through the model of the instance
+	vmss     string
+	instance string
+
+	mu sync.Mutex
+	// the updaters of the NICs of the node by name
+	updaters map[string]*nicUpdater
+	// the free IP configurations of the NICs as last read, unknown once
+	// they are updated
+	free      int
+	freeKnown bool
 }
 
-func NewProvider() Provider {
-	return Provider{}
+func NewProvider(config Config) *Provider {
+	return &Provider{
+		config:   config,
+		metadata: imds.NewClient(config.MetadataEndpoint),
+		updaters: make(map[string]*nicUpdater),
+	}
 }
 
-func (p *Provider) Associate(ctx context.Context, publicIPAddr string, localIPAddr string) (sourceIPAddr string, err error) {
-	if !p.initialized() {
-		if err := p.initialize(); err != nil {
-			return sourceIPAddr, err
-		}
+func (p *Provider) ListAssociations(ctx context.Context) ([]providers.Association, error) {
+	if err := p.initialize(); err != nil {
+		return nil, err
+	}
+	if p.outbound() {
+		return p.listOutbound(ctx)
 	}
-	return p.associate(ctx, publicIPAddr, localIPAddr)
+	return p.listAssociations(ctx)
+}
+
+func (p *Provider) EnsureAssociation(ctx context.Context, publicIPAddr string, localIPAddr string, owner providers.Owner) (providers.Association, error) {
+	if err := p.initialize(); err != nil {
+		return providers.Association{}, err
+	}
+	if p.outbound() {
+		return p.ensureOutbound(ctx, publicIPAddr, owner)
+	}
+	return p.ensureAssociation(ctx, publicIPAddr, localIPAddr, owner)
 }
 
 func (p *Provider) Dissociate(ctx context.Context, sourceIPAddr string) error {
-	if !p.initialized() {
-		if err := p.initialize(); err != nil {
-			return err
-		}
+	if err := p.initialize(); err != nil {
+		return err
+	}
+	if p.outbound() {
+		return p.dissociateOutbound(ctx, sourceIPAddr)
 	}
 	return p.dissociate(ctx, sourceIPAddr)
 }
 
+func (p *Provider) Health(ctx context.Context) error {
+	if err := p.initialize(); err != nil {
+		return err
+	}
+	if p.vmss != "" {
+		if _, err := compute.GetVMSSVM(ctx, p.vmss, p.instance); err != nil {
+			return fmt.Errorf("GetVMSSVM error: %v", err)
+		}
+		return nil
+	}
+	if _, err := compute.GetVM(ctx, p.vm); err != nil {
+		return fmt.Errorf("GetVM error: %v", err)
+	}
+	return nil
+}
+
+// Capacity is the number of IP configurations the NICs of the node can
+// still take, or when its traffic leaves through outbound rules 1 until the
+// node is in a backend pool.
+func (p *Provider) Capacity(ctx context.Context) (int, error) {
+	if err := p.initialize(); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	free, known := p.free, p.freeKnown
+	p.mu.Unlock()
+	if known {
+		return free, nil
+	}
+	if _, err := p.nics(ctx); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.free, nil
+}
+
+// Capabilities of Azure: public IPs are associated with IP configurations
+// of the NIC of the node, which holds many. Outbound rules only apply to
+// the primary IP configuration, which can be in a single one.
+func (p *Provider) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		NodeAssociation:    true,
+		MultipleIPsPerNode: !p.outbound(),
+	}
+}
+
+// outbound returns whether the traffic of the node leaves through the
+// outbound rules of the load balancer, in the loadBalancer mode.
+func (p *Provider) outbound() bool {
+	return p.config.Mode == ModeLoadBalancer
+}
+
 func (p *Provider) initialized() bool {
 	return p.vm != ""
 }
 
+// initialize connects the provider to Azure once. It is called by every
+// entry point, which can run concurrently.
 func (p *Provider) initialize() error {
+	p.initMu.Lock()
+	defer p.initMu.Unlock()
+	if p.initialized() {
+		return nil
+	}
+	return p.connect()
+}
+
+func (p *Provider) connect() error {
 	err := config.ParseEnvironment()
 	if err != nil {
 		return fmt.Errorf("config.ParseEnvironment error: %v", err)
 	}
 
-	metadata, err := imds.GetMetadata()
+	metadata, err := p.metadata.GetMetadata(context.Background())
 	if err != nil {
 		return fmt.Errorf("imds.GetMetadata error: %v", err)
 	}
 	compute := metadata.Compute
 
 	config.SetGroup(compute.AzEnvironment, compute.SubscriptionId, compute.ResourceGroupName)
+	if p.config.ResourceManagerEndpoint != "" {
+		config.SetResourceManagerEndpoint(p.config.ResourceManagerEndpoint)
+	}
+
+	arm.SetOptions(arm.Options{
+		RequestsPerSecond: p.config.RequestsPerSecond,
+		Burst:             p.config.RequestBurst,
+		Attempts:          p.config.RetryAttempts,
+		RetryDelay:        p.config.RetryDelay.Duration,
+		MaxRetryDelay:     p.config.MaxRetryDelay.Duration,
+	})
+
+	config.SetAuthMethod(p.config.AuthMethod)
+	iam.ResetAuthorizers()
+	if _, err := iam.GetResourceManagementAuthorizer(); err != nil {
+		return fmt.Errorf("cannot authenticate to Azure: %v", err)
+	}
+
+	// the IP configurations of instances of uniform scale sets come from the
+	// scale set model, which only allocates public IPs of its own but can
+	// put them in backend pools
+	vmss, instance := scaleSetInstance(compute)
+	if vmss != "" && !p.outbound() {
+		return fmt.Errorf("node %s is an instance of the uniform scale set %s, which needs the %s mode", compute.Name, vmss, ModeLoadBalancer)
+	}
 
 	p.vm = compute.Name
+	p.vmss, p.instance = vmss, instance
 
 	return nil
 }
 
-func (p *Provider) associate(ctx context.Context, publicIPAddr string, localIPAddr string) (sourceIPAddr string, err error) {
-	pip, found, err := network.LookupPublicIP(ctx, publicIPAddr)
+var scaleSetInstancePattern = regexp.MustCompile(`(?i)/virtualMachineScaleSets/([^/]+)/virtualMachines/([^/]+)$`)
+
+// scaleSetInstance returns the scale set and instance ID of a VM of a
+// uniform scale set. VMs of flexible scale sets are standalone VMs, with
+// resource IDs of their own.
+func scaleSetInstance(compute imds.Compute) (vmss string, instance string) {
+	if compute.VmScaleSetName == "" {
+		return "", ""
+	}
+	if match := scaleSetInstancePattern.FindStringSubmatch(compute.ResourceId); match != nil {
+		return match[1], match[2]
+	}
+	return "", ""
+}
+
+func (p *Provider) ensureAssociation(ctx context.Context, publicIPAddr string, localIPAddr string, owner providers.Owner) (association providers.Association, err error) {
+	pip, err := p.lookupPublicIP(ctx, publicIPAddr)
 	if err != nil {
-		return sourceIPAddr, fmt.Errorf("LookupPublicIP error: %v", err)
+		return association, err
 	}
-	if !found {
-		return sourceIPAddr, fmt.Errorf("LookupPublicIP cannot find public ip %s", publicIPAddr)
+	if pip, err = p.tagPublicIP(ctx, pip, owner); err != nil {
+		return association, err
+	}
+
+	nics, err := p.nics(ctx)
+	if err != nil {
+		return association, err
+	}
+	for _, nic := range nics {
+		if association, found := associationOf(nic, pip, publicIPAddr); found {
+			return association, nil
+		}
+	}
+
+	nic, err := p.nicFor(nics, localIPAddr)
+	if err != nil {
+		return association, err
 	}
 
 	if pip.IPConfiguration != nil {
 		err = network.DissociatePublicIP(ctx, &pip, ipconfigPrefix)
 		if err != nil {
-			return sourceIPAddr, fmt.Errorf("DissociatePublicIP error: %v", err)
+			return association, fmt.Errorf("DissociatePublicIP error: %v", err)
 		}
 	}
 
-	vm, err := compute.GetVM(ctx, p.vm)
+	ipconfigName := getIPConfigurationName(*pip.Name)
+	limit := p.maxIPConfigurations()
+	nic, err = p.updater(*nic.Name).apply(ctx, func(nic *aznetwork.Interface) (bool, error) {
+		// the NIC may have filled up since it was picked
+		if _, found := associationOf(*nic, pip, publicIPAddr); !found && !hasPrivateIP(*nic, localIPAddr) && len(*nic.IPConfigurations) >= limit {
+			return false, fmt.Errorf("nic %s is full with %d ip configurations", *nic.Name, limit)
+		}
+		changed, err := network.SetNicPublicIP(nic, pip, localIPAddr, ipconfigName)
+		if err != nil {
+			return false, err
+		}
+		return network.SetNicTags(nic, p.nicTags(owner)) || changed, nil
+	})
+	p.forgetCapacity()
 	if err != nil {
-		return sourceIPAddr, fmt.Errorf("GetVM error: %v", err)
+		return association, err
+	}
+	association, found := associationOf(nic, pip, publicIPAddr)
+	if !found {
+		return association, fmt.Errorf("cannot find public ip %s on nic %s after update", publicIPAddr, *nic.Name)
 	}
+	return association, nil
+}
 
-	for _, ni := range *vm.NetworkProfile.NetworkInterfaces {
-		resource, err := azure.ParseResourceID(*ni.ID)
-		if err != nil {
-			return sourceIPAddr, fmt.Errorf("ParseResourceID error: %v", err)
+// nicFor returns the NIC to associate a public IP with: the one holding the
+// IP configuration of localIPAddr, or else the first one with room for
+// another IP configuration, the primary NIC first.
+func (p *Provider) nicFor(nics []aznetwork.Interface, localIPAddr string) (aznetwork.Interface, error) {
+	for _, nic := range nics {
+		if hasPrivateIP(nic, localIPAddr) {
+			return nic, nil
+		}
+	}
+	limit := p.maxIPConfigurations()
+	for _, nic := range nics {
+		if len(*nic.IPConfigurations) < limit {
+			return nic, nil
 		}
+	}
+	return aznetwork.Interface{}, fmt.Errorf("cannot associate more public ips with VM %s: its %d nics hold %d ip configurations each", p.vm, len(nics), limit)
+}
 
-		nic, err := network.GetNic(ctx, resource.ResourceName)
-		if err != nil {
-			return sourceIPAddr, fmt.Errorf("GetNic error: %v", err)
+func hasPrivateIP(nic aznetwork.Interface, privateIPAddr string) bool {
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PrivateIPAddress != nil && *ipconfig.PrivateIPAddress == privateIPAddr {
+			return true
 		}
+	}
+	return false
+}
 
-		if nic.Primary == nil || *nic.Primary {
-			return network.AssociateNicWithPublicIP(ctx, nic, pip, localIPAddr, getIPConfigurationName(*pip.Name))
+// associationOf returns the association of a public IP with an IP
+// configuration of nic.
+func associationOf(nic aznetwork.Interface, pip aznetwork.PublicIPAddress, publicIPAddr string) (providers.Association, bool) {
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PublicIPAddress == nil || ipconfig.PublicIPAddress.ID == nil || ipconfig.PrivateIPAddress == nil {
+			continue
+		}
+		if strings.EqualFold(*ipconfig.PublicIPAddress.ID, *pip.ID) {
+			return providers.Association{
+				PublicIP: publicIPAddr,
+				SourceIP: *ipconfig.PrivateIPAddress,
+				Owned:    isOwned(ipconfig),
+			}, true
 		}
 	}
-	return sourceIPAddr, fmt.Errorf("cannot find primary nic on VM %s", p.vm)
+	return providers.Association{}, false
 }
 
 func (p *Provider) dissociate(ctx context.Context, privateIPAddr string) error {
-	vm, err := compute.GetVM(ctx, p.vm)
+	nics, err := p.nics(ctx)
 	if err != nil {
-		return fmt.Errorf("GetVM error: %v", err)
+		return err
+	}
+	for _, nic := range nics {
+		if !hasPrivateIP(nic, privateIPAddr) {
+			continue
+		}
+		_, err := p.updater(*nic.Name).apply(ctx, func(nic *aznetwork.Interface) (bool, error) {
+			return network.RemoveNicPublicIPWithPrivateIP(nic, privateIPAddr, ipconfigPrefix), nil
+		})
+		p.forgetCapacity()
+		return err
+	}
+	return nil
+}
+
+func (p *Provider) listAssociations(ctx context.Context) ([]providers.Association, error) {
+	nics, err := p.nics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var associations []providers.Association
+	var addrs map[string]string
+	var ipconfigs []aznetwork.InterfaceIPConfiguration
+	for _, nic := range nics {
+		ipconfigs = append(ipconfigs, *nic.IPConfigurations...)
+	}
+	for _, ipconfig := range ipconfigs {
+		if ipconfig.PrivateIPAddress == nil {
+			continue
+		}
+		association := providers.Association{
+			SourceIP: *ipconfig.PrivateIPAddress,
+			Owned:    isOwned(ipconfig),
+		}
+		if ipconfig.PublicIPAddress == nil || ipconfig.PublicIPAddress.ID == nil {
+			if association.Owned {
+				associations = append(associations, association)
+			}
+			continue
+		}
+		if addrs == nil {
+			addrs, err = publicIPAddresses(ctx, p.publicIPGroup())
+			if err != nil {
+				return nil, err
+			}
+		}
+		if addr, found := addrs[strings.ToLower(*ipconfig.PublicIPAddress.ID)]; found {
+			association.PublicIP = addr
+			associations = append(associations, association)
+		}
+	}
+	return associations, nil
+}
+
+func isOwned(ipconfig aznetwork.InterfaceIPConfiguration) bool {
+	return ipconfig.Name != nil && strings.HasPrefix(*ipconfig.Name, ipconfigPrefix)
+}
+
+// nics returns the NICs of the node, the primary one first, and records
+// their free IP configurations.
+func (p *Provider) nics(ctx context.Context) ([]aznetwork.Interface, error) {
+	var profile *azcompute.NetworkProfile
+	if p.vmss != "" {
+		vm, err := compute.GetVMSSVM(ctx, p.vmss, p.instance)
+		if err != nil {
+			return nil, fmt.Errorf("GetVMSSVM error: %v", err)
+		}
+		profile = vm.NetworkProfile
+	} else {
+		vm, err := compute.GetVM(ctx, p.vm)
+		if err != nil {
+			return nil, fmt.Errorf("GetVM error: %v", err)
+		}
+		profile = vm.NetworkProfile
 	}
 
-	for _, ni := range *vm.NetworkProfile.NetworkInterfaces {
+	var nics []aznetwork.Interface
+	primary := false
+	for _, ni := range *profile.NetworkInterfaces {
 		resource, err := azure.ParseResourceID(*ni.ID)
 		if err != nil {
-			return fmt.Errorf("ParseResourceID error: %v", err)
+			return nil, fmt.Errorf("ParseResourceID error: %v", err)
+		}
+		nic, err := p.getNic(ctx, resource.ResourceName)
+		if err != nil {
+			return nil, err
 		}
+		if !primary && (nic.Primary == nil || *nic.Primary) {
+			nics = append([]aznetwork.Interface{nic}, nics...)
+			primary = true
+		} else {
+			nics = append(nics, nic)
+		}
+	}
+	if !primary {
+		return nil, fmt.Errorf("cannot find primary nic on VM %s", p.vm)
+	}
+
+	free := p.freeOf(nics)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free, p.freeKnown = free, true
+	return nics, nil
+}
 
-		nic, err := network.GetNic(ctx, resource.ResourceName)
+func (p *Provider) getNic(ctx context.Context, name string) (aznetwork.Interface, error) {
+	if p.vmss != "" {
+		nic, err := network.GetVMSSNic(ctx, p.vmss, p.instance, name)
 		if err != nil {
-			return fmt.Errorf("GetNic error: %v", err)
+			return nic, fmt.Errorf("GetVMSSNic error: %v", err)
+		}
+		return nic, nil
+	}
+	nic, err := network.GetNic(ctx, name)
+	if err != nil {
+		return nic, fmt.Errorf("GetNic error: %v", err)
+	}
+	return nic, nil
+}
+
+// updater returns the updater of the NIC named name.
+func (p *Provider) updater(name string) *nicUpdater {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u, found := p.updaters[name]
+	if !found {
+		u = newNicUpdater(func(ctx context.Context) (aznetwork.Interface, error) {
+			return p.getNic(ctx, name)
+		})
+		p.updaters[name] = u
+	}
+	return u
+}
+
+// forgetCapacity makes Capacity read the NICs again after they changed.
+func (p *Provider) forgetCapacity() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.freeKnown = false
+}
+
+// freeOf returns the number of public IPs nics can still take.
+func (p *Provider) freeOf(nics []aznetwork.Interface) int {
+	if p.outbound() {
+		if _, found := p.outboundPool(nics[0]); found {
+			return 0
 		}
+		return 1
+	}
+	limit := p.maxIPConfigurations()
+	free := 0
+	for _, nic := range nics {
+		if n := limit - len(*nic.IPConfigurations); n > 0 {
+			free += n
+		}
+	}
+	return free
+}
+
+func (p *Provider) maxIPConfigurations() int {
+	if p.config.MaxIPConfigurationsPerNic > 0 {
+		return p.config.MaxIPConfigurationsPerNic
+	}
+	return defaultMaxIPConfigurationsPerNic
+}
+
+func (p *Provider) lookupPublicIP(ctx context.Context, publicIPAddr string) (aznetwork.PublicIPAddress, error) {
+	pip, found, err := network.LookupPublicIPInGroup(ctx, p.publicIPGroup(), publicIPAddr)
+	if err != nil {
+		return pip, fmt.Errorf("LookupPublicIP error: %v", err)
+	}
+	if !found {
+		return pip, fmt.Errorf("LookupPublicIP cannot find public ip %s", publicIPAddr)
+	}
+	return pip, nil
+}
+
+// tagPublicIP records the cluster and owner on pip.
+func (p *Provider) tagPublicIP(ctx context.Context, pip aznetwork.PublicIPAddress, owner providers.Owner) (aznetwork.PublicIPAddress, error) {
+	tags := p.nicTags(owner)
+	if owner.EgressIP != "" {
+		tags[tagEgressIP] = owner.EgressIP
+	}
+	pip, err := network.UpdatePublicIPTags(ctx, p.publicIPGroup(), pip, tags)
+	if err != nil {
+		return pip, fmt.Errorf("UpdatePublicIPTags error: %v", err)
+	}
+	return pip, nil
+}
+
+// nicTags returns the tags recording the cluster and the node of owner.
+func (p *Provider) nicTags(owner providers.Owner) map[string]string {
+	tags := map[string]string{tagCluster: p.clusterID()}
+	if owner.Node != "" {
+		tags[tagNode] = owner.Node
+	}
+	return tags
+}
+
+func (p *Provider) clusterID() string {
+	if p.config.ClusterID != "" {
+		return p.config.ClusterID
+	}
+	return config.GroupName()
+}
+
+func (p *Provider) publicIPGroup() string {
+	if p.config.PublicIPResourceGroup != "" {
+		return p.config.PublicIPResourceGroup
+	}
+	return config.GroupName()
+}
+
+// publicIPAddresses returns the addresses of the public IPs of the resource
+// group keyed by lower case resource ID.
+func publicIPAddresses(ctx context.Context, group string) (map[string]string, error) {
+	pips, err := publicIPs(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for id, pip := range pips {
+		m[id] = *pip.IPAddress
+	}
+	return m, nil
+}
 
-		if nic.Primary == nil || *nic.Primary {
-			return network.DissociateNicPublicIPWithPrivateIP(ctx, &nic, privateIPAddr, ipconfigPrefix)
+// publicIPs returns the public IPs of the resource group that have an
+// address keyed by lower case resource ID.
+func publicIPs(ctx context.Context, group string) (map[string]aznetwork.PublicIPAddress, error) {
+	result, err := network.ListPublicIPsInGroup(ctx, group)
+	if err != nil {
+		return nil, fmt.Errorf("ListPublicIPs error: %v", err)
+	}
+	m := make(map[string]aznetwork.PublicIPAddress)
+	for result.NotDone() {
+		for _, pip := range result.Values() {
+			if pip.ID != nil && pip.IPAddress != nil {
+				m[strings.ToLower(*pip.ID)] = pip
+			}
+		}
+		if err := result.NextWithContext(ctx); err != nil {
+			return nil, fmt.Errorf("ListPublicIPs error: %v", err)
 		}
 	}
-	return fmt.Errorf("cannot find primary nic on VM %s", p.vm)
+	return m, nil
 }
 
 /*
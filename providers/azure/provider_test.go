@@ -0,0 +1,888 @@
+package azure
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/providers/azure/azuretest"
+	"github.com/yingeli/egress-ip-operator/providers/azure/imds"
+	"github.com/yingeli/egress-ip-operator/providers/azure/internal/iam"
+	"github.com/yingeli/egress-ip-operator/providers/azure/network"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *azuretest.Server) {
+	s := azuretest.NewServer()
+	t.Cleanup(s.Close)
+	p := NewProvider(Config{
+		ResourceManagerEndpoint: s.URL,
+		MetadataEndpoint:        s.URL,
+		AuthMethod:              iam.AuthMethodNone,
+		RequestsPerSecond:       1000,
+		RequestBurst:            100,
+		RetryDelay:              metav1.Duration{Duration: 10 * time.Millisecond},
+	})
+	return p, s
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestEnsureAssociation(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	ctx := testContext(t)
+
+	association, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	want := []azuretest.IPConfiguration{
+		{Name: "ipconfig1", PrivateIP: "10.240.0.4"},
+		{Name: getIPConfigurationName("eip-1"), PrivateIP: association.SourceIP, PublicIP: "eip-1"},
+	}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); !reflect.DeepEqual(ipconfigs, want) {
+		t.Errorf("IP configurations %+v, want %+v", ipconfigs, want)
+	}
+	if association.PublicIP != "20.0.0.1" || association.SourceIP == "" || !association.Owned {
+		t.Errorf("association %+v, want an owned one of 20.0.0.1", association)
+	}
+
+	// once associated, nothing is updated
+	again, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if again != association {
+		t.Errorf("association %+v, want %+v", again, association)
+	}
+	if n := s.RequestCount(http.MethodPut, "networkInterfaces"); n != 1 {
+		t.Errorf("network interface updated %d times, want 1", n)
+	}
+
+	associations, err := p.ListAssociations(ctx)
+	if err != nil {
+		t.Fatalf("ListAssociations error: %v", err)
+	}
+	if !reflect.DeepEqual(associations, []providers.Association{association}) {
+		t.Errorf("associations %+v, want %+v", associations, []providers.Association{association})
+	}
+}
+
+func TestEnsureAssociationMovesPublicIP(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddVM("node-2")
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	if err := s.Associate("node-2", "eip-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.EnsureAssociation(testContext(t), "20.0.0.1", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	for _, ipconfig := range s.IPConfigurations("node-2") {
+		if ipconfig.PublicIP != "" {
+			t.Errorf("public IP %s left on node-2", ipconfig.PublicIP)
+		}
+	}
+	ipconfigs := s.IPConfigurations(azuretest.VMName)
+	if len(ipconfigs) != 2 || ipconfigs[1].PublicIP != "eip-1" {
+		t.Errorf("IP configurations %+v, want eip-1 associated", ipconfigs)
+	}
+}
+
+func TestDissociate(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	s.AddPublicIP("node-1-pip", "52.0.0.1")
+	if err := s.Associate(azuretest.VMName, "node-1-pip"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext(t)
+
+	association, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if err := p.Dissociate(ctx, association.SourceIP); err != nil {
+		t.Fatalf("Dissociate error: %v", err)
+	}
+
+	// the IP configuration made for the association goes with it, the
+	// public IP of the node stays
+	want := []azuretest.IPConfiguration{{Name: "ipconfig1", PrivateIP: "10.240.0.4", PublicIP: "node-1-pip"}}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); !reflect.DeepEqual(ipconfigs, want) {
+		t.Errorf("IP configurations %+v, want %+v", ipconfigs, want)
+	}
+	associations, err := p.ListAssociations(ctx)
+	if err != nil {
+		t.Fatalf("ListAssociations error: %v", err)
+	}
+	wantAssociations := []providers.Association{{PublicIP: "52.0.0.1", SourceIP: "10.240.0.4"}}
+	if !reflect.DeepEqual(associations, wantAssociations) {
+		t.Errorf("associations %+v, want %+v", associations, wantAssociations)
+	}
+}
+
+func TestSecondaryNics(t *testing.T) {
+	p, s := newTestProvider(t)
+	p.config.MaxIPConfigurationsPerNic = 2
+	if err := s.AddNic(azuretest.VMName, "node-1-nic-2"); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	s.AddPublicIP("eip-2", "20.0.0.2")
+	s.AddPublicIP("eip-3", "20.0.0.3")
+	ctx := testContext(t)
+
+	capacity := func(want int) {
+		t.Helper()
+		if n, err := p.Capacity(ctx); err != nil || n != want {
+			t.Errorf("Capacity %d, %v, want %d", n, err, want)
+		}
+	}
+	capacity(2)
+
+	// the primary NIC fills up first
+	if _, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); len(ipconfigs) != 2 || ipconfigs[1].PublicIP != "eip-1" {
+		t.Errorf("IP configurations of the primary NIC %+v, want eip-1 associated", ipconfigs)
+	}
+	association, err := p.EnsureAssociation(ctx, "20.0.0.2", "10.244.0.6", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if ipconfigs := s.NicIPConfigurations("node-1-nic-2"); len(ipconfigs) != 2 || ipconfigs[1].PublicIP != "eip-2" {
+		t.Errorf("IP configurations of the secondary NIC %+v, want eip-2 associated", ipconfigs)
+	}
+	capacity(0)
+
+	if _, err := p.EnsureAssociation(ctx, "20.0.0.3", "10.244.0.7", providers.Owner{}); err == nil || !strings.Contains(err.Error(), "cannot associate more public ips") {
+		t.Errorf("EnsureAssociation error %v on a full node", err)
+	}
+	associations, err := p.ListAssociations(ctx)
+	if err != nil {
+		t.Fatalf("ListAssociations error: %v", err)
+	}
+	if len(associations) != 2 || associations[1] != association {
+		t.Errorf("associations %+v, want eip-1 and %+v", associations, association)
+	}
+
+	if err := p.Dissociate(ctx, association.SourceIP); err != nil {
+		t.Fatalf("Dissociate error: %v", err)
+	}
+	if ipconfigs := s.NicIPConfigurations("node-1-nic-2"); len(ipconfigs) != 1 {
+		t.Errorf("IP configurations of the secondary NIC %+v, want the primary only", ipconfigs)
+	}
+	capacity(1)
+}
+
+func TestLoadBalancerMode(t *testing.T) {
+	p, s := newTestProvider(t)
+	p.config.Mode = ModeLoadBalancer
+	s.AddVM("node-2")
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	ctx := testContext(t)
+
+	if p.Capabilities().MultipleIPsPerNode {
+		t.Errorf("multiple IPs per node in the loadBalancer mode")
+	}
+	association, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	// traffic leaves from the primary IP configuration, which is in the
+	// backend pool of the rule
+	if want := (providers.Association{PublicIP: "20.0.0.1", SourceIP: "10.240.0.4"}); association != want {
+		t.Errorf("association %+v, want %+v", association, want)
+	}
+	want := []azuretest.OutboundRule{{Name: "egress-ip_eip-1", PublicIP: "eip-1", Members: []string{"10.240.0.4"}}}
+	if rules := s.OutboundRules(defaultLoadBalancer); !reflect.DeepEqual(rules, want) {
+		t.Errorf("outbound rules %+v, want %+v", rules, want)
+	}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); len(ipconfigs) != 1 {
+		t.Errorf("IP configurations %+v, want the primary only", ipconfigs)
+	}
+	if n, err := p.Capacity(ctx); err != nil || n != 0 {
+		t.Errorf("Capacity %d, %v, want 0", n, err)
+	}
+	associations, err := p.ListAssociations(ctx)
+	if err != nil {
+		t.Fatalf("ListAssociations error: %v", err)
+	}
+	if !reflect.DeepEqual(associations, []providers.Association{association}) {
+		t.Errorf("associations %+v, want %+v", associations, []providers.Association{association})
+	}
+
+	// once associated, nothing is updated
+	if _, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if n := s.RequestCount(http.MethodPut, "loadBalancers"); n != 1 {
+		t.Errorf("load balancer updated %d times, want 1", n)
+	}
+
+	// failing over to node-2 changes the members of the pool
+	s.SetMetadataVM("node-2")
+	p2 := NewProvider(p.config)
+	moved, err := p2.EnsureAssociation(ctx, "20.0.0.1", "10.244.1.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	want[0].Members = []string{moved.SourceIP}
+	if rules := s.OutboundRules(defaultLoadBalancer); !reflect.DeepEqual(rules, want) {
+		t.Errorf("outbound rules %+v, want %+v", rules, want)
+	}
+	if associations, err := p.ListAssociations(ctx); err != nil || len(associations) != 0 {
+		t.Errorf("associations of node-1 %+v, %v, want none", associations, err)
+	}
+
+	if err := p2.Dissociate(ctx, moved.SourceIP); err != nil {
+		t.Fatalf("Dissociate error: %v", err)
+	}
+	want[0].Members = nil
+	if rules := s.OutboundRules(defaultLoadBalancer); !reflect.DeepEqual(rules, want) {
+		t.Errorf("outbound rules %+v, want %+v", rules, want)
+	}
+	if n, err := p2.Capacity(ctx); err != nil || n != 1 {
+		t.Errorf("Capacity %d, %v, want 1", n, err)
+	}
+}
+
+func TestLoadBalancerModeOtherOutboundRule(t *testing.T) {
+	p, s := newTestProvider(t)
+	p.config.Mode = ModeLoadBalancer
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	if err := s.AddOutboundLoadBalancer("kubernetes", azuretest.VMName); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := p.EnsureAssociation(testContext(t), "20.0.0.1", "10.244.0.5", providers.Owner{})
+	if err == nil || !strings.Contains(err.Error(), "outbound rule aksOutboundRule of load balancer kubernetes") {
+		t.Fatalf("EnsureAssociation error %v, want one naming the other outbound rule", err)
+	}
+	if n := s.RequestCount(http.MethodPut, "/"); n != 0 {
+		t.Errorf("%d resources updated, want none", n)
+	}
+}
+
+func TestSubnetEgress(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	s.AddPublicIP("eip-2", "20.0.0.2")
+	ctx := testContext(t)
+
+	if err := p.EnsureSubnetEgress(ctx, "20.0.0.1", azuretest.SubnetID); err != nil {
+		t.Fatalf("EnsureSubnetEgress error: %v", err)
+	}
+	if nat := s.SubnetNatGateway(); nat != "egress-ip_eip-1" {
+		t.Errorf("NAT gateway of the subnet %q, want egress-ip_eip-1", nat)
+	}
+	if pips, _ := s.NatGatewayPublicIPs("egress-ip_eip-1"); !reflect.DeepEqual(pips, []string{"eip-1"}) {
+		t.Errorf("public IPs of the NAT gateway %v, want eip-1", pips)
+	}
+
+	// once attached, nothing is updated
+	if err := p.EnsureSubnetEgress(ctx, "20.0.0.1", azuretest.SubnetID); err != nil {
+		t.Fatalf("EnsureSubnetEgress error: %v", err)
+	}
+	if n := s.RequestCount(http.MethodPut, ""); n != 2 {
+		t.Errorf("%d updates, want 2", n)
+	}
+
+	// the subnet has room for a single NAT gateway
+	if err := p.EnsureSubnetEgress(ctx, "20.0.0.2", azuretest.SubnetID); err == nil || !strings.Contains(err.Error(), "has nat gateway") {
+		t.Errorf("EnsureSubnetEgress error %v on a subnet with a NAT gateway", err)
+	}
+	if _, found := s.NatGatewayPublicIPs("egress-ip_eip-2"); found {
+		t.Errorf("NAT gateway egress-ip_eip-2 made for a subnet that has one")
+	}
+
+	if err := p.RemoveSubnetEgress(ctx, "20.0.0.1", azuretest.SubnetID); err != nil {
+		t.Fatalf("RemoveSubnetEgress error: %v", err)
+	}
+	if nat := s.SubnetNatGateway(); nat != "" {
+		t.Errorf("NAT gateway %s left on the subnet", nat)
+	}
+	if _, found := s.NatGatewayPublicIPs("egress-ip_eip-1"); found {
+		t.Errorf("NAT gateway egress-ip_eip-1 left")
+	}
+	if err := p.RemoveSubnetEgress(ctx, "20.0.0.1", azuretest.SubnetID); err != nil {
+		t.Errorf("RemoveSubnetEgress error once removed: %v", err)
+	}
+}
+
+func TestPublicIPPrefix(t *testing.T) {
+	p, s := newTestProvider(t)
+	if err := s.AddPublicIPPrefix("egress-prefix", "20.1.0.0/31"); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	ctx := testContext(t)
+
+	addr, err := p.AllocatePublicIP(ctx, "egress-prefix", "egress-ip-default-a")
+	if err != nil {
+		t.Fatalf("AllocatePublicIP error: %v", err)
+	}
+	if addr != "20.1.0.0" {
+		t.Errorf("allocated %s, want 20.1.0.0", addr)
+	}
+	// allocating again returns the same address
+	if again, err := p.AllocatePublicIP(ctx, "egress-prefix", "egress-ip-default-a"); err != nil || again != addr {
+		t.Errorf("allocated %s again, error %v, want %s", again, err, addr)
+	}
+	if n := s.RequestCount(http.MethodPut, "/publicIPAddresses/"); n != 1 {
+		t.Errorf("%d public IPs created, want 1", n)
+	}
+
+	prefixID := "/subscriptions/" + azuretest.SubscriptionID + "/resourceGroups/" + azuretest.ResourceGroup +
+		"/providers/Microsoft.Network/publicIPPrefixes/egress-prefix"
+	if addr, err := p.AllocatePublicIP(ctx, prefixID, "egress-ip-default-b"); err != nil || addr != "20.1.0.1" {
+		t.Errorf("allocated %s by prefix ID, error %v, want 20.1.0.1", addr, err)
+	}
+	if _, err := p.AllocatePublicIP(ctx, "egress-prefix", "egress-ip-default-c"); err == nil {
+		t.Errorf("allocated from a full prefix")
+	}
+	if _, err := p.AllocatePublicIP(ctx, "egress-prefix", "eip-1"); err == nil {
+		t.Errorf("allocated a public IP that is not from the prefix")
+	}
+
+	// released public IPs are taken off their NIC and deleted
+	if _, err := p.EnsureAssociation(ctx, "20.1.0.0", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if err := p.ReleasePublicIP(ctx, "egress-prefix", "egress-ip-default-a"); err != nil {
+		t.Fatalf("ReleasePublicIP error: %v", err)
+	}
+	if s.HasPublicIP("egress-ip-default-a") {
+		t.Errorf("released public IP left")
+	}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); len(ipconfigs) != 1 {
+		t.Errorf("IP configurations %+v after release, want the primary only", ipconfigs)
+	}
+	if err := p.ReleasePublicIP(ctx, "egress-prefix", "egress-ip-default-a"); err != nil {
+		t.Errorf("ReleasePublicIP error once released: %v", err)
+	}
+	if addr, err := p.AllocatePublicIP(ctx, "egress-prefix", "egress-ip-default-c"); err != nil || addr != "20.1.0.0" {
+		t.Errorf("allocated %s after release, error %v, want 20.1.0.0", addr, err)
+	}
+
+	// public IPs of other prefixes are not released
+	if err := p.ReleasePublicIP(ctx, "egress-prefix", "eip-1"); err != nil {
+		t.Errorf("ReleasePublicIP error: %v", err)
+	}
+	if !s.HasPublicIP("eip-1") {
+		t.Errorf("public IP not allocated from the prefix released")
+	}
+}
+
+func TestClusterAssociations(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	s.AddPublicIP("eip-2", "20.0.0.2")
+	ctx := testContext(t)
+
+	a1, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{EgressIP: "uid-1", Node: "node-a"})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	a2, err := p.EnsureAssociation(ctx, "20.0.0.2", "10.244.0.6", providers.Owner{EgressIP: "uid-2", Node: "node-a"})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	want := map[string]string{tagCluster: azuretest.ResourceGroup, tagEgressIP: "uid-1", tagNode: "node-a"}
+	if tags := s.PublicIPTags("eip-1"); !reflect.DeepEqual(tags, want) {
+		t.Errorf("public IP tags %v, want %v", tags, want)
+	}
+	want = map[string]string{tagCluster: azuretest.ResourceGroup, tagNode: "node-a"}
+	if tags := s.NicTags(azuretest.VMName); !reflect.DeepEqual(tags, want) {
+		t.Errorf("NIC tags %v, want %v", tags, want)
+	}
+
+	// a daemon crashing halfway leaves the IP configuration of eip-2 behind
+	if err := s.DetachPublicIP("eip-2"); err != nil {
+		t.Fatal(err)
+	}
+	associations, err := p.ListClusterAssociations(ctx)
+	if err != nil {
+		t.Fatalf("ListClusterAssociations error: %v", err)
+	}
+	if len(associations) != 2 {
+		t.Fatalf("cluster associations %+v, want 2", associations)
+	}
+	if a := associations[0]; a.Association != a1 || a.Owner != "uid-1" || a.Node != "node-a" || a.Version == "" {
+		t.Errorf("cluster association %+v, want %+v owned by uid-1 on node-a", a, a1)
+	}
+	leaked := associations[1]
+	if leaked.PublicIP != "" || leaked.SourceIP != a2.SourceIP || !strings.HasSuffix(leaked.Resource, "/"+getIPConfigurationName("eip-2")) {
+		t.Errorf("cluster association %+v, want the IP configuration of eip-2 without public IP", leaked)
+	}
+
+	// nothing is removed from NICs changed since they were listed
+	stale := leaked
+	stale.Version = "W/\"0\""
+	if err := p.RemoveClusterAssociation(ctx, stale); err != network.ErrNicModified {
+		t.Errorf("RemoveClusterAssociation error %v, want %v", err, network.ErrNicModified)
+	}
+	if err := p.RemoveClusterAssociation(ctx, leaked); err != nil {
+		t.Fatalf("RemoveClusterAssociation error: %v", err)
+	}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); len(ipconfigs) != 2 || ipconfigs[1].PublicIP != "eip-1" {
+		t.Errorf("IP configurations %+v, want the primary and the one of eip-1", ipconfigs)
+	}
+
+	// NICs of other clusters are left out
+	other := NewProvider(Config{ResourceManagerEndpoint: s.URL, MetadataEndpoint: s.URL, AuthMethod: iam.AuthMethodNone, ClusterID: "other"})
+	if associations, err := other.ListClusterAssociations(ctx); err != nil || len(associations) != 0 {
+		t.Errorf("cluster associations %+v, error %v, want none of another cluster", associations, err)
+	}
+}
+
+func TestUnknownMode(t *testing.T) {
+	if _, err := providers.New(Name, []byte(`{"mode": "nat"}`)); err == nil {
+		t.Errorf("provider created with an unknown mode")
+	}
+}
+
+func TestLongRunningOperations(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	s.SetPolls(3)
+
+	if _, err := p.EnsureAssociation(testContext(t), "20.0.0.1", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if n := s.RequestCount(http.MethodGet, "/operations/"); n != 4 {
+		t.Errorf("operation polled %d times, want 4", n)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	ctx := testContext(t)
+
+	// the client retries conflicts a few times
+	s.FailNext(http.MethodPut, http.StatusConflict)
+	if _, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if err := p.Dissociate(ctx, s.IPConfigurations(azuretest.VMName)[1].PrivateIP); err != nil {
+		t.Fatalf("Dissociate error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.FailNext(http.MethodPut, http.StatusConflict)
+	}
+	if _, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{}); err == nil {
+		t.Fatalf("EnsureAssociation succeeded on conflict")
+	}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); len(ipconfigs) != 1 {
+		t.Errorf("IP configurations %+v after conflict, want the primary only", ipconfigs)
+	}
+
+	// the next reconcile retries
+	if _, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	s.AddPublicIP("node-1-pip", "52.0.0.1")
+	ctx := testContext(t)
+	if err := p.Health(ctx); err != nil {
+		t.Fatalf("Health error: %v", err)
+	}
+
+	// an update of a network interface changed since it was read fails
+	// instead of overwriting the change
+	nic, err := network.GetNic(ctx, azuretest.VMName+"-nic")
+	if err != nil {
+		t.Fatalf("GetNic error: %v", err)
+	}
+	if err := s.Associate(azuretest.VMName, "node-1-pip"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.UpdateNic(ctx, nic); err != network.ErrNicModified {
+		t.Fatalf("UpdateNic error %v, want %v", err, network.ErrNicModified)
+	}
+
+	// associations read the network interface again and retry
+	s.FailNext(http.MethodPut, http.StatusPreconditionFailed)
+	association, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if n := s.RequestCount(http.MethodPut, "networkInterfaces"); n != 3 {
+		t.Errorf("network interface updated %d times, want 3", n)
+	}
+	want := []azuretest.IPConfiguration{
+		{Name: "ipconfig1", PrivateIP: "10.240.0.4", PublicIP: "node-1-pip"},
+		{Name: getIPConfigurationName("eip-1"), PrivateIP: association.SourceIP, PublicIP: "eip-1"},
+	}
+	if ipconfigs := s.IPConfigurations(azuretest.VMName); !reflect.DeepEqual(ipconfigs, want) {
+		t.Errorf("IP configurations %+v, want %+v", ipconfigs, want)
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	s.FailNext(http.MethodGet, http.StatusTooManyRequests)
+
+	// retried after the delay the server asks for
+	if _, err := p.EnsureAssociation(testContext(t), "20.0.0.1", "10.244.0.5", providers.Owner{}); err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	p, s := newTestProvider(t)
+	ctx := testContext(t)
+
+	if err := p.Health(ctx); err != nil {
+		t.Errorf("Health error: %v", err)
+	}
+	s.FailNext(http.MethodGet, http.StatusForbidden)
+	if err := p.Health(ctx); err == nil {
+		t.Errorf("Health succeeded while Resource Manager fails")
+	}
+}
+
+// TestConcurrentInitialize runs the entry points of the readiness check and
+// the first reconciliation of the daemon together on a fresh provider, to
+// be run with -race.
+func TestConcurrentInitialize(t *testing.T) {
+	p, _ := newTestProvider(t)
+	ctx := testContext(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs <- p.Health(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := p.ListAssociations(ctx)
+		errs <- err
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("error: %v", err)
+		}
+	}
+	if p.vm != azuretest.VMName {
+		t.Errorf("vm = %q, want %q", p.vm, azuretest.VMName)
+	}
+}
+
+// TestScaleSetInstanceMode refuses to run on instances of uniform scale sets
+// in the ipConfiguration mode, as the controller cannot tell them apart.
+func TestScaleSetInstanceMode(t *testing.T) {
+	s := azuretest.NewScaleSetServer()
+	t.Cleanup(s.Close)
+	p := NewProvider(Config{
+		ResourceManagerEndpoint: s.URL,
+		MetadataEndpoint:        s.URL,
+		AuthMethod:              iam.AuthMethodNone,
+	})
+	ctx := testContext(t)
+
+	if !p.Capabilities().MultipleIPsPerNode {
+		t.Errorf("single IP per node in the ipConfiguration mode")
+	}
+	if err := p.Health(ctx); err == nil || !strings.Contains(err.Error(), ModeLoadBalancer) {
+		t.Errorf("Health error %v, want one about the loadBalancer mode", err)
+	}
+	if _, err := p.ListAssociations(ctx); err == nil {
+		t.Errorf("ListAssociations succeeded on a scale set instance in the ipConfiguration mode")
+	}
+	if p.initialized() {
+		t.Error("initialized on a scale set instance in the ipConfiguration mode")
+	}
+	if !p.Capabilities().MultipleIPsPerNode {
+		t.Errorf("capabilities changed by initializing")
+	}
+
+	p = NewProvider(Config{Mode: ModeLoadBalancer})
+	if p.Capabilities().MultipleIPsPerNode {
+		t.Errorf("multiple IPs per node in the loadBalancer mode")
+	}
+}
+
+func TestScaleSetInstance(t *testing.T) {
+	s := azuretest.NewScaleSetServer()
+	t.Cleanup(s.Close)
+	p := NewProvider(Config{
+		ResourceManagerEndpoint: s.URL,
+		MetadataEndpoint:        s.URL,
+		AuthMethod:              iam.AuthMethodNone,
+		RequestsPerSecond:       1000,
+		RequestBurst:            100,
+		Mode:                    ModeLoadBalancer,
+	})
+	s.AddScaleSetInstance("1")
+	s.AddPublicIP("eip-1", "20.0.0.1")
+	ctx := testContext(t)
+
+	if err := p.Health(ctx); err != nil {
+		t.Errorf("Health error: %v", err)
+	}
+	if p.vmss != azuretest.ScaleSetName || p.instance != azuretest.InstanceID {
+		t.Errorf("instance %s of scale set %s, want %s of %s", p.instance, p.vmss, azuretest.InstanceID, azuretest.ScaleSetName)
+	}
+	associations, err := p.ListAssociations(ctx)
+	if err != nil {
+		t.Fatalf("ListAssociations error: %v", err)
+	}
+	if len(associations) != 0 {
+		t.Errorf("associations %+v, want none", associations)
+	}
+	if n, err := p.Capacity(ctx); err != nil || n != 1 {
+		t.Errorf("Capacity %d, %v, want 1", n, err)
+	}
+
+	association, err := p.EnsureAssociation(ctx, "20.0.0.1", "10.244.0.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	if want := (providers.Association{PublicIP: "20.0.0.1", SourceIP: "10.240.0.4"}); association != want {
+		t.Errorf("association %+v, want %+v", association, want)
+	}
+	want := []azuretest.OutboundRule{{Name: "egress-ip_eip-1", PublicIP: "eip-1", Members: []string{"10.240.0.4"}}}
+	if rules := s.OutboundRules(defaultLoadBalancer); !reflect.DeepEqual(rules, want) {
+		t.Errorf("outbound rules %+v, want %+v", rules, want)
+	}
+	// the pool is joined through the model of the instance, as its NIC
+	// cannot be updated
+	if n := s.RequestCount(http.MethodPut, "/virtualMachineScaleSets/"+azuretest.ScaleSetName+"/virtualmachines/"+azuretest.InstanceID); n != 1 {
+		t.Errorf("instance updated %d times, want 1", n)
+	}
+	if n := s.RequestCount(http.MethodPut, "/networkInterfaces/"); n != 0 {
+		t.Errorf("network interfaces updated %d times, want none", n)
+	}
+	if n, err := p.Capacity(ctx); err != nil || n != 0 {
+		t.Errorf("Capacity %d, %v, want 0", n, err)
+	}
+	associations, err = p.ListAssociations(ctx)
+	if err != nil {
+		t.Fatalf("ListAssociations error: %v", err)
+	}
+	if !reflect.DeepEqual(associations, []providers.Association{association}) {
+		t.Errorf("associations %+v, want %+v", associations, []providers.Association{association})
+	}
+
+	// failing over to instance 1 takes instance 0 out of the pool
+	s.SetMetadataInstance("1")
+	p1 := NewProvider(p.config)
+	moved, err := p1.EnsureAssociation(ctx, "20.0.0.1", "10.244.1.5", providers.Owner{})
+	if err != nil {
+		t.Fatalf("EnsureAssociation error: %v", err)
+	}
+	want[0].Members = []string{moved.SourceIP}
+	if rules := s.OutboundRules(defaultLoadBalancer); !reflect.DeepEqual(rules, want) {
+		t.Errorf("outbound rules %+v, want %+v", rules, want)
+	}
+	if associations, err := p.ListAssociations(ctx); err != nil || len(associations) != 0 {
+		t.Errorf("associations of instance 0 %+v, %v, want none", associations, err)
+	}
+
+	if err := p1.Dissociate(ctx, moved.SourceIP); err != nil {
+		t.Fatalf("Dissociate error: %v", err)
+	}
+	want[0].Members = nil
+	if rules := s.OutboundRules(defaultLoadBalancer); !reflect.DeepEqual(rules, want) {
+		t.Errorf("outbound rules %+v, want %+v", rules, want)
+	}
+	if n, err := p1.Capacity(ctx); err != nil || n != 1 {
+		t.Errorf("Capacity %d, %v, want 1", n, err)
+	}
+}
+
+func TestScaleSetDetection(t *testing.T) {
+	tests := []struct {
+		compute  imds.Compute
+		vmss     string
+		instance string
+	}{
+		{
+			compute: imds.Compute{
+				Name:           "aks-nodepool1-vmss_3",
+				VmScaleSetName: "aks-nodepool1-vmss",
+				ResourceId:     "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-nodepool1-vmss/virtualMachines/3",
+			},
+			vmss:     "aks-nodepool1-vmss",
+			instance: "3",
+		},
+		{
+			// flexible scale sets hold standalone VMs
+			compute: imds.Compute{
+				Name:           "aks-nodepool1-vmss000003",
+				VmScaleSetName: "aks-nodepool1-vmss",
+				ResourceId:     "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/aks-nodepool1-vmss000003",
+			},
+		},
+		{
+			compute: imds.Compute{
+				Name:       "node-1",
+				ResourceId: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/node-1",
+			},
+		},
+	}
+	for _, test := range tests {
+		vmss, instance := scaleSetInstance(test.compute)
+		if vmss != test.vmss || instance != test.instance {
+			t.Errorf("scaleSetInstance(%s) = %q, %q, want %q, %q", test.compute.Name, vmss, instance, test.vmss, test.instance)
+		}
+	}
+}
+
+func setenv(t *testing.T, name string, value string) {
+	old, found := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if found {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestWorkloadIdentity(t *testing.T) {
+	s := azuretest.NewServer()
+	t.Cleanup(s.Close)
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	if err := ioutil.WriteFile(tokenFile, []byte("service-account-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AZURE_CLIENT_ID", "client")
+	setenv(t, "AZURE_TENANT_ID", "tenant")
+	setenv(t, "AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	setenv(t, "AZURE_AUTHORITY_HOST", s.URL)
+
+	// picked from the environment
+	p := NewProvider(Config{ResourceManagerEndpoint: s.URL, MetadataEndpoint: s.URL})
+	if err := p.Health(testContext(t)); err != nil {
+		t.Fatalf("Health error: %v", err)
+	}
+	if authorization := s.Authorization(); authorization != "Bearer token-1" {
+		t.Errorf("Authorization %q, want the token issued", authorization)
+	}
+	requests := s.TokenRequests()
+	if len(requests) != 1 {
+		t.Fatalf("%d token requests, want 1", len(requests))
+	}
+	form := requests[0]
+	if form.Get("client_id") != "client" || form.Get("client_assertion") != "service-account-token" ||
+		form.Get("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+		t.Errorf("token request %v, want the federated token of the client", form)
+	}
+}
+
+func TestAuthMethodErrors(t *testing.T) {
+	s := azuretest.NewServer()
+	t.Cleanup(s.Close)
+	for _, name := range []string{"AZURE_CLIENT_ID", "AZURE_TENANT_ID", "AZURE_CLIENT_SECRET", "AZURE_CLIENT_CERTIFICATE_PATH", "AZURE_FEDERATED_TOKEN_FILE"} {
+		setenv(t, name, "")
+	}
+
+	tests := []struct {
+		method string
+		err    string
+	}{
+		{iam.AuthMethodServicePrincipal, "AZURE_CLIENT_SECRET"},
+		{iam.AuthMethodCertificate, "AZURE_CLIENT_CERTIFICATE_PATH"},
+		{iam.AuthMethodWorkloadIdentity, "AZURE_FEDERATED_TOKEN_FILE"},
+		{"password", `unknown auth method "password"`},
+	}
+	for _, test := range tests {
+		p := NewProvider(Config{ResourceManagerEndpoint: s.URL, MetadataEndpoint: s.URL, AuthMethod: test.method})
+		err := p.Health(testContext(t))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("auth method %s: error %v, want one mentioning %s", test.method, err, test.err)
+		}
+	}
+	if n := len(s.Requests()); n != 0 {
+		t.Errorf("%d requests sent without credentials", n)
+	}
+}
+
+func TestCertificate(t *testing.T) {
+	s := azuretest.NewServer()
+	t.Cleanup(s.Close)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "egress-ip-operator"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateFile := filepath.Join(t.TempDir(), "client.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	if err := ioutil.WriteFile(certificateFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AZURE_CLIENT_ID", "client")
+	setenv(t, "AZURE_TENANT_ID", "tenant")
+	setenv(t, "AZURE_CLIENT_SECRET", "")
+	setenv(t, "AZURE_FEDERATED_TOKEN_FILE", "")
+	setenv(t, "AZURE_CLIENT_CERTIFICATE_PATH", certificateFile)
+
+	p := NewProvider(Config{ResourceManagerEndpoint: s.URL, MetadataEndpoint: s.URL})
+	if err := p.initialize(); err != nil {
+		t.Fatalf("initialize error: %v", err)
+	}
+
+	setenv(t, "AZURE_CLIENT_CERTIFICATE_PATH", filepath.Join(t.TempDir(), "missing.pem"))
+	p = NewProvider(Config{ResourceManagerEndpoint: s.URL, MetadataEndpoint: s.URL})
+	if err := p.initialize(); err == nil || !strings.Contains(err.Error(), "cannot read certificate") {
+		t.Errorf("initialize error %v, want one about the certificate", err)
+	}
+}
+
+func TestMissingVMName(t *testing.T) {
+	p, s := newTestProvider(t)
+	s.SetMetadataVM("")
+	if err := p.initialize(); err == nil || !strings.Contains(err.Error(), "no compute name") {
+		t.Fatalf("initialize error %v, want one about the missing VM name", err)
+	}
+	if p.initialized() {
+		t.Error("initialized without a VM name")
+	}
+}
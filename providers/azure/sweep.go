@@ -0,0 +1,88 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/egress-ip-operator/providers"
+	"github.com/yingeli/egress-ip-operator/providers/azure/network"
+)
+
+// The associations of the cluster are the IP configurations of the operator
+// on the NICs of the resource group of the node tagged with the cluster.
+var _ providers.Sweeper = &Provider{}
+
+func (p *Provider) ListClusterAssociations(ctx context.Context) ([]providers.ClusterAssociation, error) {
+	if err := p.initialize(); err != nil {
+		return nil, err
+	}
+	nics, err := network.ListNics(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ListNics error: %v", err)
+	}
+
+	var associations []providers.ClusterAssociation
+	var pips map[string]aznetwork.PublicIPAddress
+	for _, nic := range nics {
+		if tag(nic.Tags, tagCluster) != p.clusterID() || nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil {
+			continue
+		}
+		for _, ipconfig := range *nic.IPConfigurations {
+			if !isOwned(ipconfig) || ipconfig.ID == nil || ipconfig.PrivateIPAddress == nil {
+				continue
+			}
+			association := providers.ClusterAssociation{
+				Association: providers.Association{SourceIP: *ipconfig.PrivateIPAddress, Owned: true},
+				Node:        tag(nic.Tags, tagNode),
+				Resource:    *ipconfig.ID,
+				Version:     to.String(nic.Etag),
+			}
+			if ipconfig.PublicIPAddress != nil && ipconfig.PublicIPAddress.ID != nil {
+				if pips == nil {
+					if pips, err = publicIPs(ctx, p.publicIPGroup()); err != nil {
+						return nil, err
+					}
+				}
+				// the EgressIP of public IPs of other resource groups
+				// cannot be told
+				pip, found := pips[strings.ToLower(*ipconfig.PublicIPAddress.ID)]
+				if !found {
+					continue
+				}
+				association.PublicIP = *pip.IPAddress
+				association.Owner = tag(pip.Tags, tagEgressIP)
+			}
+			associations = append(associations, association)
+		}
+	}
+	return associations, nil
+}
+
+func (p *Provider) RemoveClusterAssociation(ctx context.Context, association providers.ClusterAssociation) error {
+	if err := p.initialize(); err != nil {
+		return err
+	}
+	r, err := network.ParseIPConfigurationID(association.Resource)
+	if err != nil {
+		return fmt.Errorf("ParseIPConfigurationID error: %v", err)
+	}
+	nic, err := network.GetNic(ctx, r.NicName)
+	if err != nil {
+		return fmt.Errorf("GetNic error: %v", err)
+	}
+	if to.String(nic.Etag) != association.Version {
+		return network.ErrNicModified
+	}
+	if !network.RemoveNicPublicIP(&nic, association.Resource, ipconfigPrefix) {
+		return nil
+	}
+	_, err = network.UpdateNic(ctx, nic)
+	return err
+}
+
+func tag(tags map[string]*string, name string) string {
+	return to.String(tags[name])
+}
@@ -0,0 +1,229 @@
+// Package fake is an in-memory provider for tests. It records the
+// associations of a single node and the calls made to it, and can be made
+// to fail or to respond slowly.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yingeli/egress-ip-operator/providers"
+)
+
+const Name = "fake"
+
+func init() {
+	providers.Register(Name, func(json.RawMessage) (providers.Provider, error) {
+		return New(), nil
+	})
+}
+
+// Call is a call made to the provider.
+type Call struct {
+	Method string
+	Args   []string
+}
+
+type Provider struct {
+	mu           sync.Mutex
+	caps         providers.Capabilities
+	associations map[string]providers.Association
+	failures     map[string][]error
+	latency      time.Duration
+	// associations the node can hold, Unlimited by default
+	limit      int
+	calls      []Call
+	nextSource int
+}
+
+// New returns a provider with the capabilities of Azure and no
+// associations.
+func New() *Provider {
+	return &Provider{
+		caps: providers.Capabilities{
+			NodeAssociation:    true,
+			MultipleIPsPerNode: true,
+		},
+		associations: make(map[string]providers.Association),
+		failures:     make(map[string][]error),
+		limit:        providers.Unlimited,
+	}
+}
+
+// SetLimit bounds the associations of the node, as the IP configurations a
+// NIC can hold on Azure.
+func (p *Provider) SetLimit(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+}
+
+// SetCapabilities changes the capabilities the provider reports.
+func (p *Provider) SetCapabilities(caps providers.Capabilities) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.caps = caps
+}
+
+// SetLatency makes every call take at least latency, unless its context is
+// done first.
+func (p *Provider) SetLatency(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latency = latency
+}
+
+// FailNext makes the next call of method return err. Failures queue up.
+func (p *Provider) FailNext(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[method] = append(p.failures[method], err)
+}
+
+// AddAssociation records an association as if made earlier, for instance
+// by a previous daemon or outside the operator.
+func (p *Provider) AddAssociation(association providers.Association) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.associations[association.SourceIP] = association
+}
+
+// Associations returns the associations sorted by source IP.
+func (p *Provider) Associations() []providers.Association {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sortedAssociations()
+}
+
+// Calls returns the calls made so far.
+func (p *Provider) Calls() []Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Call(nil), p.calls...)
+}
+
+// CallCount returns the number of calls made to method.
+func (p *Provider) CallCount(method string) int {
+	n := 0
+	for _, call := range p.Calls() {
+		if call.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *Provider) ListAssociations(ctx context.Context) ([]providers.Association, error) {
+	if err := p.call(ctx, "ListAssociations"); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sortedAssociations(), nil
+}
+
+// EnsureAssociation associates publicIP with a new private IP, as Azure does
+// for pod IPs without an IP configuration of their own.
+func (p *Provider) EnsureAssociation(ctx context.Context, publicIP string, privateIP string, owner providers.Owner) (providers.Association, error) {
+	if err := p.call(ctx, "EnsureAssociation", publicIP, privateIP); err != nil {
+		return providers.Association{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, association := range p.associations {
+		if association.PublicIP == publicIP {
+			return association, nil
+		}
+	}
+	if !p.caps.MultipleIPsPerNode {
+		for _, association := range p.associations {
+			if association.PublicIP != "" {
+				return providers.Association{}, fmt.Errorf("node already has public IP %s", association.PublicIP)
+			}
+		}
+	}
+	if p.limit != providers.Unlimited && len(p.associations) >= p.limit {
+		return providers.Association{}, fmt.Errorf("node is full with %d associations", len(p.associations))
+	}
+	p.nextSource++
+	association := providers.Association{
+		PublicIP: publicIP,
+		SourceIP: fmt.Sprintf("10.240.255.%d", p.nextSource),
+		Owned:    true,
+	}
+	p.associations[association.SourceIP] = association
+	return association, nil
+}
+
+func (p *Provider) Dissociate(ctx context.Context, sourceIP string) error {
+	if err := p.call(ctx, "Dissociate", sourceIP); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.associations, sourceIP)
+	return nil
+}
+
+func (p *Provider) Health(ctx context.Context) error {
+	return p.call(ctx, "Health")
+}
+
+func (p *Provider) Capacity(ctx context.Context) (int, error) {
+	if err := p.call(ctx, "Capacity"); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.limit == providers.Unlimited {
+		return providers.Unlimited, nil
+	}
+	if free := p.limit - len(p.associations); free > 0 {
+		return free, nil
+	}
+	return 0, nil
+}
+
+func (p *Provider) Capabilities() providers.Capabilities {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.caps
+}
+
+// call records a call, waits for the latency and returns the failure queued
+// for method, if any.
+func (p *Provider) call(ctx context.Context, method string, args ...string) error {
+	p.mu.Lock()
+	p.calls = append(p.calls, Call{Method: method, Args: args})
+	latency := p.latency
+	var err error
+	if failures := p.failures[method]; len(failures) > 0 {
+		err = failures[0]
+		p.failures[method] = failures[1:]
+	}
+	p.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (p *Provider) sortedAssociations() []providers.Association {
+	associations := make([]providers.Association, 0, len(p.associations))
+	for _, association := range p.associations {
+		associations = append(associations, association)
+	}
+	sort.Slice(associations, func(i, j int) bool {
+		return associations[i].SourceIP < associations[j].SourceIP
+	})
+	return associations
+}
@@ -0,0 +1,48 @@
+// Package none is the provider of clusters whose nodes can already send
+// traffic from the EgressIPs, such as bare metal nodes with routed
+// addresses, where nothing needs to be associated.
+package none
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/yingeli/egress-ip-operator/providers"
+)
+
+const Name = "none"
+
+func init() {
+	providers.Register(Name, func(json.RawMessage) (providers.Provider, error) {
+		return &Provider{}, nil
+	})
+}
+
+// Provider SNATs the traffic of gateways straight to their EgressIP.
+type Provider struct{}
+
+func (p *Provider) ListAssociations(ctx context.Context) ([]providers.Association, error) {
+	return nil, nil
+}
+
+func (p *Provider) EnsureAssociation(ctx context.Context, publicIP string, privateIP string, owner providers.Owner) (providers.Association, error) {
+	return providers.Association{PublicIP: publicIP, SourceIP: publicIP}, nil
+}
+
+func (p *Provider) Dissociate(ctx context.Context, sourceIP string) error {
+	return nil
+}
+
+func (p *Provider) Health(ctx context.Context) error {
+	return nil
+}
+
+func (p *Provider) Capacity(ctx context.Context) (int, error) {
+	return providers.Unlimited, nil
+}
+
+func (p *Provider) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		MultipleIPsPerNode: true,
+	}
+}
@@ -4,7 +4,107 @@ import (
 	"context"
 )
 
+// Association binds a public IP to a private IP of the node, which traffic
+// is SNATed to in order to leave the node with the public IP.
+type Association struct {
+	PublicIP string
+	// SourceIP is the private IP the public IP is bound to.
+	SourceIP string
+	// Owned is set when the private IP was created for the association,
+	// and is removed along with it. An owned association without a public
+	// IP has leaked.
+	Owned bool
+}
+
+// Owner is who an association is made for, recorded by providers on the
+// resources they make or change so that leaked ones can be told apart.
+type Owner struct {
+	// EgressIP is the UID of the EgressIP.
+	EgressIP string
+	// Node is the name of the node.
+	Node string
+}
+
+// Capabilities tells the operator what a provider supports.
+type Capabilities struct {
+	// NodeAssociation is set when public IPs are associated with the node
+	// the gateways of an EgressIP run on, so that they have to run on the
+	// same node. Otherwise gateways SNAT straight to their EgressIP.
+	NodeAssociation bool
+	// MultipleIPsPerNode is set when a node can hold more than one public
+	// IP at a time.
+	MultipleIPsPerNode bool
+}
+
+// Unlimited is the capacity of nodes that can take any number of public
+// IPs.
+const Unlimited = -1
+
 type Provider interface {
-	Associate(ctx context.Context, publicIP string, privateIP string) (sourceIP string, err error)
+	// ListAssociations returns the associations of the node, including
+	// public IPs of the node that are not EgressIPs.
+	ListAssociations(ctx context.Context) ([]Association, error)
+	// EnsureAssociation associates publicIP with the node for owner,
+	// preferably with privateIP, moving it from wherever it is associated.
+	// It does nothing but record owner when publicIP is already associated
+	// with the node.
+	EnsureAssociation(ctx context.Context, publicIP string, privateIP string, owner Owner) (Association, error)
+	// Dissociate removes the association of sourceIP.
 	Dissociate(ctx context.Context, sourceIP string) error
+	// Health returns an error when the provider cannot be reached.
+	Health(ctx context.Context) error
+	// Capacity returns how many more public IPs can be associated with the
+	// node, or Unlimited.
+	Capacity(ctx context.Context) (int, error)
+	Capabilities() Capabilities
+}
+
+// SubnetProvider is implemented by providers that can send the traffic of
+// a whole subnet out from a public IP, for EgressIPs of a node pool that need
+// no gateway.
+type SubnetProvider interface {
+	// EnsureSubnetEgress sends the outbound traffic of subnet out from
+	// publicIP. It does nothing when it already is.
+	EnsureSubnetEgress(ctx context.Context, publicIP string, subnet string) error
+	// RemoveSubnetEgress stops sending the outbound traffic of subnet out
+	// from publicIP.
+	RemoveSubnetEgress(ctx context.Context, publicIP string, subnet string) error
+}
+
+// PrefixProvider is implemented by providers that can allocate the public IPs
+// of EgressIPs from a reserved range of addresses, such as the ones that
+// partners allowlist.
+type PrefixProvider interface {
+	// AllocatePublicIP allocates a public IP named name from prefix and
+	// returns its address. Allocating name again returns the same address.
+	AllocatePublicIP(ctx context.Context, prefix string, name string) (string, error)
+	// ReleasePublicIP releases the public IP named name, when it was
+	// allocated from prefix. Releasing a missing one does nothing.
+	ReleasePublicIP(ctx context.Context, prefix string, name string) error
+}
+
+// ClusterAssociation is an association the operator made on a node of the
+// cluster.
+type ClusterAssociation struct {
+	Association
+	// Node is the node recorded for the association, and Owner the UID of
+	// the EgressIP recorded for its public IP, if any.
+	Node  string
+	Owner string
+	// Resource is the provider ID of what holds the association, such as
+	// an Azure IP configuration, and Version the version it was read at.
+	Resource string
+	Version  string
+}
+
+// Sweeper is implemented by providers that can list the associations the
+// operator made across the nodes of the cluster, so that the ones daemons
+// leaked, for instance by crashing halfway, can be found and removed.
+type Sweeper interface {
+	// ListClusterAssociations returns the associations the operator made
+	// on the nodes of the cluster.
+	ListClusterAssociations(ctx context.Context) ([]ClusterAssociation, error)
+	// RemoveClusterAssociation removes an association listed by
+	// ListClusterAssociations, unless what holds it changed since.
+	RemoveClusterAssociation(ctx context.Context, association ClusterAssociation) error
 }
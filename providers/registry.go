@@ -0,0 +1,76 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Factory creates a provider from its configuration block, which is nil
+// when there is none.
+type Factory func(config json.RawMessage) (Provider, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a provider available by name. Providers register
+// themselves from an init function, so that importing their package is
+// enough to select them.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, exist := factories[name]; exist {
+		panic(fmt.Sprintf("provider %s registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Names returns the names of the registered providers.
+func Names() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the provider called name with its configuration block.
+func New(name string, config json.RawMessage) (Provider, error) {
+	factoriesMu.Lock()
+	factory, exist := factories[name]
+	factoriesMu.Unlock()
+	if !exist {
+		return nil, fmt.Errorf("unknown provider %s, registered providers are %v", name, Names())
+	}
+	return factory(config)
+}
+
+// NewFromFile creates the provider called name with its block of the
+// configuration file path, if any. The file is YAML or JSON, with a block
+// per provider keyed by name:
+//
+//	azure:
+//	  publicIPResourceGroup: egress-ips
+func NewFromFile(name string, path string) (Provider, error) {
+	if path == "" {
+		return New(name, nil)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading provider config: %v", err)
+	}
+	var blocks map[string]json.RawMessage
+	if err := yaml.Unmarshal(data, &blocks); err != nil {
+		return nil, fmt.Errorf("error parsing provider config %s: %v", path, err)
+	}
+	return New(name, blocks[name])
+}
@@ -0,0 +1,186 @@
+// Package encap programs the kernel-native encapsulation tunnels (IPIP, GRE
+// and VXLAN) used between directors and gateways when encryption is not
+// required.
+package encap
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Mode is an encapsulation supported by the kernel.
+type Mode string
+
+const (
+	IPIP  Mode = "ipip"
+	GRE   Mode = "gre"
+	VXLAN Mode = "vxlan"
+)
+
+const (
+	// VXLANID is the VNI used by every EgressIP; each gateway pod has its own
+	// VTEP so there is no need to tell EgressIPs apart.
+	VXLANID   = 1
+	VXLANPort = 4789
+)
+
+// Overhead returns the number of bytes mode adds to every packet.
+func Overhead(mode Mode) (int, error) {
+	switch mode {
+	case IPIP:
+		return 20, nil
+	case GRE:
+		return 24, nil
+	case VXLAN:
+		return 50, nil
+	default:
+		return 0, fmt.Errorf("unsupported encapsulation %s", mode)
+	}
+}
+
+// MTU returns the MTU of a mode tunnel to remote, computed from the MTU of
+// the interface remote is routed through.
+func MTU(mode Mode, remote net.IP) (int, error) {
+	overhead, err := Overhead(mode)
+	if err != nil {
+		return 0, err
+	}
+	routes, err := netlink.RouteGet(remote)
+	if err != nil {
+		return 0, fmt.Errorf("RouteGet %s error: %v", remote, err)
+	}
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", remote)
+	}
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return 0, fmt.Errorf("LinkByIndex %d error: %v", routes[0].LinkIndex, err)
+	}
+	return link.Attrs().MTU - overhead, nil
+}
+
+// LinkMTU returns the MTU of a mode tunnel carried over the link name.
+func LinkMTU(mode Mode, name string) (int, error) {
+	overhead, err := Overhead(mode)
+	if err != nil {
+		return 0, err
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("LinkByName %s error: %v", name, err)
+	}
+	return link.Attrs().MTU - overhead, nil
+}
+
+// EnsureLink creates the mode link name from local to remote, replacing a
+// link of the same name with different endpoints. A nil remote creates a
+// VXLAN link without a default destination, as used by gateways.
+func EnsureLink(mode Mode, name string, local net.IP, remote net.IP, mtu int) (netlink.Link, error) {
+	attrs := netlink.LinkAttrs{Name: name, MTU: mtu}
+
+	var link netlink.Link
+	switch mode {
+	case IPIP:
+		link = &netlink.Iptun{LinkAttrs: attrs, Local: local, Remote: remote}
+	case GRE:
+		link = &netlink.Gretun{LinkAttrs: attrs, Local: local, Remote: remote}
+	case VXLAN:
+		link = &netlink.Vxlan{LinkAttrs: attrs, VxlanId: VXLANID, SrcAddr: local, Group: remote, Port: VXLANPort, Learning: true}
+	default:
+		return nil, fmt.Errorf("unsupported encapsulation %s", mode)
+	}
+
+	if existing, err := netlink.LinkByName(name); err == nil {
+		if sameEndpoints(existing, local, remote) && existing.Attrs().MTU == mtu {
+			return existing, nil
+		}
+		if err := netlink.LinkDel(existing); err != nil {
+			return nil, fmt.Errorf("LinkDel %s error: %v", name, err)
+		}
+	}
+
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("LinkAdd %s error: %v", name, err)
+	}
+	return netlink.LinkByName(name)
+}
+
+// DeleteLink removes the link name if it exists.
+func DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	return netlink.LinkDel(link)
+}
+
+// AddFloodEntry makes the VXLAN link send broadcast and unknown traffic to
+// remote in addition to any other remote VTEP.
+func AddFloodEntry(link netlink.Link, remote net.IP) error {
+	return netlink.NeighAppend(floodEntry(link, remote))
+}
+
+// DeleteFloodEntry undoes AddFloodEntry.
+func DeleteFloodEntry(link netlink.Link, remote net.IP) error {
+	return netlink.NeighDel(floodEntry(link, remote))
+}
+
+// FloodEntries returns the remote VTEPs of the VXLAN link.
+func FloodEntries(link netlink.Link) ([]net.IP, error) {
+	neighs, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return nil, err
+	}
+	var remotes []net.IP
+	for _, neigh := range neighs {
+		if neigh.IP != nil && isZeroMAC(neigh.HardwareAddr) {
+			remotes = append(remotes, neigh.IP)
+		}
+	}
+	return remotes, nil
+}
+
+func floodEntry(link netlink.Link, remote net.IP) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+		IP:           remote,
+		HardwareAddr: make(net.HardwareAddr, 6),
+	}
+}
+
+func sameEndpoints(link netlink.Link, local net.IP, remote net.IP) bool {
+	switch l := link.(type) {
+	case *netlink.Iptun:
+		return ipEqual(l.Local, local) && ipEqual(l.Remote, remote)
+	case *netlink.Gretun:
+		return ipEqual(l.Local, local) && ipEqual(l.Remote, remote)
+	case *netlink.Vxlan:
+		return ipEqual(l.SrcAddr, local) && ipEqual(l.Group, remote)
+	default:
+		return false
+	}
+}
+
+// ipEqual treats unset and unspecified addresses alike, as the kernel
+// reports unset endpoints as 0.0.0.0.
+func ipEqual(a, b net.IP) bool {
+	if len(a) == 0 || a.IsUnspecified() {
+		return len(b) == 0 || b.IsUnspecified()
+	}
+	return a.Equal(b)
+}
+
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
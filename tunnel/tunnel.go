@@ -0,0 +1,14 @@
+// Package tunnel holds what gateways and directors agree on regardless of
+// the tunnel mode.
+package tunnel
+
+import "net"
+
+// GatewayIP returns the first host address of the tunnel network, which the
+// gateway keeps for itself.
+func GatewayIP(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP.To4()))
+	copy(ip, network.IP.To4())
+	ip[len(ip)-1]++
+	return ip
+}
@@ -0,0 +1,173 @@
+// Package wireguard configures WireGuard links for the director and gateway.
+// Links are created through netlink and configured with wg(8).
+package wireguard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// ListenPort is the UDP port the gateway listens on.
+	ListenPort = 51820
+
+	wgPath = "wg"
+)
+
+// Peer is a WireGuard peer of a link.
+type Peer struct {
+	PublicKey           string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// GenerateKeyPair returns a new base64 encoded private and public key.
+func GenerateKeyPair() (privateKey string, publicKey string, err error) {
+	var key [curve25519.ScalarSize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return privateKey, publicKey, err
+	}
+	// clamp as described in https://cr.yp.to/ecdh.html
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	privateKey = base64.StdEncoding.EncodeToString(key[:])
+	publicKey, err = PublicKey(privateKey)
+	return privateKey, publicKey, err
+}
+
+// PublicKey derives the public key of a base64 encoded private key.
+func PublicKey(privateKey string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %v", err)
+	}
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// EnsureLink returns the WireGuard link name, creating it when missing.
+func EnsureLink(name string) (netlink.Link, error) {
+	if link, err := netlink.LinkByName(name); err == nil {
+		return link, nil
+	}
+	wg := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := netlink.LinkAdd(wg); err != nil {
+		return nil, fmt.Errorf("LinkAdd %s error: %v", name, err)
+	}
+	return netlink.LinkByName(name)
+}
+
+// DeleteLink removes the link name if it exists.
+func DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	return netlink.LinkDel(link)
+}
+
+// SetPrivateKey sets the private key of dev and, if listenPort is not 0, the
+// port it listens on.
+func SetPrivateKey(dev string, privateKey string, listenPort int) error {
+	f, err := ioutil.TempFile("", "wg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(privateKey); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	args := []string{"set", dev, "private-key", f.Name()}
+	if listenPort != 0 {
+		args = append(args, "listen-port", strconv.Itoa(listenPort))
+	}
+	_, err = wg(args...)
+	return err
+}
+
+// SetPeer adds peer to dev or updates it.
+func SetPeer(dev string, peer Peer) error {
+	args := []string{"set", dev, "peer", peer.PublicKey}
+	if peer.Endpoint != "" {
+		args = append(args, "endpoint", peer.Endpoint)
+	}
+	if peer.PersistentKeepalive != 0 {
+		args = append(args, "persistent-keepalive", strconv.Itoa(peer.PersistentKeepalive))
+	}
+	args = append(args, "allowed-ips", strings.Join(peer.AllowedIPs, ","))
+	_, err := wg(args...)
+	return err
+}
+
+// RemovePeer removes the peer with publicKey from dev.
+func RemovePeer(dev string, publicKey string) error {
+	_, err := wg("set", dev, "peer", publicKey, "remove")
+	return err
+}
+
+// Peers returns the public keys of the peers of dev.
+func Peers(dev string) ([]string, error) {
+	out, err := wg("show", dev, "peers")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// LatestHandshakes returns the time of the latest handshake with each peer of
+// dev. Peers that never completed a handshake are reported with a zero time.
+func LatestHandshakes(dev string) (map[string]time.Time, error) {
+	out, err := wg("show", dev, "latest-handshakes")
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]time.Time)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid handshake time %s: %v", fields[1], err)
+		}
+		if sec == 0 {
+			m[fields[0]] = time.Time{}
+		} else {
+			m[fields[0]] = time.Unix(sec, 0)
+		}
+	}
+	return m, nil
+}
+
+func wg(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(wgPath, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("wg %s error: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}